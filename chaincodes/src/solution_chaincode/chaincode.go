@@ -156,14 +156,51 @@ func (t *Chaincode) Invoke(chaincodeStub shim.ChaincodeStubInterface) (result pe
 		returnBytes, returnError = AddDatatypeToService(stub, caller, args)
 	} else if function == "removeDatatypeFromService" {
 		returnBytes, returnError = RemoveDatatypeFromService(stub, caller, args)
+	} else if function == "retireService" {
+		// get cached stub from chaincode stub, enabling putCache
+		// because service and service catalog entry assets are updated in the same transaction
+		stub2 := cached_stub.NewCachedStub(chaincodeStub, true, true, true)
+		returnBytes, returnError = RetireService(stub2, caller, args)
+	} else if function == "completeServiceRetirement" {
+		// get cached stub from chaincode stub, enabling putCache
+		// because enrollment and consent assets of many patients and the service asset are updated in the same transaction
+		stub2 := cached_stub.NewCachedStub(chaincodeStub, true, true, true)
+		returnBytes, returnError = CompleteServiceRetirement(stub2, caller, args)
 	} else if function == "getServicesOfOrg" {
 		returnBytes, returnError = GetServicesOfOrg(stub, caller, args)
+	} else if function == "searchServiceCatalog" {
+		returnBytes, returnError = SearchServiceCatalog(stub, caller, args)
+	} else if function == "reindexServiceCatalog" {
+		// get cached stub from chaincode stub, enabling putCache
+		// because multiple service catalog entry assets are updated in the same transaction
+		stub2 := cached_stub.NewCachedStub(chaincodeStub, true, true, true)
+		returnBytes, returnError = ReindexServiceCatalog(stub2, caller, args)
 
 		// Enrollment
 	} else if function == "enrollPatient" {
 		returnBytes, returnError = EnrollPatient(stub, caller, args)
+	} else if function == "enrollPatientsBatch" {
+		returnBytes, returnError = EnrollPatientsBatch(stub, caller, args)
 	} else if function == "unenrollPatient" {
 		returnBytes, returnError = UnenrollPatient(stub, caller, args)
+	} else if function == "updateEnrollmentStatus" {
+		returnBytes, returnError = UpdateEnrollmentStatus(stub, caller, args)
+	} else if function == "acknowledgeServiceTerms" {
+		returnBytes, returnError = AcknowledgeServiceTerms(stub, caller, args)
+	} else if function == "transferEnrollments" {
+		// get cached stub from chaincode stub, enabling putCache
+		// because enrollment, consent and key assets of many patients are updated in the same transaction
+		stub2 := cached_stub.NewCachedStub(chaincodeStub, true, true, true)
+		returnBytes, returnError = TransferEnrollments(stub2, caller, args)
+	} else if function == "migrateEnrollmentWriteAccess" {
+		returnBytes, returnError = MigrateEnrollmentWriteAccess(stub, caller, args)
+	} else if function == "reviewPendingConsents" {
+		// get cached stub from chaincode stub, enabling putCache
+		// because adding datatype key and put asset will be in the same transaction
+		stub2 := cached_stub.NewCachedStub(chaincodeStub, true, true, true)
+		returnBytes, returnError = ReviewPendingConsents(stub2, caller, args)
+	} else if function == "checkEligibility" {
+		returnBytes, returnError = CheckEligibility(stub, caller, args)
 	} else if function == "getPatientEnrollments" {
 		returnBytes, returnError = GetPatientEnrollments(stub, caller, args)
 	} else if function == "getServiceEnrollments" {
@@ -222,8 +259,31 @@ func (t *Chaincode) Invoke(chaincodeStub shim.ChaincodeStubInterface) (result pe
 		returnBytes, returnError = DownloadOwnerDataWithConsent(stub, caller, args)
 	} else if function == "downloadOwnerDataConsentToken" {
 		returnBytes, returnError = DownloadOwnerDataConsentToken(stub, caller, args)
+	} else if function == "downloadOwnerDataByTag" {
+		returnBytes, returnError = DownloadOwnerDataByTag(stub, caller, args)
+	} else if function == "downloadOwnerDataByTagWithConsent" {
+		returnBytes, returnError = DownloadOwnerDataByTagWithConsent(stub, caller, args)
+	} else if function == "downloadServiceCohortData" {
+		returnBytes, returnError = DownloadServiceCohortData(stub, caller, args)
+	} else if function == "getDataIntegrityProof" {
+		returnBytes, returnError = GetDataIntegrityProof(stub, caller, args)
+	} else if function == "applyRetention" {
+		// get cached stub from chaincode stub, enabling putCache
+		// because multiple data assets are updated in the same transaction
+		stub2 := cached_stub.NewCachedStub(chaincodeStub, true, true, true)
+		returnBytes, returnError = ApplyRetention(stub2, caller, args)
+	} else if function == "reindexRetentionData" {
+		// get cached stub from chaincode stub, enabling putCache
+		// because multiple data assets are updated in the same transaction
+		stub2 := cached_stub.NewCachedStub(chaincodeStub, true, true, true)
+		returnBytes, returnError = ReindexRetentionData(stub2, caller, args)
 
 		// Contract life cycle
+	} else if function == "reindexContracts" {
+		// get cached stub from chaincode stub, enabling putCache
+		// because multiple contract index assets are updated in the same transaction
+		stub2 := cached_stub.NewCachedStub(chaincodeStub, true, true, true)
+		returnBytes, returnError = ReindexContracts(stub2, caller, args)
 	} else if function == "createContract" {
 		returnBytes, returnError = CreateContract(stub, caller, args)
 	} else if function == "addContractDetail" {
@@ -238,6 +298,60 @@ func (t *Chaincode) Invoke(chaincodeStub shim.ChaincodeStubInterface) (result pe
 		returnBytes, returnError = GetContractsAsOwner(stub, caller, args)
 	} else if function == "getRequesterContracts" {
 		returnBytes, returnError = GetContractsAsRequester(stub, caller, args)
+	} else if function == "getContractTransitions" {
+		returnBytes, returnError = GetContractTransitions(stub, caller, args)
+	} else if function == "expireContracts" {
+		returnBytes, returnError = ExpireContracts(stub, caller, args)
+	} else if function == "proposeContractAmendment" {
+		returnBytes, returnError = ProposeContractAmendment(stub, caller, args)
+	} else if function == "acceptContractAmendment" {
+		returnBytes, returnError = AcceptContractAmendment(stub, caller, args)
+	} else if function == "rejectContractAmendment" {
+		returnBytes, returnError = RejectContractAmendment(stub, caller, args)
+	} else if function == "getContractAmendmentSigningPayload" {
+		returnBytes, returnError = GetContractAmendmentSigningPayload(stub, caller, args)
+	} else if function == "getContractSigningPayload" {
+		returnBytes, returnError = GetContractSigningPayload(stub, caller, args)
+	} else if function == "verifyContractSignatures" {
+		returnBytes, returnError = VerifyContractSignatures(stub, caller, args)
+	} else if function == "searchContracts" {
+		returnBytes, returnError = SearchContracts(stub, caller, args)
+	} else if function == "searchContractsSummary" {
+		returnBytes, returnError = SearchContractsSummary(stub, caller, args)
+	} else if function == "suspendContract" {
+		returnBytes, returnError = SuspendContract(stub, caller, args)
+	} else if function == "resumeContract" {
+		returnBytes, returnError = ResumeContract(stub, caller, args)
+	} else if function == "raiseContractDispute" {
+		returnBytes, returnError = RaiseContractDispute(stub, caller, args)
+	} else if function == "resolveContractDispute" {
+		returnBytes, returnError = ResolveContractDispute(stub, caller, args)
+	} else if function == "recordContractPayment" {
+		returnBytes, returnError = RecordContractPayment(stub, caller, args)
+	} else if function == "verifyContractPayment" {
+		returnBytes, returnError = VerifyContractPayment(stub, caller, args)
+	} else if function == "recordContractRefund" {
+		returnBytes, returnError = RecordContractRefund(stub, caller, args)
+	} else if function == "getContractPayments" {
+		returnBytes, returnError = GetContractPayments(stub, caller, args)
+	} else if function == "putContractTemplate" {
+		returnBytes, returnError = PutContractTemplate(stub, caller, args)
+	} else if function == "getContractTemplate" {
+		returnBytes, returnError = GetContractTemplate(stub, caller, args)
+	} else if function == "getContractTemplates" {
+		returnBytes, returnError = GetContractTemplates(stub, caller, args)
+	} else if function == "attestContractData" {
+		returnBytes, returnError = AttestContractData(stub, caller, args)
+	} else if function == "getOverdueContractAttestations" {
+		returnBytes, returnError = GetOverdueContractAttestations(stub, caller, args)
+	} else if function == "issueEnrollmentInvitation" {
+		returnBytes, returnError = IssueEnrollmentInvitation(stub, caller, args)
+	} else if function == "revokeEnrollmentInvitation" {
+		returnBytes, returnError = RevokeEnrollmentInvitation(stub, caller, args)
+	} else if function == "getEnrollmentInvitations" {
+		returnBytes, returnError = GetEnrollmentInvitations(stub, caller, args)
+	} else if function == "acceptEnrollmentInvitation" {
+		returnBytes, returnError = AcceptEnrollmentInvitation(stub, caller, args)
 
 		// Logging
 	} else if function == "getLogs" {
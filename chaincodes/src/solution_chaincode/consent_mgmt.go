@@ -44,14 +44,17 @@ const consentOptionDeny = "deny"
 
 // Consent object
 // Target can be user or service
+// FilterRule optionally narrows which records of the datatype the target can read
+// It is a simple_rule expression evaluated against the data asset, e.g. {"in": ["fasting", {"var": "private_data.tags"}]}
 type Consent struct {
-	Owner      string   `json:"owner"`
-	Service    string   `json:"service"`
-	Datatype   string   `json:"datatype"`
-	Target     string   `json:"target"`
-	Option     []string `json:"option"`
-	Timestamp  int64    `json:"timestamp"`
-	Expiration int64    `json:"expiration"`
+	Owner      string                 `json:"owner"`
+	Service    string                 `json:"service"`
+	Datatype   string                 `json:"datatype"`
+	Target     string                 `json:"target"`
+	Option     []string               `json:"option"`
+	Timestamp  int64                  `json:"timestamp"`
+	Expiration int64                  `json:"expiration"`
+	FilterRule map[string]interface{} `json:"filter_rule,omitempty"`
 }
 
 // ConsentValidation object
@@ -191,6 +194,12 @@ func PutConsentPatientData(stub cached_stub.CachedStubInterface, caller data_mod
 		return nil, errors.New("invalid consent option")
 	}
 
+	err = validateDataFilterRule(consentOMR.FilterRule)
+	if err != nil {
+		logger.Errorf("Invalid consent filter rule: %v", err)
+		return nil, errors.Wrap(err, "Invalid consent filter rule")
+	}
+
 	// Check consentDate is within 10 mins of current time
 	currTime := time.Now().Unix()
 	if currTime-consentOMR.Timestamp > 10*60 || currTime-consentOMR.Timestamp < -10*60 {
@@ -224,7 +233,7 @@ func PutConsentPatientData(stub cached_stub.CachedStubInterface, caller data_mod
 	}
 
 	//if patient is not currently enrolled, he can only deny consent
-	if enrollment.Status != "active" {
+	if enrollment.Status != EnrollmentStatusActive {
 		if !utils.InList(consentOMR.Option, consentOptionDeny) {
 			logger.Errorf("Patient not currently enrolled, can only deny")
 			return nil, errors.New("Patient not currently enrolled, can only deny")
@@ -510,6 +519,12 @@ func PutConsentOwnerData(stub cached_stub.CachedStubInterface, caller data_model
 		return nil, errors.New("invalid consent option")
 	}
 
+	err = validateDataFilterRule(consentOMR.FilterRule)
+	if err != nil {
+		logger.Errorf("Invalid consent filter rule: %v", err)
+		return nil, errors.Wrap(err, "Invalid consent filter rule")
+	}
+
 	// Check consentDate is within 10 mins of current time
 	currTime := time.Now().Unix()
 	if currTime-consentOMR.Timestamp > 10*60 || currTime-consentOMR.Timestamp < -10*60 {
@@ -728,7 +743,38 @@ func ValidateConsent(stub cached_stub.CachedStubInterface, caller data_model.Use
 		accessGranted = false
 	}
 
+	// write access needs the patient to have accepted the current service terms
+	// owners without an enrollment, such as services, have no terms to accept
+	// if the enrollment exists but cannot be read, access is denied
+	message := "permission denied"
+	if accessGranted && access == consentOptionWrite {
+		enrolled, err := CheckEnrollmentExists(stub, callerObj, GetEnrollmentID(ownerID, targetID))
+		if err != nil {
+			logger.Errorf("Failed to check enrollment of %v: %v", ownerID, err)
+			accessGranted = false
+		} else if enrolled {
+			enrollment, err := GetEnrollmentInternal(stub, callerObj, ownerID, targetID)
+			if err != nil {
+				logger.Errorf("Failed to get enrollment of %v: %v", ownerID, err)
+				accessGranted = false
+			} else if enrollment.TermsAcknowledgementRequired {
+				accessGranted = false
+				message = "permission denied, service terms must be accepted"
+			}
+		}
+	}
+
+	// the consent's own filter rule narrows which records can be read
 	validation.FilterRule = filterRule
+	if accessGranted {
+		consent, err := GetConsentInternal(stub, callerObj, targetID, datatypeID, ownerID)
+		if err != nil {
+			logger.Errorf("Failed to get consent filter rule: %v", err)
+			accessGranted = false
+		} else if len(consent.FilterRule) > 0 {
+			validation.FilterRule = simple_rule.NewRule(consent.FilterRule)
+		}
+	}
 
 	// ==============================================================
 	// Construct token
@@ -763,7 +809,7 @@ func ValidateConsent(stub cached_stub.CachedStubInterface, caller data_model.Use
 		validation.Message = "permission granted"
 	} else {
 		validation.PermissionGranted = false
-		validation.Message = "permission denied"
+		validation.Message = message
 	}
 
 	// ==============================================================
@@ -1263,8 +1309,8 @@ func GetAllConsentRequests(stub cached_stub.CachedStubInterface, caller data_mod
 				datatype.Access = consent.Option
 			}
 
-			//if enrollment is inactive and consent is denied, skip
-			if enrollment.Status == "inactive" && utils.InList(consent.Option, consentOptionDeny) {
+			//if enrollment has ended and consent is denied, skip
+			if enrollment.hasEnded() && utils.InList(consent.Option, consentOptionDeny) {
 				continue
 			} else {
 				serviceDatatypes = append(serviceDatatypes, datatype)
@@ -1323,6 +1369,9 @@ func convertToConsentCommon(stub cached_stub.CachedStubInterface, consentOMR Con
 	data := make(map[string]interface{})
 	data["consent"] = consentOMR.Option
 	data["service"] = consentOMR.Service
+	if len(consentOMR.FilterRule) > 0 {
+		data["filter_rule"] = consentOMR.FilterRule
+	}
 	consentCommon.Data = data
 
 	// get off-chain datastore connection id, if one is setup
@@ -1354,6 +1403,10 @@ func convertFromConsentCommon(consentCommon data_model.Consent) Consent {
 		if service, ok := consentCommon.Data.(map[string]interface{})["service"].(string); ok {
 			consentOMR.Service = service
 		}
+
+		if filterRule, ok := consentCommon.Data.(map[string]interface{})["filter_rule"].(map[string]interface{}); ok {
+			consentOMR.FilterRule = filterRule
+		}
 	}
 
 	return consentOMR
@@ -17,6 +17,7 @@ import (
 	"common/bchcls/data_model"
 	"common/bchcls/datastore/datastore_manager"
 	"common/bchcls/init_common"
+	"common/bchcls/simple_rule"
 	"common/bchcls/test_utils"
 	"common/bchcls/user_mgmt"
 	"common/bchcls/user_mgmt/user_groups"
@@ -1762,3 +1763,27 @@ func TestValidateConsentAsServiceAdmin(t *testing.T) {
 	test_utils.AssertTrue(t, err == nil, "AddValidateConsentQueryLog should not return any error")
 	mstub.MockTransactionEnd("addValidateConsentQueryLog")
 }
+
+func TestConsentFilterRule(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestConsentFilterRule function called")
+
+	allowed, err := dataFilterRuleAllows(nil, OwnerDataResult{})
+	test_utils.AssertTrue(t, err == nil && allowed, "Expected empty rule to allow data without tags")
+	test_utils.AssertTrue(t, validateDataFilterRule(nil) == nil, "Expected empty rule to be valid")
+
+	tagsVar := simple_rule.R("var", "private_data.tags")
+	included := simple_rule.R("or", simple_rule.R("in", "fasting", tagsVar), simple_rule.R("in", "post-op", tagsVar))
+	excluded := simple_rule.R("!", simple_rule.R("in", "sensitive", tagsVar))
+	rule := simple_rule.R("and", included, excluded)
+	test_utils.AssertTrue(t, validateDataFilterRule(rule) == nil, "Expected rule to be valid")
+	allowed, err = dataFilterRuleAllows(rule, OwnerDataResult{Tags: []string{"fasting"}})
+	test_utils.AssertTrue(t, err == nil && allowed, "Expected included tag to be allowed")
+	allowed, err = dataFilterRuleAllows(rule, OwnerDataResult{Tags: []string{"post-op", "sensitive"}})
+	test_utils.AssertTrue(t, err == nil && !allowed, "Expected excluded tag to be filtered out")
+
+	// filter rule is kept when converting to and from SDK consent
+	consentCommon := data_model.Consent{Data: map[string]interface{}{"consent": []interface{}{consentOptionRead}, "filter_rule": map[string]interface{}{"in": []interface{}{"fasting", map[string]interface{}{"var": "private_data.tags"}}}}}
+	consent := convertFromConsentCommon(consentCommon)
+	test_utils.AssertTrue(t, consent.FilterRule["in"] != nil, "Expected filter rule")
+}
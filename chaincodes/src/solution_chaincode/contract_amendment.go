@@ -0,0 +1,352 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"common/bchcls/cached_stub"
+	"common/bchcls/custom_errors"
+	"common/bchcls/data_model"
+	"common/bchcls/utils"
+
+	"github.com/pkg/errors"
+)
+
+// ContractAmendment is a change of contract terms proposed by one side of the contract
+// The terms take effect only after every party of the contract signed the amended terms,
+// so the contract never has terms that its parties have not all signed
+type ContractAmendment struct {
+	Version      int          `json:"version"`
+	Terms        interface{}  `json:"terms"`
+	ProposedBy   string       `json:"proposed_by"`
+	ProposerRole ContractRole `json:"proposer_role"`
+	ProposeDate  int64        `json:"propose_date"`
+}
+
+// ContractTermsVersion is an entry in the terms history of a contract
+// Version 1 holds the terms the contract was signed with, and has no proposer or acceptor
+type ContractTermsVersion struct {
+	Version      int          `json:"version"`
+	Terms        interface{}  `json:"terms"`
+	ProposedBy   string       `json:"proposed_by"`
+	ProposerRole ContractRole `json:"proposer_role"`
+	ProposeDate  int64        `json:"propose_date"`
+	AcceptedBy   string       `json:"accepted_by"`
+	AcceptDate   int64        `json:"accept_date"`
+}
+
+// currentTermsVersion returns the version of the contract's current terms
+// Contracts created before terms were versioned are at version 1
+func (contract Contract) currentTermsVersion() int {
+	if contract.TermsVersion < 1 {
+		return 1
+	}
+
+	return contract.TermsVersion
+}
+
+// amendedContract returns a copy of the contract with the terms of its pending amendment
+// Its signing payload is the payload parties sign when accepting the amendment
+func (contract Contract) amendedContract() Contract {
+	amended := contract
+	amended.ContractTerms = contract.PendingAmendment.Terms
+	amended.TermsVersion = contract.PendingAmendment.Version
+	amended.ContractDetails = append([]ContractDetail{}, contract.ContractDetails...)
+	return amended
+}
+
+// ProposeContractAmendment proposes new terms for a contract
+// Can be called by admins of the contract owner or requester service
+// Only one amendment can be pending at a time
+// The proposer signs the amendment with AcceptContractAmendment like every other party
+// args = [contractID, terms, timestamp]
+func ProposeContractAmendment(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 3 {
+		customErr := &custom_errors.LengthCheckingError{Type: "ProposeContractAmendment arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	contractID := args[0]
+	if utils.IsStringEmpty(contractID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "contractID"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	if args[1] == "" || args[1] == "{}" || args[1] == "[]" {
+		customErr := &custom_errors.LengthCheckingError{Type: "terms"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	var terms interface{}
+	err := json.Unmarshal([]byte(args[1]), &terms)
+	if err != nil {
+		customErr := &custom_errors.UnmarshalError{Type: "terms"}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	timestamp, err := ParseTimestamp(args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	contract, err := getContractForCaller(stub, caller, contractID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get contract")
+	}
+
+	if contract.State.isFinal() {
+		logger.Errorf("Contract %v cannot be amended in state %v", contractID, contract.State)
+		return nil, errors.New("Contract cannot be amended when contract state is " + contract.State.String())
+	}
+
+	if contract.PendingAmendment != nil {
+		logger.Errorf("Contract %v already has a pending amendment", contractID)
+		return nil, errors.New("Contract already has a pending amendment, version " + strconv.Itoa(contract.PendingAmendment.Version))
+	}
+
+	callerObj, role, err := getContractCaller(stub, caller, contract)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get contract caller")
+	}
+
+	// ==============================================================
+	// Update contract
+	// ==============================================================
+	amendment := ContractAmendment{
+		Version:      contract.currentTermsVersion() + 1,
+		Terms:        terms,
+		ProposedBy:   caller.ID,
+		ProposerRole: role,
+		ProposeDate:  timestamp}
+	contract.PendingAmendment = &amendment
+
+	contractDetail := ContractDetail{
+		ContractID:          contractID,
+		ContractDetailType:  "proposeAmendment",
+		ContractDetailTerms: amendment,
+		CreateDate:          timestamp,
+		CreatedBy:           caller.ID}
+
+	err = saveContractWithDetail(stub, caller, callerObj, contract, contractDetail, "ProposeContractAmendment")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to save contract")
+	}
+
+	return nil, nil
+}
+
+// AcceptContractAmendment signs the pending amendment of a contract for the caller's contract service
+// Can be called by admins of every contract service that has not signed the amendment yet
+// Once the owner and every requester signed the amendment, its terms become the contract terms
+// signRequest holds the caller's signature over the amended signing payload, see GetContractAmendmentSigningPayload
+// args = [contractID, version, signRequest, timestamp]
+func AcceptContractAmendment(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 4 {
+		customErr := &custom_errors.LengthCheckingError{Type: "AcceptContractAmendment arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	timestamp, err := ParseTimestamp(args[3])
+	if err != nil {
+		return nil, err
+	}
+
+	contract, callerObj, role, err := getPendingAmendmentContract(stub, caller, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	amendment := contract.PendingAmendment
+	amendedContract := contract.amendedContract()
+	if amendedContract.hasCurrentSignature(callerObj.ID) {
+		logger.Errorf("Contract service %v already signed amendment version %v", callerObj.ID, amendment.Version)
+		return nil, errors.New("Contract service already signed the amendment")
+	}
+
+	signature, err := newContractSignature(caller, callerObj.ID, role, amendedContract, args[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid amendment signature")
+	}
+
+	// ==============================================================
+	// Update contract
+	// ==============================================================
+	contractDetail := ContractDetail{
+		ContractID:          contract.ContractID,
+		ContractDetailType:  "acceptAmendment",
+		ContractDetailTerms: map[string]interface{}{"version": amendment.Version},
+		CreateDate:          timestamp,
+		CreatedBy:           caller.ID,
+		Signature:           signature}
+
+	// the amendment stays pending until every party signed it
+	amendedContract.ContractDetails = append(amendedContract.ContractDetails, contractDetail)
+	if !amendedContract.allPartiesSigned() {
+		err = saveContractWithDetail(stub, caller, callerObj, contract, contractDetail, "AcceptContractAmendment")
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to save contract")
+		}
+
+		return nil, nil
+	}
+
+	if len(contract.TermsHistory) == 0 {
+		contract.TermsHistory = append(contract.TermsHistory, ContractTermsVersion{Version: contract.currentTermsVersion(), Terms: contract.ContractTerms})
+	}
+
+	contract.TermsHistory = append(contract.TermsHistory, ContractTermsVersion{
+		Version:      amendment.Version,
+		Terms:        amendment.Terms,
+		ProposedBy:   amendment.ProposedBy,
+		ProposerRole: amendment.ProposerRole,
+		ProposeDate:  amendment.ProposeDate,
+		AcceptedBy:   caller.ID,
+		AcceptDate:   timestamp})
+	contract.ContractTerms = amendment.Terms
+	contract.TermsVersion = amendment.Version
+	contract.PendingAmendment = nil
+
+	err = saveContractWithDetail(stub, caller, callerObj, contract, contractDetail, "AcceptContractAmendment")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to save contract")
+	}
+
+	return nil, nil
+}
+
+// RejectContractAmendment rejects the pending amendment of a contract, the contract terms are not changed
+// Can be called by admins of either side of the contract; when called by the proposer, the amendment is withdrawn
+// args = [contractID, version, reason, timestamp]
+func RejectContractAmendment(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 4 {
+		customErr := &custom_errors.LengthCheckingError{Type: "RejectContractAmendment arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	reason := args[2]
+
+	timestamp, err := ParseTimestamp(args[3])
+	if err != nil {
+		return nil, err
+	}
+
+	contract, callerObj, role, err := getPendingAmendmentContract(stub, caller, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	// ==============================================================
+	// Update contract
+	// ==============================================================
+	detailType := "rejectAmendment"
+	if role == contract.PendingAmendment.ProposerRole {
+		detailType = "withdrawAmendment"
+	}
+
+	contractDetail := ContractDetail{
+		ContractID:          contract.ContractID,
+		ContractDetailType:  detailType,
+		ContractDetailTerms: map[string]interface{}{"version": contract.PendingAmendment.Version, "reason": reason},
+		CreateDate:          timestamp,
+		CreatedBy:           caller.ID}
+	contract.PendingAmendment = nil
+
+	err = saveContractWithDetail(stub, caller, callerObj, contract, contractDetail, "RejectContractAmendment")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to save contract")
+	}
+
+	return nil, nil
+}
+
+// GetContractAmendmentSigningPayload returns the signing payload of a contract with the terms of its pending amendment
+// This is the payload parties sign when accepting the amendment
+// args = [contractID, version]
+func GetContractAmendmentSigningPayload(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 2 {
+		customErr := &custom_errors.LengthCheckingError{Type: "GetContractAmendmentSigningPayload arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	contract, _, _, err := getPendingAmendmentContract(stub, caller, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	return contract.amendedContract().signingPayload()
+}
+
+// getPendingAmendmentContract returns a contract whose pending amendment has the given version,
+// the caller object acting as contract service, and the side of the contract the caller acts for
+func getPendingAmendmentContract(stub cached_stub.CachedStubInterface, caller data_model.User, contractID string, versionStr string) (Contract, data_model.User, ContractRole, error) {
+	if utils.IsStringEmpty(contractID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "contractID"}
+		logger.Errorf(customErr.Error())
+		return Contract{}, data_model.User{}, "", errors.WithStack(customErr)
+	}
+
+	version, err := strconv.Atoi(versionStr)
+	if err != nil {
+		logger.Errorf("Error converting version to type int")
+		return Contract{}, data_model.User{}, "", errors.Wrap(err, "Error converting version to type int")
+	}
+
+	contract, err := getContractForCaller(stub, caller, contractID)
+	if err != nil {
+		return Contract{}, data_model.User{}, "", errors.Wrap(err, "Failed to get contract")
+	}
+
+	if contract.PendingAmendment == nil || contract.PendingAmendment.Version != version {
+		logger.Errorf("Contract %v does not have a pending amendment with version %v", contractID, version)
+		return Contract{}, data_model.User{}, "", errors.New("Contract does not have a pending amendment with version " + versionStr)
+	}
+
+	if contract.State.isFinal() {
+		logger.Errorf("Contract %v cannot be amended in state %v", contractID, contract.State)
+		return Contract{}, data_model.User{}, "", errors.New("Contract cannot be amended when contract state is " + contract.State.String())
+	}
+
+	callerObj, role, err := getContractCaller(stub, caller, contract)
+	if err != nil {
+		return Contract{}, data_model.User{}, "", errors.Wrap(err, "Failed to get contract caller")
+	}
+
+	return contract, callerObj, role, nil
+}
@@ -0,0 +1,142 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"common/bchcls/cached_stub"
+	"common/bchcls/crypto"
+	"common/bchcls/data_model"
+	"common/bchcls/test_utils"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// GenerateContractAmendmentSignTermsTest returns AcceptContractAmendment sign terms with the caller's signature over the amended signing payload
+func GenerateContractAmendmentSignTermsTest(t *testing.T, stub cached_stub.CachedStubInterface, caller data_model.User, contractID string, version string) string {
+	payload, err := GetContractAmendmentSigningPayload(stub, caller, []string{contractID, version})
+	test_utils.AssertTrue(t, err == nil, "Expected GetContractAmendmentSigningPayload to succeed")
+	return GenerateContractSignRequestTest(t, caller, payload)
+}
+
+func TestContractAmendment(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestContractAmendment function called")
+
+	mstub := SetupIndexesAndGetStub(t)
+	ownerService1Subgroup, reqService1Subgroup := SetupContractServicesTest(t, mstub, "no")
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	mstub.MockTransactionStart("1")
+	stub := cached_stub.NewCachedStub(mstub)
+	contract1 := GenerateContractTest("contract1", "ownerOrg1", "ownerService1", "requesterOrg1", "reqService1")
+	contract1Bytes, _ := json.Marshal(&contract1)
+	contractKeyB64 := crypto.EncodeToB64String(test_utils.GenerateSymKey())
+	_, err := CreateContract(stub, reqService1Subgroup, []string{string(contract1Bytes), contractKeyB64})
+	test_utils.AssertTrue(t, err == nil, "Expected CreateContract to succeed")
+	mstub.MockTransactionEnd("1")
+
+	// requester proposes amendment
+	mstub.MockTransactionStart("2")
+	stub = cached_stub.NewCachedStub(mstub)
+	args := []string{contract1.ContractID, `{"time": "first of each week"}`, now}
+	_, err = ProposeContractAmendment(stub, reqService1Subgroup, args)
+	test_utils.AssertTrue(t, err == nil, "Expected ProposeContractAmendment to succeed")
+	mstub.MockTransactionEnd("2")
+
+	// only one pending amendment at a time
+	mstub.MockTransactionStart("3")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = ProposeContractAmendment(stub, ownerService1Subgroup, args)
+	test_utils.AssertTrue(t, err != nil, "Expected ProposeContractAmendment to fail")
+	mstub.MockTransactionEnd("3")
+
+	// proposer signs the amendment, but cannot sign it twice or sign the current terms instead
+	mstub.MockTransactionStart("4")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = AcceptContractAmendment(stub, reqService1Subgroup, []string{contract1.ContractID, "2", GenerateContractSignTermsTest(t, stub, reqService1Subgroup, contract1.ContractID), now})
+	test_utils.AssertTrue(t, err != nil, "Expected AcceptContractAmendment with signature over current terms to fail")
+	_, err = AcceptContractAmendment(stub, reqService1Subgroup, []string{contract1.ContractID, "2", GenerateContractAmendmentSignTermsTest(t, stub, reqService1Subgroup, contract1.ContractID, "2"), now})
+	test_utils.AssertTrue(t, err == nil, "Expected AcceptContractAmendment to succeed")
+	mstub.MockTransactionEnd("4")
+
+	mstub.MockTransactionStart("4a")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = AcceptContractAmendment(stub, reqService1Subgroup, []string{contract1.ContractID, "2", GenerateContractAmendmentSignTermsTest(t, stub, reqService1Subgroup, contract1.ContractID, "2"), now})
+	test_utils.AssertTrue(t, err != nil, "Expected second AcceptContractAmendment of requester to fail")
+	mstub.MockTransactionEnd("4a")
+
+	// terms are unchanged until accepted
+	mstub.MockTransactionStart("5")
+	stub = cached_stub.NewCachedStub(mstub)
+	contractBytes, err := GetContract(stub, ownerService1Subgroup, []string{contract1.ContractID})
+	test_utils.AssertTrue(t, err == nil, "Expected GetContract to succeed")
+	contract := Contract{}
+	json.Unmarshal(contractBytes, &contract)
+	test_utils.AssertTrue(t, contract.TermsVersion == 1, "Expected terms version 1")
+	test_utils.AssertTrue(t, contract.PendingAmendment != nil, "Expected pending amendment")
+	test_utils.AssertTrue(t, contract.PendingAmendment.Version == 2, "Expected pending amendment version 2")
+	terms := contract.ContractTerms.(map[string]interface{})
+	test_utils.AssertTrue(t, terms["time"] == "first of each month", "Expected original terms")
+	mstub.MockTransactionEnd("5")
+
+	// owner accepts
+	mstub.MockTransactionStart("6")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = AcceptContractAmendment(stub, ownerService1Subgroup, []string{contract1.ContractID, "2", GenerateContractAmendmentSignTermsTest(t, stub, ownerService1Subgroup, contract1.ContractID, "2"), now})
+	test_utils.AssertTrue(t, err == nil, "Expected AcceptContractAmendment to succeed")
+	mstub.MockTransactionEnd("6")
+
+	mstub.MockTransactionStart("7")
+	stub = cached_stub.NewCachedStub(mstub)
+	contractBytes, err = GetContract(stub, ownerService1Subgroup, []string{contract1.ContractID})
+	test_utils.AssertTrue(t, err == nil, "Expected GetContract to succeed")
+	contract = Contract{}
+	json.Unmarshal(contractBytes, &contract)
+	test_utils.AssertTrue(t, contract.TermsVersion == 2, "Expected terms version 2")
+	test_utils.AssertTrue(t, contract.PendingAmendment == nil, "Expected no pending amendment")
+	test_utils.AssertTrue(t, len(contract.TermsHistory) == 2, "Expected 2 terms versions")
+	test_utils.AssertTrue(t, contract.TermsHistory[1].AcceptedBy == ownerService1Subgroup.ID, "Expected owner to accept")
+	terms = contract.ContractTerms.(map[string]interface{})
+	test_utils.AssertTrue(t, terms["time"] == "first of each week", "Expected amended terms")
+	test_utils.AssertTrue(t, contract.allPartiesSigned(), "Expected every party to have signed the amended terms")
+	mstub.MockTransactionEnd("7")
+
+	// owner proposes, requester rejects
+	mstub.MockTransactionStart("8")
+	stub = cached_stub.NewCachedStub(mstub)
+	args = []string{contract1.ContractID, `{"time": "every day"}`, now}
+	_, err = ProposeContractAmendment(stub, ownerService1Subgroup, args)
+	test_utils.AssertTrue(t, err == nil, "Expected ProposeContractAmendment to succeed")
+	mstub.MockTransactionEnd("8")
+
+	mstub.MockTransactionStart("9")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = RejectContractAmendment(stub, reqService1Subgroup, []string{contract1.ContractID, "2", "too often", now})
+	test_utils.AssertTrue(t, err != nil, "Expected RejectContractAmendment of wrong version to fail")
+	_, err = RejectContractAmendment(stub, reqService1Subgroup, []string{contract1.ContractID, "3", "too often", now})
+	test_utils.AssertTrue(t, err == nil, "Expected RejectContractAmendment to succeed")
+	mstub.MockTransactionEnd("9")
+
+	mstub.MockTransactionStart("10")
+	stub = cached_stub.NewCachedStub(mstub)
+	contractBytes, err = GetContract(stub, ownerService1Subgroup, []string{contract1.ContractID})
+	test_utils.AssertTrue(t, err == nil, "Expected GetContract to succeed")
+	contract = Contract{}
+	json.Unmarshal(contractBytes, &contract)
+	test_utils.AssertTrue(t, contract.TermsVersion == 2, "Expected terms version 2")
+	test_utils.AssertTrue(t, contract.PendingAmendment == nil, "Expected no pending amendment")
+	lastDetail := contract.ContractDetails[len(contract.ContractDetails)-1]
+	test_utils.AssertTrue(t, lastDetail.ContractDetailType == "rejectAmendment", "Expected rejectAmendment contract detail")
+	mstub.MockTransactionEnd("10")
+}
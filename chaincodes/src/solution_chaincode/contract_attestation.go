@@ -0,0 +1,354 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"common/bchcls/cached_stub"
+	"common/bchcls/custom_errors"
+	"common/bchcls/data_model"
+	"common/bchcls/utils"
+
+	"github.com/pkg/errors"
+)
+
+// contractAttestationPeriod is the time in seconds requesters have to attest what they did with contract data
+// once the contract ended
+const contractAttestationPeriod int64 = 30 * 24 * 60 * 60
+
+// Contract attestation types
+const (
+	contractAttestationDestruction = "destruction"
+	contractAttestationRetention   = "retention"
+)
+
+// attestableContractStates are the contract states that require an attestation from every requester
+var attestableContractStates = []ContractState{ContractStateDownloadDone, ContractStateTerminated, ContractStateExpired}
+
+// ContractAttestation is a requester's statement of what it did with the data downloaded under a contract
+// Type is destruction or retention; RetainUntil is required for retention and is when the retained data will be destroyed
+type ContractAttestation struct {
+	ContractID  string `json:"contract_id"`
+	ServiceID   string `json:"service_id"`
+	Type        string `json:"type"`
+	Statement   string `json:"statement"`
+	RetainUntil int64  `json:"retain_until"`
+	AttestDate  int64  `json:"attest_date"`
+}
+
+// contractAttestRequest is the attestation argument of AttestContractData
+// Signature is a base64 encoded RSA PKCS #1 v1.5 signature over the SHA-256 hash of the attestation signing payload
+type contractAttestRequest struct {
+	Type        string `json:"type"`
+	Statement   string `json:"statement"`
+	RetainUntil int64  `json:"retain_until"`
+	Signature   string `json:"signature"`
+}
+
+// ContractAttestationStatus is returned by GetOverdueContractAttestations
+// PendingServices are the requester services that have not attested yet
+type ContractAttestationStatus struct {
+	ContractID      string        `json:"contract_id"`
+	State           ContractState `json:"state"`
+	EndDate         int64         `json:"end_date"`
+	DueDate         int64         `json:"due_date"`
+	PendingServices []string      `json:"pending_services"`
+}
+
+// signingPayload returns the canonical payload of the attestation that the requester org admin signs
+func (attestation ContractAttestation) signingPayload() ([]byte, error) {
+	payloadBytes, err := json.Marshal(&attestation)
+	if err != nil {
+		customErr := &custom_errors.MarshalError{Type: "ContractAttestation"}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	return payloadBytes, nil
+}
+
+// findAttestation returns the attestation of a requester service, or nil if it has not attested
+func (contract Contract) findAttestation(serviceID string) *ContractDetail {
+	for i := range contract.ContractDetails {
+		contractDetail := contract.ContractDetails[i]
+		if contractDetail.ContractDetailType == contractActionAttest && contractDetail.Signature != nil && contractDetail.Signature.ServiceID == serviceID {
+			return &contract.ContractDetails[i]
+		}
+	}
+
+	return nil
+}
+
+// pendingAttestations returns the requester services that have not attested yet
+// Returns an empty list if the contract has not ended
+func (contract Contract) pendingAttestations() []string {
+	pending := []string{}
+	if !contract.requiresAttestation() {
+		return pending
+	}
+
+	for _, serviceID := range contract.requesterServiceIDs() {
+		if contract.findAttestation(serviceID) == nil {
+			pending = append(pending, serviceID)
+		}
+	}
+
+	return pending
+}
+
+// requiresAttestation returns true if the contract is in a state that requires requester attestations
+func (contract Contract) requiresAttestation() bool {
+	return contract.State.isAttestable()
+}
+
+// isAttestable returns true if contracts in this state require requester attestations
+func (state ContractState) isAttestable() bool {
+	for _, attestableState := range attestableContractStates {
+		if state == attestableState {
+			return true
+		}
+	}
+
+	return false
+}
+
+// attestationEndDate returns when the contract ended
+// Contracts are not updated after they end until the first attestation, which records the end date
+func (contract Contract) attestationEndDate() int64 {
+	if contract.EndDate > 0 {
+		return contract.EndDate
+	}
+
+	return contract.UpdateDate
+}
+
+// AttestContractData records a requester's signed attestation that the data downloaded under an ended contract
+// was destroyed, or is retained until a given date
+// Can only be called by org admin of the requester org, once the contract is downloadDone, terminated, or expired
+// attestation is {"type": "destruction"|"retention", "statement": "...", "retain_until": 0, "signature": "..."}
+// The signature is over the JSON of ContractAttestation, with attest_date set to timestamp
+// args = [contractID, attestation, timestamp]
+func AttestContractData(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 3 {
+		customErr := &custom_errors.LengthCheckingError{Type: "AttestContractData arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	contractID := args[0]
+	if utils.IsStringEmpty(contractID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "contractID"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	attestRequest := contractAttestRequest{}
+	err := json.Unmarshal([]byte(args[1]), &attestRequest)
+	if err != nil {
+		customErr := &custom_errors.UnmarshalError{Type: "contractAttestRequest"}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	if attestRequest.Type != contractAttestationDestruction && attestRequest.Type != contractAttestationRetention {
+		logger.Errorf("Invalid attestation type (must be destruction or retention): %v", attestRequest.Type)
+		return nil, errors.New("Invalid attestation type (must be destruction or retention): " + attestRequest.Type)
+	}
+
+	if utils.IsStringEmpty(attestRequest.Statement) {
+		customErr := &custom_errors.LengthCheckingError{Type: "statement"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	if utils.IsStringEmpty(attestRequest.Signature) {
+		customErr := &custom_errors.LengthCheckingError{Type: "signature"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	timestamp, err := ParseTimestamp(args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	if attestRequest.Type == contractAttestationRetention && attestRequest.RetainUntil <= timestamp {
+		logger.Errorf("Invalid retain until date: %v", attestRequest.RetainUntil)
+		return nil, errors.New("Retention attestation must have a retain until date in the future")
+	}
+
+	if attestRequest.Type == contractAttestationDestruction && attestRequest.RetainUntil != 0 {
+		logger.Errorf("Destruction attestation cannot have a retain until date")
+		return nil, errors.New("Destruction attestation cannot have a retain until date")
+	}
+
+	contract, err := getContractForCaller(stub, caller, contractID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get contract")
+	}
+
+	if !contract.requiresAttestation() {
+		logger.Errorf("Contract must be downloadDone, terminated, or expired to attest, contract state is %v", contract.State)
+		return nil, errors.New("Contract must be downloadDone, terminated, or expired to attest, contract state is " + contract.State.String())
+	}
+
+	callerObj, role, err := getContractCaller(stub, caller, contract)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get contract caller")
+	}
+
+	serviceID, ok := getContractRequesterService(caller, contract)
+	if role != ContractRoleRequester || !ok {
+		logger.Errorf("Caller must be admin of a contract requester service")
+		return nil, errors.New("Caller must be admin of a contract requester service")
+	}
+
+	requesterOrgID := contract.RequesterOrgID
+	if coRequester := contract.findCoRequester(serviceID); coRequester != nil {
+		requesterOrgID = coRequester.OrgID
+	}
+
+	solutionCaller := convertToSolutionUser(caller)
+	if !solutionCaller.SolutionInfo.IsOrgAdmin || solutionCaller.Org != requesterOrgID {
+		logger.Errorf("Caller must be org admin of contract requester org")
+		return nil, errors.New("Caller must be org admin of contract requester org")
+	}
+
+	if contract.findAttestation(serviceID) != nil {
+		logger.Errorf("Requester service %v already attested", serviceID)
+		return nil, errors.New("Requester service " + serviceID + " already attested")
+	}
+
+	attestation := ContractAttestation{
+		ContractID:  contract.ContractID,
+		ServiceID:   serviceID,
+		Type:        attestRequest.Type,
+		Statement:   attestRequest.Statement,
+		RetainUntil: attestRequest.RetainUntil,
+		AttestDate:  timestamp}
+	payload, err := attestation.signingPayload()
+	if err != nil {
+		return nil, err
+	}
+
+	err = verifySignature(caller.PublicKey, payload, attestRequest.Signature)
+	if err != nil {
+		logger.Errorf("Failed to verify attestation signature of %v: %v", caller.ID, err)
+		return nil, errors.Wrap(err, "Failed to verify attestation signature")
+	}
+
+	// ==============================================================
+	// Update contract
+	// ==============================================================
+	contractDetail := ContractDetail{
+		ContractID:          contract.ContractID,
+		ContractDetailType:  contractActionAttest,
+		ContractDetailTerms: attestation,
+		CreateDate:          timestamp,
+		CreatedBy:           caller.ID,
+		Signature:           &ContractSignature{SignerID: caller.ID, SignerRole: role, ServiceID: serviceID, Payload: string(payload), Signature: attestRequest.Signature}}
+	if contract.EndDate == 0 {
+		contract.EndDate = contract.UpdateDate
+	}
+
+	err = saveContractWithDetail(stub, caller, callerObj, contract, contractDetail, "AttestContractData")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to save contract")
+	}
+
+	return nil, nil
+}
+
+// GetOverdueContractAttestations returns the contracts of a service that ended more than the attestation period
+// before timestamp and still miss the attestation of at least one requester
+// Can only be called by service admin or org admin of the service
+// filter is a ContractSearchFilter; its state, if given, must be downloadDone, terminated, or expired
+// args = [filter, timestamp]
+func GetOverdueContractAttestations(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 2 {
+		customErr := &custom_errors.LengthCheckingError{Type: "GetOverdueContractAttestations arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	filter := ContractSearchFilter{}
+	err := json.Unmarshal([]byte(args[0]), &filter)
+	if err != nil {
+		customErr := &custom_errors.UnmarshalError{Type: "ContractSearchFilter"}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	// timestamp is not checked against current time, so attestations that will be overdue can be looked up ahead
+	timestamp, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		logger.Errorf("Error converting timestamp to type int64")
+		return nil, errors.Wrap(err, "Error converting timestamp to type int64")
+	}
+
+	states := attestableContractStates
+	if !utils.IsStringEmpty(filter.State.String()) {
+		if !filter.State.isAttestable() {
+			logger.Errorf("Invalid contract state for attestations: %v", filter.State)
+			return nil, errors.New("Invalid contract state for attestations, must be downloadDone, terminated, or expired")
+		}
+		states = []ContractState{filter.State}
+	}
+
+	callerObj, err := getContractSearchCaller(stub, caller, filter)
+	if err != nil {
+		logger.Errorf("Failed to get contract search caller: %v", err)
+		return nil, errors.Wrap(err, "Failed to get contract search caller")
+	}
+
+	// ==============================================================
+	// Find ended contracts with missing attestations
+	// ==============================================================
+	result := []ContractAttestationStatus{}
+	for _, state := range states {
+		filter.State = state
+		contracts, _, err := searchContractsInternal(stub, callerObj, filter, 0, "")
+		if err != nil {
+			logger.Errorf("Failed to search contracts: %v", err)
+			return nil, errors.Wrap(err, "Failed to search contracts")
+		}
+
+		for _, contract := range contracts {
+			pending := contract.pendingAttestations()
+			dueDate := contract.attestationEndDate() + contractAttestationPeriod
+			if len(pending) > 0 && dueDate < timestamp {
+				result = append(result, ContractAttestationStatus{
+					ContractID:      contract.ContractID,
+					State:           contract.State,
+					EndDate:         contract.attestationEndDate(),
+					DueDate:         dueDate,
+					PendingServices: pending})
+			}
+		}
+	}
+
+	logger.Infof("found %v contracts with overdue attestations for service %v", len(result), filter.ServiceID)
+
+	return json.Marshal(&result)
+}
@@ -0,0 +1,149 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"common/bchcls/cached_stub"
+	"common/bchcls/crypto"
+	"common/bchcls/data_model"
+	"common/bchcls/test_utils"
+	"common/bchcls/user_mgmt"
+	gocrypto "crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// GenerateContractAttestationTest returns an attestation request signed by caller
+func GenerateContractAttestationTest(t *testing.T, caller data_model.User, attestation ContractAttestation) string {
+	payload, err := attestation.signingPayload()
+	test_utils.AssertTrue(t, err == nil, "Expected signingPayload to succeed")
+
+	hash := sha256.Sum256(payload)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, caller.PrivateKey, gocrypto.SHA256, hash[:])
+	test_utils.AssertTrue(t, err == nil, "Expected SignPKCS1v15 to succeed")
+
+	attestRequestBytes, _ := json.Marshal(&contractAttestRequest{
+		Type:        attestation.Type,
+		Statement:   attestation.Statement,
+		RetainUntil: attestation.RetainUntil,
+		Signature:   base64.StdEncoding.EncodeToString(signature)})
+	return string(attestRequestBytes)
+}
+
+func TestContractAttestation(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestContractAttestation function called")
+
+	mstub := SetupIndexesAndGetStub(t)
+	ownerService1Subgroup, _ := SetupContractServicesTest(t, mstub, "no")
+	now := time.Now().Unix()
+	nowStr := strconv.FormatInt(now, 10)
+
+	// register a second requester org, whose org admin attests
+	mstub.MockTransactionStart("t1")
+	stub := cached_stub.NewCachedStub(mstub, true, true, true)
+	requesterOrg2 := test_utils.CreateTestGroup("requesterOrg2")
+	requesterOrg2Bytes, _ := json.Marshal(&requesterOrg2)
+	_, err := RegisterOrg(stub, requesterOrg2, []string{string(requesterOrg2Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterOrg to succeed")
+	requesterOrg2Caller, _ := user_mgmt.GetUserData(stub, requesterOrg2, requesterOrg2.ID, true, true)
+	reqOrgDatatype2 := Datatype{DatatypeID: "reqOrgDatatype2", Description: "reqOrgDatatype2"}
+	reqOrgDatatype2Bytes, _ := json.Marshal(&reqOrgDatatype2)
+	_, err = RegisterDatatype(stub, requesterOrg2Caller, []string{string(reqOrgDatatype2Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterDatatype to succeed")
+	reqServiceDatatype := GenerateServiceDatatypeForTesting("reqOrgDatatype2", "reqService2", []string{consentOptionWrite, consentOptionRead})
+	reqService2 := GenerateServiceForTesting("reqService2", "requesterOrg2", []ServiceDatatype{reqServiceDatatype})
+	reqService2Bytes, _ := json.Marshal(&reqService2)
+	_, err = RegisterService(stub, requesterOrg2Caller, []string{string(reqService2Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterService to succeed")
+	mstub.MockTransactionEnd("t1")
+
+	mstub.MockTransactionStart("1")
+	stub = cached_stub.NewCachedStub(mstub)
+	reqService2Subgroup, _ := user_mgmt.GetUserData(stub, requesterOrg2Caller, "reqService2", true, true)
+	contract1 := GenerateContractTest("contract1", "ownerOrg1", "ownerService1", "requesterOrg2", "reqService2")
+	contract1Bytes, _ := json.Marshal(&contract1)
+	contractKeyB64 := crypto.EncodeToB64String(test_utils.GenerateSymKey())
+	_, err = CreateContract(stub, reqService2Subgroup, []string{string(contract1Bytes), contractKeyB64})
+	test_utils.AssertTrue(t, err == nil, "Expected CreateContract to succeed")
+	mstub.MockTransactionEnd("1")
+
+	// attestation is only possible once the contract ended
+	attestation := ContractAttestation{
+		ContractID: contract1.ContractID,
+		ServiceID:  "reqService2",
+		Type:       contractAttestationDestruction,
+		Statement:  "all downloaded records were deleted",
+		AttestDate: now}
+	mstub.MockTransactionStart("2")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = AttestContractData(stub, requesterOrg2Caller, []string{contract1.ContractID, GenerateContractAttestationTest(t, requesterOrg2Caller, attestation), nowStr})
+	test_utils.AssertTrue(t, err != nil, "Expected AttestContractData to fail")
+	_, err = AddContractDetail(stub, reqService2Subgroup, []string{contract1.ContractID, "terminate", "{}", nowStr})
+	test_utils.AssertTrue(t, err == nil, "Expected AddContractDetail to succeed")
+	mstub.MockTransactionEnd("2")
+
+	// attestation is overdue once the attestation period passed
+	mstub.MockTransactionStart("3")
+	stub = cached_stub.NewCachedStub(mstub)
+	filter := ContractSearchFilter{ServiceID: "ownerService1", Role: ContractRoleOwner}
+	filterBytes, _ := json.Marshal(&filter)
+	overdueBytes, err := GetOverdueContractAttestations(stub, ownerService1Subgroup, []string{string(filterBytes), nowStr})
+	test_utils.AssertTrue(t, err == nil, "Expected GetOverdueContractAttestations to succeed")
+	overdue := []ContractAttestationStatus{}
+	json.Unmarshal(overdueBytes, &overdue)
+	test_utils.AssertTrue(t, len(overdue) == 0, "Expected no overdue attestations")
+
+	laterStr := strconv.FormatInt(now+contractAttestationPeriod+60, 10)
+	overdueBytes, err = GetOverdueContractAttestations(stub, ownerService1Subgroup, []string{string(filterBytes), laterStr})
+	test_utils.AssertTrue(t, err == nil, "Expected GetOverdueContractAttestations to succeed")
+	overdue = []ContractAttestationStatus{}
+	json.Unmarshal(overdueBytes, &overdue)
+	test_utils.AssertTrue(t, len(overdue) == 1 && overdue[0].ContractID == contract1.ContractID, "Expected overdue contract1")
+	test_utils.AssertTrue(t, len(overdue[0].PendingServices) == 1 && overdue[0].PendingServices[0] == "reqService2", "Expected pending reqService2")
+	mstub.MockTransactionEnd("3")
+
+	// only requester org admin can attest, with a valid signature
+	mstub.MockTransactionStart("4")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = AttestContractData(stub, reqService2Subgroup, []string{contract1.ContractID, GenerateContractAttestationTest(t, reqService2Subgroup, attestation), nowStr})
+	test_utils.AssertTrue(t, err != nil, "Expected AttestContractData by service admin to fail")
+	_, err = AttestContractData(stub, requesterOrg2Caller, []string{contract1.ContractID, GenerateContractAttestationTest(t, reqService2Subgroup, attestation), nowStr})
+	test_utils.AssertTrue(t, err != nil, "Expected AttestContractData with wrong signer to fail")
+	_, err = AttestContractData(stub, requesterOrg2Caller, []string{contract1.ContractID, GenerateContractAttestationTest(t, requesterOrg2Caller, attestation), nowStr})
+	test_utils.AssertTrue(t, err == nil, "Expected AttestContractData to succeed")
+	mstub.MockTransactionEnd("4")
+
+	mstub.MockTransactionStart("5")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = AttestContractData(stub, requesterOrg2Caller, []string{contract1.ContractID, GenerateContractAttestationTest(t, requesterOrg2Caller, attestation), nowStr})
+	test_utils.AssertTrue(t, err != nil, "Expected second AttestContractData to fail")
+	contract, err := GetContractInternal(stub, reqService2Subgroup, contract1.ContractID)
+	test_utils.AssertTrue(t, err == nil, "Expected GetContractInternal to succeed")
+	test_utils.AssertTrue(t, contract.State == ContractStateTerminated, "Expected contract to stay terminated")
+	test_utils.AssertTrue(t, contract.EndDate == now, "Expected end date to be the terminate date")
+	lastDetail := contract.ContractDetails[len(contract.ContractDetails)-1]
+	test_utils.AssertTrue(t, lastDetail.ContractDetailType == contractActionAttest, "Expected attest contract detail")
+
+	overdueBytes, err = GetOverdueContractAttestations(stub, ownerService1Subgroup, []string{string(filterBytes), laterStr})
+	test_utils.AssertTrue(t, err == nil, "Expected GetOverdueContractAttestations to succeed")
+	overdue = []ContractAttestationStatus{}
+	json.Unmarshal(overdueBytes, &overdue)
+	test_utils.AssertTrue(t, len(overdue) == 0, "Expected no overdue attestations after attestation")
+	mstub.MockTransactionEnd("5")
+}
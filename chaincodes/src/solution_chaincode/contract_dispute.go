@@ -0,0 +1,364 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+
+	"common/bchcls/cached_stub"
+	"common/bchcls/custom_errors"
+	"common/bchcls/data_model"
+	"common/bchcls/utils"
+
+	"github.com/pkg/errors"
+)
+
+// Contract dispute resolutions
+const (
+	contractResolutionReinstate = "reinstate"
+	contractResolutionTerminate = "terminate"
+)
+
+// ContractEvidence is an attachment supporting a contract dispute
+// The attachment itself is kept off chain; Hash is the hex encoded SHA-256 of its content
+type ContractEvidence struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Hash        string `json:"hash"`
+	URI         string `json:"uri"`
+}
+
+// ContractDispute is the open dispute of a contract
+type ContractDispute struct {
+	Reason     string             `json:"reason"`
+	Evidence   []ContractEvidence `json:"evidence"`
+	RaisedBy   string             `json:"raised_by"`
+	RaiserRole ContractRole       `json:"raiser_role"`
+	RaiseDate  int64              `json:"raise_date"`
+}
+
+// validate checks the reason and evidence of a new dispute
+func (dispute ContractDispute) validate() error {
+	if utils.IsStringEmpty(dispute.Reason) {
+		return errors.New("Contract dispute must have a reason")
+	}
+
+	for _, evidence := range dispute.Evidence {
+		if utils.IsStringEmpty(evidence.Name) {
+			return errors.New("Contract dispute evidence must have a name")
+		}
+
+		hash, err := hex.DecodeString(evidence.Hash)
+		if err != nil || len(hash) != 32 {
+			return errors.New("Contract dispute evidence " + evidence.Name + " must have a hex encoded SHA-256 hash")
+		}
+	}
+
+	return nil
+}
+
+// SuspendContract temporarily holds a contract, which blocks downloads and every other action except
+// resume, dispute, terminate and expire
+// Requesters lose their access to owner data until the contract is resumed or reinstated
+// Can only be called by admins of the contract owner service
+// args = [contractID, reason, timestamp]
+func SuspendContract(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 3 {
+		customErr := &custom_errors.LengthCheckingError{Type: "SuspendContract arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	reason := args[1]
+	if utils.IsStringEmpty(reason) {
+		customErr := &custom_errors.LengthCheckingError{Type: "reason"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	timestamp, err := ParseTimestamp(args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	contract, callerObj, transition, err := getContractForHoldAction(stub, caller, args[0], contractActionSuspend)
+	if err != nil {
+		return nil, err
+	}
+
+	// ==============================================================
+	// Update contract
+	// ==============================================================
+	contractDetail := ContractDetail{
+		ContractID:          contract.ContractID,
+		ContractDetailType:  contractActionSuspend,
+		ContractDetailTerms: map[string]interface{}{"previous_state": contract.State, "reason": reason},
+		CreateDate:          timestamp,
+		CreatedBy:           caller.ID}
+	contract.ResumeState = contract.State
+	contract.State = transition.nextState(contract)
+
+	if contract.ResumeState.hasDataAccess() {
+		err = setContractDataAccess(stub, callerObj, contract, false)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to remove requester access to owner data")
+		}
+	}
+
+	err = saveContractWithDetail(stub, caller, callerObj, contract, contractDetail, "SuspendContract")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to save contract")
+	}
+
+	return nil, nil
+}
+
+// ResumeContract returns a suspended contract to the state it was suspended from
+// Requesters get back their access to owner data if the contract was downloadable
+// Can only be called by admins of the contract owner service
+// args = [contractID, timestamp]
+func ResumeContract(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 2 {
+		customErr := &custom_errors.LengthCheckingError{Type: "ResumeContract arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	timestamp, err := ParseTimestamp(args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	contract, callerObj, transition, err := getContractForHoldAction(stub, caller, args[0], contractActionResume)
+	if err != nil {
+		return nil, err
+	}
+
+	// ==============================================================
+	// Update contract
+	// ==============================================================
+	contractDetail := ContractDetail{
+		ContractID:          contract.ContractID,
+		ContractDetailType:  contractActionResume,
+		ContractDetailTerms: map[string]interface{}{"resumed_state": contract.ResumeState},
+		CreateDate:          timestamp,
+		CreatedBy:           caller.ID}
+	contract.State = transition.nextState(contract)
+	contract.ResumeState = ""
+
+	if contract.State.hasDataAccess() {
+		err = setContractDataAccess(stub, callerObj, contract, true)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to restore requester access to owner data")
+		}
+	}
+
+	err = saveContractWithDetail(stub, caller, callerObj, contract, contractDetail, "ResumeContract")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to save contract")
+	}
+
+	return nil, nil
+}
+
+// RaiseContractDispute opens a dispute on a contract, which is held until the dispute is resolved
+// Can be called by admins of either side of the contract
+// A dispute raised on a suspended contract keeps the state the contract was suspended from
+// dispute is a JSON object with a reason and a list of evidence attachments
+// args = [contractID, dispute, timestamp]
+func RaiseContractDispute(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 3 {
+		customErr := &custom_errors.LengthCheckingError{Type: "RaiseContractDispute arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	dispute := ContractDispute{}
+	err := json.Unmarshal([]byte(args[1]), &dispute)
+	if err != nil {
+		customErr := &custom_errors.UnmarshalError{Type: "ContractDispute"}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	err = dispute.validate()
+	if err != nil {
+		logger.Errorf("Invalid contract dispute: %v", err)
+		return nil, errors.Wrap(err, "Invalid contract dispute")
+	}
+
+	timestamp, err := ParseTimestamp(args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	contract, callerObj, transition, err := getContractForHoldAction(stub, caller, args[0], contractActionDispute)
+	if err != nil {
+		return nil, err
+	}
+
+	// ==============================================================
+	// Update contract
+	// ==============================================================
+	dispute.RaisedBy = caller.ID
+	dispute.RaiserRole = transition.Role
+	dispute.RaiseDate = timestamp
+	if dispute.Evidence == nil {
+		dispute.Evidence = []ContractEvidence{}
+	}
+
+	contractDetail := ContractDetail{
+		ContractID:          contract.ContractID,
+		ContractDetailType:  contractActionDispute,
+		ContractDetailTerms: dispute,
+		CreateDate:          timestamp,
+		CreatedBy:           caller.ID}
+	if contract.State != ContractStateSuspended {
+		contract.ResumeState = contract.State
+	}
+	contract.State = transition.nextState(contract)
+	contract.Dispute = &dispute
+
+	err = saveContractWithDetail(stub, caller, callerObj, contract, contractDetail, "RaiseContractDispute")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to save contract")
+	}
+
+	return nil, nil
+}
+
+// ResolveContractDispute closes the open dispute of a contract
+// Can only be called by org admin of the contract owner org
+// resolution is reinstate, which returns the contract to the state it was held from, or terminate
+// Reinstating a downloadable contract restores the requesters' access to owner data removed by SuspendContract
+// args = [contractID, resolution, notes, timestamp]
+func ResolveContractDispute(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 4 {
+		customErr := &custom_errors.LengthCheckingError{Type: "ResolveContractDispute arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	resolution := args[1]
+	if resolution != contractResolutionReinstate && resolution != contractResolutionTerminate {
+		logger.Errorf("Invalid dispute resolution (must be reinstate or terminate): %v", resolution)
+		return nil, errors.New("Invalid dispute resolution (must be reinstate or terminate): " + resolution)
+	}
+
+	notes := args[2]
+
+	timestamp, err := ParseTimestamp(args[3])
+	if err != nil {
+		return nil, err
+	}
+
+	contract, callerObj, transition, err := getContractForHoldAction(stub, caller, args[0], contractActionResolve)
+	if err != nil {
+		return nil, err
+	}
+
+	solutionCaller := convertToSolutionUser(caller)
+	if !solutionCaller.SolutionInfo.IsOrgAdmin || solutionCaller.Org != contract.OwnerOrgID {
+		logger.Errorf("Caller must be org admin of contract owner org")
+		return nil, errors.New("Caller must be org admin of contract owner org")
+	}
+
+	if resolution == contractResolutionTerminate {
+		transition, err = findContractTransition(contract, contractActionTerminate, ContractRoleOwner)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// ==============================================================
+	// Update contract
+	// ==============================================================
+	terms := map[string]interface{}{"resolution": resolution, "notes": notes}
+	if contract.Dispute != nil {
+		terms["raised_by"] = contract.Dispute.RaisedBy
+		terms["raise_date"] = contract.Dispute.RaiseDate
+	}
+
+	contractDetail := ContractDetail{
+		ContractID:          contract.ContractID,
+		ContractDetailType:  contractActionResolve,
+		ContractDetailTerms: terms,
+		CreateDate:          timestamp,
+		CreatedBy:           caller.ID}
+	contract.State = transition.nextState(contract)
+	contract.ResumeState = ""
+	contract.Dispute = nil
+
+	if resolution == contractResolutionReinstate && contract.State.hasDataAccess() {
+		err = setContractDataAccess(stub, callerObj, contract, true)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to restore requester access to owner data")
+		}
+	}
+
+	err = saveContractWithDetail(stub, caller, callerObj, contract, contractDetail, "ResolveContractDispute")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to save contract")
+	}
+
+	return nil, nil
+}
+
+// getContractForHoldAction returns a contract, the caller object acting as contract service,
+// and the transition for a suspend, resume, dispute or resolve action taken by the caller
+func getContractForHoldAction(stub cached_stub.CachedStubInterface, caller data_model.User, contractID string, action string) (Contract, data_model.User, ContractTransition, error) {
+	if utils.IsStringEmpty(contractID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "contractID"}
+		logger.Errorf(customErr.Error())
+		return Contract{}, data_model.User{}, ContractTransition{}, errors.WithStack(customErr)
+	}
+
+	contract, err := getContractForCaller(stub, caller, contractID)
+	if err != nil {
+		return Contract{}, data_model.User{}, ContractTransition{}, errors.Wrap(err, "Failed to get contract")
+	}
+
+	callerObj, role, err := getContractCaller(stub, caller, contract)
+	if err != nil {
+		return Contract{}, data_model.User{}, ContractTransition{}, errors.Wrap(err, "Failed to get contract caller")
+	}
+
+	transition, err := findContractTransition(contract, action, role)
+	if err != nil {
+		return Contract{}, data_model.User{}, ContractTransition{}, err
+	}
+
+	return contract, callerObj, transition, nil
+}
@@ -0,0 +1,203 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"common/bchcls/cached_stub"
+	"common/bchcls/crypto"
+	"common/bchcls/test_utils"
+	"common/bchcls/user_mgmt"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestContractDispute(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestContractDispute function called")
+
+	mstub := SetupIndexesAndGetStub(t)
+	_, reqService1Subgroup := SetupContractServicesTest(t, mstub, "no")
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	// register a second owner org, whose org admin resolves disputes
+	mstub.MockTransactionStart("t1")
+	stub := cached_stub.NewCachedStub(mstub, true, true, true)
+	ownerOrg2 := test_utils.CreateTestGroup("ownerOrg2")
+	ownerOrg2Bytes, _ := json.Marshal(&ownerOrg2)
+	_, err := RegisterOrg(stub, ownerOrg2, []string{string(ownerOrg2Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterOrg to succeed")
+	ownerOrg2Caller, _ := user_mgmt.GetUserData(stub, ownerOrg2, ownerOrg2.ID, true, true)
+	ownerOrgDatatype2 := Datatype{DatatypeID: "ownerOrgDatatype2", Description: "ownerOrgDatatype2"}
+	ownerOrgDatatype2Bytes, _ := json.Marshal(&ownerOrgDatatype2)
+	_, err = RegisterDatatype(stub, ownerOrg2Caller, []string{string(ownerOrgDatatype2Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterDatatype to succeed")
+	ownerServiceDatatype := GenerateServiceDatatypeForTesting("ownerOrgDatatype2", "ownerService2", []string{consentOptionWrite, consentOptionRead})
+	ownerService2 := GenerateServiceForTesting("ownerService2", "ownerOrg2", []ServiceDatatype{ownerServiceDatatype})
+	ownerService2["payment_required"] = "no"
+	ownerService2Bytes, _ := json.Marshal(&ownerService2)
+	_, err = RegisterService(stub, ownerOrg2Caller, []string{string(ownerService2Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterService to succeed")
+	mstub.MockTransactionEnd("t1")
+
+	mstub.MockTransactionStart("1")
+	stub = cached_stub.NewCachedStub(mstub)
+	ownerService2Subgroup, _ := user_mgmt.GetUserData(stub, ownerOrg2Caller, "ownerService2", true, true)
+	contract1 := GenerateContractTest("contract1", "ownerOrg2", "ownerService2", "requesterOrg1", "reqService1")
+	contract1Bytes, _ := json.Marshal(&contract1)
+	contractKeyB64 := crypto.EncodeToB64String(test_utils.GenerateSymKey())
+	_, err = CreateContract(stub, reqService1Subgroup, []string{string(contract1Bytes), contractKeyB64})
+	test_utils.AssertTrue(t, err == nil, "Expected CreateContract to succeed")
+	_, err = AddContractDetail(stub, ownerService2Subgroup, []string{contract1.ContractID, "terms", "{}", now})
+	test_utils.AssertTrue(t, err == nil, "Expected AddContractDetail to succeed")
+	mstub.MockTransactionEnd("1")
+
+	// only owner can suspend
+	mstub.MockTransactionStart("2")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = SuspendContract(stub, reqService1Subgroup, []string{contract1.ContractID, "investigation", now})
+	test_utils.AssertTrue(t, err != nil, "Expected SuspendContract to fail")
+	_, err = SuspendContract(stub, ownerService2Subgroup, []string{contract1.ContractID, "investigation", now})
+	test_utils.AssertTrue(t, err == nil, "Expected SuspendContract to succeed")
+	mstub.MockTransactionEnd("2")
+
+	// suspended contract is held
+	mstub.MockTransactionStart("3")
+	stub = cached_stub.NewCachedStub(mstub)
+	contract, err := GetContractInternal(stub, ownerService2Subgroup, contract1.ContractID)
+	test_utils.AssertTrue(t, err == nil, "Expected GetContractInternal to succeed")
+	test_utils.AssertTrue(t, contract.State == ContractStateSuspended, "Expected contract to be suspended")
+	test_utils.AssertTrue(t, contract.ResumeState == ContractStateContractReady, "Expected resume state contractReady")
+	_, err = AddContractDetail(stub, ownerService2Subgroup, []string{contract1.ContractID, "terms", "{}", now})
+	test_utils.AssertTrue(t, err != nil, "Expected AddContractDetail to fail")
+	mstub.MockTransactionEnd("3")
+
+	mstub.MockTransactionStart("4")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = ResumeContract(stub, ownerService2Subgroup, []string{contract1.ContractID, now})
+	test_utils.AssertTrue(t, err == nil, "Expected ResumeContract to succeed")
+	contract, _ = GetContractInternal(stub, ownerService2Subgroup, contract1.ContractID)
+	test_utils.AssertTrue(t, contract.State == ContractStateContractReady, "Expected contract to be contractReady")
+	mstub.MockTransactionEnd("4")
+
+	// requester raises a dispute with evidence
+	mstub.MockTransactionStart("5")
+	stub = cached_stub.NewCachedStub(mstub)
+	hash := sha256.Sum256([]byte("invoice"))
+	dispute := ContractDispute{Reason: "terms not honored", Evidence: []ContractEvidence{{Name: "invoice.pdf", Hash: "not a hash"}}}
+	disputeBytes, _ := json.Marshal(&dispute)
+	_, err = RaiseContractDispute(stub, reqService1Subgroup, []string{contract1.ContractID, string(disputeBytes), now})
+	test_utils.AssertTrue(t, err != nil, "Expected RaiseContractDispute to fail")
+	dispute.Evidence[0].Hash = hex.EncodeToString(hash[:])
+	disputeBytes, _ = json.Marshal(&dispute)
+	_, err = RaiseContractDispute(stub, reqService1Subgroup, []string{contract1.ContractID, string(disputeBytes), now})
+	test_utils.AssertTrue(t, err == nil, "Expected RaiseContractDispute to succeed")
+	mstub.MockTransactionEnd("5")
+
+	mstub.MockTransactionStart("6")
+	stub = cached_stub.NewCachedStub(mstub)
+	contract, _ = GetContractInternal(stub, reqService1Subgroup, contract1.ContractID)
+	test_utils.AssertTrue(t, contract.State == ContractStateDisputed, "Expected contract to be disputed")
+	test_utils.AssertTrue(t, contract.Dispute != nil && contract.Dispute.RaiserRole == ContractRoleRequester, "Expected open dispute raised by requester")
+
+	// only owner org admin can resolve
+	_, err = ResolveContractDispute(stub, ownerService2Subgroup, []string{contract1.ContractID, contractResolutionReinstate, "settled", now})
+	test_utils.AssertTrue(t, err != nil, "Expected ResolveContractDispute to fail")
+	_, err = ResolveContractDispute(stub, ownerOrg2Caller, []string{contract1.ContractID, contractResolutionReinstate, "settled", now})
+	test_utils.AssertTrue(t, err == nil, "Expected ResolveContractDispute to succeed")
+	mstub.MockTransactionEnd("6")
+
+	mstub.MockTransactionStart("7")
+	stub = cached_stub.NewCachedStub(mstub)
+	contract, _ = GetContractInternal(stub, ownerService2Subgroup, contract1.ContractID)
+	test_utils.AssertTrue(t, contract.State == ContractStateContractReady, "Expected contract to be reinstated")
+	test_utils.AssertTrue(t, contract.Dispute == nil, "Expected no open dispute")
+	lastDetail := contract.ContractDetails[len(contract.ContractDetails)-1]
+	test_utils.AssertTrue(t, lastDetail.ContractDetailType == contractActionResolve, "Expected resolve contract detail")
+
+	// dispute resolved by termination
+	disputeBytes, _ = json.Marshal(&ContractDispute{Reason: "data misuse"})
+	_, err = RaiseContractDispute(stub, ownerService2Subgroup, []string{contract1.ContractID, string(disputeBytes), now})
+	test_utils.AssertTrue(t, err == nil, "Expected RaiseContractDispute to succeed")
+	mstub.MockTransactionEnd("7")
+
+	mstub.MockTransactionStart("8")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = ResolveContractDispute(stub, ownerOrg2Caller, []string{contract1.ContractID, contractResolutionTerminate, "access revoked", now})
+	test_utils.AssertTrue(t, err == nil, "Expected ResolveContractDispute to succeed")
+	contract, _ = GetContractInternal(stub, ownerService2Subgroup, contract1.ContractID)
+	test_utils.AssertTrue(t, contract.State == ContractStateTerminated, "Expected contract to be terminated")
+	mstub.MockTransactionEnd("8")
+}
+
+func TestSuspendContractDataAccess(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestSuspendContractDataAccess function called")
+
+	mstub := SetupIndexesAndGetStub(t)
+	ownerService1Subgroup, reqService1Subgroup := SetupContractServicesTest(t, mstub, "no")
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	mstub.MockTransactionStart("1")
+	stub := cached_stub.NewCachedStub(mstub)
+	contract1 := GenerateContractTest("contract1", "ownerOrg1", "ownerService1", "requesterOrg1", "reqService1")
+	contract1Bytes, _ := json.Marshal(&contract1)
+	contractKeyB64 := crypto.EncodeToB64String(test_utils.GenerateSymKey())
+	_, err := CreateContract(stub, reqService1Subgroup, []string{string(contract1Bytes), contractKeyB64})
+	test_utils.AssertTrue(t, err == nil, "Expected CreateContract to succeed")
+	_, err = AddContractDetail(stub, ownerService1Subgroup, []string{contract1.ContractID, "terms", "{}", now})
+	test_utils.AssertTrue(t, err == nil, "Expected AddContractDetail to succeed")
+	_, err = AddContractDetail(stub, ownerService1Subgroup, []string{contract1.ContractID, "sign", GenerateContractSignTermsTest(t, stub, ownerService1Subgroup, contract1.ContractID), now})
+	test_utils.AssertTrue(t, err == nil, "Expected AddContractDetail to succeed")
+	_, err = AddContractDetail(stub, reqService1Subgroup, []string{contract1.ContractID, "sign", GenerateContractSignTermsTest(t, stub, reqService1Subgroup, contract1.ContractID), now})
+	test_utils.AssertTrue(t, err == nil, "Expected AddContractDetail to succeed")
+	mstub.MockTransactionEnd("1")
+
+	mstub.MockTransactionStart("2")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = GivePermissionByContract(stub, ownerService1Subgroup, []string{contract1.ContractID, "5", now, "ownerOrgDatatype1"})
+	test_utils.AssertTrue(t, err == nil, "Expected GivePermissionByContract to succeed")
+	mstub.MockTransactionEnd("2")
+
+	// suspending a downloadable contract removes requester access to owner data
+	mstub.MockTransactionStart("3")
+	stub = cached_stub.NewCachedStub(mstub)
+	datatypeSymKeyPath, err := GetDatatypeKeyPath(stub, reqService1Subgroup, "ownerOrgDatatype1", "ownerService1")
+	test_utils.AssertTrue(t, err == nil, "Expected GetDatatypeKeyPath to succeed")
+	test_utils.AssertTrue(t, len(datatypeSymKeyPath) != 0, "Expected access to datatype key")
+	_, err = SuspendContract(stub, ownerService1Subgroup, []string{contract1.ContractID, "investigation", now})
+	test_utils.AssertTrue(t, err == nil, "Expected SuspendContract to succeed")
+	mstub.MockTransactionEnd("3")
+
+	mstub.MockTransactionStart("4")
+	stub = cached_stub.NewCachedStub(mstub)
+	datatypeSymKeyPath, err = GetDatatypeKeyPath(stub, reqService1Subgroup, "ownerOrgDatatype1", "ownerService1")
+	test_utils.AssertTrue(t, err == nil, "Expected GetDatatypeKeyPath to succeed")
+	test_utils.AssertTrue(t, len(datatypeSymKeyPath) == 0, "Expected no access to datatype key while suspended")
+	_, err = ResumeContract(stub, ownerService1Subgroup, []string{contract1.ContractID, now})
+	test_utils.AssertTrue(t, err == nil, "Expected ResumeContract to succeed")
+	mstub.MockTransactionEnd("4")
+
+	// resuming restores access
+	mstub.MockTransactionStart("5")
+	stub = cached_stub.NewCachedStub(mstub)
+	contract, err := GetContractInternal(stub, ownerService1Subgroup, contract1.ContractID)
+	test_utils.AssertTrue(t, err == nil, "Expected GetContractInternal to succeed")
+	test_utils.AssertTrue(t, contract.State == ContractStateDownloadReady, "Expected contract to be downloadReady")
+	datatypeSymKeyPath, err = GetDatatypeKeyPath(stub, reqService1Subgroup, "ownerOrgDatatype1", "ownerService1")
+	test_utils.AssertTrue(t, err == nil, "Expected GetDatatypeKeyPath to succeed")
+	test_utils.AssertTrue(t, len(datatypeSymKeyPath) != 0, "Expected access to datatype key after resume")
+	mstub.MockTransactionEnd("5")
+}
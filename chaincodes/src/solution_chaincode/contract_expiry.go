@@ -0,0 +1,188 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"common/bchcls/cached_stub"
+	"common/bchcls/custom_errors"
+	"common/bchcls/data_model"
+	"common/bchcls/utils"
+
+	"github.com/pkg/errors"
+)
+
+// ContractExpiryReport is returned by ExpireContracts
+type ContractExpiryReport struct {
+	ServiceID string   `json:"service_id"`
+	Expired   []string `json:"expired"`
+	Timestamp int64    `json:"timestamp"`
+}
+
+// isEffective returns true if timestamp is within the contract's effective period
+func (contract Contract) isEffective(timestamp int64) bool {
+	if contract.EffectiveDate > 0 && timestamp < contract.EffectiveDate {
+		return false
+	}
+
+	return !contract.isExpired(timestamp)
+}
+
+// isExpired returns true if the contract has an expiration date at or before timestamp
+func (contract Contract) isExpired(timestamp int64) bool {
+	return contract.ExpirationDate > 0 && contract.ExpirationDate <= timestamp
+}
+
+// ExpireContracts moves lapsed contracts of a service to expired state
+// Contracts where the service is owner, requester or co-requester are examined
+// A ContractDetail of type "expire" is added to each expired contract
+// Can only be called by service admin or org admin of the service
+// args = [serviceID, timestamp]
+func ExpireContracts(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 2 {
+		customErr := &custom_errors.LengthCheckingError{Type: "ExpireContracts arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	serviceID := args[0]
+	if utils.IsStringEmpty(serviceID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "serviceID"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	timestamp, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		logger.Errorf("Error converting timestamp to type int64")
+		return nil, errors.Wrap(err, "Error converting timestamp to type int64")
+	}
+
+	// Check timestamp is within 10 mins of current time
+	currTime := time.Now().Unix()
+	if currTime-timestamp > 10*60 || currTime-timestamp < -10*60 {
+		logger.Errorf("Invalid Timestamp (current time: %v)  %v", currTime, timestamp)
+		return nil, errors.New("Invalid Timestamp, not within possible time range")
+	}
+
+	service, err := GetServiceInternal(stub, caller, serviceID, false)
+	if err != nil {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	if utils.IsStringEmpty(service.ServiceID) {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	if !CallerIsAdminOfService(caller, service.ServiceID, service.OrgID) {
+		logger.Errorf("Caller must be admin of service")
+		return nil, errors.New("Caller must be admin of service")
+	}
+
+	// ==============================================================
+	// Act as service
+	// ==============================================================
+	callerObj, err := GetOwnerCaller(stub, caller, serviceID)
+	if err != nil {
+		logger.Errorf("Failed to get service caller: %v", err)
+		return nil, errors.Wrap(err, "Failed to get service caller")
+	}
+
+	// ==============================================================
+	// Get contracts of service, as owner, requester and co-requester
+	// ==============================================================
+	ownerContracts, err := GetContractsInternal(stub, callerObj, []string{"owner_service_id"}, []string{serviceID})
+	if err != nil {
+		customErr := &GetDatasError{FieldNames: []string{"owner_service_id"}, Values: []string{serviceID}}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	requesterContracts, err := GetContractsInternal(stub, callerObj, []string{"requester_service_id"}, []string{serviceID})
+	if err != nil {
+		customErr := &GetDatasError{FieldNames: []string{"requester_service_id"}, Values: []string{serviceID}}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	// co-requester services are only found through the contract index
+	indexedContracts, err := getContractsByIndex(stub, callerObj, serviceID, ContractRoleRequester, "")
+	if err != nil {
+		logger.Errorf("Failed to get contracts of service %v from index: %v", serviceID, err)
+		return nil, errors.Wrap(err, "Failed to get contracts of service "+serviceID+" from index")
+	}
+
+	// ==============================================================
+	// Expire lapsed contracts
+	// ==============================================================
+	report := ContractExpiryReport{ServiceID: serviceID, Expired: []string{}, Timestamp: timestamp}
+	examined := []string{}
+	for _, contract := range append(append(ownerContracts, requesterContracts...), indexedContracts...) {
+		if utils.IsStringEmpty(contract.ContractID) || utils.InList(examined, contract.ContractID) {
+			continue
+		}
+		examined = append(examined, contract.ContractID)
+
+		if !contract.isExpired(timestamp) {
+			continue
+		}
+
+		role := ContractRoleOwner
+		if contract.OwnerServiceID != serviceID {
+			role = ContractRoleRequester
+		}
+
+		transition, err := findContractTransition(contract, contractActionExpire, role)
+		if err != nil {
+			// already terminated or expired
+			continue
+		}
+
+		err = expireContract(stub, caller, callerObj, contract, transition, timestamp)
+		if err != nil {
+			logger.Errorf("Failed to expire contract %v: %v", contract.ContractID, err)
+			return nil, errors.Wrap(err, "Failed to expire contract "+contract.ContractID)
+		}
+
+		report.Expired = append(report.Expired, contract.ContractID)
+	}
+
+	logger.Infof("expired %v contracts of service %v", len(report.Expired), serviceID)
+
+	return json.Marshal(&report)
+}
+
+// expireContract moves a contract to expired state and adds the expire contract detail
+// callerObj is the owner or requester service of the contract
+func expireContract(stub cached_stub.CachedStubInterface, caller data_model.User, callerObj data_model.User, contract Contract, transition ContractTransition, timestamp int64) error {
+	contractDetail := ContractDetail{}
+	contractDetail.ContractID = contract.ContractID
+	contractDetail.ContractDetailType = contractActionExpire
+	contractDetail.ContractDetailTerms = map[string]interface{}{"previous_state": contract.State, "expiration_date": contract.ExpirationDate}
+	contractDetail.CreateDate = timestamp
+	contractDetail.CreatedBy = caller.ID
+
+	contract.State = transition.To
+
+	return saveContractWithDetail(stub, caller, callerObj, contract, contractDetail, "ExpireContract")
+}
@@ -0,0 +1,223 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"common/bchcls/cached_stub"
+	"common/bchcls/crypto"
+	"common/bchcls/test_utils"
+	"common/bchcls/user_mgmt"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestExpireContracts(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestExpireContracts function called")
+
+	mstub := SetupIndexesAndGetStub(t)
+	ownerService1Subgroup, reqService1Subgroup := SetupContractServicesTest(t, mstub, "no")
+
+	now := time.Now().Unix()
+	later := strconv.FormatInt(now+120, 10)
+
+	// expiration date must be after create date
+	mstub.MockTransactionStart("1")
+	stub := cached_stub.NewCachedStub(mstub)
+	contract1 := GenerateContractTest("contract1", "ownerOrg1", "ownerService1", "requesterOrg1", "reqService1")
+	contract1.ExpirationDate = now - 60
+	contract1Bytes, _ := json.Marshal(&contract1)
+	contractKeyB64 := crypto.EncodeToB64String(test_utils.GenerateSymKey())
+	_, err := CreateContract(stub, reqService1Subgroup, []string{string(contract1Bytes), contractKeyB64})
+	test_utils.AssertTrue(t, err != nil, "Expected CreateContract to fail")
+	mstub.MockTransactionEnd("1")
+
+	// create contract that expires in a minute
+	mstub.MockTransactionStart("2")
+	stub = cached_stub.NewCachedStub(mstub)
+	contract1.ExpirationDate = now + 60
+	contract1Bytes, _ = json.Marshal(&contract1)
+	_, err = CreateContract(stub, reqService1Subgroup, []string{string(contract1Bytes), contractKeyB64})
+	test_utils.AssertTrue(t, err == nil, "Expected CreateContract to succeed")
+	mstub.MockTransactionEnd("2")
+
+	// owner accepts terms, both sides sign, owner gives permission
+	mstub.MockTransactionStart("3")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = AddContractDetail(stub, ownerService1Subgroup, []string{contract1.ContractID, "terms", "{}", strconv.FormatInt(now, 10)})
+	test_utils.AssertTrue(t, err == nil, "Expected AddContractDetail to succeed")
+	mstub.MockTransactionEnd("3")
+
+	mstub.MockTransactionStart("4")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = AddContractDetail(stub, ownerService1Subgroup, []string{contract1.ContractID, "sign", GenerateContractSignTermsTest(t, stub, ownerService1Subgroup, contract1.ContractID), strconv.FormatInt(now, 10)})
+	test_utils.AssertTrue(t, err == nil, "Expected AddContractDetail to succeed")
+	_, err = AddContractDetail(stub, reqService1Subgroup, []string{contract1.ContractID, "sign", GenerateContractSignTermsTest(t, stub, reqService1Subgroup, contract1.ContractID), strconv.FormatInt(now, 10)})
+	test_utils.AssertTrue(t, err == nil, "Expected AddContractDetail to succeed")
+	mstub.MockTransactionEnd("4")
+
+	mstub.MockTransactionStart("5")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = GivePermissionByContract(stub, ownerService1Subgroup, []string{contract1.ContractID, "2", strconv.FormatInt(now, 10), "ownerOrgDatatype1"})
+	test_utils.AssertTrue(t, err == nil, "Expected GivePermissionByContract to succeed")
+	mstub.MockTransactionEnd("5")
+
+	// download allowed before expiry
+	mstub.MockTransactionStart("6")
+	stub = cached_stub.NewCachedStub(mstub)
+	args := []string{contract1.ContractID, "ownerOrgDatatype1", "false", "0", "0", "1000", strconv.FormatInt(now, 10)}
+	_, err = DownloadOwnerDataAsRequester(stub, reqService1Subgroup, args)
+	test_utils.AssertTrue(t, err == nil, "Expected DownloadOwnerDataAsRequester to succeed")
+	mstub.MockTransactionEnd("6")
+
+	// download refused after expiry, even before sweep
+	mstub.MockTransactionStart("7")
+	stub = cached_stub.NewCachedStub(mstub)
+	args = []string{contract1.ContractID, "ownerOrgDatatype1", "false", "0", "0", "1000", later}
+	_, err = DownloadOwnerDataAsRequester(stub, reqService1Subgroup, args)
+	test_utils.AssertTrue(t, err != nil, "Expected DownloadOwnerDataAsRequester to fail")
+	mstub.MockTransactionEnd("7")
+
+	// sweep before expiry does nothing
+	mstub.MockTransactionStart("8")
+	stub = cached_stub.NewCachedStub(mstub)
+	reportBytes, err := ExpireContracts(stub, ownerService1Subgroup, []string{"ownerService1", strconv.FormatInt(now, 10)})
+	test_utils.AssertTrue(t, err == nil, "Expected ExpireContracts to succeed")
+	report := ContractExpiryReport{}
+	json.Unmarshal(reportBytes, &report)
+	test_utils.AssertTrue(t, len(report.Expired) == 0, "Expected no expired contracts")
+	mstub.MockTransactionEnd("8")
+
+	// sweep after expiry
+	mstub.MockTransactionStart("9")
+	stub = cached_stub.NewCachedStub(mstub)
+	reportBytes, err = ExpireContracts(stub, reqService1Subgroup, []string{"reqService1", later})
+	test_utils.AssertTrue(t, err == nil, "Expected ExpireContracts to succeed")
+	report = ContractExpiryReport{}
+	json.Unmarshal(reportBytes, &report)
+	test_utils.AssertTrue(t, len(report.Expired) == 1, "Expected 1 expired contract")
+	test_utils.AssertTrue(t, report.Expired[0] == contract1.ContractID, "Expected contract1 to expire")
+	mstub.MockTransactionEnd("9")
+
+	// contract is expired and has an expire contract detail
+	mstub.MockTransactionStart("10")
+	stub = cached_stub.NewCachedStub(mstub)
+	contractBytes, err := GetContract(stub, ownerService1Subgroup, []string{contract1.ContractID})
+	test_utils.AssertTrue(t, err == nil, "Expected GetContract to succeed")
+	contract := Contract{}
+	json.Unmarshal(contractBytes, &contract)
+	test_utils.AssertTrue(t, contract.State == ContractStateExpired, "Expected contract to be expired")
+	lastDetail := contract.ContractDetails[len(contract.ContractDetails)-1]
+	test_utils.AssertTrue(t, lastDetail.ContractDetailType == "expire", "Expected expire contract detail")
+	mstub.MockTransactionEnd("10")
+
+	// expired contract cannot be changed or expired again
+	mstub.MockTransactionStart("11")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = AddContractDetail(stub, ownerService1Subgroup, []string{contract1.ContractID, "terminate", "{}", later})
+	test_utils.AssertTrue(t, err != nil, "Expected AddContractDetail to fail")
+	reportBytes, err = ExpireContracts(stub, ownerService1Subgroup, []string{"ownerService1", later})
+	test_utils.AssertTrue(t, err == nil, "Expected ExpireContracts to succeed")
+	report = ContractExpiryReport{}
+	json.Unmarshal(reportBytes, &report)
+	test_utils.AssertTrue(t, len(report.Expired) == 0, "Expected no expired contracts")
+	mstub.MockTransactionEnd("11")
+
+	// expired contract requires an attestation from the requester
+	mstub.MockTransactionStart("12")
+	stub = cached_stub.NewCachedStub(mstub)
+	filter := ContractSearchFilter{ServiceID: "ownerService1", Role: ContractRoleOwner, State: ContractStateExpired}
+	filterBytes, _ := json.Marshal(&filter)
+	overdueStr := strconv.FormatInt(now+120+contractAttestationPeriod+60, 10)
+	overdueBytes, err := GetOverdueContractAttestations(stub, ownerService1Subgroup, []string{string(filterBytes), overdueStr})
+	test_utils.AssertTrue(t, err == nil, "Expected GetOverdueContractAttestations to succeed")
+	overdue := []ContractAttestationStatus{}
+	json.Unmarshal(overdueBytes, &overdue)
+	test_utils.AssertTrue(t, len(overdue) == 1 && overdue[0].ContractID == contract1.ContractID, "Expected overdue contract1")
+	test_utils.AssertTrue(t, len(overdue[0].PendingServices) == 1 && overdue[0].PendingServices[0] == "reqService1", "Expected pending reqService1")
+	mstub.MockTransactionEnd("12")
+}
+
+func TestExpireContractsAsCoRequester(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestExpireContractsAsCoRequester function called")
+
+	mstub := SetupIndexesAndGetStub(t)
+	ownerService1Subgroup, reqService1Subgroup := SetupContractServicesTest(t, mstub, "no")
+
+	now := time.Now().Unix()
+	later := strconv.FormatInt(now+120, 10)
+
+	// register second requester org and service
+	mstub.MockTransactionStart("t1")
+	stub := cached_stub.NewCachedStub(mstub, true, true, true)
+	requesterOrg2 := test_utils.CreateTestGroup("requesterOrg2")
+	requesterOrg2Bytes, _ := json.Marshal(&requesterOrg2)
+	_, err := RegisterOrg(stub, requesterOrg2, []string{string(requesterOrg2Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterOrg to succeed")
+	requesterOrg2Caller, _ := user_mgmt.GetUserData(stub, requesterOrg2, requesterOrg2.ID, true, true)
+	reqOrgDatatype2 := Datatype{DatatypeID: "reqOrgDatatype2", Description: "reqOrgDatatype2"}
+	reqOrgDatatype2Bytes, _ := json.Marshal(&reqOrgDatatype2)
+	_, err = RegisterDatatype(stub, requesterOrg2Caller, []string{string(reqOrgDatatype2Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterDatatype to succeed")
+	reqServiceDatatype := GenerateServiceDatatypeForTesting("reqOrgDatatype2", "reqService2", []string{consentOptionWrite, consentOptionRead})
+	reqService2 := GenerateServiceForTesting("reqService2", "requesterOrg2", []ServiceDatatype{reqServiceDatatype})
+	reqService2Bytes, _ := json.Marshal(&reqService2)
+	_, err = RegisterService(stub, requesterOrg2Caller, []string{string(reqService2Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterService to succeed")
+	mstub.MockTransactionEnd("t1")
+
+	mstub.MockTransactionStart("t2")
+	stub = cached_stub.NewCachedStub(mstub)
+	reqService2Subgroup, _ := user_mgmt.GetUserData(stub, requesterOrg2, "reqService2", true, true)
+	mstub.MockTransactionEnd("t2")
+
+	// create multi-party contract that expires in a minute
+	mstub.MockTransactionStart("1")
+	stub = cached_stub.NewCachedStub(mstub)
+	contract1 := GenerateContractTest("contract1", "ownerOrg1", "ownerService1", "requesterOrg1", "reqService1")
+	contract1.CoRequesters = []ContractRequester{{OrgID: "requesterOrg2", ServiceID: "reqService2"}}
+	contract1.ExpirationDate = now + 60
+	contract1Bytes, _ := json.Marshal(&contract1)
+	contractKeyB64 := crypto.EncodeToB64String(test_utils.GenerateSymKey())
+	_, err = CreateContract(stub, reqService1Subgroup, []string{string(contract1Bytes), contractKeyB64})
+	test_utils.AssertTrue(t, err == nil, "Expected CreateContract to succeed")
+	mstub.MockTransactionEnd("1")
+
+	// co-requester sweeps its lapsed contract
+	mstub.MockTransactionStart("2")
+	stub = cached_stub.NewCachedStub(mstub)
+	reportBytes, err := ExpireContracts(stub, reqService2Subgroup, []string{"reqService2", later})
+	test_utils.AssertTrue(t, err == nil, "Expected ExpireContracts to succeed")
+	report := ContractExpiryReport{}
+	json.Unmarshal(reportBytes, &report)
+	test_utils.AssertTrue(t, len(report.Expired) == 1 && report.Expired[0] == contract1.ContractID, "Expected contract1 to expire")
+	mstub.MockTransactionEnd("2")
+
+	mstub.MockTransactionStart("3")
+	stub = cached_stub.NewCachedStub(mstub)
+	contractBytes, err := GetContract(stub, ownerService1Subgroup, []string{contract1.ContractID})
+	test_utils.AssertTrue(t, err == nil, "Expected GetContract to succeed")
+	contract := Contract{}
+	json.Unmarshal(contractBytes, &contract)
+	test_utils.AssertTrue(t, contract.State == ContractStateExpired, "Expected contract to be expired")
+
+	// lead requester finds nothing left to expire
+	reportBytes, err = ExpireContracts(stub, reqService1Subgroup, []string{"reqService1", later})
+	test_utils.AssertTrue(t, err == nil, "Expected ExpireContracts to succeed")
+	report = ContractExpiryReport{}
+	json.Unmarshal(reportBytes, &report)
+	test_utils.AssertTrue(t, len(report.Expired) == 0, "Expected no expired contracts")
+	mstub.MockTransactionEnd("3")
+}
@@ -0,0 +1,444 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"common/bchcls/asset_mgmt"
+	"common/bchcls/cached_stub"
+	"common/bchcls/custom_errors"
+	"common/bchcls/data_model"
+	"common/bchcls/utils"
+
+	"github.com/pkg/errors"
+)
+
+// IndexContractEntry is the index of contracts by each of their parties
+const IndexContractEntry = "ContractEntryTable"
+
+// ContractEntryNamespace is the namespace of contract index entry assets
+const ContractEntryNamespace = "ContractEntryAsset"
+
+const maxContractReindexBatchSize = 500
+
+// contractIndexAny is the counterparty org or datatype of the index entries that match any counterparty org or datatype
+const contractIndexAny = "*"
+
+// contractIndexEntry is an index entry of a contract for one of its parties
+// A contract can have several requester services, counterparty orgs and datatypes, so each combination is stored
+// as its own asset, see putContractIndex; the combinations include contractIndexAny, so a search without
+// counterparty org or datatype filter finds each contract once
+// Contracts without datatype scopes are indexed under the datatypes of the owner service
+// Entries are encrypted with the contract key, so every party of the contract can read them
+type contractIndexEntry struct {
+	EntryID           string        `json:"entry_id"`
+	ContractID        string        `json:"contract_id"`
+	ServiceID         string        `json:"service_id"`
+	Role              ContractRole  `json:"role"`
+	CounterpartyOrgID string        `json:"counterparty_org_id"`
+	Datatype          string        `json:"datatype"`
+	State             ContractState `json:"state"`
+	PaymentStatus     string        `json:"payment_status"`
+	CreateDate        int64         `json:"create_date"`
+}
+
+// ContractReindexResult is returned by ReindexContracts
+// Bookmark is the last contract reindexed, pass it to continue; empty when all contracts are done
+type ContractReindexResult struct {
+	ServiceID string   `json:"service_id"`
+	Contracts []string `json:"contracts"`
+	Bookmark  string   `json:"bookmark"`
+}
+
+// getContractIndexEntryID composes the ID of an index entry of a contract
+func getContractIndexEntryID(contractID string, serviceID string, role ContractRole, counterpartyOrgID string, datatype string) string {
+	entryIDHash := sha256.Sum256([]byte(contractID + "\x00" + serviceID + "\x00" + string(role) + "\x00" + counterpartyOrgID + "\x00" + datatype))
+	return hex.EncodeToString(entryIDHash[:])
+}
+
+// counterpartyOrgIDs returns the orgs on the other side of the contract than role
+func (contract Contract) counterpartyOrgIDs(role ContractRole) []string {
+	if role == ContractRoleRequester {
+		return []string{contract.OwnerOrgID}
+	}
+
+	orgIDs := []string{contract.RequesterOrgID}
+	for _, requester := range contract.CoRequesters {
+		if !utils.InList(orgIDs, requester.OrgID) {
+			orgIDs = append(orgIDs, requester.OrgID)
+		}
+	}
+
+	return orgIDs
+}
+
+// indexEntries returns the index entries of the contract for the owner service and each requester service
+// datatypeIDs are the datatypes the contract covers
+func (contract Contract) indexEntries(datatypeIDs []string) []contractIndexEntry {
+	entries := []contractIndexEntry{}
+	parties := map[ContractRole][]string{
+		ContractRoleOwner:     {contract.OwnerServiceID},
+		ContractRoleRequester: contract.requesterServiceIDs()}
+	paymentStatus := contract.paymentStatus()
+	for _, role := range []ContractRole{ContractRoleOwner, ContractRoleRequester} {
+		for _, serviceID := range parties[role] {
+			for _, counterpartyOrgID := range append([]string{contractIndexAny}, contract.counterpartyOrgIDs(role)...) {
+				for _, datatype := range append([]string{contractIndexAny}, datatypeIDs...) {
+					entries = append(entries, contractIndexEntry{
+						EntryID:           getContractIndexEntryID(contract.ContractID, serviceID, role, counterpartyOrgID, datatype),
+						ContractID:        contract.ContractID,
+						ServiceID:         serviceID,
+						Role:              role,
+						CounterpartyOrgID: counterpartyOrgID,
+						Datatype:          datatype,
+						State:             contract.State,
+						PaymentStatus:     paymentStatus,
+						CreateDate:        contract.CreateDate})
+				}
+			}
+		}
+	}
+
+	return entries
+}
+
+// getContractIndexDatatypes returns the datatypes the contract is indexed under
+// Contracts without datatype scopes cover every datatype of the owner service
+func getContractIndexDatatypes(stub cached_stub.CachedStubInterface, caller data_model.User, contract Contract) ([]string, error) {
+	datatypeIDs := []string{}
+	if len(contract.Datatypes) > 0 {
+		for _, scope := range contract.Datatypes {
+			datatypeIDs = append(datatypeIDs, scope.DatatypeID)
+		}
+
+		return datatypeIDs, nil
+	}
+
+	ownerService, err := GetServiceInternal(stub, caller, contract.OwnerServiceID, false)
+	if err != nil {
+		customErr := &GetServiceError{Service: contract.OwnerServiceID}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	for _, serviceDatatype := range ownerService.Datatypes {
+		datatypeIDs = append(datatypeIDs, serviceDatatype.DatatypeID)
+	}
+
+	return datatypeIDs, nil
+}
+
+// convertContractIndexEntryToAsset converts an index entry of a contract to an asset
+func convertContractIndexEntryToAsset(entry contractIndexEntry, ownerIDs []string) data_model.Asset {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+
+	asset := data_model.Asset{}
+	asset.AssetId = asset_mgmt.GetAssetId(ContractEntryNamespace, entry.EntryID)
+	asset.Datatypes = []string{}
+	metaData := make(map[string]string)
+	metaData["namespace"] = ContractEntryNamespace
+	asset.Metadata = metaData
+	asset.PrivateData, _ = json.Marshal(&entry)
+	asset.PublicData, _ = json.Marshal(map[string]string{"entry_id": entry.EntryID})
+	asset.OwnerIds = ownerIDs
+	asset.IndexTableName = IndexContractEntry
+	return asset
+}
+
+// putContractIndex adds or updates the index entries of a contract, and deletes entries it no longer has
+// Must be called every time the contract asset is saved, so the entries follow the contract state,
+// requester services and datatypes
+// callerObj is the owner or requester service of the contract
+func putContractIndex(stub cached_stub.CachedStubInterface, callerObj data_model.User, contract Contract, contractKey data_model.Key, ownerIDs []string) error {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+
+	datatypeIDs, err := getContractIndexDatatypes(stub, callerObj, contract)
+	if err != nil {
+		return errors.Wrap(err, "Failed to get datatypes of contract")
+	}
+
+	entries := contract.indexEntries(datatypeIDs)
+	err = deleteStaleContractIndexEntries(stub, callerObj, contract.ContractID, entries, contractKey)
+	if err != nil {
+		return err
+	}
+
+	assetManager := asset_mgmt.GetAssetManager(stub, callerObj)
+	for _, entry := range entries {
+		entryAsset := convertContractIndexEntryToAsset(entry, ownerIDs)
+		existingAsset, err := asset_mgmt.GetEncryptedAssetData(stub, entryAsset.AssetId)
+		if err != nil {
+			customErr := &custom_errors.GetAssetDataError{AssetId: entryAsset.AssetId}
+			logger.Errorf("%v: %v", customErr, err)
+			return errors.Wrap(err, customErr.Error())
+		}
+
+		if utils.IsStringEmpty(existingAsset.AssetId) {
+			err = assetManager.AddAsset(entryAsset, contractKey, false)
+		} else {
+			err = assetManager.UpdateAsset(entryAsset, contractKey, true)
+		}
+		if err != nil {
+			customErr := &PutAssetError{Asset: entryAsset.AssetId}
+			logger.Errorf("%v: %v", customErr, err)
+			return errors.Wrap(err, customErr.Error())
+		}
+	}
+
+	return nil
+}
+
+// deleteStaleContractIndexEntries deletes index entries of a contract that are not in entries,
+// such as entries of a removed co-requester service or datatype
+func deleteStaleContractIndexEntries(stub cached_stub.CachedStubInterface, callerObj data_model.User, contractID string, entries []contractIndexEntry, contractKey data_model.Key) error {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+
+	entryAssetIDs := []string{}
+	for _, entry := range entries {
+		entryAssetIDs = append(entryAssetIDs, asset_mgmt.GetAssetId(ContractEntryNamespace, entry.EntryID))
+	}
+
+	assetManager := asset_mgmt.GetAssetManager(stub, callerObj)
+	iter, err := assetManager.GetAssetIter(ContractEntryNamespace, IndexContractEntry, []string{"contract_id", "entry_id"}, []string{contractID}, []string{contractID}, false, false, KeyPathFunc, "", -1, nil)
+	if err != nil {
+		logger.Errorf("GetAssets failed: %v", err)
+		return errors.Wrap(err, "GetAssets failed")
+	}
+
+	// entries are deleted after the iterator is closed
+	staleAssetIDs := []string{}
+	for iter.HasNext() {
+		entryAsset, err := iter.Next()
+		if err != nil {
+			iter.Close()
+			customErr := &custom_errors.IterError{}
+			logger.Errorf("%v: %v", customErr, err)
+			return errors.Wrap(err, customErr.Error())
+		}
+
+		if !utils.IsStringEmpty(entryAsset.AssetId) && !utils.InList(entryAssetIDs, entryAsset.AssetId) {
+			staleAssetIDs = append(staleAssetIDs, entryAsset.AssetId)
+		}
+	}
+	iter.Close()
+
+	for _, assetID := range staleAssetIDs {
+		err = assetManager.DeleteAsset(assetID, contractKey)
+		if err != nil {
+			customErr := &DeleteAssetError{Asset: assetID}
+			logger.Errorf("%v: %v", customErr, err)
+			return errors.Wrap(err, customErr.Error())
+		}
+	}
+
+	return nil
+}
+
+// getContractsByIndex returns the contracts of a party in a state, using the contract index entries
+// state is optional
+// Contracts the caller cannot decrypt are skipped
+func getContractsByIndex(stub cached_stub.CachedStubInterface, caller data_model.User, serviceID string, role ContractRole, state string) ([]Contract, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+
+	fieldNames := []string{"service_id", "role", "counterparty_org_id", "datatype", "create_date", "contract_id"}
+	values := []string{serviceID, string(role), contractIndexAny, contractIndexAny}
+	if !utils.IsStringEmpty(state) {
+		fieldNames = []string{"service_id", "role", "counterparty_org_id", "datatype", "state", "create_date", "contract_id"}
+		values = append(values, state)
+	}
+
+	iter, err := asset_mgmt.GetAssetManager(stub, caller).GetAssetIter(ContractEntryNamespace, IndexContractEntry, fieldNames, values, values, true, false, KeyPathFunc, "", -1, nil)
+	if err != nil {
+		logger.Errorf("GetAssets failed: %v", err)
+		return nil, errors.Wrap(err, "GetAssets failed")
+	}
+
+	defer iter.Close()
+	contracts := []Contract{}
+	for iter.HasNext() {
+		entryAsset, err := iter.Next()
+		if err != nil {
+			customErr := &custom_errors.IterError{}
+			logger.Errorf("%v: %v", customErr, err)
+			return nil, errors.Wrap(err, customErr.Error())
+		}
+
+		if utils.IsStringEmpty(entryAsset.AssetId) || data_model.IsEncryptedData(entryAsset.PrivateData) {
+			continue
+		}
+
+		entry := contractIndexEntry{}
+		json.Unmarshal(entryAsset.PrivateData, &entry)
+		contract, err := getIndexedContract(stub, caller, entry.ContractID)
+		if err != nil {
+			return nil, err
+		}
+
+		if !utils.IsStringEmpty(contract.ContractID) {
+			contracts = append(contracts, contract)
+		}
+	}
+
+	return contracts, nil
+}
+
+// getIndexedContract returns the contract of an index entry, or an empty contract if the caller cannot decrypt it
+func getIndexedContract(stub cached_stub.CachedStubInterface, caller data_model.User, contractID string) (Contract, error) {
+	solutionCaller := convertToSolutionUser(caller)
+	options := []string{}
+	if solutionCaller.SolutionInfo.IsOrgAdmin {
+		options = append(options, solutionCaller.Org)
+	}
+
+	contract, err := GetContractInternal(stub, caller, contractID, options...)
+	if err != nil {
+		customErr := &GetContractError{ContractID: contractID}
+		logger.Errorf("%v: %v", customErr, err)
+		return Contract{}, errors.Wrap(err, customErr.Error())
+	}
+
+	return contract, nil
+}
+
+// ReindexContracts adds contracts created before the contract index existed to the index
+// Also adds contracts without datatype scopes under datatypes added to the owner service since they were indexed
+// Can only be called by service admin or org admin of the service
+// Reindexes the contracts the service owns or is lead requester of, which adds the entries of all their parties,
+// so co-requesters find the contracts once the owner or lead requester service reindexed them
+// At most batchSize contracts are reindexed per call, in order of contract ID, starting after bookmark
+// args = [serviceID, batchSize, bookmark]
+func ReindexContracts(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 3 {
+		customErr := &custom_errors.LengthCheckingError{Type: "ReindexContracts arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	serviceID := args[0]
+	if utils.IsStringEmpty(serviceID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "serviceID"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	batchSize, err := strconv.Atoi(args[1])
+	if err != nil {
+		logger.Errorf("Error converting batchSize to type int")
+		return nil, errors.Wrap(err, "Error converting batchSize to type int")
+	}
+
+	if batchSize <= 0 || batchSize > maxContractReindexBatchSize {
+		logger.Errorf("Invalid batch size: %v", batchSize)
+		return nil, errors.New("Batch size must be between 1 and " + strconv.Itoa(maxContractReindexBatchSize))
+	}
+
+	bookmark := args[2]
+
+	service, err := GetServiceInternal(stub, caller, serviceID, false)
+	if err != nil {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	if utils.IsStringEmpty(service.ServiceID) {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	if !CallerIsAdminOfService(caller, service.ServiceID, service.OrgID) {
+		logger.Errorf("Caller must be admin of service")
+		return nil, errors.New("Caller must be admin of service")
+	}
+
+	// ==============================================================
+	// Act as service
+	// ==============================================================
+	callerObj, err := GetOwnerCaller(stub, caller, serviceID)
+	if err != nil {
+		logger.Errorf("Failed to get service caller: %v", err)
+		return nil, errors.Wrap(err, "Failed to get service caller")
+	}
+
+	// ==============================================================
+	// Find contracts of the service
+	// ==============================================================
+	contracts := []Contract{}
+	for _, serviceField := range []string{"owner_service_id", "requester_service_id"} {
+		serviceContracts, err := GetContractsInternal(stub, callerObj, []string{serviceField}, []string{serviceID})
+		if err != nil {
+			customErr := &GetDatasError{FieldNames: []string{serviceField}, Values: []string{serviceID}}
+			logger.Errorf("%v: %v", customErr, err)
+			return nil, errors.Wrap(err, customErr.Error())
+		}
+		contracts = append(contracts, serviceContracts...)
+	}
+	sort.Slice(contracts, func(i, j int) bool { return contracts[i].ContractID < contracts[j].ContractID })
+
+	// ==============================================================
+	// Reindex each contract, starting after bookmark
+	// ==============================================================
+	result := ContractReindexResult{ServiceID: serviceID, Contracts: []string{}}
+	assetManager := asset_mgmt.GetAssetManager(stub, callerObj)
+	for _, contract := range contracts {
+		if contract.ContractID <= bookmark || utils.InList(result.Contracts, contract.ContractID) {
+			continue
+		}
+
+		if len(result.Contracts) == batchSize {
+			result.Bookmark = result.Contracts[len(result.Contracts)-1]
+			break
+		}
+
+		contractAssetID := asset_mgmt.GetAssetId(ContractAssetNamespace, contract.ContractID)
+		contractAssetData, err := asset_mgmt.GetEncryptedAssetData(stub, contractAssetID)
+		if err != nil {
+			customErr := &custom_errors.GetAssetDataError{AssetId: contractAssetID}
+			logger.Errorf("%v: %v", customErr, err)
+			return nil, errors.Wrap(err, customErr.Error())
+		}
+
+		keyPath, err := GetKeyPath(stub, callerObj, contractAssetID)
+		if err != nil || len(keyPath) <= 0 {
+			customErr := &GetKeyPathError{Caller: callerObj.ID, AssetID: contractAssetID}
+			logger.Errorf(customErr.Error())
+			return nil, errors.New(customErr.Error())
+		}
+
+		contractKey, err := assetManager.GetAssetKey(contractAssetID, keyPath)
+		if err != nil {
+			logger.Errorf("Failed to get contractKey: %v", err)
+			return nil, errors.Wrap(err, "Failed to get contractKey")
+		}
+
+		err = putContractIndex(stub, callerObj, contract, contractKey, contractAssetData.OwnerIds)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to reindex contract "+contract.ContractID)
+		}
+
+		result.Contracts = append(result.Contracts, contract.ContractID)
+	}
+
+	logger.Infof("reindexed %v contracts of service %v", len(result.Contracts), serviceID)
+
+	return json.Marshal(&result)
+}
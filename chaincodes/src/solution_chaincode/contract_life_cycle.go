@@ -32,29 +32,51 @@ const ContractAssetNamespace = "ContractAsset"
 
 // ContractDetail object
 type ContractDetail struct {
-	ContractID          string      `json:"contract_id"`
-	ContractDetailType  string      `json:"contract_detail_type"`
-	ContractDetailTerms interface{} `json:"contract_detail_terms"`
-	CreateDate          int64       `json:"create_date"`
-	CreatedBy           string      `json:"created_by"`
+	ContractID          string             `json:"contract_id"`
+	ContractDetailType  string             `json:"contract_detail_type"`
+	ContractDetailTerms interface{}        `json:"contract_detail_terms"`
+	CreateDate          int64              `json:"create_date"`
+	CreatedBy           string             `json:"created_by"`
+	Signature           *ContractSignature `json:"signature,omitempty"`
 }
 
 // Contract object
+// EffectiveDate and ExpirationDate bound the period in which downloads are allowed, 0 means no bound
+// Datatypes lists the owner service datatypes covered by the contract; if empty, every datatype of the owner service is covered
+// TermsVersion is the version of ContractTerms, increased each time both sides agree on an amendment
+// CoRequesters are the requesters of a multi-party contract other than the lead requester
+// EndDate is when a downloadDone, terminated, or expired contract ended, recorded with the first requester attestation
+// TemplateID and TemplateVersion identify the owner service contract template the contract was created from, if any
 type Contract struct {
-	ContractID         string           `json:"contract_id"`
-	OwnerOrgID         string           `json:"owner_org_id"`
-	OwnerServiceID     string           `json:"owner_service_id"`
-	RequesterOrgID     string           `json:"requester_org_id"`
-	RequesterServiceID string           `json:"requester_service_id"`
-	ContractTerms      interface{}      `json:"contract_terms"`
-	State              string           `json:"state"`
-	CreateDate         int64            `json:"create_date"`
-	UpdateDate         int64            `json:"update_date"`
-	ContractDetails    []ContractDetail `json:"contract_details"`
-	PaymentRequired    string           `json:"payment_required"`
-	PaymentVerified    string           `json:"payment_verified"`
-	MaxNumDownload     int              `json:"max_num_download"`
-	NumDownload        int              `json:"num_download"`
+	ContractID         string                  `json:"contract_id"`
+	OwnerOrgID         string                  `json:"owner_org_id"`
+	OwnerServiceID     string                  `json:"owner_service_id"`
+	RequesterOrgID     string                  `json:"requester_org_id"`
+	RequesterServiceID string                  `json:"requester_service_id"`
+	ContractTerms      interface{}             `json:"contract_terms"`
+	State              ContractState           `json:"state"`
+	CreateDate         int64                   `json:"create_date"`
+	UpdateDate         int64                   `json:"update_date"`
+	ContractDetails    []ContractDetail        `json:"contract_details"`
+	PaymentRequired    string                  `json:"payment_required"`
+	PaymentVerified    string                  `json:"payment_verified"`
+	MaxNumDownload     int                     `json:"max_num_download"`
+	NumDownload        int                     `json:"num_download"`
+	EffectiveDate      int64                   `json:"effective_date"`
+	ExpirationDate     int64                   `json:"expiration_date"`
+	Datatypes          []ContractDatatypeScope `json:"datatypes"`
+	TermsVersion       int                     `json:"terms_version"`
+	TermsHistory       []ContractTermsVersion  `json:"terms_history"`
+	PendingAmendment   *ContractAmendment      `json:"pending_amendment,omitempty"`
+	CoRequesters       []ContractRequester     `json:"co_requesters"`
+	PaymentDue         int64                   `json:"payment_due"`
+	Currency           string                  `json:"currency"`
+	Payments           []ContractPayment       `json:"payments"`
+	ResumeState        ContractState           `json:"resume_state,omitempty"`
+	Dispute            *ContractDispute        `json:"dispute,omitempty"`
+	TemplateID         string                  `json:"template_id,omitempty"`
+	TemplateVersion    int                     `json:"template_version,omitempty"`
+	EndDate            int64                   `json:"end_date,omitempty"`
 }
 
 // ContractLog object
@@ -70,18 +92,22 @@ type ContractLog struct {
 
 // ContractPublicData consists of a contract's public fields
 type ContractPublicData struct {
-	OwnerServiceID     string `json:"owner_service_id"`
-	RequesterServiceID string `json:"requester_service_id"`
+	ContractID            string   `json:"contract_id"`
+	CreateDate            int64    `json:"create_date"`
+	OwnerServiceID        string   `json:"owner_service_id"`
+	RequesterServiceID    string   `json:"requester_service_id"`
+	CoRequesterServiceIDs []string `json:"co_requester_service_ids,omitempty"`
 }
 
 // CreateContract creates a new contract asset
-// Can be called by both contract requester and contract owner
+// Can be called by both contract lead requester and contract owner
+// If the contract has a template ID, the contract is created from that contract template of the owner service
 // Returns error if contract already exists
 //
 // 1) Validate contract fields and sym key
 // 2) Verify caller has permission
 // 3) Store contract as asset and use contract sym key as asset key
-// 4) Encrypt contract sym key with owner pub key and requester pub key
+// 4) Encrypt contract sym key with owner pub key and the pub key of each requester
 //
 // args = [ contract, contractKey ]
 func CreateContract(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
@@ -153,6 +179,11 @@ func CreateContract(stub cached_stub.CachedStubInterface, caller data_model.User
 		return nil, errors.WithStack(customErr)
 	}
 
+	err = ownerService.checkNotRetiring()
+	if err != nil {
+		return nil, err
+	}
+
 	// Return error if there is already a contract with this ID
 	solutionCaller := convertToSolutionUser(caller)
 	existingContract := Contract{}
@@ -177,6 +208,27 @@ func CreateContract(stub cached_stub.CachedStubInterface, caller data_model.User
 		return nil, errors.New("A contract with this ID already exists")
 	}
 
+	// Instantiate owner service contract template, which replaces terms, pricing and validity period of the contract
+	if !utils.IsStringEmpty(contract.TemplateID) {
+		template, err := getContractTemplate(stub, caller, contract.OwnerServiceID, contract.TemplateID)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to get contract template")
+		}
+
+		if template.Version == 0 {
+			logger.Errorf("Contract template %v of service %v not found", contract.TemplateID, contract.OwnerServiceID)
+			return nil, errors.New("Contract template " + contract.TemplateID + " of service " + contract.OwnerServiceID + " not found")
+		}
+
+		err = template.instantiate(&contract)
+		if err != nil {
+			logger.Errorf("Failed to instantiate contract template: %v", err)
+			return nil, errors.Wrap(err, "Failed to instantiate contract template")
+		}
+	} else {
+		contract.TemplateVersion = 0
+	}
+
 	// Validate contract terms
 	contractTermsBytes, err := json.Marshal(&contract.ContractTerms)
 	if err != nil {
@@ -235,6 +287,18 @@ func CreateContract(stub cached_stub.CachedStubInterface, caller data_model.User
 		return nil, errors.WithStack(customErr)
 	}
 
+	err = requesterService.checkNotRetiring()
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate co-requesters of a multi-party contract
+	err = validateContractCoRequesters(stub, caller, contract)
+	if err != nil {
+		logger.Errorf("Invalid contract co-requesters: %v", err)
+		return nil, errors.Wrap(err, "Invalid contract co-requesters")
+	}
+
 	// Check create date is within 10 mins of current time
 	currTime := time.Now().Unix()
 	if currTime-contract.CreateDate > 10*60 || currTime-contract.CreateDate < -10*60 {
@@ -242,12 +306,37 @@ func CreateContract(stub cached_stub.CachedStubInterface, caller data_model.User
 		return nil, errors.New("Invalid create date, not within possible time range")
 	}
 
+	// Validate contract effective period
+	// 0 means the contract is effective from creation, and does not expire
+	if contract.EffectiveDate < 0 || contract.ExpirationDate < 0 {
+		logger.Errorf("Invalid contract effective period: %v - %v", contract.EffectiveDate, contract.ExpirationDate)
+		return nil, errors.New("Invalid contract effective period, dates cannot be negative")
+	}
+
+	if contract.ExpirationDate > 0 && (contract.ExpirationDate <= contract.EffectiveDate || contract.ExpirationDate <= contract.CreateDate) {
+		logger.Errorf("Invalid contract expiration date: %v", contract.ExpirationDate)
+		return nil, errors.New("Invalid contract expiration date, must be after effective date and create date")
+	}
+
+	// Validate contract datatype scopes
+	err = validateContractDatatypeScopes(contract.Datatypes, ownerService)
+	if err != nil {
+		logger.Errorf("Invalid contract datatypes: %v", err)
+		return nil, errors.Wrap(err, "Invalid contract datatypes")
+	}
+
 	// Validate contract payment required
 	if contract.PaymentRequired != "yes" && contract.PaymentRequired != "no" {
 		logger.Errorf("Invalid contract payment required field (must be yes or no): %v", contract.PaymentRequired)
 		return nil, errors.New("Invalid contract payment required field, must be yes or no")
 	}
 
+	// Validate contract payment due
+	if contract.PaymentDue < 0 || (contract.PaymentDue > 0 && utils.IsStringEmpty(contract.Currency)) {
+		logger.Errorf("Invalid contract payment due: %v %v", contract.PaymentDue, contract.Currency)
+		return nil, errors.New("Invalid contract payment due, must not be negative and must have a currency")
+	}
+
 	// Validate contract sym key
 	contractKey := data_model.Key{ID: key_mgmt.GetSymKeyId(contract.ContractID), Type: key_mgmt.KEY_TYPE_SYM}
 	contractKey.KeyBytes, err = crypto.ParseSymKeyB64(args[1])
@@ -264,8 +353,22 @@ func CreateContract(stub cached_stub.CachedStubInterface, caller data_model.User
 	// Set MaxNumDownload, NumDownload, PaymentVerified, UpdateDate
 	contract.MaxNumDownload = 0
 	contract.NumDownload = 0
+	for i := range contract.Datatypes {
+		contract.Datatypes[i].NumDownload = 0
+	}
+	for i := range contract.CoRequesters {
+		contract.CoRequesters[i].NumDownload = 0
+		contract.CoRequesters[i].DatatypeNumDownload = make(map[string]int)
+	}
 	contract.PaymentVerified = "no"
-	contract.PaymentRequired = ownerService.PaymentRequired
+	contract.Payments = []ContractPayment{}
+	contract.TermsVersion = 1
+	contract.TermsHistory = []ContractTermsVersion{}
+	contract.PendingAmendment = nil
+	// the pricing of a template decides whether payment is required, otherwise the owner service does
+	if utils.IsStringEmpty(contract.TemplateID) {
+		contract.PaymentRequired = ownerService.PaymentRequired
+	}
 	contract.UpdateDate = contract.CreateDate
 
 	//construct contract detail
@@ -339,12 +442,18 @@ func CreateContract(stub cached_stub.CachedStubInterface, caller data_model.User
 	}
 
 	// Update contract state
+	contract.State = ContractStateNew
+	role := ContractRoleOwner
 	if isAdminRequesterService {
-		contract.State = "requested"
-	} else { // isAdminOwnerService
-		contract.State = "contractReady"
+		role = ContractRoleRequester
 	}
 
+	transition, err := findContractTransition(contract, contractActionRequest, role)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create contract")
+	}
+	contract.State = transition.To
+
 	// ==============================================================
 	// Save contract as asset
 	// ==============================================================
@@ -369,6 +478,11 @@ func CreateContract(stub cached_stub.CachedStubInterface, caller data_model.User
 		return nil, errors.Wrap(err, customErr.Error())
 	}
 
+	err = putContractIndex(stub, callerObj, contract, contractKey, contractAsset.OwnerIds)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to add contract index")
+	}
+
 	// ==============================================================
 	// Give write access to contract owner/requester
 	// ==============================================================
@@ -389,6 +503,17 @@ func CreateContract(stub cached_stub.CachedStubInterface, caller data_model.User
 		return nil, errors.Wrap(err, custom_err.Error())
 	}
 
+	// Each co-requester gets its own share of the contract key
+	for _, requester := range contract.CoRequesters {
+		accessControl.UserId = requester.ServiceID
+		err = assetManager.AddAccessToAsset(accessControl, true)
+		if err != nil {
+			custom_err := &custom_errors.AddAccessError{Key: contractKey.ID}
+			logger.Errorf("%v: %v", custom_err, err)
+			return nil, errors.Wrap(err, custom_err.Error())
+		}
+	}
+
 	// ==============================================================
 	// Logging
 	// ==============================================================
@@ -576,25 +701,30 @@ func AddContractDetailDownload(stub cached_stub.CachedStubInterface, caller data
 	// ==============================================================
 	solutionCaller := convertToSolutionUser(caller)
 	callerObj := caller
-	// caller must be either org admin of contract requester org || caller is a service admin of contract requester service
+	// caller must be either org admin of a contract requester org || caller is a service admin of a contract requester service
+	requesterServiceID, err := getContractPublicDataRequesterService(stub, caller, contractPublicData)
+	if err != nil {
+		return nil, err
+	}
+
 	// If caller is org admin, then have to use key paths
 	if solutionCaller.SolutionInfo.IsOrgAdmin {
-		symKeyPath, prvKeyPath, err := GetUserAssetSymAndPrivateKeyPaths(stub, caller, contractPublicData.RequesterServiceID)
+		symKeyPath, prvKeyPath, err := GetUserAssetSymAndPrivateKeyPaths(stub, caller, requesterServiceID)
 		if err != nil {
 			logger.Errorf("Failed to get symKeyPath and prvKeyPath for user asset")
 			return nil, errors.Wrap(err, "Failed to get symKeyPath and prvKeyPath for user asset")
 		}
-		callerObj, err = user_mgmt.GetUserData(stub, caller, contractPublicData.RequesterServiceID, true, false, symKeyPath, prvKeyPath)
+		callerObj, err = user_mgmt.GetUserData(stub, caller, requesterServiceID, true, false, symKeyPath, prvKeyPath)
 		if err != nil {
-			customErr := &GetUserError{User: contractPublicData.RequesterServiceID}
+			customErr := &GetUserError{User: requesterServiceID}
 			logger.Errorf("%v: %v", customErr, err)
 			return nil, errors.Wrap(err, customErr.Error())
 		}
 	} else {
-		if caller.ID != contractPublicData.RequesterServiceID { // No need to get user object if caller is contract requester service itself
-			callerObj, err = user_mgmt.GetUserData(stub, caller, contractPublicData.RequesterServiceID, true, false)
+		if caller.ID != requesterServiceID { // No need to get user object if caller is the contract requester service itself
+			callerObj, err = user_mgmt.GetUserData(stub, caller, requesterServiceID, true, false)
 			if err != nil {
-				customErr := &GetUserError{User: contractPublicData.RequesterServiceID}
+				customErr := &GetUserError{User: requesterServiceID}
 				logger.Errorf("%v: %v", customErr, err)
 				return nil, errors.Wrap(err, customErr.Error())
 			}
@@ -654,8 +784,16 @@ func AddContractDetailDownload(stub cached_stub.CachedStubInterface, caller data
 	// ==============================================================
 	// Manage key relationships
 	// ==============================================================
-	if contract.MaxNumDownload <= contract.NumDownload {
-		contract.State = "downloadDone"
+	// contract wide download limit or the datatype's own quota is used up by this requester
+	// the contract state only changes once every requester used up the contract wide limit
+	if contract.requesterLimitReached(requesterServiceID) || contract.requesterQuotaReached(requesterServiceID, datatypeID) {
+		if contract.allRequestersLimitReached() {
+			transition, err := findContractTransition(contract, contractActionDownload, ContractRoleRequester)
+			if err != nil {
+				return nil, errors.Wrap(err, "Failed to update contract state")
+			}
+			contract.State = transition.To
+		}
 
 		userAccessManager := user_access_ctrl.GetUserAccessManager(stub, callerObj)
 
@@ -673,7 +811,7 @@ func AddContractDetailDownload(stub cached_stub.CachedStubInterface, caller data
 			return nil, errors.Wrap(err, "Failed to GetDatatypeSymKey")
 		}
 
-		requester := data_model.User{ID: contract.RequesterServiceID}
+		requester := data_model.User{ID: requesterServiceID}
 		err = userAccessManager.RemoveAccessByKey(requester.GetPubPrivKeyId(), datatypeSymKey.ID)
 		if err != nil {
 			customErr := &custom_errors.AddAccessError{Key: "requester service pub key to owner data key"}
@@ -708,12 +846,17 @@ func AddContractDetailDownload(stub cached_stub.CachedStubInterface, caller data
 		return nil, errors.Wrap(err, customErr.Error())
 	}
 
+	err = putContractIndex(stub, callerObj, contract, contractKey, contractAsset.OwnerIds)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to update contract index")
+	}
+
 	// ==============================================================
 	// Logging
 	// ==============================================================
 	contractLogSymKey := GetLogSymKeyFromKey(contractKey)
 
-	contractLog := ContractLog{Contract: contract.ContractID, Datatype: datatypeID, OwnerService: contract.OwnerServiceID, RequesterService: contract.RequesterServiceID, OwnerOrg: contract.OwnerOrgID, RequesterOrg: contract.RequesterOrgID}
+	contractLog := ContractLog{Contract: contract.ContractID, Datatype: datatypeID, OwnerService: contract.OwnerServiceID, RequesterService: requesterServiceID, OwnerOrg: contract.OwnerOrgID, RequesterOrg: contract.RequesterOrgID}
 	solutionLog := SolutionLog{
 		TransactionID: stub.GetTxID(),
 		Namespace:     "OMR",
@@ -734,6 +877,7 @@ func AddContractDetailDownload(stub cached_stub.CachedStubInterface, caller data
 
 // AddContractDetail adds contract detail for an existing contract
 // Appends a ContractDetail object to the contract
+// For sign, terms is {"signature": "<base64 signature over the contract signing payload>"}
 // args = [contactId, contractStatus, terms, timestamp]
 func AddContractDetail(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
 	defer utils.ExitFnLog(utils.EnterFnLog())
@@ -815,126 +959,48 @@ func AddContractDetail(stub cached_stub.CachedStubInterface, caller data_model.U
 	// ==============================================================
 	// Change caller
 	// ==============================================================
-	callerObj := caller
-	isAdminRequesterService := false
-	// caller is org admin of contract owner org || caller is a service admin of contract owner service
-	if (solutionCaller.SolutionInfo.IsOrgAdmin && solutionCaller.Org == contract.OwnerOrgID) || utils.InList(solutionCaller.SolutionInfo.Services, contract.OwnerServiceID) {
-		// If caller is org admin, then have to use key paths
-		if solutionCaller.SolutionInfo.IsOrgAdmin {
-			symKeyPath, prvKeyPath, err := GetUserAssetSymAndPrivateKeyPaths(stub, caller, contract.OwnerServiceID)
-			if err != nil {
-				logger.Errorf("Failed to get symKeyPath and prvKeyPath for user asset")
-				return nil, errors.Wrap(err, "Failed to get symKeyPath and prvKeyPath for user asset")
-			}
-			// act as contract owner service
-			callerObj, err = user_mgmt.GetUserData(stub, caller, contract.OwnerServiceID, true, false, symKeyPath, prvKeyPath)
-			if err != nil {
-				customErr := &GetUserError{User: contract.OwnerServiceID}
-				logger.Errorf("%v: %v", customErr, err)
-				return nil, errors.Wrap(err, customErr.Error())
-			}
-		} else {
-			callerObj, err = user_mgmt.GetUserData(stub, caller, contract.OwnerServiceID, true, false)
-			if err != nil {
-				customErr := &GetUserError{User: contract.OwnerServiceID}
-				logger.Errorf("%v: %v", customErr, err)
-				return nil, errors.Wrap(err, customErr.Error())
-			}
-		}
-	} else {
-		// caller must be either org admin of contract requester org || caller is a service admin of contract requester service
-		// If caller is org admin, then have to use key paths
-		if solutionCaller.SolutionInfo.IsOrgAdmin {
-			symKeyPath, prvKeyPath, err := GetUserAssetSymAndPrivateKeyPaths(stub, caller, contract.RequesterServiceID)
-			if err != nil {
-				logger.Errorf("Failed to get symKeyPath and prvKeyPath for user asset")
-				return nil, errors.Wrap(err, "Failed to get symKeyPath and prvKeyPath for user asset")
-			}
-			callerObj, err = user_mgmt.GetUserData(stub, caller, contract.RequesterServiceID, true, false, symKeyPath, prvKeyPath)
-			if err != nil {
-				customErr := &GetUserError{User: contract.RequesterServiceID}
-				logger.Errorf("%v: %v", customErr, err)
-				return nil, errors.Wrap(err, customErr.Error())
-			}
-		} else {
-			callerObj, err = user_mgmt.GetUserData(stub, caller, contract.RequesterServiceID, true, false)
-			if err != nil {
-				customErr := &GetUserError{User: contract.RequesterServiceID}
-				logger.Errorf("%v: %v", customErr, err)
-				return nil, errors.Wrap(err, customErr.Error())
-			}
-		}
-
-		isAdminRequesterService = true
-	}
-
-	if callerObj.PrivateKey == nil {
-		logger.Errorf("Caller does not have access to owner private key")
-		return nil, errors.New("Caller does not have access to owner private key")
+	// act as the owner service, or the requester service caller is admin of
+	callerObj, role, err := getContractCaller(stub, caller, contract)
+	if err != nil {
+		return nil, err
 	}
 
 	// ==============================================================
 	// Update contract status
 	// ==============================================================
 
-	var okAdd = false
-	if contractStatus == "request" {
-		if (contract.State == "new" || contract.State == "requested") && isAdminRequesterService {
-			// If called by requester set status to "requested"
-			okAdd = true
-			contract.State = "requested"
-		} else if (contract.State == "new" || contract.State == "requested") && !isAdminRequesterService {
-			// If called by owner set status to "contractReady"
-			okAdd = true
-			contract.State = "contractReady"
-		}
-		// Handle "Add Terms" by both Requester and Owner
-	} else if contractStatus == "terms" {
-		if (contract.State == "requested" || contract.State == "contractReady") && isAdminRequesterService {
-			// If called by requester set status to "requested"
-			okAdd = true
-			contract.State = "requested"
-		} else if (contract.State == "requested" || contract.State == "contractReady") && !isAdminRequesterService {
-			// If called by owner set status to "contractReady"
-			okAdd = true
-			contract.State = "contractReady"
-		}
-	} else if contractStatus == "sign" {
-		addTerms = false
-		if contract.State == "contractReady" && isAdminRequesterService {
-			okAdd = true
-			contract.State = "contractSigned"
-		}
-	} else if contractStatus == "payment" {
-		addTerms = false
-		if (contract.PaymentRequired == "yes") && (contract.State == "contractSigned" || contract.State == "paymentDone") && isAdminRequesterService {
-			okAdd = true
-			contract.State = "paymentDone"
-		}
-	} else if contractStatus == "verify" {
-		addTerms = false
-		if (contract.PaymentRequired == "yes") && (contract.State == "contractSigned" || contract.State == "paymentDone") && !isAdminRequesterService {
-			okAdd = true
-			contract.State = "paymentVerified"
-			contract.PaymentVerified = "yes"
+	if !utils.InList(contractDetailActions, contractStatus) {
+		logger.Error("Invalid contract status: " + contractStatus + ". Contract state: " + contract.State.String())
+		return nil, errors.New("Invalid contract status: " + contractStatus + ". Contract state: " + contract.State.String())
+	}
+
+	// Signing party must sign the contract's current signing payload with their own key
+	// The new signature counts towards the sign transition guards
+	var signature *ContractSignature
+	guardContract := contract
+	if contractStatus == contractActionSign {
+		signature, err = newContractSignature(caller, callerObj.ID, role, contract, args[2])
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid contract signature")
 		}
-	} else if contractStatus == "terminate" {
+
+		terms = map[string]interface{}{}
+		guardContract.ContractDetails = append(append([]ContractDetail{}, contract.ContractDetails...), ContractDetail{ContractDetailType: contractActionSign, Signature: signature})
+	}
+
+	transition, err := findContractTransition(guardContract, contractStatus, role)
+	if err != nil {
+		logger.Error(caller.ID + " user is not allowed to change contract " + contractID + " when contract state is " + contract.State.String())
+		return nil, errors.New(caller.ID + " user is not allowed to change contract " + contractID + " when contract state is " + contract.State.String())
+	}
+
+	contract.State = transition.To
+	if !transition.UpdatesTerms {
 		addTerms = false
-		if (contract.State == "new" || contract.State == "requested" || contract.State == "contractReady" || contract.State == "contractSigned" || contract.State == "paymentDone" || contract.State == "paymentVerified" || contract.State == "downloadReady" || contract.State == "downloadDone") && isAdminRequesterService {
-			okAdd = true
-			contract.State = "terminated"
-		} else if (contract.State == "new" || contract.State == "requested" || contract.State == "contractReady" || contract.State == "contractSigned" || contract.State == "paymentDone" || contract.State == "paymentVerified" || contract.State == "downloadReady" || contract.State == "downloadDone") && !isAdminRequesterService {
-			okAdd = true
-			contract.State = "terminated"
-		}
-	} else {
-		logger.Error("Invalid contract status: " + contractStatus + ". Contract state: " + contract.State)
-		return nil, errors.New("Invalid contract status: " + contractStatus + ". Contract state: " + contract.State)
 	}
 
-	if !okAdd {
-		logger.Error(caller.ID + " user is not allowed to change contract " + contractID + " when contract state is " + contract.State)
-		return nil, errors.New(caller.ID + " user is not allowed to change contract " + contractID + " when contract state is " + contract.State)
+	if contractStatus == contractActionVerify {
+		contract.updatePaymentVerified()
 	}
 
 	// ==============================================================
@@ -947,6 +1013,7 @@ func AddContractDetail(stub cached_stub.CachedStubInterface, caller data_model.U
 	contractDetail.ContractDetailTerms = terms
 	contractDetail.CreateDate = timestamp
 	contractDetail.CreatedBy = caller.ID
+	contractDetail.Signature = signature
 	contract.ContractDetails = append(contract.ContractDetails, contractDetail)
 	contract.UpdateDate = timestamp
 
@@ -999,6 +1066,11 @@ func AddContractDetail(stub cached_stub.CachedStubInterface, caller data_model.U
 		return nil, errors.Wrap(err, customErr.Error())
 	}
 
+	err = putContractIndex(stub, callerObj, contract, contractKey, contractAsset.OwnerIds)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to update contract index")
+	}
+
 	// ==============================================================
 	// Logging
 	// ==============================================================
@@ -1008,7 +1080,7 @@ func AddContractDetail(stub cached_stub.CachedStubInterface, caller data_model.U
 	solutionLog := SolutionLog{
 		TransactionID: stub.GetTxID(),
 		Namespace:     "OMR",
-		FunctionName:  "AddContractDetail" + contract.State,
+		FunctionName:  "AddContractDetail" + contract.State.String(),
 		CallerID:      caller.ID,
 		Timestamp:     contract.UpdateDate,
 		Data:          contractLog}
@@ -1036,6 +1108,7 @@ func AddContractDetail(stub cached_stub.CachedStubInterface, caller data_model.U
 }
 
 // GivePermissionByContract gives a requester permission to download for a contract
+// For multi-party contracts, every requester with downloads left under the new limit is given permission
 // Can only be used by contract data owner
 // args = [contractID, maxNumDownloadAllowed, timestamp, datatypeID]
 // datatypeID = the datatype that requester wants data for
@@ -1094,16 +1167,23 @@ func GivePermissionByContract(stub cached_stub.CachedStubInterface, caller data_
 		return nil, errors.Wrap(err, "Error converting maxNumDownloadAllowedB64 to type int64")
 	}
 
-	if int(maxNumDownloadAllowed) <= contract.NumDownload {
-		logger.Errorf("Number of downloads by requester is already %v", contract.NumDownload)
-		return nil, errors.New("Number of downloads by requester is already " + string(contract.NumDownload))
+	// for multi-party contracts, the new limit must let at least one requester download again
+	numDownload := contract.NumDownload
+	for _, requester := range contract.CoRequesters {
+		if requester.NumDownload < numDownload {
+			numDownload = requester.NumDownload
+		}
+	}
+
+	if int(maxNumDownloadAllowed) <= numDownload {
+		logger.Errorf("Number of downloads by requester is already %v", numDownload)
+		return nil, errors.New("Number of downloads by requester is already " + strconv.Itoa(numDownload))
 	}
 
-	if !((contract.State == "contractSigned" && contract.PaymentRequired == "no") ||
-		(contract.State == "paymentVerified" && contract.PaymentRequired == "yes") ||
-		contract.State == "downloadReady" || contract.State == "downloadDone") {
-		logger.Errorf("The contract state of " + contract.State + " does not allow granting permission")
-		return nil, errors.New("The contract state of " + contract.State + " does not allow granting permission")
+	transition, err := findContractTransition(contract, contractActionPermission, ContractRoleOwner)
+	if err != nil {
+		logger.Errorf("The contract state of " + contract.State.String() + " does not allow granting permission")
+		return nil, errors.New("The contract state of " + contract.State.String() + " does not allow granting permission")
 	}
 
 	// Validate timestamp
@@ -1113,6 +1193,11 @@ func GivePermissionByContract(stub cached_stub.CachedStubInterface, caller data_
 		return nil, errors.Wrap(err, "Error converting timestamp to type int64")
 	}
 
+	if contract.isExpired(timestamp) {
+		logger.Errorf("Contract %v expired at %v", contractID, contract.ExpirationDate)
+		return nil, errors.New("Contract " + contractID + " has expired")
+	}
+
 	// Validate datatype
 	datatypeID := args[3]
 	if utils.IsStringEmpty(datatypeID) {
@@ -1133,6 +1218,24 @@ func GivePermissionByContract(stub cached_stub.CachedStubInterface, caller data_
 		return nil, errors.WithStack(customErr)
 	}
 
+	if !contract.coversDatatype(datatypeID) {
+		logger.Errorf("Contract %v does not cover datatype %v", contractID, datatypeID)
+		return nil, errors.New("Contract does not cover datatype " + datatypeID)
+	}
+
+	// requesters that can still download the datatype under the new limit
+	permittedRequesters := []string{}
+	for _, requesterServiceID := range contract.requesterServiceIDs() {
+		if int(maxNumDownloadAllowed) > contract.requesterNumDownload(requesterServiceID) && !contract.requesterQuotaReached(requesterServiceID, datatypeID) {
+			permittedRequesters = append(permittedRequesters, requesterServiceID)
+		}
+	}
+
+	if len(permittedRequesters) == 0 {
+		logger.Errorf("Download quota of datatype %v is already reached", datatypeID)
+		return nil, errors.New("Download quota of datatype " + datatypeID + " is already reached")
+	}
+
 	// ==============================================================
 	// Change caller
 	// ==============================================================
@@ -1176,7 +1279,7 @@ func GivePermissionByContract(stub cached_stub.CachedStubInterface, caller data_
 	contractDetail := ContractDetail{}
 	contractDetail.ContractID = contractID
 	contractDetail.ContractDetailType = "permission"
-	contractDetail.ContractDetailTerms = map[string]int{"previous_max_num_download": contract.MaxNumDownload, "max_num_download": int(maxNumDownloadAllowed)}
+	contractDetail.ContractDetailTerms = map[string]interface{}{"previous_max_num_download": contract.MaxNumDownload, "max_num_download": int(maxNumDownloadAllowed), "datatype_id": datatypeID}
 	contractDetail.CreateDate = timestamp
 	contractDetail.CreatedBy = caller.ID
 
@@ -1184,11 +1287,7 @@ func GivePermissionByContract(stub cached_stub.CachedStubInterface, caller data_
 	contract.ContractDetails = append(contract.ContractDetails, contractDetail)
 	contract.MaxNumDownload = int(maxNumDownloadAllowed)
 
-	if contract.NumDownload >= contract.MaxNumDownload {
-		contract.State = "downloadDone"
-	} else {
-		contract.State = "downloadReady"
-	}
+	contract.State = transition.To
 
 	// get contract asset ownersList, because ownerList cannot change
 	contractAssetData, err := asset_mgmt.GetEncryptedAssetData(stub, asset_mgmt.GetAssetId(ContractAssetNamespace, contractID))
@@ -1234,8 +1333,13 @@ func GivePermissionByContract(stub cached_stub.CachedStubInterface, caller data_
 		return nil, errors.Wrap(err, customErr.Error())
 	}
 
+	err = putContractIndex(stub, callerObj, contract, contractKey, contractAsset.OwnerIds)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to update contract index")
+	}
+
 	// ==============================================================
-	// Add access to contract requester to download owner data
+	// Add access to contract requesters to download owner data
 	// ==============================================================
 
 	datatypeSymKeyPath, err := GetDatatypeKeyPath(stub, callerObj, datatypeID, contract.OwnerServiceID)
@@ -1251,18 +1355,21 @@ func GivePermissionByContract(stub cached_stub.CachedStubInterface, caller data_
 		return nil, errors.Wrap(err, "Failed to GetDatatypeSymKey")
 	}
 
-	requester, err := user_mgmt.GetUserData(stub, callerObj, contract.RequesterServiceID, false, false)
-	if err != nil {
-		customErr := &GetUserError{User: contract.RequesterServiceID}
-		logger.Errorf("%v: %v", customErr, err)
-		return nil, errors.Wrap(err, customErr.Error())
-	}
 	userAccessManager := user_access_ctrl.GetUserAccessManager(stub, callerObj)
-	err = userAccessManager.AddAccessByKey(requester.GetPublicKey(), datatypeSymKey)
-	if err != nil {
-		customErr := &custom_errors.AddAccessError{Key: "requester service pub key to owner data key"}
-		logger.Errorf("%v: %v", customErr, err)
-		return nil, errors.Wrap(err, customErr.Error())
+	for _, requesterServiceID := range permittedRequesters {
+		requester, err := user_mgmt.GetUserData(stub, callerObj, requesterServiceID, false, false)
+		if err != nil {
+			customErr := &GetUserError{User: requesterServiceID}
+			logger.Errorf("%v: %v", customErr, err)
+			return nil, errors.Wrap(err, customErr.Error())
+		}
+
+		err = userAccessManager.AddAccessByKey(requester.GetPublicKey(), datatypeSymKey)
+		if err != nil {
+			customErr := &custom_errors.AddAccessError{Key: "requester service pub key to owner data key"}
+			logger.Errorf("%v: %v", customErr, err)
+			return nil, errors.Wrap(err, customErr.Error())
+		}
 	}
 
 	// ==============================================================
@@ -1289,6 +1396,98 @@ func GivePermissionByContract(stub cached_stub.CachedStubInterface, caller data_
 	return nil, nil
 }
 
+// getContractPermittedDatatypes returns the datatypes the owner gave permission for through GivePermissionByContract
+// Permissions recorded before the datatype was kept in the permission terms count for every datatype the contract covers
+func getContractPermittedDatatypes(stub cached_stub.CachedStubInterface, caller data_model.User, contract Contract) ([]string, error) {
+	datatypeIDs := []string{}
+	legacyPermission := false
+	for _, contractDetail := range contract.ContractDetails {
+		if contractDetail.ContractDetailType != contractActionPermission {
+			continue
+		}
+
+		terms, _ := contractDetail.ContractDetailTerms.(map[string]interface{})
+		datatypeID, _ := terms["datatype_id"].(string)
+		if utils.IsStringEmpty(datatypeID) {
+			legacyPermission = true
+		} else if !utils.InList(datatypeIDs, datatypeID) {
+			datatypeIDs = append(datatypeIDs, datatypeID)
+		}
+	}
+
+	if !legacyPermission {
+		return datatypeIDs, nil
+	}
+
+	ownerService, err := GetServiceInternal(stub, caller, contract.OwnerServiceID, false)
+	if err != nil {
+		customErr := &GetServiceError{Service: contract.OwnerServiceID}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	for _, serviceDatatype := range ownerService.Datatypes {
+		if contract.coversDatatype(serviceDatatype.DatatypeID) && !utils.InList(datatypeIDs, serviceDatatype.DatatypeID) {
+			datatypeIDs = append(datatypeIDs, serviceDatatype.DatatypeID)
+		}
+	}
+
+	return datatypeIDs, nil
+}
+
+// setContractDataAccess gives or removes access to the owner datatype keys for every requester of the contract
+// that can still download under the contract, which are the requesters GivePermissionByContract gave access to
+// callerObj must be the contract owner service
+func setContractDataAccess(stub cached_stub.CachedStubInterface, callerObj data_model.User, contract Contract, giveAccess bool) error {
+	datatypeIDs, err := getContractPermittedDatatypes(stub, callerObj, contract)
+	if err != nil {
+		return errors.Wrap(err, "Failed to get permitted datatypes of contract")
+	}
+
+	userAccessManager := user_access_ctrl.GetUserAccessManager(stub, callerObj)
+	for _, datatypeID := range datatypeIDs {
+		datatypeSymKeyPath, err := GetDatatypeKeyPath(stub, callerObj, datatypeID, contract.OwnerServiceID)
+		if err != nil {
+			customErr := &GetDatatypeKeyPathError{Caller: callerObj.ID, DatatypeID: datatypeID}
+			logger.Errorf(customErr.Error())
+			return errors.New(customErr.Error())
+		}
+
+		datatypeSymKey, err := GetDatatypeSymKey(stub, callerObj, datatypeID, contract.OwnerServiceID, datatypeSymKeyPath)
+		if err != nil {
+			logger.Errorf("Failed to GetDatatypeSymKey: %v", err)
+			return errors.Wrap(err, "Failed to GetDatatypeSymKey")
+		}
+
+		for _, requesterServiceID := range contract.requesterServiceIDs() {
+			if contract.requesterLimitReached(requesterServiceID) || contract.requesterQuotaReached(requesterServiceID, datatypeID) {
+				continue
+			}
+
+			if giveAccess {
+				requester, err := user_mgmt.GetUserData(stub, callerObj, requesterServiceID, false, false)
+				if err != nil {
+					customErr := &GetUserError{User: requesterServiceID}
+					logger.Errorf("%v: %v", customErr, err)
+					return errors.Wrap(err, customErr.Error())
+				}
+
+				err = userAccessManager.AddAccessByKey(requester.GetPublicKey(), datatypeSymKey)
+			} else {
+				err = userAccessManager.RemoveAccessByKey(data_model.User{ID: requesterServiceID}.GetPubPrivKeyId(), datatypeSymKey.ID)
+			}
+
+			if err != nil {
+				customErr := &custom_errors.AddAccessError{Key: "requester service pub key to owner data key"}
+				logger.Errorf("%v: %v", customErr, err)
+				return errors.Wrap(err, customErr.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
 // GetContractsInternal is the internal private function for getting contracts
 func GetContractsInternal(stub cached_stub.CachedStubInterface, caller data_model.User, fieldNames []string, values []string) ([]Contract, error) {
 	defer utils.ExitFnLog(utils.EnterFnLog())
@@ -1378,6 +1577,7 @@ func GetContractsAsOwner(stub cached_stub.CachedStubInterface, caller data_model
 }
 
 // GetContractsAsRequester returns contracts as requester, filtered by state
+// Contracts of co-requesters are found through the contract index, see ReindexContracts for contracts created before it existed
 // args = [requesterID, state]
 // state is an optional parameter
 func GetContractsAsRequester(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
@@ -1407,23 +1607,12 @@ func GetContractsAsRequester(stub cached_stub.CachedStubInterface, caller data_m
 	// Get contracts
 	// ==============================================================
 
-	contracts := []Contract{}
-	if utils.IsStringEmpty(state) {
-		var err error
-		contracts, err = GetContractsInternal(stub, caller, []string{"requester_service_id"}, []string{requesterID})
-		if err != nil {
-			customErr := &GetDatasError{FieldNames: []string{"requester_service_id", "state"}, Values: []string{requesterID, state}}
-			logger.Errorf("%v: %v", customErr, err)
-			return nil, errors.Wrap(err, customErr.Error())
-		}
-	} else {
-		var err error
-		contracts, err = GetContractsInternal(stub, caller, []string{"requester_service_id", "state"}, []string{requesterID, state})
-		if err != nil {
-			customErr := &GetDatasError{FieldNames: []string{"requester_service_id", "state"}, Values: []string{requesterID, state}}
-			logger.Errorf("%v: %v", customErr, err)
-			return nil, errors.Wrap(err, customErr.Error())
-		}
+	// the contract index has entries for the lead requester and each co-requester
+	contracts, err := getContractsByIndex(stub, caller, requesterID, ContractRoleRequester, state)
+	if err != nil {
+		customErr := &GetDatasError{FieldNames: []string{"requester_service_id", "state"}, Values: []string{requesterID, state}}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
 	}
 
 	// return contracts
@@ -1457,8 +1646,13 @@ func convertContractToAsset(contract Contract, ownersList []string) (data_model.
 	asset.Metadata = metaData
 
 	publicData := ContractPublicData{}
+	publicData.ContractID = contract.ContractID
+	publicData.CreateDate = contract.CreateDate
 	publicData.RequesterServiceID = contract.RequesterServiceID
 	publicData.OwnerServiceID = contract.OwnerServiceID
+	for _, requester := range contract.CoRequesters {
+		publicData.CoRequesterServiceIDs = append(publicData.CoRequesterServiceIDs, requester.ServiceID)
+	}
 	asset.PublicData, _ = json.Marshal(publicData)
 
 	contractPrivateData, err := json.Marshal(&contract)
@@ -1485,6 +1679,130 @@ func convertContractToAsset(contract Contract, ownersList []string) (data_model.
 	return asset, nil
 }
 
+// getContractForCaller returns a contract the caller has access to
+// Org admins get the contract using their org's key paths
+func getContractForCaller(stub cached_stub.CachedStubInterface, caller data_model.User, contractID string) (Contract, error) {
+	solutionCaller := convertToSolutionUser(caller)
+	contract := Contract{}
+	var err error
+	if solutionCaller.SolutionInfo.IsOrgAdmin {
+		contract, err = GetContractInternal(stub, caller, contractID, solutionCaller.Org)
+	} else {
+		contract, err = GetContractInternal(stub, caller, contractID)
+	}
+
+	if err != nil || utils.IsStringEmpty(contract.ContractID) {
+		customErr := &GetContractError{ContractID: contractID}
+		logger.Errorf(customErr.Error())
+		return Contract{}, errors.New(customErr.Error())
+	}
+
+	return contract, nil
+}
+
+// getContractCaller returns a caller object acting as the owner or a requester service of the contract,
+// and the side of the contract the caller acts for
+func getContractCaller(stub cached_stub.CachedStubInterface, caller data_model.User, contract Contract) (data_model.User, ContractRole, error) {
+	role, ok := getContractCallerRole(caller, contract)
+	if !ok {
+		logger.Errorf("Caller must be admin of contract owner or requester service")
+		return data_model.User{}, "", errors.New("Caller must be admin of contract owner or requester service")
+	}
+
+	serviceID := contract.OwnerServiceID
+	if role == ContractRoleRequester {
+		serviceID, _ = getContractRequesterService(caller, contract)
+	}
+
+	callerObj, err := GetOwnerCaller(stub, caller, serviceID)
+	if err != nil {
+		logger.Errorf("Failed to get contract service caller: %v", err)
+		return data_model.User{}, "", errors.Wrap(err, "Failed to get contract service caller")
+	}
+
+	return callerObj, role, nil
+}
+
+// saveContractWithDetail appends contractDetail to the contract, updates the contract asset and adds a contract log
+// callerObj is the owner or requester service of the contract
+func saveContractWithDetail(stub cached_stub.CachedStubInterface, caller data_model.User, callerObj data_model.User, contract Contract, contractDetail ContractDetail, functionName string) error {
+	contract.UpdateDate = contractDetail.CreateDate
+	contract.ContractDetails = append(contract.ContractDetails, contractDetail)
+
+	// get contract asset ownersList, because ownerList cannot change
+	contractAssetID := asset_mgmt.GetAssetId(ContractAssetNamespace, contract.ContractID)
+	contractAssetData, err := asset_mgmt.GetEncryptedAssetData(stub, contractAssetID)
+	if err != nil {
+		customErr := &custom_errors.GetAssetDataError{AssetId: contractAssetID}
+		logger.Errorf("%v", customErr)
+		return errors.WithStack(customErr)
+	}
+
+	contractAsset, err := convertContractToAsset(contract, contractAssetData.OwnerIds)
+	if err != nil {
+		customErr := &ConvertToAssetError{Asset: "contractAsset"}
+		logger.Errorf("%v: %v", customErr, err)
+		return errors.Wrap(err, customErr.Error())
+	}
+
+	assetManager := asset_mgmt.GetAssetManager(stub, callerObj)
+	keyPath, err := GetKeyPath(stub, callerObj, contractAssetID)
+	if err != nil || len(keyPath) <= 0 {
+		customErr := &GetKeyPathError{Caller: callerObj.ID, AssetID: contractAssetID}
+		logger.Errorf(customErr.Error())
+		return errors.New(customErr.Error())
+	}
+
+	contractKey, err := assetManager.GetAssetKey(contractAssetID, keyPath)
+	if err != nil {
+		logger.Errorf("Failed to get contractKey: %v", err)
+		return errors.Wrap(err, "Failed to get contractKey")
+	}
+
+	err = assetManager.UpdateAsset(contractAsset, contractKey, true)
+	if err != nil {
+		customErr := &PutAssetError{Asset: contract.ContractID}
+		logger.Errorf("%v: %v", customErr, err)
+		return errors.Wrap(err, customErr.Error())
+	}
+
+	err = putContractIndex(stub, callerObj, contract, contractKey, contractAsset.OwnerIds)
+	if err != nil {
+		return errors.Wrap(err, "Failed to update contract index")
+	}
+
+	// ==============================================================
+	// Logging
+	// ==============================================================
+	contractLogSymKey := GetLogSymKeyFromKey(contractKey)
+
+	contractLog := ContractLog{Contract: contract.ContractID, OwnerService: contract.OwnerServiceID, RequesterService: contract.RequesterServiceID, OwnerOrg: contract.OwnerOrgID, RequesterOrg: contract.RequesterOrgID, Data: contractDetail.ContractDetailTerms}
+	solutionLog := SolutionLog{
+		TransactionID: stub.GetTxID(),
+		Namespace:     "OMR",
+		FunctionName:  functionName,
+		CallerID:      caller.ID,
+		Timestamp:     contractDetail.CreateDate,
+		Data:          contractLog}
+
+	err = AddLogWithParams(stub, callerObj, solutionLog, contractLogSymKey)
+	if err != nil {
+		customErr := &AddSolutionLogError{FunctionName: solutionLog.FunctionName}
+		logger.Errorf("%v: %v", customErr, err)
+		return errors.Wrap(err, customErr.Error())
+	}
+
+	userAccessManager := user_access_ctrl.GetUserAccessManager(stub, callerObj)
+	err = userAccessManager.AddAccessByKey(callerObj.GetLogSymKey(), contractLogSymKey)
+	if err != nil {
+		customErr := &custom_errors.AddAccessError{Key: "service log sym key to contract log sym key"}
+		logger.Errorf("%v: %v", customErr, err)
+		return errors.Wrap(err, customErr.Error())
+	}
+
+	return nil
+}
+
 // SetupContractIndex sets up contract index table
 func SetupContractIndex(stub cached_stub.CachedStubInterface) error {
 	defer utils.ExitFnLog(utils.EnterFnLog())
@@ -1495,11 +1813,28 @@ func SetupContractIndex(stub cached_stub.CachedStubInterface) error {
 	contractTable.AddIndex([]string{"requester_service_id", "state", "contract_id"}, false)
 	contractTable.AddIndex([]string{"owner_service_id", "requester_service_id", "state", "contract_id"}, false)
 	contractTable.AddIndex([]string{"requester_service_id", "owner_service_id", "state", "contract_id"}, false)
+	contractTable.AddIndex([]string{"owner_service_id", "create_date", "contract_id"}, false)
+	contractTable.AddIndex([]string{"requester_service_id", "create_date", "contract_id"}, false)
+	contractTable.AddIndex([]string{"owner_service_id", "state", "create_date", "contract_id"}, false)
+	contractTable.AddIndex([]string{"requester_service_id", "state", "create_date", "contract_id"}, false)
 	err := contractTable.SaveToLedger()
 
 	if err != nil {
 		return err
 	}
 
+	// a contract can have several requester services, counterparty orgs and datatypes,
+	// so each combination is stored as its own asset, see putContractIndex
+	contractEntryTable := index.GetTable(stub, IndexContractEntry, "entry_id")
+	contractEntryTable.AddIndex([]string{"service_id", "role", "counterparty_org_id", "datatype", "create_date", "contract_id"}, false)
+	contractEntryTable.AddIndex([]string{"service_id", "role", "counterparty_org_id", "datatype", "state", "create_date", "contract_id"}, false)
+	contractEntryTable.AddIndex([]string{"service_id", "role", "counterparty_org_id", "datatype", "payment_status", "create_date", "contract_id"}, false)
+	contractEntryTable.AddIndex([]string{"service_id", "role", "counterparty_org_id", "datatype", "state", "payment_status", "create_date", "contract_id"}, false)
+	contractEntryTable.AddIndex([]string{"contract_id", "entry_id"}, false)
+	err = contractEntryTable.SaveToLedger()
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
@@ -12,6 +12,7 @@ package main
 import (
 	"common/bchcls/cached_stub"
 	"common/bchcls/crypto"
+	"common/bchcls/data_model"
 	"common/bchcls/init_common"
 	"common/bchcls/test_utils"
 	"common/bchcls/user_mgmt"
@@ -41,6 +42,68 @@ func GenerateContractTest(contractID string, ownerOrgID string, ownerServiceID s
 	return contract
 }
 
+// SetupContractServicesTest registers an owner org with service ownerService1 and a requester org with
+// service reqService1, and uploads one ownerOrgDatatype1 record as ownerService1
+// Returns the owner service and requester service callers
+func SetupContractServicesTest(t *testing.T, mstub *test_utils.NewMockStub, ownerPaymentRequired string) (data_model.User, data_model.User) {
+	mstub.MockTransactionStart("setupContractServices")
+	stub := cached_stub.NewCachedStub(mstub, true, true, true)
+	init_common.Init(stub)
+	err := SetupDataIndex(stub)
+	test_utils.AssertTrue(t, err == nil, "Expected SetupDataIndex to succeed")
+	systemAdmin := test_utils.CreateTestUser("systemAdmin")
+	systemAdmin.Role = SOLUTION_ROLE_SYSTEM
+	systemAdminBytes, _ := json.Marshal(&systemAdmin)
+	_, err = RegisterUser(stub, systemAdmin, []string{string(systemAdminBytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterUser to succeed")
+	RegisterSystemDatatypeTest(t, stub, systemAdmin)
+
+	requesterOrg1 := test_utils.CreateTestGroup("requesterOrg1")
+	requesterOrg1Bytes, _ := json.Marshal(&requesterOrg1)
+	_, err = RegisterOrg(stub, requesterOrg1, []string{string(requesterOrg1Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterOrg to succeed")
+	requesterOrg1Caller, _ := user_mgmt.GetUserData(stub, requesterOrg1, requesterOrg1.ID, true, true)
+	reqOrgDatatype1 := Datatype{DatatypeID: "reqOrgDatatype1", Description: "reqOrgDatatype1"}
+	reqOrgDatatype1Bytes, _ := json.Marshal(&reqOrgDatatype1)
+	_, err = RegisterDatatype(stub, requesterOrg1Caller, []string{string(reqOrgDatatype1Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterDatatype to succeed")
+	reqServiceDatatype := GenerateServiceDatatypeForTesting("reqOrgDatatype1", "reqService1", []string{consentOptionWrite, consentOptionRead})
+	reqService1 := GenerateServiceForTesting("reqService1", "requesterOrg1", []ServiceDatatype{reqServiceDatatype})
+	reqService1Bytes, _ := json.Marshal(&reqService1)
+	_, err = RegisterService(stub, requesterOrg1Caller, []string{string(reqService1Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterService to succeed")
+
+	ownerOrg1 := test_utils.CreateTestGroup("ownerOrg1")
+	ownerOrg1Bytes, _ := json.Marshal(&ownerOrg1)
+	_, err = RegisterOrg(stub, ownerOrg1, []string{string(ownerOrg1Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterOrg to succeed")
+	ownerOrg1Caller, _ := user_mgmt.GetUserData(stub, ownerOrg1, ownerOrg1.ID, true, true)
+	ownerOrgDatatype1 := Datatype{DatatypeID: "ownerOrgDatatype1", Description: "ownerOrgDatatype1"}
+	ownerOrgDatatype1Bytes, _ := json.Marshal(&ownerOrgDatatype1)
+	_, err = RegisterDatatype(stub, ownerOrg1Caller, []string{string(ownerOrgDatatype1Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterDatatype to succeed")
+	ownerServiceDatatype := GenerateServiceDatatypeForTesting("ownerOrgDatatype1", "ownerService1", []string{consentOptionWrite, consentOptionRead})
+	ownerService1 := GenerateServiceForTesting("ownerService1", "ownerOrg1", []ServiceDatatype{ownerServiceDatatype})
+	ownerService1["payment_required"] = ownerPaymentRequired
+	ownerService1Bytes, _ := json.Marshal(&ownerService1)
+	_, err = RegisterService(stub, ownerOrg1Caller, []string{string(ownerService1Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterService to succeed")
+	mstub.MockTransactionEnd("setupContractServices")
+
+	mstub.MockTransactionStart("setupContractData")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	ownerService1Subgroup, _ := user_mgmt.GetUserData(stub, ownerOrg1Caller, "ownerService1", true, true)
+	reqService1Subgroup, _ := user_mgmt.GetUserData(stub, requesterOrg1, "reqService1", true, true)
+	ownerData := GenerateOwnerData("ownerService1", "ownerOrgDatatype1")
+	ownerDataBytes, _ := json.Marshal(&ownerData)
+	dataKeyB64 := crypto.EncodeToB64String(test_utils.GenerateSymKey())
+	_, err = UploadOwnerData(stub, ownerService1Subgroup, []string{string(ownerDataBytes), dataKeyB64})
+	test_utils.AssertTrue(t, err == nil, "Expected UploadOwnerData to succeed")
+	mstub.MockTransactionEnd("setupContractData")
+
+	return ownerService1Subgroup, reqService1Subgroup
+}
+
 func TestCreateContract(t *testing.T) {
 	logger.SetLevel(shim.LogDebug)
 	logger.Info("TestCreateContract function called")
@@ -645,10 +708,13 @@ func TestContractLifeCycle(t *testing.T) {
 	test_utils.AssertTrue(t, err == nil, "AddContractDetail succcessful")
 	mstub.MockTransactionEnd("12")
 
-	// requester sign contract
+	// owner and requester sign contract
 	mstub.MockTransactionStart("13")
 	stub = cached_stub.NewCachedStub(mstub)
-	args = []string{contract1.ContractID, "sign", "{}", strconv.FormatInt(time.Now().Unix(), 10)}
+	args = []string{contract1.ContractID, "sign", GenerateContractSignTermsTest(t, stub, ownerService1Subgroup, contract1.ContractID), strconv.FormatInt(time.Now().Unix(), 10)}
+	_, err = AddContractDetail(stub, ownerService1Subgroup, args)
+	test_utils.AssertTrue(t, err == nil, "AddContractDetail succcessful")
+	args = []string{contract1.ContractID, "sign", GenerateContractSignTermsTest(t, stub, reqService1Subgroup, contract1.ContractID), strconv.FormatInt(time.Now().Unix(), 10)}
 	_, err = AddContractDetail(stub, reqService1Subgroup, args)
 	test_utils.AssertTrue(t, err == nil, "AddContractDetail succcessful")
 	mstub.MockTransactionEnd("13")
@@ -789,10 +855,13 @@ func TestContractLifeCycle(t *testing.T) {
 	test_utils.AssertTrue(t, err == nil, "AddContractDetail succcessful")
 	mstub.MockTransactionEnd("25")
 
-	// sign contract as requester org user with service admin permission
+	// sign contract as owner and as requester org user with service admin permission
 	mstub.MockTransactionStart("26a")
 	stub = cached_stub.NewCachedStub(mstub)
-	args = []string{contract2.ContractID, "sign", "{}", strconv.FormatInt(time.Now().Unix(), 10)}
+	args = []string{contract2.ContractID, "sign", GenerateContractSignTermsTest(t, stub, orgUser2Caller, contract2.ContractID), strconv.FormatInt(time.Now().Unix(), 10)}
+	_, err = AddContractDetail(stub, orgUser2Caller, args)
+	test_utils.AssertTrue(t, err == nil, "AddContractDetail succcessful")
+	args = []string{contract2.ContractID, "sign", GenerateContractSignTermsTest(t, stub, orgUser1Caller, contract2.ContractID), strconv.FormatInt(time.Now().Unix(), 10)}
 	_, err = AddContractDetail(stub, orgUser1Caller, args)
 	test_utils.AssertTrue(t, err == nil, "AddContractDetail succcessful")
 	mstub.MockTransactionEnd("26a")
@@ -949,10 +1018,13 @@ func TestContractLifeCycle(t *testing.T) {
 	test_utils.AssertTrue(t, err == nil, "AddContractDetail succcessful")
 	mstub.MockTransactionEnd("41")
 
-	// sign contract as requester org user with org admin permission
+	// sign contract as owner and as requester org user with org admin permission
 	mstub.MockTransactionStart("42")
 	stub = cached_stub.NewCachedStub(mstub)
-	args = []string{contract3.ContractID, "sign", "{}", strconv.FormatInt(time.Now().Unix(), 10)}
+	args = []string{contract3.ContractID, "sign", GenerateContractSignTermsTest(t, stub, orgUser4Caller, contract3.ContractID), strconv.FormatInt(time.Now().Unix(), 10)}
+	_, err = AddContractDetail(stub, orgUser4Caller, args)
+	test_utils.AssertTrue(t, err == nil, "AddContractDetail succcessful")
+	args = []string{contract3.ContractID, "sign", GenerateContractSignTermsTest(t, stub, orgUser3Caller, contract3.ContractID), strconv.FormatInt(time.Now().Unix(), 10)}
 	_, err = AddContractDetail(stub, orgUser3Caller, args)
 	test_utils.AssertTrue(t, err == nil, "AddContractDetail succcessful")
 	mstub.MockTransactionEnd("42")
@@ -1148,10 +1220,13 @@ func TestContractMaxNumDownload(t *testing.T) {
 	test_utils.AssertTrue(t, err == nil, "AddContractDetail succcessful")
 	mstub.MockTransactionEnd("12")
 
-	// requester sign contract
+	// owner and requester sign contract
 	mstub.MockTransactionStart("13")
 	stub = cached_stub.NewCachedStub(mstub)
-	args = []string{contract1.ContractID, "sign", "{}", strconv.FormatInt(time.Now().Unix(), 10)}
+	args = []string{contract1.ContractID, "sign", GenerateContractSignTermsTest(t, stub, ownerService1Subgroup, contract1.ContractID), strconv.FormatInt(time.Now().Unix(), 10)}
+	_, err = AddContractDetail(stub, ownerService1Subgroup, args)
+	test_utils.AssertTrue(t, err == nil, "AddContractDetail succcessful")
+	args = []string{contract1.ContractID, "sign", GenerateContractSignTermsTest(t, stub, reqService1Subgroup, contract1.ContractID), strconv.FormatInt(time.Now().Unix(), 10)}
 	_, err = AddContractDetail(stub, reqService1Subgroup, args)
 	test_utils.AssertTrue(t, err == nil, "AddContractDetail succcessful")
 	mstub.MockTransactionEnd("13")
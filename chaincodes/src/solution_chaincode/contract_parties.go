@@ -0,0 +1,188 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"common/bchcls/cached_stub"
+	"common/bchcls/data_model"
+	"common/bchcls/utils"
+
+	"github.com/pkg/errors"
+)
+
+// ContractRequester is an additional requester of a multi-party contract
+// The contract's RequesterOrgID and RequesterServiceID are the lead requester, whose download counters are
+// the contract's NumDownload and the datatype scopes' NumDownload
+// Each co-requester keeps its own download counters; MaxNumDownload limits apply to every requester separately
+type ContractRequester struct {
+	OrgID               string         `json:"org_id"`
+	ServiceID           string         `json:"service_id"`
+	NumDownload         int            `json:"num_download"`
+	DatatypeNumDownload map[string]int `json:"datatype_num_download"`
+}
+
+// validateContractCoRequesters checks the co-requesters of a new contract
+func validateContractCoRequesters(stub cached_stub.CachedStubInterface, caller data_model.User, contract Contract) error {
+	seen := []string{contract.RequesterServiceID}
+	for _, requester := range contract.CoRequesters {
+		if utils.IsStringEmpty(requester.OrgID) || utils.IsStringEmpty(requester.ServiceID) {
+			return errors.New("Contract co-requester must have an org and a service")
+		}
+
+		if requester.OrgID == contract.OwnerOrgID {
+			return errors.New("Contract co-requester cannot be in the owner org")
+		}
+
+		if utils.InList(seen, requester.ServiceID) {
+			return errors.New("Contract requester is repeated: " + requester.ServiceID)
+		}
+		seen = append(seen, requester.ServiceID)
+
+		service, err := GetServiceInternal(stub, caller, requester.ServiceID, false)
+		if err != nil || utils.IsStringEmpty(service.ServiceID) {
+			return errors.New("Failed to get co-requester service " + requester.ServiceID)
+		}
+
+		if service.OrgID != requester.OrgID {
+			return errors.New("Co-requester service " + requester.ServiceID + " does not belong to org " + requester.OrgID)
+		}
+
+		err = service.checkNotRetiring()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// requesterServiceIDs returns the lead requester service followed by the co-requester services
+func (contract Contract) requesterServiceIDs() []string {
+	serviceIDs := []string{contract.RequesterServiceID}
+	for _, requester := range contract.CoRequesters {
+		serviceIDs = append(serviceIDs, requester.ServiceID)
+	}
+
+	return serviceIDs
+}
+
+// findCoRequester returns the co-requester with the given service, or nil if there is none
+func (contract *Contract) findCoRequester(serviceID string) *ContractRequester {
+	for i := range contract.CoRequesters {
+		if contract.CoRequesters[i].ServiceID == serviceID {
+			return &contract.CoRequesters[i]
+		}
+	}
+
+	return nil
+}
+
+// requesterNumDownload returns the number of downloads by a requester service
+func (contract Contract) requesterNumDownload(serviceID string) int {
+	if requester := contract.findCoRequester(serviceID); requester != nil {
+		return requester.NumDownload
+	}
+
+	return contract.NumDownload
+}
+
+// requesterLimitReached returns true if a requester service used up the contract wide download limit
+func (contract Contract) requesterLimitReached(serviceID string) bool {
+	return contract.MaxNumDownload <= contract.requesterNumDownload(serviceID)
+}
+
+// requesterQuotaReached returns true if a requester service used up the download quota of a datatype
+func (contract Contract) requesterQuotaReached(serviceID string, datatypeID string) bool {
+	scope := contract.findDatatypeScope(datatypeID)
+	if scope == nil {
+		return false
+	}
+
+	requester := contract.findCoRequester(serviceID)
+	if requester == nil {
+		return scope.quotaReached()
+	}
+
+	return scope.MaxNumDownload > 0 && requester.DatatypeNumDownload[datatypeID] >= scope.MaxNumDownload
+}
+
+// allRequestersLimitReached returns true if every requester service used up the contract wide download limit
+func (contract Contract) allRequestersLimitReached() bool {
+	for _, serviceID := range contract.requesterServiceIDs() {
+		if !contract.requesterLimitReached(serviceID) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// recordRequesterDownload counts a download of a datatype by a requester service
+func (contract *Contract) recordRequesterDownload(serviceID string, datatypeID string) {
+	scope := contract.findDatatypeScope(datatypeID)
+	requester := contract.findCoRequester(serviceID)
+	if requester == nil {
+		contract.NumDownload = contract.NumDownload + 1
+		if scope != nil {
+			scope.NumDownload = scope.NumDownload + 1
+		}
+		return
+	}
+
+	requester.NumDownload = requester.NumDownload + 1
+	if scope != nil {
+		if requester.DatatypeNumDownload == nil {
+			requester.DatatypeNumDownload = make(map[string]int)
+		}
+		requester.DatatypeNumDownload[datatypeID] = requester.DatatypeNumDownload[datatypeID] + 1
+	}
+}
+
+// getContractRequesterService returns the requester service of the contract the caller is admin of
+// The lead requester is checked first; returns false if caller is admin of none of the requester services
+func getContractRequesterService(caller data_model.User, contract Contract) (string, bool) {
+	if CallerIsAdminOfService(caller, contract.RequesterServiceID, contract.RequesterOrgID) {
+		return contract.RequesterServiceID, true
+	}
+
+	for _, requester := range contract.CoRequesters {
+		if CallerIsAdminOfService(caller, requester.ServiceID, requester.OrgID) {
+			return requester.ServiceID, true
+		}
+	}
+
+	return "", false
+}
+
+// getContractPublicDataRequesterService returns the requester service in contract public data the caller acts for
+// Used before the contract can be decrypted; returns an error if the caller is not admin of any requester service
+func getContractPublicDataRequesterService(stub cached_stub.CachedStubInterface, caller data_model.User, publicData ContractPublicData) (string, error) {
+	solutionCaller := convertToSolutionUser(caller)
+	for _, serviceID := range publicData.requesterServiceIDs() {
+		if caller.ID == serviceID || utils.InList(solutionCaller.SolutionInfo.Services, serviceID) {
+			return serviceID, nil
+		}
+
+		if solutionCaller.SolutionInfo.IsOrgAdmin {
+			service, err := GetServiceInternal(stub, caller, serviceID, false)
+			if err == nil && service.OrgID == solutionCaller.Org {
+				return serviceID, nil
+			}
+		}
+	}
+
+	logger.Errorf("Caller must be admin of a contract requester service")
+	return "", errors.New("Caller must be admin of a contract requester service")
+}
+
+// requesterServiceIDs returns the lead requester service followed by the co-requester services
+func (publicData ContractPublicData) requesterServiceIDs() []string {
+	return append([]string{publicData.RequesterServiceID}, publicData.CoRequesterServiceIDs...)
+}
@@ -0,0 +1,211 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"common/bchcls/cached_stub"
+	"common/bchcls/crypto"
+	"common/bchcls/test_utils"
+	"common/bchcls/user_mgmt"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestMultiPartyContract(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestMultiPartyContract function called")
+
+	mstub := SetupIndexesAndGetStub(t)
+	ownerService1Subgroup, reqService1Subgroup := SetupContractServicesTest(t, mstub, "no")
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	// register second requester org and service
+	mstub.MockTransactionStart("t1")
+	stub := cached_stub.NewCachedStub(mstub, true, true, true)
+	requesterOrg2 := test_utils.CreateTestGroup("requesterOrg2")
+	requesterOrg2Bytes, _ := json.Marshal(&requesterOrg2)
+	_, err := RegisterOrg(stub, requesterOrg2, []string{string(requesterOrg2Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterOrg to succeed")
+	requesterOrg2Caller, _ := user_mgmt.GetUserData(stub, requesterOrg2, requesterOrg2.ID, true, true)
+	reqOrgDatatype2 := Datatype{DatatypeID: "reqOrgDatatype2", Description: "reqOrgDatatype2"}
+	reqOrgDatatype2Bytes, _ := json.Marshal(&reqOrgDatatype2)
+	_, err = RegisterDatatype(stub, requesterOrg2Caller, []string{string(reqOrgDatatype2Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterDatatype to succeed")
+	reqServiceDatatype := GenerateServiceDatatypeForTesting("reqOrgDatatype2", "reqService2", []string{consentOptionWrite, consentOptionRead})
+	reqService2 := GenerateServiceForTesting("reqService2", "requesterOrg2", []ServiceDatatype{reqServiceDatatype})
+	reqService2Bytes, _ := json.Marshal(&reqService2)
+	_, err = RegisterService(stub, requesterOrg2Caller, []string{string(reqService2Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterService to succeed")
+	mstub.MockTransactionEnd("t1")
+
+	mstub.MockTransactionStart("t2")
+	stub = cached_stub.NewCachedStub(mstub)
+	reqService2Subgroup, _ := user_mgmt.GetUserData(stub, requesterOrg2, "reqService2", true, true)
+	mstub.MockTransactionEnd("t2")
+
+	// co-requester cannot be the lead requester
+	mstub.MockTransactionStart("1")
+	stub = cached_stub.NewCachedStub(mstub)
+	contract1 := GenerateContractTest("contract1", "ownerOrg1", "ownerService1", "requesterOrg1", "reqService1")
+	contract1.CoRequesters = []ContractRequester{{OrgID: "requesterOrg1", ServiceID: "reqService1"}}
+	contract1Bytes, _ := json.Marshal(&contract1)
+	contractKeyB64 := crypto.EncodeToB64String(test_utils.GenerateSymKey())
+	_, err = CreateContract(stub, reqService1Subgroup, []string{string(contract1Bytes), contractKeyB64})
+	test_utils.AssertTrue(t, err != nil, "Expected CreateContract to fail")
+	mstub.MockTransactionEnd("1")
+
+	mstub.MockTransactionStart("2")
+	stub = cached_stub.NewCachedStub(mstub)
+	contract1.CoRequesters = []ContractRequester{{OrgID: "requesterOrg2", ServiceID: "reqService2"}}
+	contract1Bytes, _ = json.Marshal(&contract1)
+	_, err = CreateContract(stub, reqService1Subgroup, []string{string(contract1Bytes), contractKeyB64})
+	test_utils.AssertTrue(t, err == nil, "Expected CreateContract to succeed")
+	mstub.MockTransactionEnd("2")
+
+	// co-requester has its own key share
+	mstub.MockTransactionStart("3")
+	stub = cached_stub.NewCachedStub(mstub)
+	contractBytes, err := GetContract(stub, reqService2Subgroup, []string{contract1.ContractID})
+	test_utils.AssertTrue(t, err == nil, "Expected GetContract to succeed")
+	contract := Contract{}
+	json.Unmarshal(contractBytes, &contract)
+	test_utils.AssertTrue(t, contract.ContractID == contract1.ContractID, "Expected co-requester to get contract")
+
+	// co-requester finds the contract through the contract index
+	contractsBytes, err := GetContractsAsRequester(stub, reqService2Subgroup, []string{"reqService2", ""})
+	test_utils.AssertTrue(t, err == nil, "Expected GetContractsAsRequester to succeed")
+	contracts := []Contract{}
+	json.Unmarshal(contractsBytes, &contracts)
+	test_utils.AssertTrue(t, len(contracts) == 1 && contracts[0].ContractID == contract1.ContractID, "Expected co-requester to find contract")
+	contractsBytes, err = GetContractsAsRequester(stub, reqService2Subgroup, []string{"reqService2", string(ContractStateRequested)})
+	test_utils.AssertTrue(t, err == nil, "Expected GetContractsAsRequester to succeed")
+	contracts = []Contract{}
+	json.Unmarshal(contractsBytes, &contracts)
+	test_utils.AssertTrue(t, len(contracts) == 1, "Expected co-requester to find requested contract")
+
+	filterBytes, _ := json.Marshal(&ContractSearchFilter{ServiceID: "reqService2", Role: ContractRoleRequester, CounterpartyOrgID: "ownerOrg1"})
+	searchBytes, err := SearchContracts(stub, reqService2Subgroup, []string{string(filterBytes), "10", ""})
+	test_utils.AssertTrue(t, err == nil, "Expected SearchContracts to succeed")
+	searchResult := ContractSearchResult{}
+	json.Unmarshal(searchBytes, &searchResult)
+	test_utils.AssertTrue(t, len(searchResult.Contracts) == 1, "Expected co-requester search to find contract")
+	filterBytes, _ = json.Marshal(&ContractSearchFilter{ServiceID: "ownerService1", Role: ContractRoleOwner, CounterpartyOrgID: "requesterOrg2"})
+	searchBytes, err = SearchContracts(stub, ownerService1Subgroup, []string{string(filterBytes), "10", ""})
+	test_utils.AssertTrue(t, err == nil, "Expected SearchContracts to succeed")
+	searchResult = ContractSearchResult{}
+	json.Unmarshal(searchBytes, &searchResult)
+	test_utils.AssertTrue(t, len(searchResult.Contracts) == 1, "Expected owner search by co-requester org to find contract")
+	mstub.MockTransactionEnd("3")
+
+	// contract is signed only after every requester signs
+	mstub.MockTransactionStart("4")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = AddContractDetail(stub, ownerService1Subgroup, []string{contract1.ContractID, "terms", "{}", now})
+	test_utils.AssertTrue(t, err == nil, "Expected AddContractDetail to succeed")
+	_, err = AddContractDetail(stub, ownerService1Subgroup, []string{contract1.ContractID, "sign", GenerateContractSignTermsTest(t, stub, ownerService1Subgroup, contract1.ContractID), now})
+	test_utils.AssertTrue(t, err == nil, "Expected AddContractDetail to succeed")
+	_, err = AddContractDetail(stub, reqService1Subgroup, []string{contract1.ContractID, "sign", GenerateContractSignTermsTest(t, stub, reqService1Subgroup, contract1.ContractID), now})
+	test_utils.AssertTrue(t, err == nil, "Expected AddContractDetail to succeed")
+	mstub.MockTransactionEnd("4")
+
+	mstub.MockTransactionStart("5")
+	stub = cached_stub.NewCachedStub(mstub)
+	resultBytes, err := VerifyContractSignatures(stub, reqService2Subgroup, []string{contract1.ContractID})
+	test_utils.AssertTrue(t, err == nil, "Expected VerifyContractSignatures to succeed")
+	result := ContractSignaturesResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, result.OwnerSigned && !result.RequesterSigned, "Expected co-requester signature to be pending")
+	test_utils.AssertTrue(t, len(result.PendingServices) == 1 && result.PendingServices[0] == "reqService2", "Expected reqService2 to be pending")
+	_, err = AddContractDetail(stub, reqService2Subgroup, []string{contract1.ContractID, "sign", GenerateContractSignTermsTest(t, stub, reqService2Subgroup, contract1.ContractID), now})
+	test_utils.AssertTrue(t, err == nil, "Expected AddContractDetail to succeed")
+	mstub.MockTransactionEnd("5")
+
+	mstub.MockTransactionStart("6")
+	stub = cached_stub.NewCachedStub(mstub)
+	contractBytes, err = GetContract(stub, ownerService1Subgroup, []string{contract1.ContractID})
+	test_utils.AssertTrue(t, err == nil, "Expected GetContract to succeed")
+	contract = Contract{}
+	json.Unmarshal(contractBytes, &contract)
+	test_utils.AssertTrue(t, contract.State == ContractStateContractSigned, "Expected contract to be contractSigned")
+	_, err = GivePermissionByContract(stub, ownerService1Subgroup, []string{contract1.ContractID, "1", now, "ownerOrgDatatype1"})
+	test_utils.AssertTrue(t, err == nil, "Expected GivePermissionByContract to succeed")
+	mstub.MockTransactionEnd("6")
+
+	// each requester has its own download counter
+	mstub.MockTransactionStart("7")
+	stub = cached_stub.NewCachedStub(mstub)
+	args := []string{contract1.ContractID, "ownerOrgDatatype1", "false", "0", "0", "1000", now}
+	downloadBytes, err := DownloadOwnerDataAsRequester(stub, reqService2Subgroup, args)
+	test_utils.AssertTrue(t, err == nil, "Expected DownloadOwnerDataAsRequester to succeed")
+	downloadResult := OwnerDataDownloadResult{}
+	json.Unmarshal(downloadBytes, &downloadResult)
+	test_utils.AssertTrue(t, len(downloadResult.OwnerDatas) == 1, "Expected 1 owner data")
+	mstub.MockTransactionEnd("7")
+
+	mstub.MockTransactionStart("8")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = AddContractDetailDownload(stub, ownerService1Subgroup, []string{contract1.ContractID, downloadResult.EncryptedContract, "ownerOrgDatatype1"})
+	test_utils.AssertTrue(t, err != nil, "Expected AddContractDetailDownload by owner to fail")
+	_, err = AddContractDetailDownload(stub, reqService2Subgroup, []string{contract1.ContractID, downloadResult.EncryptedContract, "ownerOrgDatatype1"})
+	test_utils.AssertTrue(t, err == nil, "Expected AddContractDetailDownload to succeed")
+	mstub.MockTransactionEnd("8")
+
+	mstub.MockTransactionStart("9")
+	stub = cached_stub.NewCachedStub(mstub)
+	contractBytes, err = GetContract(stub, reqService1Subgroup, []string{contract1.ContractID})
+	test_utils.AssertTrue(t, err == nil, "Expected GetContract to succeed")
+	contract = Contract{}
+	json.Unmarshal(contractBytes, &contract)
+	test_utils.AssertTrue(t, contract.State == ContractStateDownloadReady, "Expected contract to stay downloadReady")
+	test_utils.AssertTrue(t, contract.NumDownload == 0, "Expected no downloads by lead requester")
+	test_utils.AssertTrue(t, contract.CoRequesters[0].NumDownload == 1, "Expected 1 download by co-requester")
+	downloadBytes, err = DownloadOwnerDataAsRequester(stub, reqService1Subgroup, args)
+	test_utils.AssertTrue(t, err == nil, "Expected DownloadOwnerDataAsRequester to succeed")
+	downloadResult = OwnerDataDownloadResult{}
+	json.Unmarshal(downloadBytes, &downloadResult)
+	test_utils.AssertTrue(t, len(downloadResult.OwnerDatas) == 1, "Expected 1 owner data")
+	mstub.MockTransactionEnd("9")
+
+	mstub.MockTransactionStart("10")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = AddContractDetailDownload(stub, reqService1Subgroup, []string{contract1.ContractID, downloadResult.EncryptedContract, "ownerOrgDatatype1"})
+	test_utils.AssertTrue(t, err == nil, "Expected AddContractDetailDownload to succeed")
+	mstub.MockTransactionEnd("10")
+
+	mstub.MockTransactionStart("11")
+	stub = cached_stub.NewCachedStub(mstub)
+	contractBytes, err = GetContract(stub, reqService1Subgroup, []string{contract1.ContractID})
+	test_utils.AssertTrue(t, err == nil, "Expected GetContract to succeed")
+	contract = Contract{}
+	json.Unmarshal(contractBytes, &contract)
+	test_utils.AssertTrue(t, contract.State == ContractStateDownloadDone, "Expected contract to be downloadDone")
+
+	// index entries follow the contract state
+	contractsBytes, err = GetContractsAsRequester(stub, reqService2Subgroup, []string{"reqService2", string(ContractStateDownloadDone)})
+	test_utils.AssertTrue(t, err == nil, "Expected GetContractsAsRequester to succeed")
+	contracts = []Contract{}
+	json.Unmarshal(contractsBytes, &contracts)
+	test_utils.AssertTrue(t, len(contracts) == 1, "Expected co-requester to find downloadDone contract")
+	mstub.MockTransactionEnd("11")
+
+	// reindexing is idempotent
+	mstub.MockTransactionStart("12")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	reindexBytes, err := ReindexContracts(stub, ownerService1Subgroup, []string{"ownerService1", "10", ""})
+	test_utils.AssertTrue(t, err == nil, "Expected ReindexContracts to succeed")
+	reindexResult := ContractReindexResult{}
+	json.Unmarshal(reindexBytes, &reindexResult)
+	test_utils.AssertTrue(t, len(reindexResult.Contracts) == 1 && reindexResult.Bookmark == "", "Expected 1 contract reindexed")
+	mstub.MockTransactionEnd("12")
+}
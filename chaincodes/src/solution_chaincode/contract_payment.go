@@ -0,0 +1,437 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"common/bchcls/cached_stub"
+	"common/bchcls/custom_errors"
+	"common/bchcls/data_model"
+	"common/bchcls/utils"
+
+	"github.com/pkg/errors"
+)
+
+// Contract payment record types
+const (
+	contractPaymentTypePayment = "payment"
+	contractPaymentTypeRefund  = "refund"
+)
+
+// ContractPayment is a structured record of money moving between the parties of a contract
+// Amount is in the smallest unit of the currency, e.g. cents
+// Payments are recorded by a requester service and count towards the contract totals once the owner verifies them
+// Refunds are recorded by the owner service and are verified when they are recorded
+type ContractPayment struct {
+	PaymentID  string `json:"payment_id"`
+	Type       string `json:"type"`
+	Amount     int64  `json:"amount"`
+	Currency   string `json:"currency"`
+	Reference  string `json:"reference"`
+	PayerID    string `json:"payer_id"`
+	RecordedBy string `json:"recorded_by"`
+	RecordDate int64  `json:"record_date"`
+	VerifierID string `json:"verifier_id"`
+	VerifyDate int64  `json:"verify_date"`
+}
+
+// ContractPaymentSummary is returned by GetContractPayments
+// Paid is the total of verified payments, Pending the total of payments waiting for verification
+// Balance is Paid less Refunded, the contract is settled once Balance reaches PaymentDue
+type ContractPaymentSummary struct {
+	ContractID string            `json:"contract_id"`
+	State      ContractState     `json:"state"`
+	PaymentDue int64             `json:"payment_due"`
+	Currency   string            `json:"currency"`
+	Paid       int64             `json:"paid"`
+	Pending    int64             `json:"pending"`
+	Refunded   int64             `json:"refunded"`
+	Balance    int64             `json:"balance"`
+	Status     string            `json:"status"`
+	Payments   []ContractPayment `json:"payments"`
+}
+
+// isVerified returns true if the owner verified the payment
+func (payment ContractPayment) isVerified() bool {
+	return !utils.IsStringEmpty(payment.VerifierID)
+}
+
+// paymentTotals returns the totals of verified payments, unverified payments and refunds of the contract
+func (contract Contract) paymentTotals() (int64, int64, int64) {
+	var paid, pending, refunded int64
+	for _, payment := range contract.Payments {
+		if payment.Type == contractPaymentTypeRefund {
+			refunded = refunded + payment.Amount
+		} else if payment.isVerified() {
+			paid = paid + payment.Amount
+		} else {
+			pending = pending + payment.Amount
+		}
+	}
+
+	return paid, pending, refunded
+}
+
+// paymentBalance returns the verified payments of the contract less refunds
+func (contract Contract) paymentBalance() int64 {
+	paid, _, refunded := contract.paymentTotals()
+	return paid - refunded
+}
+
+// paymentSettled returns true if payment is required and the payment balance covers the payment due
+func (contract Contract) paymentSettled() bool {
+	return contract.PaymentRequired == "yes" && contract.paymentBalance() >= contract.PaymentDue
+}
+
+// updatePaymentVerified keeps the legacy PaymentVerified flag in line with the payment state
+func (contract *Contract) updatePaymentVerified() {
+	if contract.State == ContractStatePaymentVerified {
+		contract.PaymentVerified = "yes"
+	} else if contract.State == ContractStatePaymentDone {
+		contract.PaymentVerified = "no"
+	}
+}
+
+// findPayment returns the payment record with the given ID, or nil if there is none
+func (contract *Contract) findPayment(paymentID string) *ContractPayment {
+	for i := range contract.Payments {
+		if contract.Payments[i].PaymentID == paymentID {
+			return &contract.Payments[i]
+		}
+	}
+
+	return nil
+}
+
+// newContractPayment parses and validates a payment or refund record passed by a contract party
+func newContractPayment(contract Contract, paymentType string, paymentStr string) (ContractPayment, error) {
+	payment := ContractPayment{}
+	err := json.Unmarshal([]byte(paymentStr), &payment)
+	if err != nil {
+		customErr := &custom_errors.UnmarshalError{Type: "ContractPayment"}
+		logger.Errorf("%v: %v", customErr, err)
+		return ContractPayment{}, errors.Wrap(err, customErr.Error())
+	}
+
+	if payment.Amount <= 0 {
+		logger.Errorf("Invalid %v amount: %v", paymentType, payment.Amount)
+		return ContractPayment{}, errors.New("Invalid " + paymentType + " amount, must be greater than 0")
+	}
+
+	if utils.IsStringEmpty(payment.Currency) || (!utils.IsStringEmpty(contract.Currency) && payment.Currency != contract.Currency) {
+		logger.Errorf("Invalid %v currency: %v", paymentType, payment.Currency)
+		return ContractPayment{}, errors.New("Invalid " + paymentType + " currency, must match contract currency " + contract.Currency)
+	}
+
+	if utils.IsStringEmpty(payment.Reference) {
+		customErr := &custom_errors.LengthCheckingError{Type: "reference"}
+		logger.Errorf(customErr.Error())
+		return ContractPayment{}, errors.WithStack(customErr)
+	}
+
+	payment.PaymentID = paymentType + strconv.Itoa(len(contract.Payments)+1)
+	payment.Type = paymentType
+	payment.VerifierID = ""
+	payment.VerifyDate = 0
+
+	return payment, nil
+}
+
+// RecordContractPayment records a payment made by a requester service
+// Can only be called by admins of a contract requester service, when the contract requires payment
+// The contract moves to paymentDone; the payment counts towards the contract totals once the owner verifies it
+// payment is a JSON object with amount, currency and an external reference
+// args = [contractID, payment, timestamp]
+func RecordContractPayment(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 3 {
+		customErr := &custom_errors.LengthCheckingError{Type: "RecordContractPayment arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	timestamp, err := ParseTimestamp(args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	contract, callerObj, role, err := getPaymentContract(stub, caller, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if role != ContractRoleRequester {
+		logger.Errorf("Caller must be admin of a contract requester service")
+		return nil, errors.New("Caller must be admin of a contract requester service")
+	}
+
+	payment, err := newContractPayment(contract, contractPaymentTypePayment, args[1])
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid contract payment")
+	}
+
+	transition, err := findContractTransition(contract, contractActionPayment, role)
+	if err != nil {
+		return nil, err
+	}
+
+	// ==============================================================
+	// Update contract
+	// ==============================================================
+	payment.PayerID = callerObj.ID
+	payment.RecordedBy = caller.ID
+	payment.RecordDate = timestamp
+	contract.Payments = append(contract.Payments, payment)
+	contract.State = transition.To
+	contract.updatePaymentVerified()
+
+	contractDetail := ContractDetail{
+		ContractID:          contract.ContractID,
+		ContractDetailType:  contractActionPayment,
+		ContractDetailTerms: payment,
+		CreateDate:          timestamp,
+		CreatedBy:           caller.ID}
+
+	err = saveContractWithDetail(stub, caller, callerObj, contract, contractDetail, "RecordContractPayment")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to save contract")
+	}
+
+	return nil, nil
+}
+
+// VerifyContractPayment verifies a payment recorded by a requester service
+// Can only be called by admins of the contract owner service
+// The contract moves to paymentVerified once the payment balance covers the payment due, otherwise it stays in paymentDone
+// args = [contractID, paymentID, timestamp]
+func VerifyContractPayment(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 3 {
+		customErr := &custom_errors.LengthCheckingError{Type: "VerifyContractPayment arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	paymentID := args[1]
+	if utils.IsStringEmpty(paymentID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "paymentID"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	timestamp, err := ParseTimestamp(args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	contract, callerObj, role, err := getPaymentContract(stub, caller, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if role != ContractRoleOwner {
+		logger.Errorf("Caller must be admin of contract owner service")
+		return nil, errors.New("Caller must be admin of contract owner service")
+	}
+
+	payment := contract.findPayment(paymentID)
+	if payment == nil || payment.Type != contractPaymentTypePayment {
+		logger.Errorf("Contract %v does not have payment %v", contract.ContractID, paymentID)
+		return nil, errors.New("Contract does not have payment " + paymentID)
+	}
+
+	if payment.isVerified() {
+		logger.Errorf("Payment %v is already verified", paymentID)
+		return nil, errors.New("Payment " + paymentID + " is already verified")
+	}
+
+	// the verified payment counts towards the paymentSettled guard
+	payment.VerifierID = caller.ID
+	payment.VerifyDate = timestamp
+	transition, err := findContractTransition(contract, contractActionVerify, role)
+	if err != nil {
+		return nil, err
+	}
+
+	// ==============================================================
+	// Update contract
+	// ==============================================================
+	contract.State = transition.To
+	contract.updatePaymentVerified()
+
+	contractDetail := ContractDetail{
+		ContractID:          contract.ContractID,
+		ContractDetailType:  contractActionVerify,
+		ContractDetailTerms: *payment,
+		CreateDate:          timestamp,
+		CreatedBy:           caller.ID}
+
+	err = saveContractWithDetail(stub, caller, callerObj, contract, contractDetail, "VerifyContractPayment")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to save contract")
+	}
+
+	return nil, nil
+}
+
+// RecordContractRefund records a refund paid back by the owner service
+// Can only be called by admins of the contract owner service; the refund cannot exceed the payment balance
+// A contract in paymentDone or paymentVerified moves to the payment state matching the new balance
+// A downloadable contract left below the payment due moves back to paymentDone and its requesters lose access to the owner data
+// A contract in any other state keeps its state
+// refund is a JSON object with amount, currency and an external reference
+// args = [contractID, refund, timestamp]
+func RecordContractRefund(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 3 {
+		customErr := &custom_errors.LengthCheckingError{Type: "RecordContractRefund arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	timestamp, err := ParseTimestamp(args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	contract, callerObj, role, err := getPaymentContract(stub, caller, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if role != ContractRoleOwner {
+		logger.Errorf("Caller must be admin of contract owner service")
+		return nil, errors.New("Caller must be admin of contract owner service")
+	}
+
+	refund, err := newContractPayment(contract, contractPaymentTypeRefund, args[1])
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid contract refund")
+	}
+
+	if refund.Amount > contract.paymentBalance() {
+		logger.Errorf("Refund amount %v exceeds payment balance %v", refund.Amount, contract.paymentBalance())
+		return nil, errors.New("Refund amount exceeds payment balance of " + strconv.FormatInt(contract.paymentBalance(), 10))
+	}
+
+	// ==============================================================
+	// Update contract
+	// ==============================================================
+	refund.PayerID = callerObj.ID
+	refund.RecordedBy = caller.ID
+	refund.RecordDate = timestamp
+	refund.VerifierID = caller.ID
+	refund.VerifyDate = timestamp
+	contract.Payments = append(contract.Payments, refund)
+
+	previousState := contract.State
+	if transition, err := findContractTransition(contract, contractActionRefund, role); err == nil {
+		contract.State = transition.To
+		contract.updatePaymentVerified()
+	}
+
+	// requesters keep their access to owner data only while the payment due is covered
+	if previousState.hasDataAccess() && contract.paymentBalance() < contract.PaymentDue {
+		err = setContractDataAccess(stub, callerObj, contract, false)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to remove requester access to owner data")
+		}
+	}
+
+	contractDetail := ContractDetail{
+		ContractID:          contract.ContractID,
+		ContractDetailType:  contractActionRefund,
+		ContractDetailTerms: refund,
+		CreateDate:          timestamp,
+		CreatedBy:           caller.ID}
+
+	err = saveContractWithDetail(stub, caller, callerObj, contract, contractDetail, "RecordContractRefund")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to save contract")
+	}
+
+	return nil, nil
+}
+
+// GetContractPayments returns the payment records and totals of a contract
+// Can be called by admins of the contract owner or requester services
+// args = [contractID]
+func GetContractPayments(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 1 {
+		customErr := &custom_errors.LengthCheckingError{Type: "GetContractPayments arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	contract, _, _, err := getPaymentContract(stub, caller, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	paid, pending, refunded := contract.paymentTotals()
+	summary := ContractPaymentSummary{
+		ContractID: contract.ContractID,
+		State:      contract.State,
+		PaymentDue: contract.PaymentDue,
+		Currency:   contract.Currency,
+		Paid:       paid,
+		Pending:    pending,
+		Refunded:   refunded,
+		Balance:    paid - refunded,
+		Status:     contract.paymentStatus(),
+		Payments:   contract.Payments}
+	if summary.Payments == nil {
+		summary.Payments = []ContractPayment{}
+	}
+
+	return json.Marshal(&summary)
+}
+
+// getPaymentContract returns a contract, the caller object acting as contract service,
+// and the side of the contract the caller acts for
+func getPaymentContract(stub cached_stub.CachedStubInterface, caller data_model.User, contractID string) (Contract, data_model.User, ContractRole, error) {
+	if utils.IsStringEmpty(contractID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "contractID"}
+		logger.Errorf(customErr.Error())
+		return Contract{}, data_model.User{}, "", errors.WithStack(customErr)
+	}
+
+	contract, err := getContractForCaller(stub, caller, contractID)
+	if err != nil {
+		return Contract{}, data_model.User{}, "", errors.Wrap(err, "Failed to get contract")
+	}
+
+	callerObj, role, err := getContractCaller(stub, caller, contract)
+	if err != nil {
+		return Contract{}, data_model.User{}, "", errors.Wrap(err, "Failed to get contract caller")
+	}
+
+	return contract, callerObj, role, nil
+}
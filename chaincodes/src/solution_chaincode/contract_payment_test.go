@@ -0,0 +1,150 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"common/bchcls/cached_stub"
+	"common/bchcls/crypto"
+	"common/bchcls/test_utils"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestContractPayments(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestContractPayments function called")
+
+	mstub := SetupIndexesAndGetStub(t)
+	ownerService1Subgroup, reqService1Subgroup := SetupContractServicesTest(t, mstub, "yes")
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	mstub.MockTransactionStart("1")
+	stub := cached_stub.NewCachedStub(mstub)
+	contract1 := GenerateContractTest("contract1", "ownerOrg1", "ownerService1", "requesterOrg1", "reqService1")
+	contract1.PaymentRequired = "yes"
+	contract1.PaymentDue = 1000
+	contract1.Currency = "USD"
+	contract1Bytes, _ := json.Marshal(&contract1)
+	contractKeyB64 := crypto.EncodeToB64String(test_utils.GenerateSymKey())
+	_, err := CreateContract(stub, reqService1Subgroup, []string{string(contract1Bytes), contractKeyB64})
+	test_utils.AssertTrue(t, err == nil, "Expected CreateContract to succeed")
+	_, err = AddContractDetail(stub, ownerService1Subgroup, []string{contract1.ContractID, "terms", "{}", now})
+	test_utils.AssertTrue(t, err == nil, "Expected AddContractDetail to succeed")
+	mstub.MockTransactionEnd("1")
+
+	// payment cannot be recorded before contract is signed
+	mstub.MockTransactionStart("2")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = RecordContractPayment(stub, reqService1Subgroup, []string{contract1.ContractID, `{"amount": 400, "currency": "USD", "reference": "wire-1"}`, now})
+	test_utils.AssertTrue(t, err != nil, "Expected RecordContractPayment to fail")
+	_, err = AddContractDetail(stub, ownerService1Subgroup, []string{contract1.ContractID, "sign", GenerateContractSignTermsTest(t, stub, ownerService1Subgroup, contract1.ContractID), now})
+	test_utils.AssertTrue(t, err == nil, "Expected AddContractDetail to succeed")
+	_, err = AddContractDetail(stub, reqService1Subgroup, []string{contract1.ContractID, "sign", GenerateContractSignTermsTest(t, stub, reqService1Subgroup, contract1.ContractID), now})
+	test_utils.AssertTrue(t, err == nil, "Expected AddContractDetail to succeed")
+	mstub.MockTransactionEnd("2")
+
+	// partial payment
+	mstub.MockTransactionStart("3")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = RecordContractPayment(stub, reqService1Subgroup, []string{contract1.ContractID, `{"amount": 400, "currency": "EUR", "reference": "wire-1"}`, now})
+	test_utils.AssertTrue(t, err != nil, "Expected RecordContractPayment to fail with wrong currency")
+	_, err = RecordContractPayment(stub, reqService1Subgroup, []string{contract1.ContractID, `{"amount": 400, "currency": "USD", "reference": "wire-1"}`, now})
+	test_utils.AssertTrue(t, err == nil, "Expected RecordContractPayment to succeed")
+	_, err = VerifyContractPayment(stub, reqService1Subgroup, []string{contract1.ContractID, "payment1", now})
+	test_utils.AssertTrue(t, err != nil, "Expected VerifyContractPayment by requester to fail")
+	_, err = VerifyContractPayment(stub, ownerService1Subgroup, []string{contract1.ContractID, "payment1", now})
+	test_utils.AssertTrue(t, err == nil, "Expected VerifyContractPayment to succeed")
+	mstub.MockTransactionEnd("3")
+
+	mstub.MockTransactionStart("4")
+	stub = cached_stub.NewCachedStub(mstub)
+	summaryBytes, err := GetContractPayments(stub, reqService1Subgroup, []string{contract1.ContractID})
+	test_utils.AssertTrue(t, err == nil, "Expected GetContractPayments to succeed")
+	summary := ContractPaymentSummary{}
+	json.Unmarshal(summaryBytes, &summary)
+	test_utils.AssertTrue(t, summary.State == ContractStatePaymentDone, "Expected paymentDone state after partial payment")
+	test_utils.AssertTrue(t, summary.Paid == 400 && summary.Balance == 400, "Expected 400 paid")
+	test_utils.AssertTrue(t, summary.Status == contractPaymentPartial, "Expected partial payment status")
+	mstub.MockTransactionEnd("4")
+
+	// remaining payment settles the contract
+	mstub.MockTransactionStart("5")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = RecordContractPayment(stub, reqService1Subgroup, []string{contract1.ContractID, `{"amount": 600, "currency": "USD", "reference": "wire-2"}`, now})
+	test_utils.AssertTrue(t, err == nil, "Expected RecordContractPayment to succeed")
+	_, err = VerifyContractPayment(stub, ownerService1Subgroup, []string{contract1.ContractID, "payment2", now})
+	test_utils.AssertTrue(t, err == nil, "Expected VerifyContractPayment to succeed")
+	_, err = VerifyContractPayment(stub, ownerService1Subgroup, []string{contract1.ContractID, "payment2", now})
+	test_utils.AssertTrue(t, err != nil, "Expected VerifyContractPayment to fail for verified payment")
+	mstub.MockTransactionEnd("5")
+
+	mstub.MockTransactionStart("6")
+	stub = cached_stub.NewCachedStub(mstub)
+	contract, err := GetContractInternal(stub, ownerService1Subgroup, contract1.ContractID)
+	test_utils.AssertTrue(t, err == nil, "Expected GetContractInternal to succeed")
+	test_utils.AssertTrue(t, contract.State == ContractStatePaymentVerified, "Expected paymentVerified state")
+	test_utils.AssertTrue(t, contract.PaymentVerified == "yes", "Expected payment verified flag")
+
+	// refund moves contract back to paymentDone
+	_, err = RecordContractRefund(stub, ownerService1Subgroup, []string{contract1.ContractID, `{"amount": 2000, "currency": "USD", "reference": "refund-1"}`, now})
+	test_utils.AssertTrue(t, err != nil, "Expected RecordContractRefund over balance to fail")
+	_, err = RecordContractRefund(stub, ownerService1Subgroup, []string{contract1.ContractID, `{"amount": 200, "currency": "USD", "reference": "refund-1"}`, now})
+	test_utils.AssertTrue(t, err == nil, "Expected RecordContractRefund to succeed")
+	mstub.MockTransactionEnd("6")
+
+	mstub.MockTransactionStart("7")
+	stub = cached_stub.NewCachedStub(mstub)
+	summaryBytes, err = GetContractPayments(stub, ownerService1Subgroup, []string{contract1.ContractID})
+	test_utils.AssertTrue(t, err == nil, "Expected GetContractPayments to succeed")
+	summary = ContractPaymentSummary{}
+	json.Unmarshal(summaryBytes, &summary)
+	test_utils.AssertTrue(t, summary.State == ContractStatePaymentDone, "Expected paymentDone state after refund")
+	test_utils.AssertTrue(t, summary.Paid == 1000 && summary.Refunded == 200 && summary.Balance == 800, "Expected balance of 800")
+	test_utils.AssertTrue(t, len(summary.Payments) == 3, "Expected 3 payment records")
+	test_utils.AssertTrue(t, summary.Payments[2].PayerID == "ownerService1", "Expected refund paid by owner service")
+	mstub.MockTransactionEnd("7")
+
+	// settle again and give permission to download
+	mstub.MockTransactionStart("8")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = RecordContractPayment(stub, reqService1Subgroup, []string{contract1.ContractID, `{"amount": 200, "currency": "USD", "reference": "wire-3"}`, now})
+	test_utils.AssertTrue(t, err == nil, "Expected RecordContractPayment to succeed")
+	_, err = VerifyContractPayment(stub, ownerService1Subgroup, []string{contract1.ContractID, "payment4", now})
+	test_utils.AssertTrue(t, err == nil, "Expected VerifyContractPayment to succeed")
+	_, err = GivePermissionByContract(stub, ownerService1Subgroup, []string{contract1.ContractID, "2", now, "ownerOrgDatatype1"})
+	test_utils.AssertTrue(t, err == nil, "Expected GivePermissionByContract to succeed")
+	mstub.MockTransactionEnd("8")
+
+	mstub.MockTransactionStart("9")
+	stub = cached_stub.NewCachedStub(mstub)
+	datatypeSymKeyPath, err := GetDatatypeKeyPath(stub, reqService1Subgroup, "ownerOrgDatatype1", "ownerService1")
+	test_utils.AssertTrue(t, err == nil, "Expected GetDatatypeKeyPath to succeed")
+	test_utils.AssertTrue(t, len(datatypeSymKeyPath) != 0, "Expected access to datatype key")
+
+	// refund below the payment due moves a downloadable contract back to paymentDone and removes access
+	_, err = RecordContractRefund(stub, ownerService1Subgroup, []string{contract1.ContractID, `{"amount": 500, "currency": "USD", "reference": "refund-2"}`, now})
+	test_utils.AssertTrue(t, err == nil, "Expected RecordContractRefund to succeed")
+	mstub.MockTransactionEnd("9")
+
+	mstub.MockTransactionStart("10")
+	stub = cached_stub.NewCachedStub(mstub)
+	contract, err = GetContractInternal(stub, ownerService1Subgroup, contract1.ContractID)
+	test_utils.AssertTrue(t, err == nil, "Expected GetContractInternal to succeed")
+	test_utils.AssertTrue(t, contract.State == ContractStatePaymentDone, "Expected paymentDone state after refund")
+	test_utils.AssertTrue(t, contract.PaymentVerified == "no", "Expected payment verified flag to be cleared")
+	datatypeSymKeyPath, err = GetDatatypeKeyPath(stub, reqService1Subgroup, "ownerOrgDatatype1", "ownerService1")
+	test_utils.AssertTrue(t, err == nil, "Expected GetDatatypeKeyPath to succeed")
+	test_utils.AssertTrue(t, len(datatypeSymKeyPath) == 0, "Expected no access to datatype key")
+	mstub.MockTransactionEnd("10")
+}
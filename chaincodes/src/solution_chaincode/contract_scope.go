@@ -0,0 +1,101 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"strconv"
+
+	"common/bchcls/utils"
+
+	"github.com/pkg/errors"
+)
+
+// ContractDatatypeScope limits what a contract requester can download for one datatype
+// MaxNumDownload of 0 means only the contract wide MaxNumDownload applies
+// StartTimestamp and EndTimestamp bound the timestamps of records that can be downloaded, 0 means no bound
+// FilterRule optionally restricts records, it is a simple_rule expression like a consent filter rule
+type ContractDatatypeScope struct {
+	DatatypeID     string                 `json:"datatype_id"`
+	MaxNumDownload int                    `json:"max_num_download"`
+	NumDownload    int                    `json:"num_download"`
+	StartTimestamp int64                  `json:"start_timestamp"`
+	EndTimestamp   int64                  `json:"end_timestamp"`
+	FilterRule     map[string]interface{} `json:"filter_rule,omitempty"`
+}
+
+// validateContractDatatypeScopes checks the datatype scopes of a new contract against the owner service
+func validateContractDatatypeScopes(scopes []ContractDatatypeScope, ownerService Service) error {
+	seen := []string{}
+	for _, scope := range scopes {
+		if utils.IsStringEmpty(scope.DatatypeID) {
+			return errors.New("Contract datatype scope must have a datatype")
+		}
+
+		if utils.InList(seen, scope.DatatypeID) {
+			return errors.New("Contract datatype scope is repeated for datatype " + scope.DatatypeID)
+		}
+		seen = append(seen, scope.DatatypeID)
+
+		if !ownerService.hasDatatype(scope.DatatypeID) {
+			return errors.New("Owner service does not contain datatype " + scope.DatatypeID)
+		}
+
+		if scope.MaxNumDownload < 0 {
+			return errors.New("Invalid max num download for datatype " + scope.DatatypeID + ": " + strconv.Itoa(scope.MaxNumDownload))
+		}
+
+		if scope.StartTimestamp < 0 || scope.EndTimestamp < 0 || (scope.EndTimestamp > 0 && scope.EndTimestamp < scope.StartTimestamp) {
+			return errors.New("Invalid time range for datatype " + scope.DatatypeID)
+		}
+
+		err := validateDataFilterRule(scope.FilterRule)
+		if err != nil {
+			return errors.Wrap(err, "Invalid filter rule for datatype "+scope.DatatypeID)
+		}
+	}
+
+	return nil
+}
+
+// findDatatypeScope returns the scope of a datatype, or nil if the contract does not declare one
+func (contract *Contract) findDatatypeScope(datatypeID string) *ContractDatatypeScope {
+	for i := range contract.Datatypes {
+		if contract.Datatypes[i].DatatypeID == datatypeID {
+			return &contract.Datatypes[i]
+		}
+	}
+
+	return nil
+}
+
+// coversDatatype returns true if the contract allows downloading the datatype
+// Contracts without datatype scopes cover every datatype of the owner service
+func (contract *Contract) coversDatatype(datatypeID string) bool {
+	return len(contract.Datatypes) == 0 || contract.findDatatypeScope(datatypeID) != nil
+}
+
+// quotaReached returns true if the datatype's own download quota is used up
+func (scope *ContractDatatypeScope) quotaReached() bool {
+	return scope.MaxNumDownload > 0 && scope.NumDownload >= scope.MaxNumDownload
+}
+
+// narrowTimeRange returns the requested time range narrowed to the scope's time range
+// endTimestamp of 0 means no upper bound
+func (scope *ContractDatatypeScope) narrowTimeRange(startTimestamp int64, endTimestamp int64) (int64, int64) {
+	if scope.StartTimestamp > startTimestamp {
+		startTimestamp = scope.StartTimestamp
+	}
+
+	if scope.EndTimestamp > 0 && (endTimestamp <= 0 || endTimestamp > scope.EndTimestamp) {
+		endTimestamp = scope.EndTimestamp
+	}
+
+	return startTimestamp, endTimestamp
+}
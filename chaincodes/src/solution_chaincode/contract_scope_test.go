@@ -0,0 +1,152 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"common/bchcls/cached_stub"
+	"common/bchcls/crypto"
+	"common/bchcls/simple_rule"
+	"common/bchcls/test_utils"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestContractDatatypeScopes(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestContractDatatypeScopes function called")
+
+	mstub := SetupIndexesAndGetStub(t)
+	ownerService1Subgroup, reqService1Subgroup := SetupContractServicesTest(t, mstub, "no")
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	// scope datatype must belong to owner service
+	mstub.MockTransactionStart("1")
+	stub := cached_stub.NewCachedStub(mstub)
+	contract1 := GenerateContractTest("contract1", "ownerOrg1", "ownerService1", "requesterOrg1", "reqService1")
+	contract1.Datatypes = []ContractDatatypeScope{{DatatypeID: "reqOrgDatatype1", MaxNumDownload: 1}}
+	contract1Bytes, _ := json.Marshal(&contract1)
+	contractKeyB64 := crypto.EncodeToB64String(test_utils.GenerateSymKey())
+	_, err := CreateContract(stub, reqService1Subgroup, []string{string(contract1Bytes), contractKeyB64})
+	test_utils.AssertTrue(t, err != nil, "Expected CreateContract to fail")
+	mstub.MockTransactionEnd("1")
+
+	// one download of tagged records only
+	mstub.MockTransactionStart("2")
+	stub = cached_stub.NewCachedStub(mstub)
+	contract1.Datatypes = []ContractDatatypeScope{{DatatypeID: "ownerOrgDatatype1", MaxNumDownload: 1, FilterRule: simple_rule.R("in", "research", simple_rule.R("var", "private_data.tags"))}}
+	contract1Bytes, _ = json.Marshal(&contract1)
+	_, err = CreateContract(stub, reqService1Subgroup, []string{string(contract1Bytes), contractKeyB64})
+	test_utils.AssertTrue(t, err == nil, "Expected CreateContract to succeed")
+	mstub.MockTransactionEnd("2")
+
+	mstub.MockTransactionStart("3")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = AddContractDetail(stub, ownerService1Subgroup, []string{contract1.ContractID, "terms", "{}", now})
+	test_utils.AssertTrue(t, err == nil, "Expected AddContractDetail to succeed")
+	_, err = AddContractDetail(stub, ownerService1Subgroup, []string{contract1.ContractID, "sign", GenerateContractSignTermsTest(t, stub, ownerService1Subgroup, contract1.ContractID), now})
+	test_utils.AssertTrue(t, err == nil, "Expected AddContractDetail to succeed")
+	_, err = AddContractDetail(stub, reqService1Subgroup, []string{contract1.ContractID, "sign", GenerateContractSignTermsTest(t, stub, reqService1Subgroup, contract1.ContractID), now})
+	test_utils.AssertTrue(t, err == nil, "Expected AddContractDetail to succeed")
+	mstub.MockTransactionEnd("3")
+
+	// permission for a datatype outside of contract fails
+	mstub.MockTransactionStart("4")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = GivePermissionByContract(stub, ownerService1Subgroup, []string{contract1.ContractID, "5", now, "reqOrgDatatype1"})
+	test_utils.AssertTrue(t, err != nil, "Expected GivePermissionByContract to fail")
+	mstub.MockTransactionEnd("4")
+
+	mstub.MockTransactionStart("5")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = GivePermissionByContract(stub, ownerService1Subgroup, []string{contract1.ContractID, "5", now, "ownerOrgDatatype1"})
+	test_utils.AssertTrue(t, err == nil, "Expected GivePermissionByContract to succeed")
+	mstub.MockTransactionEnd("5")
+
+	// download of a datatype outside of contract fails
+	mstub.MockTransactionStart("6")
+	stub = cached_stub.NewCachedStub(mstub)
+	args := []string{contract1.ContractID, "reqOrgDatatype1", "false", "0", "0", "1000", now}
+	_, err = DownloadOwnerDataAsRequester(stub, reqService1Subgroup, args)
+	test_utils.AssertTrue(t, err != nil, "Expected DownloadOwnerDataAsRequester to fail")
+	mstub.MockTransactionEnd("6")
+
+	// untagged record is filtered out by datatype scope, and the empty download is not counted
+	mstub.MockTransactionStart("7")
+	stub = cached_stub.NewCachedStub(mstub)
+	args = []string{contract1.ContractID, "ownerOrgDatatype1", "false", "0", "0", "1000", now}
+	downloadBytes, err := DownloadOwnerDataAsRequester(stub, reqService1Subgroup, args)
+	test_utils.AssertTrue(t, err == nil, "Expected DownloadOwnerDataAsRequester to succeed")
+	downloadResult := OwnerDataDownloadResult{}
+	json.Unmarshal(downloadBytes, &downloadResult)
+	test_utils.AssertTrue(t, len(downloadResult.OwnerDatas) == 0, "Expected no owner data")
+	mstub.MockTransactionEnd("7")
+
+	mstub.MockTransactionStart("8")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = AddContractDetailDownload(stub, reqService1Subgroup, []string{contract1.ContractID, downloadResult.EncryptedContract, "ownerOrgDatatype1"})
+	test_utils.AssertTrue(t, err == nil, "Expected AddContractDetailDownload to succeed")
+	mstub.MockTransactionEnd("8")
+
+	mstub.MockTransactionStart("9")
+	stub = cached_stub.NewCachedStub(mstub)
+	contract, err := GetContractInternal(stub, reqService1Subgroup, contract1.ContractID)
+	test_utils.AssertTrue(t, err == nil, "Expected GetContractInternal to succeed")
+	test_utils.AssertTrue(t, contract.Datatypes[0].NumDownload == 0, "Expected no download of datatype")
+	ownerData := GenerateOwnerData("ownerService1", "ownerOrgDatatype1")
+	ownerData.Timestamp = ownerData.Timestamp + 1
+	ownerData.Tags = []string{"research"}
+	ownerDataBytes, _ := json.Marshal(&ownerData)
+	_, err = UploadOwnerData(stub, ownerService1Subgroup, []string{string(ownerDataBytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected UploadOwnerData to succeed")
+	mstub.MockTransactionEnd("9")
+
+	// a newer untagged record is the latest record, but is outside of the scope
+	mstub.MockTransactionStart("9a")
+	stub = cached_stub.NewCachedStub(mstub)
+	untaggedData := GenerateOwnerData("ownerService1", "ownerOrgDatatype1")
+	untaggedData.Timestamp = ownerData.Timestamp + 1
+	untaggedDataBytes, _ := json.Marshal(&untaggedData)
+	_, err = UploadOwnerData(stub, ownerService1Subgroup, []string{string(untaggedDataBytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected UploadOwnerData to succeed")
+	mstub.MockTransactionEnd("9a")
+
+	// latest only download within the scope returns the latest tagged record with its timestamp
+	mstub.MockTransactionStart("10")
+	stub = cached_stub.NewCachedStub(mstub)
+	args = []string{contract1.ContractID, "ownerOrgDatatype1", "true", "0", "0", "1000", now}
+	downloadBytes, err = DownloadOwnerDataAsRequester(stub, reqService1Subgroup, args)
+	test_utils.AssertTrue(t, err == nil, "Expected DownloadOwnerDataAsRequester to succeed")
+	downloadResult = OwnerDataDownloadResult{}
+	json.Unmarshal(downloadBytes, &downloadResult)
+	test_utils.AssertTrue(t, len(downloadResult.OwnerDatas) == 1, "Expected 1 owner data")
+	test_utils.AssertTrue(t, downloadResult.OwnerDatas[0].Timestamp == ownerData.Timestamp, "Expected timestamp of tagged record")
+	mstub.MockTransactionEnd("10")
+
+	mstub.MockTransactionStart("11")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = AddContractDetailDownload(stub, reqService1Subgroup, []string{contract1.ContractID, downloadResult.EncryptedContract, "ownerOrgDatatype1"})
+	test_utils.AssertTrue(t, err == nil, "Expected AddContractDetailDownload to succeed")
+	mstub.MockTransactionEnd("11")
+
+	// datatype quota is used up, even though contract allows more downloads
+	mstub.MockTransactionStart("12")
+	stub = cached_stub.NewCachedStub(mstub)
+	contract, err = GetContractInternal(stub, reqService1Subgroup, contract1.ContractID)
+	test_utils.AssertTrue(t, err == nil, "Expected GetContractInternal to succeed")
+	test_utils.AssertTrue(t, contract.State == ContractStateDownloadReady, "Expected contract to be downloadReady")
+	test_utils.AssertTrue(t, contract.Datatypes[0].NumDownload == 1, "Expected 1 download of datatype")
+	_, err = DownloadOwnerDataAsRequester(stub, reqService1Subgroup, args)
+	test_utils.AssertTrue(t, err != nil, "Expected DownloadOwnerDataAsRequester to fail")
+	mstub.MockTransactionEnd("12")
+}
@@ -0,0 +1,406 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"common/bchcls/asset_mgmt"
+	"common/bchcls/cached_stub"
+	"common/bchcls/custom_errors"
+	"common/bchcls/data_model"
+	"common/bchcls/utils"
+
+	"github.com/pkg/errors"
+)
+
+const maxContractSearchPageSize = 100
+
+// Contract payment statuses, used to filter contract searches
+const (
+	contractPaymentNotRequired = "notRequired"
+	contractPaymentPending     = "pending"
+	contractPaymentPartial     = "partial"
+	contractPaymentVerified    = "verified"
+)
+
+// ContractSearchFilter selects contracts of a service for SearchContracts and SearchContractsSummary
+// Role is the side of the contract the service is on, owner or requester
+// All other fields are optional
+// CounterpartyOrgID is the requester org (or a co-requester org) when searching as owner, and the owner org when searching as requester
+// PaymentStatus is one of notRequired, pending, partial or verified
+// Datatype finds the contracts covering the datatype
+// StartDate and EndDate bound the contract create date, 0 means no bound
+type ContractSearchFilter struct {
+	ServiceID         string        `json:"service_id"`
+	Role              ContractRole  `json:"role"`
+	State             ContractState `json:"state"`
+	CounterpartyOrgID string        `json:"counterparty_org_id"`
+	PaymentStatus     string        `json:"payment_status"`
+	StartDate         int64         `json:"start_date"`
+	EndDate           int64         `json:"end_date"`
+	Datatype          string        `json:"datatype"`
+}
+
+// ContractSearchResult is returned by SearchContracts
+// Bookmark is the last contract returned, pass it to get the next page; empty when there are no more pages
+type ContractSearchResult struct {
+	Contracts []Contract `json:"contracts"`
+	Bookmark  string     `json:"bookmark"`
+}
+
+// ContractStateSummary holds the number of contracts in a state and their total downloads
+type ContractStateSummary struct {
+	State          ContractState `json:"state"`
+	Count          int           `json:"count"`
+	TotalDownloads int           `json:"total_downloads"`
+}
+
+// ContractSearchSummary is returned by SearchContractsSummary
+type ContractSearchSummary struct {
+	Filter         ContractSearchFilter   `json:"filter"`
+	States         []ContractStateSummary `json:"states"`
+	Count          int                    `json:"count"`
+	TotalDownloads int                    `json:"total_downloads"`
+}
+
+// paymentStatus returns the payment status of the contract, based on its payment records
+func (contract Contract) paymentStatus() string {
+	if contract.PaymentRequired != "yes" {
+		return contractPaymentNotRequired
+	}
+
+	// contracts without payment records were verified with the legacy verify action
+	if len(contract.Payments) == 0 {
+		if contract.PaymentVerified == "yes" {
+			return contractPaymentVerified
+		}
+
+		return contractPaymentPending
+	}
+
+	if contract.paymentSettled() {
+		return contractPaymentVerified
+	}
+
+	if contract.paymentBalance() > 0 {
+		return contractPaymentPartial
+	}
+
+	return contractPaymentPending
+}
+
+// totalNumDownload returns the number of downloads by all requesters of the contract
+func (contract Contract) totalNumDownload() int {
+	total := contract.NumDownload
+	for _, requester := range contract.CoRequesters {
+		total = total + requester.NumDownload
+	}
+
+	return total
+}
+
+// validate checks the search filter
+func (filter ContractSearchFilter) validate() error {
+	if utils.IsStringEmpty(filter.ServiceID) {
+		return errors.New("Contract search filter must have a service")
+	}
+
+	if filter.Role != ContractRoleOwner && filter.Role != ContractRoleRequester {
+		return errors.New("Invalid contract search role (must be owner or requester): " + string(filter.Role))
+	}
+
+	if !utils.IsStringEmpty(filter.PaymentStatus) && !utils.InList([]string{contractPaymentNotRequired, contractPaymentPending, contractPaymentPartial, contractPaymentVerified}, filter.PaymentStatus) {
+		return errors.New("Invalid contract search payment status: " + filter.PaymentStatus)
+	}
+
+	if filter.CounterpartyOrgID == contractIndexAny || filter.Datatype == contractIndexAny {
+		return errors.New("Invalid contract search counterparty org or datatype: " + contractIndexAny)
+	}
+
+	if filter.StartDate < 0 || filter.EndDate < 0 || (filter.EndDate > 0 && filter.EndDate < filter.StartDate) {
+		return errors.New("Invalid contract search date range")
+	}
+
+	return nil
+}
+
+// SearchContracts returns a page of contracts of a service matching a search filter
+// Can only be called by service admin or org admin of the service
+// Contracts the caller cannot decrypt are skipped and do not count toward the page size
+// All filters are covered by the contract index, so a page is only short when the caller cannot decrypt some contracts
+// args = [filter, pageSize, bookmark]
+func SearchContracts(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 3 {
+		customErr := &custom_errors.LengthCheckingError{Type: "SearchContracts arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	filter := ContractSearchFilter{}
+	err := json.Unmarshal([]byte(args[0]), &filter)
+	if err != nil {
+		customErr := &custom_errors.UnmarshalError{Type: "ContractSearchFilter"}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	pageSize, err := strconv.Atoi(args[1])
+	if err != nil {
+		logger.Errorf("Error converting pageSize to type int")
+		return nil, errors.Wrap(err, "Error converting pageSize to type int")
+	}
+
+	if pageSize <= 0 || pageSize > maxContractSearchPageSize {
+		logger.Errorf("Invalid page size: %v", pageSize)
+		return nil, errors.New("Page size must be between 1 and " + strconv.Itoa(maxContractSearchPageSize))
+	}
+
+	bookmark := args[2]
+
+	callerObj, err := getContractSearchCaller(stub, caller, filter)
+	if err != nil {
+		logger.Errorf("Failed to get contract search caller: %v", err)
+		return nil, errors.Wrap(err, "Failed to get contract search caller")
+	}
+
+	// ==============================================================
+	// Get a page of contracts, starting at bookmark
+	// ==============================================================
+	contracts, nextBookmark, err := searchContractsInternal(stub, callerObj, filter, pageSize, bookmark)
+	if err != nil {
+		logger.Errorf("Failed to search contracts: %v", err)
+		return nil, errors.Wrap(err, "Failed to search contracts")
+	}
+
+	result := ContractSearchResult{Contracts: contracts, Bookmark: nextBookmark}
+	logger.Infof("found %v contracts of service %v", len(result.Contracts), filter.ServiceID)
+
+	return json.Marshal(&result)
+}
+
+// SearchContractsSummary returns the number of contracts of a service matching a search filter
+// and their total downloads, per contract state
+// Can only be called by service admin or org admin of the service
+// args = [filter]
+func SearchContractsSummary(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 1 {
+		customErr := &custom_errors.LengthCheckingError{Type: "SearchContractsSummary arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	filter := ContractSearchFilter{}
+	err := json.Unmarshal([]byte(args[0]), &filter)
+	if err != nil {
+		customErr := &custom_errors.UnmarshalError{Type: "ContractSearchFilter"}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	callerObj, err := getContractSearchCaller(stub, caller, filter)
+	if err != nil {
+		logger.Errorf("Failed to get contract search caller: %v", err)
+		return nil, errors.Wrap(err, "Failed to get contract search caller")
+	}
+
+	// ==============================================================
+	// Page through matching contracts and sum up per state
+	// ==============================================================
+	summary := ContractSearchSummary{Filter: filter, States: []ContractStateSummary{}}
+	stateIndex := make(map[ContractState]int)
+	bookmark := ""
+	for {
+		contracts, nextBookmark, err := searchContractsInternal(stub, callerObj, filter, maxContractSearchPageSize, bookmark)
+		if err != nil {
+			logger.Errorf("Failed to search contracts: %v", err)
+			return nil, errors.Wrap(err, "Failed to search contracts")
+		}
+
+		for _, contract := range contracts {
+			i, ok := stateIndex[contract.State]
+			if !ok {
+				i = len(summary.States)
+				stateIndex[contract.State] = i
+				summary.States = append(summary.States, ContractStateSummary{State: contract.State})
+			}
+
+			summary.States[i].Count++
+			summary.States[i].TotalDownloads = summary.States[i].TotalDownloads + contract.totalNumDownload()
+			summary.Count++
+			summary.TotalDownloads = summary.TotalDownloads + contract.totalNumDownload()
+		}
+
+		if utils.IsStringEmpty(nextBookmark) {
+			break
+		}
+		bookmark = nextBookmark
+	}
+
+	logger.Infof("summarized %v contracts of service %v", summary.Count, filter.ServiceID)
+
+	return json.Marshal(&summary)
+}
+
+// getContractSearchCaller validates the search filter and returns a caller object acting as the filter's service
+func getContractSearchCaller(stub cached_stub.CachedStubInterface, caller data_model.User, filter ContractSearchFilter) (data_model.User, error) {
+	err := filter.validate()
+	if err != nil {
+		logger.Errorf("Invalid contract search filter: %v", err)
+		return data_model.User{}, errors.Wrap(err, "Invalid contract search filter")
+	}
+
+	service, err := GetServiceInternal(stub, caller, filter.ServiceID, false)
+	if err != nil {
+		customErr := &GetServiceError{Service: filter.ServiceID}
+		logger.Errorf("%v: %v", customErr, err)
+		return data_model.User{}, errors.Wrap(err, customErr.Error())
+	}
+
+	if utils.IsStringEmpty(service.ServiceID) {
+		customErr := &GetServiceError{Service: filter.ServiceID}
+		logger.Errorf(customErr.Error())
+		return data_model.User{}, errors.WithStack(customErr)
+	}
+
+	if !CallerIsAdminOfService(caller, service.ServiceID, service.OrgID) {
+		logger.Errorf("Caller must be admin of service")
+		return data_model.User{}, errors.New("Caller must be admin of service")
+	}
+
+	return GetOwnerCaller(stub, caller, filter.ServiceID)
+}
+
+// searchContractsInternal returns contracts matching filter, ordered by create date, starting after the bookmark contract
+// Returns at most pageSize contracts, or all contracts if pageSize is 0
+// Returns the bookmark of the next page, empty when there are no more contracts
+func searchContractsInternal(stub cached_stub.CachedStubInterface, callerObj data_model.User, filter ContractSearchFilter, pageSize int, bookmark string) ([]Contract, string, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+
+	// counterparty org and datatype are always part of the range, since the index has an entry matching any of them;
+	// state and payment status narrow the index range when given, the create date range is always covered by the index
+	counterpartyOrgID := contractIndexAny
+	if !utils.IsStringEmpty(filter.CounterpartyOrgID) {
+		counterpartyOrgID = filter.CounterpartyOrgID
+	}
+	datatype := contractIndexAny
+	if !utils.IsStringEmpty(filter.Datatype) {
+		datatype = filter.Datatype
+	}
+
+	fieldNames := []string{"service_id", "role", "counterparty_org_id", "datatype"}
+	prefix := []string{filter.ServiceID, string(filter.Role), counterpartyOrgID, datatype}
+	if !utils.IsStringEmpty(string(filter.State)) {
+		fieldNames = append(fieldNames, "state")
+		prefix = append(prefix, string(filter.State))
+	}
+	if !utils.IsStringEmpty(filter.PaymentStatus) {
+		fieldNames = append(fieldNames, "payment_status")
+		prefix = append(prefix, filter.PaymentStatus)
+	}
+	fieldNames = append(fieldNames, "create_date", "contract_id")
+
+	startValues := append([]string{}, prefix...)
+	endValues := append([]string{}, prefix...)
+	if !utils.IsStringEmpty(bookmark) {
+		bookmarkAssetID := asset_mgmt.GetAssetId(ContractAssetNamespace, bookmark)
+		bookmarkAsset, err := asset_mgmt.GetEncryptedAssetData(stub, bookmarkAssetID)
+		if err != nil {
+			customErr := &custom_errors.GetAssetDataError{AssetId: bookmarkAssetID}
+			logger.Errorf("%v: %v", customErr, err)
+			return nil, "", errors.Wrap(err, customErr.Error())
+		}
+
+		bookmarkPublicData := ContractPublicData{}
+		json.Unmarshal(bookmarkAsset.PublicData, &bookmarkPublicData)
+		if bookmarkPublicData.ContractID != bookmark {
+			logger.Errorf("Invalid bookmark: %v", bookmark)
+			return nil, "", errors.New("Invalid bookmark: " + bookmark)
+		}
+
+		createDateStr, err := utils.ConvertToString(bookmarkPublicData.CreateDate)
+		if err != nil {
+			errMsg := "Failed to ConvertToString for bookmark create date"
+			logger.Errorf("%v: %v", errMsg, err)
+			return nil, "", errors.Wrap(err, errMsg)
+		}
+		startValues = append(startValues, createDateStr, bookmark)
+	} else if filter.StartDate > 0 {
+		startDateStr, err := utils.ConvertToString(filter.StartDate)
+		if err != nil {
+			errMsg := "Failed to ConvertToString for startDate"
+			logger.Errorf("%v: %v", errMsg, err)
+			return nil, "", errors.Wrap(err, errMsg)
+		}
+		startValues = append(startValues, startDateStr)
+	}
+
+	if filter.EndDate > 0 {
+		endDateStr, err := utils.ConvertToString(filter.EndDate)
+		if err != nil {
+			errMsg := "Failed to ConvertToString for endDate"
+			logger.Errorf("%v: %v", errMsg, err)
+			return nil, "", errors.Wrap(err, errMsg)
+		}
+		endValues = append(endValues, endDateStr)
+	}
+
+	contracts := []Contract{}
+	matchEntry := func(entryAsset *data_model.Asset) (string, bool) {
+		if data_model.IsEncryptedData(entryAsset.PrivateData) {
+			logger.Warningf("Skipping contract index entry %v, caller does not have access", entryAsset.AssetId)
+			return "", false
+		}
+
+		entry := contractIndexEntry{}
+		json.Unmarshal(entryAsset.PrivateData, &entry)
+		// the index range is compared as strings, so the end date is checked again
+		return entry.ContractID, filter.EndDate <= 0 || entry.CreateDate <= filter.EndDate
+	}
+	collectContract := func(entryAsset *data_model.Asset) (bool, error) {
+		entry := contractIndexEntry{}
+		json.Unmarshal(entryAsset.PrivateData, &entry)
+		contract, err := GetContractInternal(stub, callerObj, entry.ContractID)
+		if err != nil {
+			customErr := &GetContractError{ContractID: entry.ContractID}
+			logger.Errorf("%v: %v", customErr, err)
+			return false, errors.Wrap(err, customErr.Error())
+		}
+
+		if utils.IsStringEmpty(contract.ContractID) {
+			logger.Warningf("Skipping contract %v, caller does not have access", entry.ContractID)
+			return false, nil
+		}
+
+		contracts = append(contracts, contract)
+		return true, nil
+	}
+
+	nextBookmark, err := getAssetPage(stub, callerObj, ContractEntryNamespace, IndexContractEntry, fieldNames, startValues, endValues, true, KeyPathFunc, pageSize, bookmark, matchEntry, collectContract)
+	if err != nil {
+		logger.Errorf("Failed to get page of contracts: %v", err)
+		return nil, "", errors.Wrap(err, "Failed to get page of contracts")
+	}
+
+	return contracts, nextBookmark, nil
+}
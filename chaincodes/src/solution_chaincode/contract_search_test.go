@@ -0,0 +1,199 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"common/bchcls/cached_stub"
+	"common/bchcls/crypto"
+	"common/bchcls/test_utils"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestSearchContracts(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestSearchContracts function called")
+
+	mstub := SetupIndexesAndGetStub(t)
+	ownerService1Subgroup, reqService1Subgroup := SetupContractServicesTest(t, mstub, "no")
+	now := time.Now().Unix()
+
+	// three contracts created four minutes apart, the last one is scoped to a datatype
+	mstub.MockTransactionStart("1")
+	stub := cached_stub.NewCachedStub(mstub)
+	for i := 1; i <= 3; i++ {
+		contract := GenerateContractTest("contract"+strconv.Itoa(i), "ownerOrg1", "ownerService1", "requesterOrg1", "reqService1")
+		contract.CreateDate = now - int64(3-i)*4*60
+		if i == 3 {
+			contract.Datatypes = []ContractDatatypeScope{{DatatypeID: "ownerOrgDatatype1"}}
+		}
+		contractBytes, _ := json.Marshal(&contract)
+		contractKeyB64 := crypto.EncodeToB64String(test_utils.GenerateSymKey())
+		_, err := CreateContract(stub, reqService1Subgroup, []string{string(contractBytes), contractKeyB64})
+		test_utils.AssertTrue(t, err == nil, "Expected CreateContract to succeed")
+	}
+	mstub.MockTransactionEnd("1")
+
+	mstub.MockTransactionStart("2")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err := AddContractDetail(stub, ownerService1Subgroup, []string{"contract1", "terms", "{}", strconv.FormatInt(now, 10)})
+	test_utils.AssertTrue(t, err == nil, "Expected AddContractDetail to succeed")
+	mstub.MockTransactionEnd("2")
+
+	// requester cannot search as owner service
+	mstub.MockTransactionStart("3")
+	stub = cached_stub.NewCachedStub(mstub)
+	filter := ContractSearchFilter{ServiceID: "ownerService1", Role: ContractRoleOwner}
+	filterBytes, _ := json.Marshal(&filter)
+	_, err = SearchContracts(stub, reqService1Subgroup, []string{string(filterBytes), "10", ""})
+	test_utils.AssertTrue(t, err != nil, "Expected SearchContracts to fail")
+	mstub.MockTransactionEnd("3")
+
+	// page through all contracts of owner service
+	mstub.MockTransactionStart("4")
+	stub = cached_stub.NewCachedStub(mstub)
+	resultBytes, err := SearchContracts(stub, ownerService1Subgroup, []string{string(filterBytes), "2", ""})
+	test_utils.AssertTrue(t, err == nil, "Expected SearchContracts to succeed")
+	result := ContractSearchResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, len(result.Contracts) == 2, "Expected 2 contracts")
+	test_utils.AssertTrue(t, result.Contracts[0].ContractID == "contract1", "Expected contracts ordered by create date")
+	test_utils.AssertTrue(t, result.Bookmark == "contract2", "Expected bookmark contract2")
+
+	resultBytes, err = SearchContracts(stub, ownerService1Subgroup, []string{string(filterBytes), "2", result.Bookmark})
+	test_utils.AssertTrue(t, err == nil, "Expected SearchContracts to succeed")
+	result = ContractSearchResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, len(result.Contracts) == 1 && result.Contracts[0].ContractID == "contract3", "Expected contract3")
+	test_utils.AssertTrue(t, result.Bookmark == "", "Expected no more pages")
+	mstub.MockTransactionEnd("4")
+
+	// filters
+	mstub.MockTransactionStart("5")
+	stub = cached_stub.NewCachedStub(mstub)
+	filter = ContractSearchFilter{ServiceID: "reqService1", Role: ContractRoleRequester, State: ContractStateContractReady}
+	filterBytes, _ = json.Marshal(&filter)
+	resultBytes, err = SearchContracts(stub, reqService1Subgroup, []string{string(filterBytes), "10", ""})
+	test_utils.AssertTrue(t, err == nil, "Expected SearchContracts to succeed")
+	result = ContractSearchResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, len(result.Contracts) == 1 && result.Contracts[0].ContractID == "contract1", "Expected contract1 by state")
+
+	filter = ContractSearchFilter{ServiceID: "reqService1", Role: ContractRoleRequester, StartDate: now - 60}
+	filterBytes, _ = json.Marshal(&filter)
+	resultBytes, err = SearchContracts(stub, reqService1Subgroup, []string{string(filterBytes), "10", ""})
+	test_utils.AssertTrue(t, err == nil, "Expected SearchContracts to succeed")
+	result = ContractSearchResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, len(result.Contracts) == 1 && result.Contracts[0].ContractID == "contract3", "Expected contract3 by date")
+
+	filter = ContractSearchFilter{ServiceID: "ownerService1", Role: ContractRoleOwner, CounterpartyOrgID: "requesterOrg2"}
+	filterBytes, _ = json.Marshal(&filter)
+	resultBytes, err = SearchContracts(stub, ownerService1Subgroup, []string{string(filterBytes), "10", ""})
+	test_utils.AssertTrue(t, err == nil, "Expected SearchContracts to succeed")
+	result = ContractSearchResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, len(result.Contracts) == 0, "Expected no contracts with requesterOrg2")
+
+	filter = ContractSearchFilter{ServiceID: "ownerService1", Role: ContractRoleOwner, CounterpartyOrgID: "requesterOrg1", State: ContractStateRequested}
+	filterBytes, _ = json.Marshal(&filter)
+	resultBytes, err = SearchContracts(stub, ownerService1Subgroup, []string{string(filterBytes), "1", ""})
+	test_utils.AssertTrue(t, err == nil, "Expected SearchContracts to succeed")
+	result = ContractSearchResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, len(result.Contracts) == 1 && result.Contracts[0].ContractID == "contract2", "Expected contract2 by counterparty and state")
+	test_utils.AssertTrue(t, result.Bookmark == "contract2", "Expected bookmark contract2")
+
+	// contracts without datatype scopes cover every datatype of the owner service
+	filter = ContractSearchFilter{ServiceID: "reqService1", Role: ContractRoleRequester, Datatype: "ownerOrgDatatype1"}
+	filterBytes, _ = json.Marshal(&filter)
+	resultBytes, err = SearchContracts(stub, reqService1Subgroup, []string{string(filterBytes), "10", ""})
+	test_utils.AssertTrue(t, err == nil, "Expected SearchContracts to succeed")
+	result = ContractSearchResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, len(result.Contracts) == 3, "Expected 3 contracts covering ownerOrgDatatype1")
+
+	filter = ContractSearchFilter{ServiceID: "reqService1", Role: ContractRoleRequester, Datatype: "unknownDatatype"}
+	filterBytes, _ = json.Marshal(&filter)
+	resultBytes, err = SearchContracts(stub, reqService1Subgroup, []string{string(filterBytes), "10", ""})
+	test_utils.AssertTrue(t, err == nil, "Expected SearchContracts to succeed")
+	result = ContractSearchResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, len(result.Contracts) == 0, "Expected no contracts covering unknownDatatype")
+
+	filter = ContractSearchFilter{ServiceID: "reqService1", Role: ContractRoleRequester, Datatype: contractIndexAny}
+	filterBytes, _ = json.Marshal(&filter)
+	_, err = SearchContracts(stub, reqService1Subgroup, []string{string(filterBytes), "10", ""})
+	test_utils.AssertTrue(t, err != nil, "Expected SearchContracts with wildcard datatype to fail")
+
+	filter = ContractSearchFilter{ServiceID: "ownerService1", Role: ContractRoleOwner, PaymentStatus: "unknown"}
+	filterBytes, _ = json.Marshal(&filter)
+	_, err = SearchContracts(stub, ownerService1Subgroup, []string{string(filterBytes), "10", ""})
+	test_utils.AssertTrue(t, err != nil, "Expected SearchContracts to fail")
+	mstub.MockTransactionEnd("5")
+
+	// summary per state
+	mstub.MockTransactionStart("6")
+	stub = cached_stub.NewCachedStub(mstub)
+	filter = ContractSearchFilter{ServiceID: "ownerService1", Role: ContractRoleOwner, PaymentStatus: contractPaymentNotRequired}
+	filterBytes, _ = json.Marshal(&filter)
+	summaryBytes, err := SearchContractsSummary(stub, ownerService1Subgroup, []string{string(filterBytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected SearchContractsSummary to succeed")
+	summary := ContractSearchSummary{}
+	json.Unmarshal(summaryBytes, &summary)
+	test_utils.AssertTrue(t, summary.Count == 3, "Expected 3 contracts")
+	test_utils.AssertTrue(t, len(summary.States) == 2, "Expected 2 states")
+	for _, stateSummary := range summary.States {
+		if stateSummary.State == ContractStateRequested {
+			test_utils.AssertTrue(t, stateSummary.Count == 2, "Expected 2 requested contracts")
+		}
+	}
+	test_utils.AssertTrue(t, summary.TotalDownloads == 0, "Expected no downloads")
+	mstub.MockTransactionEnd("6")
+
+	// datatype removed from owner service, entries of contract2 are dropped when it is saved again
+	mstub.MockTransactionStart("7")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = RemoveDatatypeFromService(stub, ownerService1Subgroup, []string{"ownerService1", "ownerOrgDatatype1"})
+	test_utils.AssertTrue(t, err == nil, "Expected RemoveDatatypeFromService to succeed")
+	mstub.MockTransactionEnd("7")
+
+	mstub.MockTransactionStart("8")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = AddContractDetail(stub, ownerService1Subgroup, []string{"contract2", "terms", "{}", strconv.FormatInt(now, 10)})
+	test_utils.AssertTrue(t, err == nil, "Expected AddContractDetail to succeed")
+	mstub.MockTransactionEnd("8")
+
+	mstub.MockTransactionStart("9")
+	stub = cached_stub.NewCachedStub(mstub)
+	filter = ContractSearchFilter{ServiceID: "reqService1", Role: ContractRoleRequester, Datatype: "ownerOrgDatatype1"}
+	filterBytes, _ = json.Marshal(&filter)
+	resultBytes, err = SearchContracts(stub, reqService1Subgroup, []string{string(filterBytes), "10", ""})
+	test_utils.AssertTrue(t, err == nil, "Expected SearchContracts to succeed")
+	result = ContractSearchResult{}
+	json.Unmarshal(resultBytes, &result)
+	for _, contract := range result.Contracts {
+		test_utils.AssertTrue(t, contract.ContractID != "contract2", "Expected no stale entry of contract2")
+	}
+	test_utils.AssertTrue(t, len(result.Contracts) == 2, "Expected 2 contracts covering ownerOrgDatatype1")
+
+	filter = ContractSearchFilter{ServiceID: "reqService1", Role: ContractRoleRequester}
+	filterBytes, _ = json.Marshal(&filter)
+	resultBytes, err = SearchContracts(stub, reqService1Subgroup, []string{string(filterBytes), "10", ""})
+	test_utils.AssertTrue(t, err == nil, "Expected SearchContracts to succeed")
+	result = ContractSearchResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, len(result.Contracts) == 3, "Expected 3 contracts")
+	mstub.MockTransactionEnd("9")
+}
@@ -0,0 +1,328 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	gocrypto "crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+
+	"common/bchcls/cached_stub"
+	"common/bchcls/custom_errors"
+	"common/bchcls/data_model"
+	"common/bchcls/user_mgmt"
+	"common/bchcls/utils"
+
+	"github.com/pkg/errors"
+)
+
+// ContractSignature is a signature by one party of a contract over the contract signing payload
+// SignerID is the user who signed, ServiceID is the contract service the signer acted for
+// Payload is the exact canonical payload that was signed, so the signature can be verified after terms change
+// Signature is a base64 encoded RSA PKCS #1 v1.5 signature over the SHA-256 hash of Payload
+type ContractSignature struct {
+	SignerID   string       `json:"signer_id"`
+	SignerRole ContractRole `json:"signer_role"`
+	ServiceID  string       `json:"service_id"`
+	Payload    string       `json:"payload"`
+	Signature  string       `json:"signature"`
+}
+
+// ContractSigningParty is a co-requester in the contract signing payload
+type ContractSigningParty struct {
+	OrgID     string `json:"org_id"`
+	ServiceID string `json:"service_id"`
+}
+
+// ContractSigningPayload holds the agreed parts of a contract
+// Its JSON serialization is the canonical form that contract parties sign
+// Download counters are always zero in the payload, since they change after signing
+type ContractSigningPayload struct {
+	ContractID         string                  `json:"contract_id"`
+	OwnerOrgID         string                  `json:"owner_org_id"`
+	OwnerServiceID     string                  `json:"owner_service_id"`
+	RequesterOrgID     string                  `json:"requester_org_id"`
+	RequesterServiceID string                  `json:"requester_service_id"`
+	TermsVersion       int                     `json:"terms_version"`
+	Terms              interface{}             `json:"terms"`
+	PaymentRequired    string                  `json:"payment_required"`
+	PaymentDue         int64                   `json:"payment_due,omitempty"`
+	Currency           string                  `json:"currency,omitempty"`
+	EffectiveDate      int64                   `json:"effective_date"`
+	ExpirationDate     int64                   `json:"expiration_date"`
+	Datatypes          []ContractDatatypeScope `json:"datatypes"`
+	CoRequesters       []ContractSigningParty  `json:"co_requesters,omitempty"`
+}
+
+// ContractSignatureVerification is the result of verifying one contract signature
+// Current is true if the signature is over the contract's current signing payload
+type ContractSignatureVerification struct {
+	SignerID   string       `json:"signer_id"`
+	SignerRole ContractRole `json:"signer_role"`
+	ServiceID  string       `json:"service_id"`
+	SignDate   int64        `json:"sign_date"`
+	Valid      bool         `json:"valid"`
+	Current    bool         `json:"current"`
+	Error      string       `json:"error,omitempty"`
+}
+
+// ContractSignaturesResult is returned by VerifyContractSignatures
+// RequesterSigned is true once every requester service has a valid signature over the current payload
+// PendingServices are the contract services that have not signed the current payload yet
+type ContractSignaturesResult struct {
+	ContractID      string                          `json:"contract_id"`
+	Payload         string                          `json:"payload"`
+	OwnerSigned     bool                            `json:"owner_signed"`
+	RequesterSigned bool                            `json:"requester_signed"`
+	PendingServices []string                        `json:"pending_services"`
+	Signatures      []ContractSignatureVerification `json:"signatures"`
+}
+
+// contractSignRequest is passed as the terms argument of AddContractDetail for the sign action
+type contractSignRequest struct {
+	Signature string `json:"signature"`
+}
+
+// signingPayload returns the canonical payload of the contract that parties sign
+func (contract Contract) signingPayload() ([]byte, error) {
+	payload := ContractSigningPayload{
+		ContractID:         contract.ContractID,
+		OwnerOrgID:         contract.OwnerOrgID,
+		OwnerServiceID:     contract.OwnerServiceID,
+		RequesterOrgID:     contract.RequesterOrgID,
+		RequesterServiceID: contract.RequesterServiceID,
+		TermsVersion:       contract.currentTermsVersion(),
+		Terms:              contract.ContractTerms,
+		PaymentRequired:    contract.PaymentRequired,
+		PaymentDue:         contract.PaymentDue,
+		Currency:           contract.Currency,
+		EffectiveDate:      contract.EffectiveDate,
+		ExpirationDate:     contract.ExpirationDate,
+		Datatypes:          []ContractDatatypeScope{}}
+	for _, scope := range contract.Datatypes {
+		scope.NumDownload = 0
+		payload.Datatypes = append(payload.Datatypes, scope)
+	}
+	for _, requester := range contract.CoRequesters {
+		payload.CoRequesters = append(payload.CoRequesters, ContractSigningParty{OrgID: requester.OrgID, ServiceID: requester.ServiceID})
+	}
+
+	payloadBytes, err := json.Marshal(&payload)
+	if err != nil {
+		customErr := &custom_errors.MarshalError{Type: "ContractSigningPayload"}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	return payloadBytes, nil
+}
+
+// signedServiceID returns the contract service a signature was made for
+// Signatures made before multi-party contracts have no service, and are for the owner or lead requester service
+func (signature ContractSignature) signedServiceID(contract Contract) string {
+	if !utils.IsStringEmpty(signature.ServiceID) {
+		return signature.ServiceID
+	}
+
+	if signature.SignerRole == ContractRoleOwner {
+		return contract.OwnerServiceID
+	}
+
+	return contract.RequesterServiceID
+}
+
+// hasCurrentSignature returns true if the party of the given contract service signed the contract's current signing payload
+// Signatures are verified when they are added, so only the payload is compared here
+func (contract Contract) hasCurrentSignature(serviceID string) bool {
+	payload, err := contract.signingPayload()
+	if err != nil {
+		return false
+	}
+
+	for _, contractDetail := range contract.ContractDetails {
+		signature := contractDetail.Signature
+		if signature != nil && signature.signedServiceID(contract) == serviceID && signature.Payload == string(payload) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allPartiesSigned returns true if the owner and every requester signed the contract's current signing payload
+func (contract Contract) allPartiesSigned() bool {
+	for _, serviceID := range append([]string{contract.OwnerServiceID}, contract.requesterServiceIDs()...) {
+		if !contract.hasCurrentSignature(serviceID) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// verifySignature checks a base64 encoded signature over payload against a public key
+func verifySignature(publicKey *rsa.PublicKey, payload []byte, signatureB64 string) error {
+	if publicKey == nil {
+		return errors.New("Signer does not have a public key")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(signatureB64)
+	if err != nil {
+		return errors.Wrap(err, "Failed to decode signature")
+	}
+
+	hash := sha256.Sum256(payload)
+	err = rsa.VerifyPKCS1v15(publicKey, gocrypto.SHA256, hash[:], signature)
+	if err != nil {
+		return errors.Wrap(err, "Invalid signature")
+	}
+
+	return nil
+}
+
+// newContractSignature parses the sign request of the caller and verifies it over the contract's current signing payload
+// serviceID is the contract service the caller signs for
+func newContractSignature(caller data_model.User, serviceID string, role ContractRole, contract Contract, signRequestStr string) (*ContractSignature, error) {
+	signRequest := contractSignRequest{}
+	err := json.Unmarshal([]byte(signRequestStr), &signRequest)
+	if err != nil {
+		customErr := &custom_errors.UnmarshalError{Type: "signRequest"}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	if utils.IsStringEmpty(signRequest.Signature) {
+		customErr := &custom_errors.LengthCheckingError{Type: "signature"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	payload, err := contract.signingPayload()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get contract signing payload")
+	}
+
+	err = verifySignature(caller.PublicKey, payload, signRequest.Signature)
+	if err != nil {
+		logger.Errorf("Failed to verify contract signature of %v: %v", caller.ID, err)
+		return nil, errors.Wrap(err, "Failed to verify contract signature")
+	}
+
+	return &ContractSignature{SignerID: caller.ID, SignerRole: role, ServiceID: serviceID, Payload: string(payload), Signature: signRequest.Signature}, nil
+}
+
+// GetContractSigningPayload returns the canonical payload of a contract that parties sign
+// args = [contractID]
+func GetContractSigningPayload(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 1 {
+		customErr := &custom_errors.LengthCheckingError{Type: "GetContractSigningPayload arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	contractID := args[0]
+	if utils.IsStringEmpty(contractID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "contractID"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	contract, err := getContractForCaller(stub, caller, contractID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get contract")
+	}
+
+	return contract.signingPayload()
+}
+
+// VerifyContractSignatures verifies all signatures stored in a contract's details against the signers' public keys
+// args = [contractID]
+func VerifyContractSignatures(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 1 {
+		customErr := &custom_errors.LengthCheckingError{Type: "VerifyContractSignatures arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	contractID := args[0]
+	if utils.IsStringEmpty(contractID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "contractID"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	contract, err := getContractForCaller(stub, caller, contractID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get contract")
+	}
+
+	payload, err := contract.signingPayload()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get contract signing payload")
+	}
+
+	result := ContractSignaturesResult{ContractID: contractID, Payload: string(payload), PendingServices: []string{}, Signatures: []ContractSignatureVerification{}}
+	signedServices := []string{}
+	for _, contractDetail := range contract.ContractDetails {
+		// attestations are signed over their own payload, see AttestContractData
+		signature := contractDetail.Signature
+		if signature == nil || contractDetail.ContractDetailType == contractActionAttest {
+			continue
+		}
+
+		verification := ContractSignatureVerification{
+			SignerID:   signature.SignerID,
+			SignerRole: signature.SignerRole,
+			ServiceID:  signature.signedServiceID(contract),
+			SignDate:   contractDetail.CreateDate,
+			Current:    signature.Payload == string(payload)}
+
+		signer, err := user_mgmt.GetUserData(stub, caller, signature.SignerID, false, false)
+		if err != nil || utils.IsStringEmpty(signer.ID) {
+			verification.Error = "Failed to get signer " + signature.SignerID
+		} else {
+			err = verifySignature(signer.PublicKey, []byte(signature.Payload), signature.Signature)
+			if err != nil {
+				verification.Error = err.Error()
+			} else {
+				verification.Valid = true
+			}
+		}
+
+		if verification.Valid && verification.Current {
+			signedServices = append(signedServices, verification.ServiceID)
+		}
+
+		result.Signatures = append(result.Signatures, verification)
+	}
+
+	result.OwnerSigned = utils.InList(signedServices, contract.OwnerServiceID)
+	if !result.OwnerSigned {
+		result.PendingServices = append(result.PendingServices, contract.OwnerServiceID)
+	}
+
+	result.RequesterSigned = true
+	for _, serviceID := range contract.requesterServiceIDs() {
+		if !utils.InList(signedServices, serviceID) {
+			result.RequesterSigned = false
+			result.PendingServices = append(result.PendingServices, serviceID)
+		}
+	}
+
+	return json.Marshal(&result)
+}
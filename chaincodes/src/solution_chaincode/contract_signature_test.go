@@ -0,0 +1,131 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"common/bchcls/cached_stub"
+	"common/bchcls/crypto"
+	"common/bchcls/data_model"
+	"common/bchcls/test_utils"
+	gocrypto "crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// GenerateContractSignTermsTest returns AddContractDetail sign terms with the caller's signature over the contract signing payload
+func GenerateContractSignTermsTest(t *testing.T, stub cached_stub.CachedStubInterface, caller data_model.User, contractID string) string {
+	payload, err := GetContractSigningPayload(stub, caller, []string{contractID})
+	test_utils.AssertTrue(t, err == nil, "Expected GetContractSigningPayload to succeed")
+	return GenerateContractSignRequestTest(t, caller, payload)
+}
+
+// GenerateContractSignRequestTest signs payload with the caller's private key and returns the sign request
+func GenerateContractSignRequestTest(t *testing.T, caller data_model.User, payload []byte) string {
+	hash := sha256.Sum256(payload)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, caller.PrivateKey, gocrypto.SHA256, hash[:])
+	test_utils.AssertTrue(t, err == nil, "Expected SignPKCS1v15 to succeed")
+
+	signTermsBytes, _ := json.Marshal(&contractSignRequest{Signature: base64.StdEncoding.EncodeToString(signature)})
+	return string(signTermsBytes)
+}
+
+func TestContractSignatures(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestContractSignatures function called")
+
+	mstub := SetupIndexesAndGetStub(t)
+	ownerService1Subgroup, reqService1Subgroup := SetupContractServicesTest(t, mstub, "no")
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	mstub.MockTransactionStart("1")
+	stub := cached_stub.NewCachedStub(mstub)
+	contract1 := GenerateContractTest("contract1", "ownerOrg1", "ownerService1", "requesterOrg1", "reqService1")
+	contract1Bytes, _ := json.Marshal(&contract1)
+	contractKeyB64 := crypto.EncodeToB64String(test_utils.GenerateSymKey())
+	_, err := CreateContract(stub, reqService1Subgroup, []string{string(contract1Bytes), contractKeyB64})
+	test_utils.AssertTrue(t, err == nil, "Expected CreateContract to succeed")
+	_, err = AddContractDetail(stub, ownerService1Subgroup, []string{contract1.ContractID, "terms", "{}", now})
+	test_utils.AssertTrue(t, err == nil, "Expected AddContractDetail to succeed")
+	mstub.MockTransactionEnd("1")
+
+	// sign without signature fails
+	mstub.MockTransactionStart("2")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = AddContractDetail(stub, ownerService1Subgroup, []string{contract1.ContractID, "sign", "{}", now})
+	test_utils.AssertTrue(t, err != nil, "Expected AddContractDetail to fail")
+	mstub.MockTransactionEnd("2")
+
+	// signature by another user's key fails
+	mstub.MockTransactionStart("3")
+	stub = cached_stub.NewCachedStub(mstub)
+	signTerms := GenerateContractSignTermsTest(t, stub, reqService1Subgroup, contract1.ContractID)
+	_, err = AddContractDetail(stub, ownerService1Subgroup, []string{contract1.ContractID, "sign", signTerms, now})
+	test_utils.AssertTrue(t, err != nil, "Expected AddContractDetail to fail")
+	mstub.MockTransactionEnd("3")
+
+	// requester cannot sign before owner
+	mstub.MockTransactionStart("4")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = AddContractDetail(stub, reqService1Subgroup, []string{contract1.ContractID, "sign", signTerms, now})
+	test_utils.AssertTrue(t, err != nil, "Expected AddContractDetail to fail")
+	mstub.MockTransactionEnd("4")
+
+	mstub.MockTransactionStart("5")
+	stub = cached_stub.NewCachedStub(mstub)
+	signTerms = GenerateContractSignTermsTest(t, stub, ownerService1Subgroup, contract1.ContractID)
+	_, err = AddContractDetail(stub, ownerService1Subgroup, []string{contract1.ContractID, "sign", signTerms, now})
+	test_utils.AssertTrue(t, err == nil, "Expected AddContractDetail to succeed")
+	mstub.MockTransactionEnd("5")
+
+	mstub.MockTransactionStart("6")
+	stub = cached_stub.NewCachedStub(mstub)
+	resultBytes, err := VerifyContractSignatures(stub, reqService1Subgroup, []string{contract1.ContractID})
+	test_utils.AssertTrue(t, err == nil, "Expected VerifyContractSignatures to succeed")
+	result := ContractSignaturesResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, result.OwnerSigned, "Expected owner signature")
+	test_utils.AssertTrue(t, !result.RequesterSigned, "Expected no requester signature")
+	test_utils.AssertTrue(t, len(result.Signatures) == 1, "Expected 1 signature")
+	mstub.MockTransactionEnd("6")
+
+	mstub.MockTransactionStart("7")
+	stub = cached_stub.NewCachedStub(mstub)
+	signTerms = GenerateContractSignTermsTest(t, stub, reqService1Subgroup, contract1.ContractID)
+	_, err = AddContractDetail(stub, reqService1Subgroup, []string{contract1.ContractID, "sign", signTerms, now})
+	test_utils.AssertTrue(t, err == nil, "Expected AddContractDetail to succeed")
+	mstub.MockTransactionEnd("7")
+
+	mstub.MockTransactionStart("8")
+	stub = cached_stub.NewCachedStub(mstub)
+	resultBytes, err = VerifyContractSignatures(stub, ownerService1Subgroup, []string{contract1.ContractID})
+	test_utils.AssertTrue(t, err == nil, "Expected VerifyContractSignatures to succeed")
+	result = ContractSignaturesResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, result.OwnerSigned && result.RequesterSigned, "Expected both signatures")
+	test_utils.AssertTrue(t, len(result.Signatures) == 2, "Expected 2 signatures")
+	for _, signature := range result.Signatures {
+		test_utils.AssertTrue(t, signature.Valid && signature.Current, "Expected valid current signature")
+	}
+
+	contractBytes, err := GetContract(stub, ownerService1Subgroup, []string{contract1.ContractID})
+	test_utils.AssertTrue(t, err == nil, "Expected GetContract to succeed")
+	contract := Contract{}
+	json.Unmarshal(contractBytes, &contract)
+	test_utils.AssertTrue(t, contract.State == ContractStateContractSigned, "Expected contract to be contractSigned")
+	mstub.MockTransactionEnd("8")
+}
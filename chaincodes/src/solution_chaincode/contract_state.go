@@ -0,0 +1,338 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"common/bchcls/cached_stub"
+	"common/bchcls/custom_errors"
+	"common/bchcls/data_model"
+	"common/bchcls/utils"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// ContractState is the state of a contract
+type ContractState string
+
+// Contract states
+const (
+	ContractStateNew             ContractState = "new"
+	ContractStateRequested       ContractState = "requested"
+	ContractStateContractReady   ContractState = "contractReady"
+	ContractStateContractSigned  ContractState = "contractSigned"
+	ContractStatePaymentDone     ContractState = "paymentDone"
+	ContractStatePaymentVerified ContractState = "paymentVerified"
+	ContractStateDownloadReady   ContractState = "downloadReady"
+	ContractStateDownloadDone    ContractState = "downloadDone"
+	ContractStateSuspended       ContractState = "suspended"
+	ContractStateDisputed        ContractState = "disputed"
+	ContractStateTerminated      ContractState = "terminated"
+	ContractStateExpired         ContractState = "expired"
+)
+
+// ContractRole is the side of a contract a caller acts for
+type ContractRole string
+
+// Contract roles
+const (
+	ContractRoleOwner     ContractRole = "owner"
+	ContractRoleRequester ContractRole = "requester"
+)
+
+// Contract actions
+// All actions except permission, download, expire, suspend, resume, dispute, resolve, refund and attest are passed as contractStatus to AddContractDetail
+// Attest records a requester attestation on an ended contract and is not part of the state machine
+const (
+	contractActionRequest    = "request"
+	contractActionTerms      = "terms"
+	contractActionSign       = "sign"
+	contractActionPayment    = "payment"
+	contractActionVerify     = "verify"
+	contractActionTerminate  = "terminate"
+	contractActionPermission = "permission"
+	contractActionDownload   = "download"
+	contractActionExpire     = "expire"
+	contractActionSuspend    = "suspend"
+	contractActionResume     = "resume"
+	contractActionDispute    = "dispute"
+	contractActionResolve    = "resolve"
+	contractActionRefund     = "refund"
+	contractActionAttest     = "attest"
+)
+
+// contractDetailActions are the actions that can be taken with AddContractDetail
+var contractDetailActions = []string{
+	contractActionRequest,
+	contractActionTerms,
+	contractActionSign,
+	contractActionPayment,
+	contractActionVerify,
+	contractActionTerminate,
+}
+
+// Contract transition guards
+const (
+	contractGuardPaymentRequired      = "paymentRequired"
+	contractGuardPaymentNotRequired   = "paymentNotRequired"
+	contractGuardDownloadLimitReached = "downloadLimitReached"
+	contractGuardHasExpirationDate    = "hasExpirationDate"
+	contractGuardOwnerSignedTerms     = "ownerSignedTerms"
+	contractGuardAllPartiesSigned     = "allPartiesSigned"
+	contractGuardPaymentSettled       = "paymentSettled"
+)
+
+// contractGuards maps a guard name to the check it performs on a contract
+var contractGuards = map[string]func(contract Contract) bool{
+	contractGuardPaymentRequired: func(contract Contract) bool {
+		return contract.PaymentRequired == "yes"
+	},
+	contractGuardPaymentNotRequired: func(contract Contract) bool {
+		return contract.PaymentRequired == "no"
+	},
+	contractGuardDownloadLimitReached: func(contract Contract) bool {
+		return contract.allRequestersLimitReached()
+	},
+	contractGuardHasExpirationDate: func(contract Contract) bool {
+		return contract.ExpirationDate > 0
+	},
+	contractGuardOwnerSignedTerms: func(contract Contract) bool {
+		return contract.hasCurrentSignature(contract.OwnerServiceID)
+	},
+	contractGuardAllPartiesSigned: func(contract Contract) bool {
+		return contract.allPartiesSigned()
+	},
+	contractGuardPaymentSettled: func(contract Contract) bool {
+		return contract.paymentSettled()
+	},
+}
+
+// ContractTransition is a single allowed move of the contract state machine
+// Guard is the name of an extra condition on the contract, empty if there is none
+// To is empty for transitions that return a held contract to its ResumeState
+// UpdatesTerms is true if the action replaces the contract terms
+type ContractTransition struct {
+	Action       string          `json:"action"`
+	Role         ContractRole    `json:"role"`
+	From         []ContractState `json:"from"`
+	To           ContractState   `json:"to"`
+	Guard        string          `json:"guard,omitempty"`
+	UpdatesTerms bool            `json:"updates_terms"`
+}
+
+// suspendableContractStates are all states a contract can be suspended or disputed from
+var suspendableContractStates = []ContractState{
+	ContractStateNew,
+	ContractStateRequested,
+	ContractStateContractReady,
+	ContractStateContractSigned,
+	ContractStatePaymentDone,
+	ContractStatePaymentVerified,
+	ContractStateDownloadReady,
+	ContractStateDownloadDone,
+}
+
+// activeContractStates are all states a contract can be terminated or expired from
+var activeContractStates = append(append([]ContractState{}, suspendableContractStates...), ContractStateSuspended, ContractStateDisputed)
+
+// contractTransitions is the contract state machine
+// Every state other than terminated and expired must have at least one way out
+// Expire is only taken by ExpireContracts, once the expiration date has passed
+// The owner signs first without changing state; requesters can only sign terms the owner signed
+// The contract is signed once every party signed, so the first allowed transition for an action is taken
+// Verified payments net of refunds decide between paymentDone and paymentVerified, so a partial payment keeps paymentDone
+// A refund that leaves a downloadable contract below the payment due moves it back to paymentDone
+// Suspended and disputed contracts are held: nothing but resume, resolve, terminate or expire is allowed,
+// so downloads are blocked until the contract returns to the state it was held from
+var contractTransitions = []ContractTransition{
+	{Action: contractActionRequest, Role: ContractRoleRequester, From: []ContractState{ContractStateNew, ContractStateRequested}, To: ContractStateRequested, UpdatesTerms: true},
+	{Action: contractActionRequest, Role: ContractRoleOwner, From: []ContractState{ContractStateNew, ContractStateRequested}, To: ContractStateContractReady, UpdatesTerms: true},
+	{Action: contractActionTerms, Role: ContractRoleRequester, From: []ContractState{ContractStateRequested, ContractStateContractReady}, To: ContractStateRequested, UpdatesTerms: true},
+	{Action: contractActionTerms, Role: ContractRoleOwner, From: []ContractState{ContractStateRequested, ContractStateContractReady}, To: ContractStateContractReady, UpdatesTerms: true},
+	{Action: contractActionSign, Role: ContractRoleOwner, From: []ContractState{ContractStateContractReady}, To: ContractStateContractReady},
+	{Action: contractActionSign, Role: ContractRoleRequester, From: []ContractState{ContractStateContractReady}, To: ContractStateContractSigned, Guard: contractGuardAllPartiesSigned},
+	{Action: contractActionSign, Role: ContractRoleRequester, From: []ContractState{ContractStateContractReady}, To: ContractStateContractReady, Guard: contractGuardOwnerSignedTerms},
+	{Action: contractActionPayment, Role: ContractRoleRequester, From: []ContractState{ContractStateContractSigned, ContractStatePaymentDone}, To: ContractStatePaymentDone, Guard: contractGuardPaymentRequired},
+	{Action: contractActionVerify, Role: ContractRoleOwner, From: []ContractState{ContractStateContractSigned, ContractStatePaymentDone}, To: ContractStatePaymentVerified, Guard: contractGuardPaymentSettled},
+	{Action: contractActionVerify, Role: ContractRoleOwner, From: []ContractState{ContractStateContractSigned, ContractStatePaymentDone}, To: ContractStatePaymentDone, Guard: contractGuardPaymentRequired},
+	{Action: contractActionRefund, Role: ContractRoleOwner, From: []ContractState{ContractStatePaymentDone, ContractStatePaymentVerified}, To: ContractStatePaymentVerified, Guard: contractGuardPaymentSettled},
+	{Action: contractActionRefund, Role: ContractRoleOwner, From: []ContractState{ContractStatePaymentDone, ContractStatePaymentVerified}, To: ContractStatePaymentDone, Guard: contractGuardPaymentRequired},
+	{Action: contractActionRefund, Role: ContractRoleOwner, From: []ContractState{ContractStateDownloadReady}, To: ContractStateDownloadReady, Guard: contractGuardPaymentSettled},
+	{Action: contractActionRefund, Role: ContractRoleOwner, From: []ContractState{ContractStateDownloadDone}, To: ContractStateDownloadDone, Guard: contractGuardPaymentSettled},
+	{Action: contractActionRefund, Role: ContractRoleOwner, From: []ContractState{ContractStateDownloadReady, ContractStateDownloadDone}, To: ContractStatePaymentDone, Guard: contractGuardPaymentRequired},
+	{Action: contractActionPermission, Role: ContractRoleOwner, From: []ContractState{ContractStateContractSigned}, To: ContractStateDownloadReady, Guard: contractGuardPaymentNotRequired},
+	{Action: contractActionPermission, Role: ContractRoleOwner, From: []ContractState{ContractStatePaymentVerified}, To: ContractStateDownloadReady, Guard: contractGuardPaymentRequired},
+	{Action: contractActionPermission, Role: ContractRoleOwner, From: []ContractState{ContractStateDownloadReady, ContractStateDownloadDone}, To: ContractStateDownloadReady},
+	{Action: contractActionDownload, Role: ContractRoleRequester, From: []ContractState{ContractStateDownloadReady}, To: ContractStateDownloadDone, Guard: contractGuardDownloadLimitReached},
+	{Action: contractActionSuspend, Role: ContractRoleOwner, From: suspendableContractStates, To: ContractStateSuspended},
+	{Action: contractActionResume, Role: ContractRoleOwner, From: []ContractState{ContractStateSuspended}},
+	{Action: contractActionDispute, Role: ContractRoleRequester, From: append(append([]ContractState{}, suspendableContractStates...), ContractStateSuspended), To: ContractStateDisputed},
+	{Action: contractActionDispute, Role: ContractRoleOwner, From: append(append([]ContractState{}, suspendableContractStates...), ContractStateSuspended), To: ContractStateDisputed},
+	{Action: contractActionResolve, Role: ContractRoleOwner, From: []ContractState{ContractStateDisputed}},
+	{Action: contractActionTerminate, Role: ContractRoleRequester, From: activeContractStates, To: ContractStateTerminated},
+	{Action: contractActionTerminate, Role: ContractRoleOwner, From: activeContractStates, To: ContractStateTerminated},
+	{Action: contractActionExpire, Role: ContractRoleRequester, From: activeContractStates, To: ContractStateExpired, Guard: contractGuardHasExpirationDate},
+	{Action: contractActionExpire, Role: ContractRoleOwner, From: activeContractStates, To: ContractStateExpired, Guard: contractGuardHasExpirationDate},
+}
+
+// ContractTransitionsResult is returned by GetContractTransitions
+type ContractTransitionsResult struct {
+	ContractID  string               `json:"contract_id"`
+	State       ContractState        `json:"state"`
+	Role        ContractRole         `json:"role"`
+	Transitions []ContractTransition `json:"transitions"`
+}
+
+// allows returns true if the transition can be taken by role from the contract's current state
+func (transition ContractTransition) allows(contract Contract, role ContractRole) bool {
+	if transition.Role != role {
+		return false
+	}
+
+	fromOK := false
+	for _, state := range transition.From {
+		if state == contract.State {
+			fromOK = true
+			break
+		}
+	}
+
+	if !fromOK {
+		return false
+	}
+
+	if !utils.IsStringEmpty(transition.Guard) {
+		guard, ok := contractGuards[transition.Guard]
+		if !ok || !guard(contract) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// nextState returns the state the contract moves to with the transition
+// Transitions without a To state return the contract to the state it was held from
+func (transition ContractTransition) nextState(contract Contract) ContractState {
+	if utils.IsStringEmpty(transition.To.String()) {
+		return contract.ResumeState
+	}
+
+	return transition.To
+}
+
+// findContractTransition returns the transition for action taken by role from the contract's current state
+// Returns an error if the action is not allowed
+func findContractTransition(contract Contract, action string, role ContractRole) (ContractTransition, error) {
+	for _, transition := range contractTransitions {
+		if transition.Action == action && transition.allows(contract, role) {
+			return transition, nil
+		}
+	}
+
+	errMsg := "Action " + action + " is not allowed for contract " + role.String() + " when contract state is " + contract.State.String()
+	logger.Errorf(errMsg)
+	return ContractTransition{}, errors.New(errMsg)
+}
+
+// getAvailableContractTransitions returns the transitions role can take from the contract's current state
+func getAvailableContractTransitions(contract Contract, role ContractRole) []ContractTransition {
+	transitions := []ContractTransition{}
+	for _, transition := range contractTransitions {
+		if transition.allows(contract, role) {
+			transitions = append(transitions, transition)
+		}
+	}
+
+	return transitions
+}
+
+// getContractCallerRole returns the side of the contract the caller acts for
+// A caller who is admin of both the owner and a requester service acts as owner; every contract action resolves
+// the caller's role here, see getContractCaller
+// Returns false if caller is admin of neither the owner nor any requester service
+func getContractCallerRole(caller data_model.User, contract Contract) (ContractRole, bool) {
+	if CallerIsAdminOfService(caller, contract.OwnerServiceID, contract.OwnerOrgID) {
+		return ContractRoleOwner, true
+	}
+
+	if _, ok := getContractRequesterService(caller, contract); ok {
+		return ContractRoleRequester, true
+	}
+
+	return "", false
+}
+
+// String returns the contract state as a string
+func (state ContractState) String() string {
+	return string(state)
+}
+
+// isFinal returns true if no action can be taken on a contract in this state
+func (state ContractState) isFinal() bool {
+	return state == ContractStateTerminated || state == ContractStateExpired
+}
+
+// hasDataAccess returns true if requesters hold access to owner data keys in this state, see GivePermissionByContract
+func (state ContractState) hasDataAccess() bool {
+	return state == ContractStateDownloadReady || state == ContractStateDownloadDone
+}
+
+// String returns the contract role as a string
+func (role ContractRole) String() string {
+	return string(role)
+}
+
+// GetContractTransitions returns the actions the caller may take next on a contract
+// Can be called by admins of the contract owner or requester service
+// Expire is not returned, since it is only taken by ExpireContracts
+// args = [contractID]
+func GetContractTransitions(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 1 {
+		customErr := &custom_errors.LengthCheckingError{Type: "GetContractTransitions arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.New(customErr.Error())
+	}
+
+	contractID := args[0]
+	if utils.IsStringEmpty(contractID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "contractID"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	contract, err := getContractForCaller(stub, caller, contractID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get contract")
+	}
+
+	role, ok := getContractCallerRole(caller, contract)
+	if !ok {
+		logger.Errorf("Caller must be admin of contract owner or requester service")
+		return nil, errors.New("Caller must be admin of contract owner or requester service")
+	}
+
+	result := ContractTransitionsResult{
+		ContractID:  contract.ContractID,
+		State:       contract.State,
+		Role:        role,
+		Transitions: []ContractTransition{}}
+	for _, transition := range getAvailableContractTransitions(contract, role) {
+		if transition.Action != contractActionExpire {
+			transition.To = transition.nextState(contract)
+			result.Transitions = append(result.Transitions, transition)
+		}
+	}
+
+	return json.Marshal(&result)
+}
@@ -0,0 +1,132 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"common/bchcls/test_utils"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestContractTransitions(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestContractTransitions function called")
+
+	contract := GenerateContractTest("contract1", "org1", "service1", "org2", "service2")
+
+	// every state except terminated can be left by someone
+	for _, state := range activeContractStates {
+		contract.State = state
+		contract.PaymentRequired = "no"
+		available := append(getAvailableContractTransitions(contract, ContractRoleOwner), getAvailableContractTransitions(contract, ContractRoleRequester)...)
+		test_utils.AssertTrue(t, len(available) > 0, "Expected a transition out of "+state.String())
+	}
+
+	contract.State = ContractStateTerminated
+	test_utils.AssertTrue(t, len(getAvailableContractTransitions(contract, ContractRoleOwner)) == 0, "Expected no transition out of terminated")
+	test_utils.AssertTrue(t, len(getAvailableContractTransitions(contract, ContractRoleRequester)) == 0, "Expected no transition out of terminated")
+
+	// request sets the state based on role
+	contract.State = ContractStateNew
+	transition, err := findContractTransition(contract, contractActionRequest, ContractRoleRequester)
+	test_utils.AssertTrue(t, err == nil, "Expected request to be allowed")
+	test_utils.AssertTrue(t, transition.To == ContractStateRequested, "Expected requested state")
+	transition, err = findContractTransition(contract, contractActionRequest, ContractRoleOwner)
+	test_utils.AssertTrue(t, err == nil, "Expected request to be allowed")
+	test_utils.AssertTrue(t, transition.To == ContractStateContractReady, "Expected contractReady state")
+
+	// owner signs first, requester can only sign terms the owner signed
+	contract.State = ContractStateContractReady
+	transition, err = findContractTransition(contract, contractActionSign, ContractRoleOwner)
+	test_utils.AssertTrue(t, err == nil, "Expected owner sign to succeed")
+	test_utils.AssertTrue(t, transition.To == ContractStateContractReady, "Expected contractReady state")
+	_, err = findContractTransition(contract, contractActionSign, ContractRoleRequester)
+	test_utils.AssertTrue(t, err != nil, "Expected requester sign to fail before owner signs")
+	payload, _ := contract.signingPayload()
+	contract.ContractDetails = []ContractDetail{{ContractDetailType: contractActionSign, Signature: &ContractSignature{SignerRole: ContractRoleOwner, Payload: string(payload)}}}
+	transition, err = findContractTransition(contract, contractActionSign, ContractRoleRequester)
+	test_utils.AssertTrue(t, err == nil, "Expected requester sign to succeed")
+	test_utils.AssertTrue(t, transition.UpdatesTerms == false, "Expected sign not to update terms")
+
+	// contract is signed once every requester signed
+	contract.CoRequesters = []ContractRequester{{OrgID: "org3", ServiceID: "service3"}}
+	payload, _ = contract.signingPayload()
+	contract.ContractDetails = []ContractDetail{
+		{ContractDetailType: contractActionSign, Signature: &ContractSignature{SignerRole: ContractRoleOwner, ServiceID: "service1", Payload: string(payload)}},
+		{ContractDetailType: contractActionSign, Signature: &ContractSignature{SignerRole: ContractRoleRequester, ServiceID: "service2", Payload: string(payload)}}}
+	transition, err = findContractTransition(contract, contractActionSign, ContractRoleRequester)
+	test_utils.AssertTrue(t, err == nil, "Expected requester sign to succeed")
+	test_utils.AssertTrue(t, transition.To == ContractStateContractReady, "Expected contractReady state until all requesters sign")
+	contract.ContractDetails = append(contract.ContractDetails, ContractDetail{ContractDetailType: contractActionSign, Signature: &ContractSignature{SignerRole: ContractRoleRequester, ServiceID: "service3", Payload: string(payload)}})
+	transition, err = findContractTransition(contract, contractActionSign, ContractRoleRequester)
+	test_utils.AssertTrue(t, err == nil, "Expected requester sign to succeed")
+	test_utils.AssertTrue(t, transition.To == ContractStateContractSigned, "Expected contractSigned state")
+	contract.ContractTerms = map[string]interface{}{"price": "changed"}
+	_, err = findContractTransition(contract, contractActionSign, ContractRoleRequester)
+	test_utils.AssertTrue(t, err != nil, "Expected requester sign to fail after terms change")
+
+	// payment guard
+	contract.State = ContractStateContractSigned
+	contract.PaymentRequired = "no"
+	_, err = findContractTransition(contract, contractActionPayment, ContractRoleRequester)
+	test_utils.AssertTrue(t, err != nil, "Expected payment to fail when payment is not required")
+	_, err = findContractTransition(contract, contractActionPermission, ContractRoleOwner)
+	test_utils.AssertTrue(t, err == nil, "Expected permission to succeed when payment is not required")
+
+	contract.PaymentRequired = "yes"
+	_, err = findContractTransition(contract, contractActionPermission, ContractRoleOwner)
+	test_utils.AssertTrue(t, err != nil, "Expected permission to fail before payment is verified")
+	transition, err = findContractTransition(contract, contractActionVerify, ContractRoleOwner)
+	test_utils.AssertTrue(t, err == nil, "Expected verify to succeed")
+	test_utils.AssertTrue(t, transition.To == ContractStatePaymentVerified, "Expected paymentVerified state")
+	contract.PaymentDue = 100
+	transition, err = findContractTransition(contract, contractActionVerify, ContractRoleOwner)
+	test_utils.AssertTrue(t, err == nil, "Expected verify to succeed")
+	test_utils.AssertTrue(t, transition.To == ContractStatePaymentDone, "Expected paymentDone state until payment due is covered")
+	contract.PaymentDue = 0
+
+	// download limit guard
+	contract.State = ContractStateDownloadReady
+	contract.MaxNumDownload = 2
+	contract.NumDownload = 1
+	_, err = findContractTransition(contract, contractActionDownload, ContractRoleRequester)
+	test_utils.AssertTrue(t, err != nil, "Expected download to keep downloadReady state")
+	contract.NumDownload = 2
+	_, err = findContractTransition(contract, contractActionDownload, ContractRoleRequester)
+	test_utils.AssertTrue(t, err != nil, "Expected download to keep downloadReady state until every requester is done")
+	contract.CoRequesters[0].NumDownload = 2
+	transition, err = findContractTransition(contract, contractActionDownload, ContractRoleRequester)
+	test_utils.AssertTrue(t, err == nil, "Expected download to succeed")
+	test_utils.AssertTrue(t, transition.To == ContractStateDownloadDone, "Expected downloadDone state")
+
+	// owner can give permission again after downloads are done
+	contract.State = ContractStateDownloadDone
+	actions := []string{}
+	for _, transition := range getAvailableContractTransitions(contract, ContractRoleOwner) {
+		actions = append(actions, transition.Action)
+	}
+	test_utils.AssertTrue(t, len(actions) == 4, "Expected 4 owner actions")
+	test_utils.AssertTrue(t, actions[0] == contractActionPermission, "Expected permission action")
+	test_utils.AssertTrue(t, actions[1] == contractActionSuspend, "Expected suspend action")
+	test_utils.AssertTrue(t, actions[2] == contractActionDispute, "Expected dispute action")
+	test_utils.AssertTrue(t, actions[3] == contractActionTerminate, "Expected terminate action")
+
+	// suspended contract only resumes to the state it was held from
+	contract.State = ContractStateSuspended
+	contract.ResumeState = ContractStateDownloadReady
+	_, err = findContractTransition(contract, contractActionDownload, ContractRoleRequester)
+	test_utils.AssertTrue(t, err != nil, "Expected download to fail when suspended")
+	transition, err = findContractTransition(contract, contractActionResume, ContractRoleOwner)
+	test_utils.AssertTrue(t, err == nil, "Expected resume to succeed")
+	test_utils.AssertTrue(t, transition.nextState(contract) == ContractStateDownloadReady, "Expected downloadReady state")
+	_, err = findContractTransition(contract, contractActionResume, ContractRoleRequester)
+	test_utils.AssertTrue(t, err != nil, "Expected requester resume to fail")
+}
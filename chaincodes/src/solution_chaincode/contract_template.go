@@ -0,0 +1,443 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+
+	"common/bchcls/asset_mgmt"
+	"common/bchcls/cached_stub"
+	"common/bchcls/custom_errors"
+	"common/bchcls/data_model"
+	"common/bchcls/index"
+	"common/bchcls/key_mgmt"
+	"common/bchcls/utils"
+
+	"github.com/pkg/errors"
+)
+
+// contract templates are public, like service terms, and are saved as assets of the service publishing them
+const IndexContractTemplate = "ContractTemplateTable"
+const ContractTemplateAssetNamespace = "ContractTemplateAsset"
+
+// Contract template statuses, only active templates can be instantiated
+const (
+	contractTemplateActive   = "active"
+	contractTemplateInactive = "inactive"
+)
+
+// Contract template pricing models
+const (
+	contractPricingFree  = "free"
+	contractPricingFixed = "fixed"
+)
+
+// ContractTemplate is published by an owner service and instantiated by requesters to create contracts
+// Datatypes are the datatypes offered, with their default download quotas; if empty, every datatype of the service is offered
+// ValidityPeriod is in seconds from the contract effective date, 0 means contracts do not expire
+// Version is increased each time the template is updated; contracts keep the values of the version they were created from
+type ContractTemplate struct {
+	TemplateID     string                  `json:"template_id"`
+	ServiceID      string                  `json:"service_id"`
+	OrgID          string                  `json:"org_id"`
+	Name           string                  `json:"name"`
+	Terms          interface{}             `json:"terms"`
+	Datatypes      []ContractDatatypeScope `json:"datatypes"`
+	PricingModel   string                  `json:"pricing_model"`
+	Price          int64                   `json:"price"`
+	Currency       string                  `json:"currency"`
+	ValidityPeriod int64                   `json:"validity_period"`
+	Status         string                  `json:"status"`
+	Version        int                     `json:"version"`
+	CreateDate     int64                   `json:"create_date"`
+	UpdateDate     int64                   `json:"update_date"`
+	UpdatedBy      string                  `json:"updated_by"`
+}
+
+// contractTemplatePublicData is the public data of a template asset
+// TemplateKey identifies the template among the templates of every service
+type contractTemplatePublicData struct {
+	ContractTemplate
+	TemplateKey string `json:"template_key"`
+}
+
+// validate checks the fields of a template against the service publishing it
+func (template ContractTemplate) validate(service Service) error {
+	if utils.IsStringEmpty(template.TemplateID) {
+		return errors.New("Contract template must have a template ID")
+	}
+
+	if template.Status != contractTemplateActive && template.Status != contractTemplateInactive {
+		return errors.New("Invalid contract template status (must be active or inactive): " + template.Status)
+	}
+
+	err := validateContractDatatypeScopes(template.Datatypes, service)
+	if err != nil {
+		return errors.Wrap(err, "Invalid contract template datatypes")
+	}
+
+	for _, scope := range template.Datatypes {
+		if scope.NumDownload != 0 {
+			return errors.New("Contract template cannot have downloads for datatype " + scope.DatatypeID)
+		}
+	}
+
+	switch template.PricingModel {
+	case contractPricingFree:
+		if template.Price != 0 {
+			return errors.New("Free contract template cannot have a price")
+		}
+	case contractPricingFixed:
+		if template.Price <= 0 || utils.IsStringEmpty(template.Currency) {
+			return errors.New("Fixed price contract template must have a positive price and a currency")
+		}
+	default:
+		return errors.New("Invalid contract template pricing model (must be free or fixed): " + template.PricingModel)
+	}
+
+	if template.ValidityPeriod < 0 {
+		return errors.New("Invalid contract template validity period: " + strconv.FormatInt(template.ValidityPeriod, 10))
+	}
+
+	return nil
+}
+
+// instantiate copies the template into a new contract
+// Payment is required for fixed price templates, and not for free templates
+// Requested datatypes must be offered by the template and cannot exceed its download quotas; if none are requested,
+// every datatype offered by the template is used
+func (template ContractTemplate) instantiate(contract *Contract) error {
+	if template.Status != contractTemplateActive {
+		return errors.New("Contract template " + template.TemplateID + " is not active")
+	}
+
+	if len(contract.Datatypes) == 0 {
+		contract.Datatypes = append([]ContractDatatypeScope{}, template.Datatypes...)
+	} else if len(template.Datatypes) > 0 {
+		for i, scope := range contract.Datatypes {
+			offered := template.findDatatypeScope(scope.DatatypeID)
+			if offered == nil {
+				return errors.New("Contract template does not offer datatype " + scope.DatatypeID)
+			}
+
+			if offered.MaxNumDownload > 0 && (scope.MaxNumDownload == 0 || scope.MaxNumDownload > offered.MaxNumDownload) {
+				contract.Datatypes[i].MaxNumDownload = offered.MaxNumDownload
+			}
+		}
+	}
+
+	contract.ContractTerms = template.Terms
+	contract.PaymentRequired = "no"
+	if template.PricingModel == contractPricingFixed {
+		contract.PaymentRequired = "yes"
+	}
+	contract.PaymentDue = template.Price
+	contract.Currency = template.Currency
+	if template.ValidityPeriod > 0 {
+		start := contract.EffectiveDate
+		if start == 0 {
+			start = contract.CreateDate
+		}
+		contract.ExpirationDate = start + template.ValidityPeriod
+	}
+	contract.TemplateVersion = template.Version
+
+	return nil
+}
+
+// findDatatypeScope returns the offered scope of a datatype, or nil if the template does not offer it
+func (template ContractTemplate) findDatatypeScope(datatypeID string) *ContractDatatypeScope {
+	for i := range template.Datatypes {
+		if template.Datatypes[i].DatatypeID == datatypeID {
+			return &template.Datatypes[i]
+		}
+	}
+
+	return nil
+}
+
+// PutContractTemplate publishes a new contract template, or a new version of an existing template
+// Can only be called by admins of the template service
+// Contracts already created from the template are not affected
+// args = [template, timestamp]
+func PutContractTemplate(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 2 {
+		customErr := &custom_errors.LengthCheckingError{Type: "PutContractTemplate arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	template := ContractTemplate{}
+	err := json.Unmarshal([]byte(args[0]), &template)
+	if err != nil {
+		customErr := &custom_errors.UnmarshalError{Type: "ContractTemplate"}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	timestamp, err := ParseTimestamp(args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if utils.IsStringEmpty(template.ServiceID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "template.ServiceID"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	service, err := GetServiceInternal(stub, caller, template.ServiceID, false)
+	if err != nil {
+		customErr := &GetServiceError{Service: template.ServiceID}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	if utils.IsStringEmpty(service.ServiceID) {
+		customErr := &GetServiceError{Service: template.ServiceID}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	if !CallerIsAdminOfService(caller, service.ServiceID, service.OrgID) {
+		logger.Errorf("Caller must be admin of service")
+		return nil, errors.New("Caller must be admin of service")
+	}
+
+	if utils.IsStringEmpty(template.Status) {
+		template.Status = contractTemplateActive
+	}
+
+	err = template.validate(service)
+	if err != nil {
+		logger.Errorf("Invalid contract template: %v", err)
+		return nil, errors.Wrap(err, "Invalid contract template")
+	}
+
+	existingTemplate, err := getContractTemplate(stub, caller, template.ServiceID, template.TemplateID)
+	if err != nil {
+		return nil, err
+	}
+
+	// ==============================================================
+	// Save template
+	// ==============================================================
+	template.OrgID = service.OrgID
+	template.Version = existingTemplate.Version + 1
+	template.CreateDate = timestamp
+	if existingTemplate.Version > 0 {
+		template.CreateDate = existingTemplate.CreateDate
+	}
+	template.UpdateDate = timestamp
+	template.UpdatedBy = caller.ID
+	if template.Datatypes == nil {
+		template.Datatypes = []ContractDatatypeScope{}
+	}
+
+	serviceCaller, err := GetOwnerCaller(stub, caller, template.ServiceID)
+	if err != nil {
+		logger.Errorf("Failed to get service caller: %v", err)
+		return nil, errors.Wrap(err, "Failed to get service caller")
+	}
+
+	err = putContractTemplate(stub, serviceCaller, template, existingTemplate.Version > 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// GetContractTemplate returns the current version of a contract template
+// Templates are public and can be read by any caller
+// args = [serviceID, templateID]
+func GetContractTemplate(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 2 {
+		customErr := &custom_errors.LengthCheckingError{Type: "GetContractTemplate arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	template, err := getContractTemplate(stub, caller, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if template.Version == 0 {
+		logger.Errorf("Contract template %v of service %v not found", args[1], args[0])
+		return nil, errors.New("Contract template " + args[1] + " of service " + args[0] + " not found")
+	}
+
+	return json.Marshal(&template)
+}
+
+// GetContractTemplates returns the contract templates of a service, including inactive ones
+// Templates are public and can be read by any caller
+// args = [serviceID]
+func GetContractTemplates(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 1 {
+		customErr := &custom_errors.LengthCheckingError{Type: "GetContractTemplates arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	serviceID := args[0]
+	if utils.IsStringEmpty(serviceID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "serviceID"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	iter, err := asset_mgmt.GetAssetManager(stub, caller).GetAssetIter(ContractTemplateAssetNamespace, IndexContractTemplate, []string{"service_id", "template_id"}, []string{serviceID}, []string{serviceID}, false, false, OMRServiceAssetKeyPathFunc, "", -1, nil)
+	if err != nil {
+		logger.Errorf("Failed to get contract templates: %v", err)
+		return nil, errors.Wrap(err, "Failed to get contract templates")
+	}
+
+	defer iter.Close()
+	templates := []ContractTemplate{}
+	for iter.HasNext() {
+		templateAsset, err := iter.Next()
+		if err != nil {
+			customErr := &custom_errors.IterError{}
+			logger.Errorf("%v: %v", customErr, err)
+			return nil, errors.Wrap(err, customErr.Error())
+		}
+
+		template, err := convertContractTemplateFromAsset(templateAsset)
+		if err != nil {
+			return nil, err
+		}
+
+		templates = append(templates, template)
+	}
+
+	return json.Marshal(&templates)
+}
+
+// getContractTemplate returns a contract template, or an empty template with version 0 if it does not exist
+func getContractTemplate(stub cached_stub.CachedStubInterface, caller data_model.User, serviceID string, templateID string) (ContractTemplate, error) {
+	templateAssetID := asset_mgmt.GetAssetId(ContractTemplateAssetNamespace, getContractTemplateKey(serviceID, templateID))
+	templateAsset, err := asset_mgmt.GetAssetManager(stub, caller).GetAsset(templateAssetID, data_model.Key{})
+	if err != nil {
+		customErr := &custom_errors.GetAssetDataError{AssetId: templateAssetID}
+		logger.Errorf("%v: %v", customErr, err)
+		return ContractTemplate{}, errors.Wrap(err, customErr.Error())
+	}
+
+	if utils.IsStringEmpty(templateAsset.AssetId) {
+		return ContractTemplate{}, nil
+	}
+
+	return convertContractTemplateFromAsset(templateAsset)
+}
+
+// putContractTemplate saves a template asset, encrypted with the sym key of the service publishing it
+// serviceCaller must be the service itself
+func putContractTemplate(stub cached_stub.CachedStubInterface, serviceCaller data_model.User, template ContractTemplate, exists bool) error {
+	templateAsset, err := convertContractTemplateToAsset(template)
+	if err != nil {
+		customErr := &ConvertToAssetError{Asset: "templateAsset"}
+		logger.Errorf("%v: %v", customErr, err)
+		return errors.Wrap(err, customErr.Error())
+	}
+
+	templateAssetKey := data_model.Key{ID: serviceCaller.GetSymKeyId(), Type: key_mgmt.KEY_TYPE_SYM, KeyBytes: serviceCaller.SymKey}
+	templateAsset.AssetKeyId = templateAssetKey.ID
+
+	assetManager := asset_mgmt.GetAssetManager(stub, serviceCaller)
+	if exists {
+		err = assetManager.UpdateAsset(templateAsset, templateAssetKey, true)
+	} else {
+		err = assetManager.AddAsset(templateAsset, templateAssetKey, false)
+	}
+	if err != nil {
+		customErr := &PutAssetError{Asset: templateAsset.AssetId}
+		logger.Errorf("%v: %v", customErr, err)
+		return errors.Wrap(err, customErr.Error())
+	}
+
+	return nil
+}
+
+// getContractTemplateKey returns the key identifying a template of a service
+func getContractTemplateKey(serviceID string, templateID string) string {
+	templateKeyHash := sha256.Sum256([]byte(serviceID + "\x00" + templateID))
+	return hex.EncodeToString(templateKeyHash[:])
+}
+
+func convertContractTemplateToAsset(template ContractTemplate) (data_model.Asset, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+
+	publicData := contractTemplatePublicData{ContractTemplate: template, TemplateKey: getContractTemplateKey(template.ServiceID, template.TemplateID)}
+	publicBytes, err := json.Marshal(&publicData)
+	if err != nil {
+		customErr := &custom_errors.MarshalError{Type: "ContractTemplate"}
+		logger.Errorf("%v: %v", customErr, err)
+		return data_model.Asset{}, errors.Wrap(err, customErr.Error())
+	}
+
+	asset := data_model.Asset{}
+	asset.AssetId = asset_mgmt.GetAssetId(ContractTemplateAssetNamespace, publicData.TemplateKey)
+	asset.Datatypes = []string{}
+	metaData := make(map[string]string)
+	metaData["namespace"] = ContractTemplateAssetNamespace
+	asset.Metadata = metaData
+	asset.PublicData = publicBytes
+	asset.PrivateData = []byte("{}")
+	asset.OwnerIds = []string{template.ServiceID}
+	asset.IndexTableName = IndexContractTemplate
+
+	return asset, nil
+}
+
+func convertContractTemplateFromAsset(asset *data_model.Asset) (ContractTemplate, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+
+	publicData := contractTemplatePublicData{}
+	err := json.Unmarshal(asset.PublicData, &publicData)
+	if err != nil {
+		customErr := &custom_errors.UnmarshalError{Type: "ContractTemplate"}
+		logger.Errorf("%v: %v", customErr, err)
+		return ContractTemplate{}, errors.Wrap(err, customErr.Error())
+	}
+
+	return publicData.ContractTemplate, nil
+}
+
+// SetupContractTemplateIndex sets up the index of contract templates
+func SetupContractTemplateIndex(stub cached_stub.CachedStubInterface) error {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+
+	templateTable := index.GetTable(stub, IndexContractTemplate, "template_key")
+	templateTable.AddIndex([]string{"service_id", "template_id"}, false)
+	templateTable.AddIndex([]string{"service_id", "status", "template_id"}, false)
+	err := templateTable.SaveToLedger()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
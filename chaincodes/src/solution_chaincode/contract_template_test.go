@@ -0,0 +1,124 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"common/bchcls/cached_stub"
+	"common/bchcls/crypto"
+	"common/bchcls/test_utils"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestContractTemplates(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestContractTemplates function called")
+
+	mstub := SetupIndexesAndGetStub(t)
+	ownerService1Subgroup, reqService1Subgroup := SetupContractServicesTest(t, mstub, "no")
+	now := time.Now().Unix()
+	nowStr := strconv.FormatInt(now, 10)
+
+	// only owner service admins can publish templates
+	mstub.MockTransactionStart("1")
+	stub := cached_stub.NewCachedStub(mstub)
+	template := ContractTemplate{
+		TemplateID:     "research",
+		ServiceID:      "ownerService1",
+		Name:           "Research access",
+		Terms:          map[string]interface{}{"purpose": "research"},
+		Datatypes:      []ContractDatatypeScope{{DatatypeID: "ownerOrgDatatype1", MaxNumDownload: 5}},
+		PricingModel:   contractPricingFree,
+		ValidityPeriod: 3600}
+	templateBytes, _ := json.Marshal(&template)
+	_, err := PutContractTemplate(stub, reqService1Subgroup, []string{string(templateBytes), nowStr})
+	test_utils.AssertTrue(t, err != nil, "Expected PutContractTemplate to fail")
+	_, err = PutContractTemplate(stub, ownerService1Subgroup, []string{string(templateBytes), nowStr})
+	test_utils.AssertTrue(t, err == nil, "Expected PutContractTemplate to succeed")
+	mstub.MockTransactionEnd("1")
+
+	// requester instantiates the template
+	mstub.MockTransactionStart("2")
+	stub = cached_stub.NewCachedStub(mstub)
+	contract1 := GenerateContractTest("contract1", "ownerOrg1", "ownerService1", "requesterOrg1", "reqService1")
+	contract1.TemplateID = "research"
+	contract1.Datatypes = []ContractDatatypeScope{{DatatypeID: "ownerOrgDatatype1", MaxNumDownload: 10}}
+	contract1Bytes, _ := json.Marshal(&contract1)
+	_, err = CreateContract(stub, reqService1Subgroup, []string{string(contract1Bytes), crypto.EncodeToB64String(test_utils.GenerateSymKey())})
+	test_utils.AssertTrue(t, err == nil, "Expected CreateContract to succeed")
+	mstub.MockTransactionEnd("2")
+
+	mstub.MockTransactionStart("3")
+	stub = cached_stub.NewCachedStub(mstub)
+	contract, err := GetContractInternal(stub, reqService1Subgroup, contract1.ContractID)
+	test_utils.AssertTrue(t, err == nil, "Expected GetContractInternal to succeed")
+	test_utils.AssertTrue(t, contract.TemplateID == "research" && contract.TemplateVersion == 1, "Expected template version 1")
+	test_utils.AssertTrue(t, contract.ContractTerms.(map[string]interface{})["purpose"] == "research", "Expected template terms")
+	test_utils.AssertTrue(t, contract.Datatypes[0].MaxNumDownload == 5, "Expected template download quota")
+	test_utils.AssertTrue(t, contract.ExpirationDate == contract.CreateDate+3600, "Expected template validity period")
+
+	// updated template is a new version
+	template.Terms = map[string]interface{}{"purpose": "commercial"}
+	template.PricingModel = contractPricingFixed
+	template.Price = 500
+	template.Currency = "USD"
+	templateBytes, _ = json.Marshal(&template)
+	_, err = PutContractTemplate(stub, ownerService1Subgroup, []string{string(templateBytes), nowStr})
+	test_utils.AssertTrue(t, err == nil, "Expected PutContractTemplate to succeed")
+	mstub.MockTransactionEnd("3")
+
+	mstub.MockTransactionStart("4")
+	stub = cached_stub.NewCachedStub(mstub)
+	templatesBytes, err := GetContractTemplates(stub, reqService1Subgroup, []string{"ownerService1"})
+	test_utils.AssertTrue(t, err == nil, "Expected GetContractTemplates to succeed")
+	templates := []ContractTemplate{}
+	json.Unmarshal(templatesBytes, &templates)
+	test_utils.AssertTrue(t, len(templates) == 1 && templates[0].Version == 2, "Expected template version 2")
+
+	contract2 := GenerateContractTest("contract2", "ownerOrg1", "ownerService1", "requesterOrg1", "reqService1")
+	contract2.TemplateID = "research"
+	contract2Bytes, _ := json.Marshal(&contract2)
+	_, err = CreateContract(stub, reqService1Subgroup, []string{string(contract2Bytes), crypto.EncodeToB64String(test_utils.GenerateSymKey())})
+	test_utils.AssertTrue(t, err == nil, "Expected CreateContract to succeed")
+	mstub.MockTransactionEnd("4")
+
+	// contracts keep the template version they were created from
+	mstub.MockTransactionStart("5")
+	stub = cached_stub.NewCachedStub(mstub)
+	contract, _ = GetContractInternal(stub, reqService1Subgroup, contract1.ContractID)
+	test_utils.AssertTrue(t, contract.ContractTerms.(map[string]interface{})["purpose"] == "research", "Expected unchanged terms")
+	test_utils.AssertTrue(t, contract.PaymentDue == 0 && contract.TemplateVersion == 1, "Expected unchanged pricing")
+	test_utils.AssertTrue(t, contract.PaymentRequired == "no", "Expected no payment required for free template")
+	contract, _ = GetContractInternal(stub, reqService1Subgroup, contract2.ContractID)
+	test_utils.AssertTrue(t, contract.ContractTerms.(map[string]interface{})["purpose"] == "commercial", "Expected new terms")
+	test_utils.AssertTrue(t, contract.PaymentDue == 500 && contract.Currency == "USD", "Expected template price")
+	test_utils.AssertTrue(t, contract.PaymentRequired == "yes", "Expected payment required for fixed price template")
+	test_utils.AssertTrue(t, len(contract.Datatypes) == 1 && contract.TemplateVersion == 2, "Expected template datatypes")
+
+	// inactive templates cannot be instantiated
+	template.Status = contractTemplateInactive
+	templateBytes, _ = json.Marshal(&template)
+	_, err = PutContractTemplate(stub, ownerService1Subgroup, []string{string(templateBytes), nowStr})
+	test_utils.AssertTrue(t, err == nil, "Expected PutContractTemplate to succeed")
+	mstub.MockTransactionEnd("5")
+
+	mstub.MockTransactionStart("6")
+	stub = cached_stub.NewCachedStub(mstub)
+	contract3 := GenerateContractTest("contract3", "ownerOrg1", "ownerService1", "requesterOrg1", "reqService1")
+	contract3.TemplateID = "research"
+	contract3Bytes, _ := json.Marshal(&contract3)
+	_, err = CreateContract(stub, reqService1Subgroup, []string{string(contract3Bytes), crypto.EncodeToB64String(test_utils.GenerateSymKey())})
+	test_utils.AssertTrue(t, err != nil, "Expected CreateContract to fail")
+	mstub.MockTransactionEnd("6")
+}
@@ -0,0 +1,343 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"common/bchcls/asset_mgmt"
+	"common/bchcls/cached_stub"
+	"common/bchcls/custom_errors"
+	"common/bchcls/data_model"
+	"common/bchcls/utils"
+
+	"github.com/pkg/errors"
+)
+
+const maxCohortPageSize = 100
+
+// CohortPatientData holds downloaded data of one consenting patient
+// TransactionLog is the download log of the patient, under the patient's consent log key
+type CohortPatientData struct {
+	Patient        string                              `json:"patient"`
+	OwnerDatas     []OwnerDataResult                   `json:"owner_datas"`
+	TransactionLog data_model.ExportableTransactionLog `json:"transaction_log"`
+}
+
+// CohortDataResult is returned by DownloadServiceCohortData
+// Bookmark is the last patient examined, pass it to get the next page; empty when there are no more pages
+type CohortDataResult struct {
+	Service         string                              `json:"service"`
+	Datatype        string                              `json:"datatype"`
+	Patients        []CohortPatientData                 `json:"patients"`
+	SkippedPatients int                                 `json:"skipped_patients"`
+	Bookmark        string                              `json:"bookmark"`
+	TransactionLog  data_model.ExportableTransactionLog `json:"transaction_log"`
+}
+
+// cohortLog is stored in the data field of the aggregated download log
+type cohortLog struct {
+	Patients        []string `json:"patients"`
+	SkippedPatients int      `json:"skipped_patients"`
+	StartTimestamp  int64    `json:"start_timestamp"`
+	EndTimestamp    int64    `json:"end_timestamp"`
+	Bookmark        string   `json:"bookmark"`
+}
+
+// DownloadServiceCohortData downloads data of a datatype for all patients enrolled in a service
+// who currently have a valid read (or write) consent for the service and datatype
+// Can only be called by service admin or org admin of the service
+// Enrollments are examined in pages of at most pageSize patients, starting after bookmark
+// A log is generated for each included patient under the patient's consent log key, like DownloadOwnerDataWithConsent,
+// and one log is generated for the whole page under the service log key
+// args = [serviceID, datatype, startTimestamp, endTimestamp, pageSize, bookmark, timestamp]
+func DownloadServiceCohortData(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 7 {
+		customErr := &custom_errors.LengthCheckingError{Type: "DownloadServiceCohortData arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	serviceID := args[0]
+	if utils.IsStringEmpty(serviceID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "serviceID"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	datatypeID := args[1]
+	if utils.IsStringEmpty(datatypeID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "datatype"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	startTimestamp, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		logger.Errorf("Error converting startTimestamp to type int64")
+		return nil, errors.Wrap(err, "Error converting startTimestamp to type int64")
+	}
+
+	endTimestamp, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil {
+		logger.Errorf("Error converting endTimestamp to type int64")
+		return nil, errors.Wrap(err, "Error converting endTimestamp to type int64")
+	}
+
+	pageSize, err := strconv.Atoi(args[4])
+	if err != nil {
+		logger.Errorf("Error converting pageSize to type int")
+		return nil, errors.Wrap(err, "Error converting pageSize to type int")
+	}
+
+	if pageSize <= 0 || pageSize > maxCohortPageSize {
+		logger.Errorf("Invalid page size: %v", pageSize)
+		return nil, errors.New("Page size must be between 1 and " + strconv.Itoa(maxCohortPageSize))
+	}
+
+	bookmark := args[5]
+
+	timestamp, err := strconv.ParseInt(args[6], 10, 64)
+	if err != nil {
+		logger.Errorf("Error converting timestamp to type int64")
+		return nil, errors.Wrap(err, "Error converting timestamp to type int64")
+	}
+
+	// Check timestamp is within 10 mins of current time
+	currTime := time.Now().Unix()
+	if currTime-timestamp > 10*60 || currTime-timestamp < -10*60 {
+		logger.Errorf("Invalid Timestamp (current time: %v)  %v", currTime, timestamp)
+		return nil, errors.New("Invalid Timestamp, not within possible time range")
+	}
+
+	service, err := GetServiceInternal(stub, caller, serviceID, false)
+	if err != nil {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	if utils.IsStringEmpty(service.ServiceID) {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	if !CallerIsAdminOfService(caller, service.ServiceID, service.OrgID) {
+		logger.Errorf("Caller must be admin of service")
+		return nil, errors.New("Caller must be admin of service")
+	}
+
+	if !service.hasDatatype(datatypeID) {
+		logger.Errorf("This service does not contain the specified datatype")
+		return nil, errors.New("This service does not contain the specified datatype")
+	}
+
+	// ==============================================================
+	// Act as service, since service is the consent target
+	// ==============================================================
+	callerObj, err := GetOwnerCaller(stub, caller, serviceID)
+	if err != nil {
+		logger.Errorf("Failed to get service caller: %v", err)
+		return nil, errors.Wrap(err, "Failed to get service caller")
+	}
+
+	// ==============================================================
+	// Get a page of active enrollments, starting at bookmark
+	// ==============================================================
+	startValues := []string{serviceID, EnrollmentStatusActive}
+	if !utils.IsStringEmpty(bookmark) {
+		startValues = append(startValues, bookmark)
+	}
+	endValues := []string{serviceID, EnrollmentStatusActive}
+
+	// fetch one extra enrollment, since start of range includes the patient the bookmark points at,
+	// and one more to find out if there is a next page
+	limit := pageSize + 2
+	iter, err := asset_mgmt.GetAssetManager(stub, callerObj).GetAssetIter(EnrollmentAssetNamespace, IndexEnrollment, []string{"service_id", "status", "user_id"}, startValues, endValues, true, false, KeyPathFunc, "", limit, nil)
+	if err != nil {
+		logger.Errorf("GetServiceAssets failed: %v", err)
+		return nil, errors.Wrap(err, "GetServiceAssets failed")
+	}
+
+	defer iter.Close()
+	patients := []string{}
+	lastPatient := ""
+	examined := 0
+	hasMore := false
+	for iter.HasNext() {
+		enrollmentAsset, err := iter.Next()
+		if err != nil {
+			customErr := &custom_errors.IterError{}
+			logger.Errorf("%v: %v", customErr, err)
+			return nil, errors.Wrap(err, customErr.Error())
+		}
+		examined++
+
+		publicData := enrollmentPublicData{}
+		json.Unmarshal(enrollmentAsset.PublicData, &publicData)
+		if utils.IsStringEmpty(publicData.UserID) || publicData.UserID == bookmark {
+			continue
+		}
+
+		if len(patients) == pageSize {
+			hasMore = true
+			break
+		}
+		lastPatient = publicData.UserID
+
+		if data_model.IsEncryptedData(enrollmentAsset.PrivateData) {
+			logger.Warningf("Skipping enrollment %v, caller does not have access", enrollmentAsset.AssetId)
+			continue
+		}
+
+		patients = append(patients, publicData.UserID)
+	}
+
+	// iterator stopped at the limit, there may be more enrollments
+	if examined >= limit {
+		hasMore = true
+	}
+
+	// ==============================================================
+	// Download data of patients with valid consent
+	// ==============================================================
+	result := CohortDataResult{Service: serviceID, Datatype: datatypeID, Patients: []CohortPatientData{}}
+	includedPatients := []string{}
+	for _, patient := range patients {
+		consent, err := GetConsentInternal(stub, callerObj, serviceID, datatypeID, patient)
+		if err != nil || utils.IsStringEmpty(consent.Owner) {
+			result.SkippedPatients++
+			continue
+		}
+
+		if utils.InList(consent.Option, consentOptionDeny) || (!utils.InList(consent.Option, consentOptionRead) && !utils.InList(consent.Option, consentOptionWrite)) {
+			result.SkippedPatients++
+			continue
+		}
+
+		if consent.Expiration > 0 && consent.Expiration < timestamp {
+			result.SkippedPatients++
+			continue
+		}
+
+		patientDatas, err := getCohortPatientData(stub, callerObj, patient, datatypeID, startTimestamp, endTimestamp, consent.FilterRule)
+		if err != nil {
+			customErr := &GetDatasError{FieldNames: []string{"owner", "datatype"}, Values: []string{patient, datatypeID}}
+			logger.Errorf("%v: %v", customErr, err)
+			return nil, errors.Wrap(err, customErr.Error())
+		}
+
+		patientLog, err := getCohortPatientLog(stub, caller, callerObj, serviceID, datatypeID, patient, startTimestamp, endTimestamp, timestamp)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Patients = append(result.Patients, CohortPatientData{Patient: patient, OwnerDatas: patientDatas, TransactionLog: patientLog})
+		includedPatients = append(includedPatients, patient)
+	}
+
+	if hasMore {
+		result.Bookmark = lastPatient
+	}
+
+	// ==============================================================
+	// Logging
+	// ==============================================================
+	logData := cohortLog{
+		Patients:        includedPatients,
+		SkippedPatients: result.SkippedPatients,
+		StartTimestamp:  startTimestamp,
+		EndTimestamp:    endTimestamp,
+		Bookmark:        bookmark}
+	dataLog := DataLog{Owner: serviceID, Target: serviceID, Datatype: datatypeID, Service: serviceID, Data: logData}
+	solutionLog := SolutionLog{
+		TransactionID: stub.GetTxID(),
+		Namespace:     "OMR",
+		FunctionName:  "DownloadServiceCohortData",
+		CallerID:      caller.ID,
+		Timestamp:     timestamp,
+		Data:          dataLog}
+	exportableLog, err := GenerateExportableSolutionLog(stub, caller, solutionLog, callerObj.GetLogSymKey())
+	if err != nil {
+		customErr := &GenerateExportableTransactionLogError{Function: solutionLog.FunctionName}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	result.TransactionLog = exportableLog
+	logger.Infof("got cohort data for %v patients", len(result.Patients))
+
+	return json.Marshal(&result)
+}
+
+// getCohortPatientLog returns the download log of one patient, under the patient's consent log key
+// callerObj must be the service, which is the consent target
+func getCohortPatientLog(stub cached_stub.CachedStubInterface, caller data_model.User, callerObj data_model.User, serviceID string, datatypeID string, patient string, startTimestamp int64, endTimestamp int64, timestamp int64) (data_model.ExportableTransactionLog, error) {
+	consentKey, err := GetConsentKeyInternal(stub, callerObj, serviceID, datatypeID, patient)
+	if err != nil {
+		logger.Errorf("Failed to get consent key of patient %v: %v", patient, err)
+		return data_model.ExportableTransactionLog{}, errors.Wrap(err, "Failed to get consent key of patient "+patient)
+	}
+
+	logData := cohortLog{StartTimestamp: startTimestamp, EndTimestamp: endTimestamp}
+	dataLog := DataLog{Owner: patient, Target: serviceID, Datatype: datatypeID, Service: serviceID, Data: logData}
+	solutionLog := SolutionLog{
+		TransactionID: stub.GetTxID(),
+		Namespace:     "OMR",
+		FunctionName:  "DownloadServiceCohortData",
+		CallerID:      caller.ID,
+		Timestamp:     timestamp,
+		Data:          dataLog}
+	exportableLog, err := GenerateExportableSolutionLog(stub, caller, solutionLog, GetLogSymKeyFromKey(consentKey))
+	if err != nil {
+		customErr := &GenerateExportableTransactionLogError{Function: solutionLog.FunctionName}
+		logger.Errorf("%v: %v", customErr, err)
+		return data_model.ExportableTransactionLog{}, errors.Wrap(err, customErr.Error())
+	}
+
+	return exportableLog, nil
+}
+
+// getCohortPatientData returns data of a patient and datatype within the time range allowed by the consent filter rule
+// Assume caller is consent target
+func getCohortPatientData(stub cached_stub.CachedStubInterface, caller data_model.User, patient string, datatypeID string, startTimestamp int64, endTimestamp int64, filterRule map[string]interface{}) ([]OwnerDataResult, error) {
+	startValues := []string{patient, datatypeID}
+	if startTimestamp >= 0 {
+		startTimestampStr, err := utils.ConvertToString(startTimestamp)
+		if err != nil {
+			errMsg := "Failed to ConvertToString for startTimestamp"
+			logger.Errorf("%v: %v", errMsg, err)
+			return nil, errors.Wrap(err, errMsg)
+		}
+		startValues = append(startValues, startTimestampStr)
+	}
+
+	endValues := []string{patient, datatypeID}
+	if endTimestamp > 0 {
+		endTimestampStr, err := utils.ConvertToString(endTimestamp)
+		if err != nil {
+			errMsg := "Failed to ConvertToString for endTimestamp"
+			logger.Errorf("%v: %v", errMsg, err)
+			return nil, errors.Wrap(err, errMsg)
+		}
+		endValues = append(endValues, endTimestampStr)
+	}
+
+	return GetDataInternal(stub, caller, []string{"owner", "datatype", "timestamp"}, startValues, endValues, -1, getDataFilterRule(filterRule))
+}
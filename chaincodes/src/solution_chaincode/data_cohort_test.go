@@ -0,0 +1,164 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"common/bchcls/cached_stub"
+	"common/bchcls/crypto"
+	"common/bchcls/data_model"
+	"common/bchcls/init_common"
+	"common/bchcls/test_utils"
+	"common/bchcls/user_mgmt"
+	"common/bchcls/utils"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestDownloadServiceCohortData(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestDownloadServiceCohortData function called")
+
+	// create a MockStub
+	mstub := SetupIndexesAndGetStub(t)
+
+	// register admin user
+	mstub.MockTransactionStart("t123")
+	stub := cached_stub.NewCachedStub(mstub)
+	init_common.Init(stub)
+	err := SetupDataIndex(stub)
+	systemAdmin := test_utils.CreateTestUser("systemAdmin")
+	systemAdmin.Role = SOLUTION_ROLE_SYSTEM
+	systemAdminBytes, _ := json.Marshal(&systemAdmin)
+	_, err = RegisterUser(stub, systemAdmin, []string{string(systemAdminBytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterUser to succeed")
+	mstub.MockTransactionEnd("t123")
+
+	// Register system datatypes
+	mstub.MockTransactionStart("init")
+	stub = cached_stub.NewCachedStub(mstub)
+	RegisterSystemDatatypeTest(t, stub, systemAdmin)
+	mstub.MockTransactionEnd("init")
+
+	// register org
+	mstub.MockTransactionStart("t123")
+	stub = cached_stub.NewCachedStub(mstub)
+	org1 := test_utils.CreateTestGroup("org1")
+	org1Bytes, _ := json.Marshal(&org1)
+	_, err = RegisterOrg(stub, org1, []string{string(org1Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterOrg to succeed")
+	mstub.MockTransactionEnd("t123")
+
+	//  register datatype
+	mstub.MockTransactionStart("t123")
+	stub = cached_stub.NewCachedStub(mstub)
+	datatype1 := Datatype{DatatypeID: "datatype1", Description: "datatype1"}
+	datatype1Bytes, _ := json.Marshal(&datatype1)
+	org1Caller, _ := user_mgmt.GetUserData(stub, org1, org1.ID, true, true)
+	_, err = RegisterDatatype(stub, org1Caller, []string{string(datatype1Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterDatatype to succeed")
+	mstub.MockTransactionEnd("t123")
+
+	//  register service
+	mstub.MockTransactionStart("t123")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	serviceDatatype1 := GenerateServiceDatatypeForTesting("datatype1", "service1", []string{consentOptionWrite, consentOptionRead})
+	service1 := GenerateServiceForTesting("service1", "org1", []ServiceDatatype{serviceDatatype1})
+	service1Bytes, _ := json.Marshal(&service1)
+	_, err = RegisterService(stub, org1Caller, []string{string(service1Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterService to succeed")
+	mstub.MockTransactionEnd("t123")
+
+	// register and enroll 3 patients
+	// patient1 and patient3 give consent, patient2 denies
+	patientCallers := []data_model.User{}
+	for i, option := range [][]string{{consentOptionWrite, consentOptionRead}, {consentOptionDeny}, {consentOptionRead}} {
+		patientID := "patient" + strconv.Itoa(i+1)
+		mstub.MockTransactionStart("register" + patientID)
+		stub = cached_stub.NewCachedStub(mstub)
+		patient := test_utils.CreateTestUser(patientID)
+		patientBytes, _ := json.Marshal(&patient)
+		_, err = user_mgmt.RegisterUser(stub, org1Caller, []string{string(patientBytes), "false"})
+		test_utils.AssertTrue(t, err == nil, "Expected RegisterUser to succeed")
+		mstub.MockTransactionEnd("register" + patientID)
+
+		mstub.MockTransactionStart("enroll" + patientID)
+		stub = cached_stub.NewCachedStub(mstub)
+		enrollment := GenerateEnrollmentTest(patientID, "service1")
+		enrollmentBytes, _ := json.Marshal(&enrollment)
+		enrollmentKeyB64 := crypto.EncodeToB64String(test_utils.GenerateSymKey())
+		_, err = EnrollPatient(stub, org1Caller, []string{string(enrollmentBytes), enrollmentKeyB64})
+		test_utils.AssertTrue(t, err == nil, "Expected EnrollPatient to succeed")
+		mstub.MockTransactionEnd("enroll" + patientID)
+
+		mstub.MockTransactionStart("consent" + patientID)
+		stub = cached_stub.NewCachedStub(mstub, true, true, true)
+		consent := Consent{Owner: patientID, Service: "service1", Target: "service1", Datatype: "datatype1", Option: option, Timestamp: time.Now().Unix()}
+		consentBytes, _ := json.Marshal(&consent)
+		consentKeyB64 := crypto.EncodeToB64String(test_utils.GenerateSymKey())
+		patientCaller, _ := user_mgmt.GetUserData(stub, patient, patientID, true, true)
+		_, err = PutConsentPatientData(stub, patientCaller, []string{string(consentBytes), consentKeyB64})
+		test_utils.AssertTrue(t, err == nil, "Expected PutConsentPatientData to succeed")
+		mstub.MockTransactionEnd("consent" + patientID)
+		patientCallers = append(patientCallers, patientCaller)
+	}
+
+	// upload data for patients with write consent
+	mstub.MockTransactionStart("upload")
+	stub = cached_stub.NewCachedStub(mstub)
+	service1Subgroup, _ := user_mgmt.GetUserData(stub, org1Caller, "service1", true, true)
+	patientData := GeneratePatientData("patient1", "datatype1", "service1")
+	patientDataBytes, _ := json.Marshal(&patientData)
+	_, err = UploadUserData(stub, service1Subgroup, []string{string(patientDataBytes), crypto.EncodeToB64String(test_utils.GenerateSymKey())})
+	test_utils.AssertTrue(t, err == nil, "Expected UploadUserData to succeed")
+	mstub.MockTransactionEnd("upload")
+
+	timestampStr := strconv.FormatInt(time.Now().Unix(), 10)
+
+	// patient cannot download cohort data
+	mstub.MockTransactionStart("1")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = DownloadServiceCohortData(stub, patientCallers[0], []string{"service1", "datatype1", "0", "0", "2", "", timestampStr})
+	test_utils.AssertTrue(t, err != nil, "Expected DownloadServiceCohortData to fail")
+	mstub.MockTransactionEnd("1")
+
+	// first page: patient1 is included, patient2 is skipped
+	mstub.MockTransactionStart("2")
+	stub = cached_stub.NewCachedStub(mstub)
+	resultBytes, err := DownloadServiceCohortData(stub, service1Subgroup, []string{"service1", "datatype1", "0", "0", "2", "", timestampStr})
+	test_utils.AssertTrue(t, err == nil, "Expected DownloadServiceCohortData to succeed")
+	result := CohortDataResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, len(result.Patients) == 1, "Expected 1 patient")
+	test_utils.AssertTrue(t, result.Patients[0].Patient == "patient1", "Expected patient1")
+	test_utils.AssertTrue(t, len(result.Patients[0].OwnerDatas) == 1, "Expected 1 record")
+	patientLogBytes, _ := json.Marshal(&result.Patients[0].TransactionLog)
+	emptyLogBytes, _ := json.Marshal(&data_model.ExportableTransactionLog{})
+	test_utils.AssertTrue(t, string(patientLogBytes) != string(emptyLogBytes), "Expected patient download log")
+	test_utils.AssertTrue(t, result.SkippedPatients == 1, "Expected 1 skipped patient")
+	test_utils.AssertTrue(t, result.Bookmark == "patient2", "Expected bookmark")
+	mstub.MockTransactionEnd("2")
+
+	// second page: patient3 is included, no more pages
+	mstub.MockTransactionStart("3")
+	stub = cached_stub.NewCachedStub(mstub)
+	resultBytes, err = DownloadServiceCohortData(stub, org1Caller, []string{"service1", "datatype1", "0", "0", "2", result.Bookmark, timestampStr})
+	test_utils.AssertTrue(t, err == nil, "Expected DownloadServiceCohortData to succeed")
+	result = CohortDataResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, len(result.Patients) == 1, "Expected 1 patient")
+	test_utils.AssertTrue(t, result.Patients[0].Patient == "patient3", "Expected patient3")
+	test_utils.AssertTrue(t, len(result.Patients[0].OwnerDatas) == 0, "Expected no records")
+	test_utils.AssertTrue(t, utils.IsStringEmpty(result.Bookmark), "Expected no more pages")
+	mstub.MockTransactionEnd("3")
+}
@@ -10,9 +10,13 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"strconv"
+	"strings"
 	"time"
 
 	"common/bchcls/asset_mgmt"
@@ -24,6 +28,7 @@ import (
 	"common/bchcls/datatype"
 	"common/bchcls/index"
 	"common/bchcls/key_mgmt"
+	"common/bchcls/simple_rule"
 	"common/bchcls/user_access_ctrl"
 	"common/bchcls/user_mgmt"
 	"common/bchcls/user_mgmt/user_keys"
@@ -35,24 +40,58 @@ import (
 const IndexData = "dataTable"
 const OwnerDataNamespace = "OwnerDataAsset"
 
+const IndexDataTag = "dataTagTable"
+const DataTagNamespace = "DataTagAsset"
+const maxDataTags = 20
+
+// latestDataScanWindow is the first time window, in seconds, searched back by getLatestDataInRange
+const latestDataScanWindow = 60 * 60
+
 // De-identified fields:
 //   - Owner
 //   - Service
 type OwnerData struct {
-	DataID    string      `json:"data_id"`
-	Owner     string      `json:"owner"`
-	Service   string      `json:"service"`
-	Datatype  string      `json:"datatype"`
-	Timestamp int64       `json:"timestamp"`
-	Data      interface{} `json:"data"`
+	DataID     string          `json:"data_id"`
+	Owner      string          `json:"owner"`
+	Service    string          `json:"service"`
+	Datatype   string          `json:"datatype"`
+	Timestamp  int64           `json:"timestamp"`
+	Provenance *DataProvenance `json:"provenance,omitempty"`
+	Tags       []string        `json:"tags,omitempty"`
+	Data       interface{}     `json:"data"`
 }
 
 type OwnerDataResult struct {
-	Owner     string      `json:"owner"`
-	Service   string      `json:"service"`
-	Datatype  string      `json:"datatype"`
-	Timestamp int64       `json:"timestamp"`
-	Data      interface{} `json:"data"`
+	Owner      string          `json:"owner"`
+	Service    string          `json:"service"`
+	Datatype   string          `json:"datatype"`
+	Timestamp  int64           `json:"timestamp"`
+	Provenance *DataProvenance `json:"provenance,omitempty"`
+	Tags       []string        `json:"tags,omitempty"`
+	Data       interface{}     `json:"data"`
+}
+
+// DataProvenance describes where a record came from
+// OriginalTimestamp is when the record was produced by the source; IngestTimestamp is when the record was uploaded
+// Author is the user who uploaded the record
+// Signature is an optional base64 encoded signature of the data by the source, see validateDataProvenance
+// SignerID is the registered user ID of the device or source system whose key made the signature
+type DataProvenance struct {
+	SourceSystem      string `json:"source_system"`
+	DeviceID          string `json:"device_id"`
+	Author            string `json:"author"`
+	OriginalTimestamp int64  `json:"original_timestamp"`
+	IngestTimestamp   int64  `json:"ingest_timestamp"`
+	SignerID          string `json:"signer_id"`
+	Signature         string `json:"signature"`
+}
+
+// DataProvenanceFilter is an optional download filter; empty fields match any value
+type DataProvenanceFilter struct {
+	SourceSystem string `json:"source_system"`
+	DeviceID     string `json:"device_id"`
+	Author       string `json:"author"`
+	SignedOnly   bool   `json:"signed_only"`
 }
 
 type OwnerDataDownloadResult struct {
@@ -66,13 +105,48 @@ type OwnerDataResultWithLog struct {
 	TransactionLog data_model.ExportableTransactionLog `json:"transaction_log"`
 }
 
+// ownerDataPublicData is stored on ledger with each owner data asset
+// DataHash is computed at upload time over the private data, which may be stored off-chain
+// Shredded is set when the data was removed by retention policy
+type ownerDataPublicData struct {
+	DataID                string `json:"data_id"`
+	Timestamp             int64  `json:"timestamp"`
+	DataHash              string `json:"data_hash"`
+	TxID                  string `json:"tx_id"`
+	TxTimestamp           int64  `json:"tx_timestamp"`
+	DatastoreConnectionID string `json:"datastore_connection_id"`
+	Shredded              bool   `json:"shredded,omitempty"`
+}
+
+// DataIntegrityProof is returned by GetDataIntegrityProof
+// BlockNumber is the block holding the upload transaction
+// Shredded data no longer matches the recorded hash, since its payload was removed by retention policy
+type DataIntegrityProof struct {
+	DataID                string `json:"data_id"`
+	Owner                 string `json:"owner"`
+	Datatype              string `json:"datatype"`
+	Timestamp             int64  `json:"timestamp"`
+	RecordedHash          string `json:"recorded_hash"`
+	CurrentHash           string `json:"current_hash"`
+	TxID                  string `json:"tx_id"`
+	TxTimestamp           int64  `json:"tx_timestamp"`
+	BlockNumber           uint64 `json:"block_number"`
+	OffChain              bool   `json:"off_chain"`
+	Shredded              bool   `json:"shredded"`
+	DatastoreConnectionID string `json:"datastore_connection_id"`
+	Matches               bool   `json:"matches"`
+}
+
 // log object for data upload and download
 type DataLog struct {
-	Owner    string      `json:"owner"`
-	Target   string      `json:"target"`
-	Datatype string      `json:"datatype"`
-	Service  string      `json:"service"`
-	Data     interface{} `json:"data"`
+	Owner            string                `json:"owner"`
+	Target           string                `json:"target"`
+	Datatype         string                `json:"datatype"`
+	Service          string                `json:"service"`
+	Provenance       *DataProvenance       `json:"provenance,omitempty"`
+	ProvenanceFilter *DataProvenanceFilter `json:"provenance_filter,omitempty"`
+	Tags             []string              `json:"tags,omitempty"`
+	Data             interface{}           `json:"data"`
 }
 
 // UploadUserData uploads patient data
@@ -131,6 +205,18 @@ func UploadUserData(stub cached_stub.CachedStubInterface, caller data_model.User
 	// set data ID
 	patientData.DataID = GetPatientDataID(patientData.Owner, patientData.Datatype, patientData.Timestamp)
 
+	err = validateDataProvenance(stub, &patientData, caller)
+	if err != nil {
+		logger.Errorf("Invalid provenance: %v", err)
+		return nil, errors.Wrap(err, "Invalid provenance")
+	}
+
+	err = validateDataTags(&patientData)
+	if err != nil {
+		logger.Errorf("Invalid tags: %v", err)
+		return nil, errors.Wrap(err, "Invalid tags")
+	}
+
 	// ==============================================================
 	// Get service and act as service
 	// because org admin cannot update data asset
@@ -182,11 +268,16 @@ func UploadUserData(stub cached_stub.CachedStubInterface, caller data_model.User
 	}
 
 	// If not currently enrolled, return error
-	if enrollment.Status != "active" {
+	if enrollment.Status != EnrollmentStatusActive {
 		logger.Errorf("Data owner not currently enrolled")
 		return nil, errors.New("Data owner not currently enrolled")
 	}
 
+	if enrollment.TermsAcknowledgementRequired {
+		logger.Errorf("Data owner has not accepted the current service terms")
+		return nil, errors.New("Data owner has not accepted the current service terms")
+	}
+
 	// Check consent option
 	consent, err := GetConsentInternal(stub, caller, patientData.Service, patientData.Datatype, patientData.Owner)
 	if err != nil {
@@ -244,6 +335,7 @@ func UploadUserData(stub cached_stub.CachedStubInterface, caller data_model.User
 		return nil, errors.New(customErr.Error())
 	}
 
+	dataKey := data_model.Key{}
 	if len(keyPath) == 0 {
 		// key path length is 0, assume asset does not exist
 		// if asset does not exist
@@ -256,7 +348,14 @@ func UploadUserData(stub cached_stub.CachedStubInterface, caller data_model.User
 		}
 
 		// Validate data key
-		dataKey := data_model.Key{ID: key_mgmt.GetSymKeyId(patientData.Owner + patientData.Datatype), Type: key_mgmt.KEY_TYPE_SYM}
+		// key ID changes every time retention destroys the previous data key
+		dataKeyID, err := GetOwnerDataKeyID(stub, patientData.Owner, patientData.Datatype)
+		if err != nil {
+			logger.Errorf("Failed to get data key ID: %v", err)
+			return nil, errors.Wrap(err, "Failed to get data key ID")
+		}
+
+		dataKey = data_model.Key{ID: dataKeyID, Type: key_mgmt.KEY_TYPE_SYM}
 		dataKey.KeyBytes, err = crypto.ParseSymKeyB64(args[1])
 		if err != nil {
 			logger.Errorf("Invalid dataKey")
@@ -285,6 +384,7 @@ func UploadUserData(stub cached_stub.CachedStubInterface, caller data_model.User
 		}
 
 		// add new asset
+		setOwnerDataHash(&patientDataAsset, dataKey)
 		err = assetManager.AddAsset(patientDataAsset, dataKey, false)
 		if err != nil {
 			customErr := &PutAssetError{Asset: patientDataAsset.AssetId}
@@ -303,6 +403,7 @@ func UploadUserData(stub cached_stub.CachedStubInterface, caller data_model.User
 			return nil, errors.Wrap(err, customErr.Error())
 		}
 
+		setOwnerDataHash(&latestPatientDataAsset, dataKey)
 		err = assetManager.AddAsset(latestPatientDataAsset, dataKey, false)
 		if err != nil {
 			customErr := &PutAssetError{Asset: latestPatientDataID}
@@ -310,13 +411,14 @@ func UploadUserData(stub cached_stub.CachedStubInterface, caller data_model.User
 			return nil, errors.Wrap(err, customErr.Error())
 		}
 	} else {
-		dataKey, err := assetManager.GetAssetKey(latestPatientDataAssetID, keyPath)
+		dataKey, err = assetManager.GetAssetKey(latestPatientDataAssetID, keyPath)
 		if err != nil {
 			logger.Errorf("Failed to get data AssetKey for existing data: %v", err)
 			return nil, errors.Wrap(err, "Failed to data AssetKey for existing data")
 		}
 		// asset exists
 		// first add new asset with ID of ownerId + datatypeId + timestamp under existing key
+		setOwnerDataHash(&patientDataAsset, dataKey)
 		err = assetManager.AddAsset(patientDataAsset, dataKey, false)
 		if err != nil {
 			customErr := &PutAssetError{Asset: patientDataAsset.AssetId}
@@ -335,6 +437,7 @@ func UploadUserData(stub cached_stub.CachedStubInterface, caller data_model.User
 			return nil, errors.Wrap(err, customErr.Error())
 		}
 
+		setOwnerDataHash(&latestPatientDataAsset, dataKey)
 		err = assetManager.UpdateAsset(latestPatientDataAsset, dataKey, true)
 		if err != nil {
 			customErr := &PutAssetError{Asset: latestPatientDataAssetID}
@@ -343,6 +446,12 @@ func UploadUserData(stub cached_stub.CachedStubInterface, caller data_model.User
 		}
 	}
 
+	err = putDataTagIndex(stub, callerObj, patientData, dataKey)
+	if err != nil {
+		logger.Errorf("Failed to index data tags: %v", err)
+		return nil, errors.Wrap(err, "Failed to index data tags")
+	}
+
 	// ==============================================================
 	// Logging
 	// ==============================================================
@@ -369,7 +478,7 @@ func UploadUserData(stub cached_stub.CachedStubInterface, caller data_model.User
 	// access from ownerLogSymKey and targetLogSymKey to enrollmentLogSymKey already added in enroll mgmt
 	enrollmentLogSymKey := GetLogSymKeyFromKey(enrollmentKey)
 
-	dataLog := DataLog{Owner: patientData.Owner, Datatype: patientData.Datatype, Service: patientData.Service}
+	dataLog := DataLog{Owner: patientData.Owner, Datatype: patientData.Datatype, Service: patientData.Service, Provenance: patientData.Provenance, Tags: patientData.Tags}
 	solutionLog := SolutionLog{
 		TransactionID: stub.GetTxID(),
 		Namespace:     "OMR",
@@ -437,6 +546,18 @@ func UploadOwnerData(stub cached_stub.CachedStubInterface, caller data_model.Use
 	// owner is same as service
 	ownerData.DataID = GetOwnerDataID(ownerData.Owner, ownerData.Datatype, ownerData.Timestamp)
 
+	err = validateDataProvenance(stub, &ownerData, caller)
+	if err != nil {
+		logger.Errorf("Invalid provenance: %v", err)
+		return nil, errors.Wrap(err, "Invalid provenance")
+	}
+
+	err = validateDataTags(&ownerData)
+	if err != nil {
+		logger.Errorf("Invalid tags: %v", err)
+		return nil, errors.Wrap(err, "Invalid tags")
+	}
+
 	// ==============================================================
 	// Get owner and act as owner
 	// because org admin cannot update data asset
@@ -544,7 +665,14 @@ func UploadOwnerData(stub cached_stub.CachedStubInterface, caller data_model.Use
 		}
 
 		// Validate data key
-		dataKey = data_model.Key{ID: key_mgmt.GetSymKeyId(ownerData.Owner + ownerData.Datatype), Type: key_mgmt.KEY_TYPE_SYM}
+		// key ID changes every time retention destroys the previous data key
+		dataKeyID, err := GetOwnerDataKeyID(stub, ownerData.Owner, ownerData.Datatype)
+		if err != nil {
+			logger.Errorf("Failed to get data key ID: %v", err)
+			return nil, errors.Wrap(err, "Failed to get data key ID")
+		}
+
+		dataKey = data_model.Key{ID: dataKeyID, Type: key_mgmt.KEY_TYPE_SYM}
 		dataKey.KeyBytes, err = crypto.ParseSymKeyB64(args[1])
 		if err != nil {
 			logger.Errorf("Invalid dataKey")
@@ -572,6 +700,7 @@ func UploadOwnerData(stub cached_stub.CachedStubInterface, caller data_model.Use
 		}
 
 		// add new asset
+		setOwnerDataHash(&ownerDataAsset, dataKey)
 		err = assetManager.AddAsset(ownerDataAsset, dataKey, false)
 		if err != nil {
 			customErr := &PutAssetError{Asset: ownerDataAsset.AssetId}
@@ -590,6 +719,7 @@ func UploadOwnerData(stub cached_stub.CachedStubInterface, caller data_model.Use
 			return nil, errors.Wrap(err, customErr.Error())
 		}
 
+		setOwnerDataHash(&latestOwnerDataAsset, dataKey)
 		err = assetManager.AddAsset(latestOwnerDataAsset, dataKey, false)
 		if err != nil {
 			customErr := &PutAssetError{Asset: ownerDataAsset.AssetId}
@@ -605,6 +735,7 @@ func UploadOwnerData(stub cached_stub.CachedStubInterface, caller data_model.Use
 
 		// asset exists
 		//  add new asset with ID of ownerId + datatypeId + timestamp under existing key
+		setOwnerDataHash(&ownerDataAsset, dataKey)
 		err = assetManager.AddAsset(ownerDataAsset, dataKey, false)
 		if err != nil {
 			customErr := &PutAssetError{Asset: latestOwnerDataAssetID}
@@ -623,6 +754,7 @@ func UploadOwnerData(stub cached_stub.CachedStubInterface, caller data_model.Use
 			return nil, errors.Wrap(err, customErr.Error())
 		}
 
+		setOwnerDataHash(&latestOwnerDataAsset, dataKey)
 		err = assetManager.UpdateAsset(latestOwnerDataAsset, dataKey, true)
 		if err != nil {
 			customErr := &PutAssetError{Asset: latestOwnerDataAssetID}
@@ -631,11 +763,17 @@ func UploadOwnerData(stub cached_stub.CachedStubInterface, caller data_model.Use
 		}
 	}
 
+	err = putDataTagIndex(stub, callerObj, ownerData, dataKey)
+	if err != nil {
+		logger.Errorf("Failed to index data tags: %v", err)
+		return nil, errors.Wrap(err, "Failed to index data tags")
+	}
+
 	// ==============================================================
 	// Logging
 	// ==============================================================
 	logSymKey := GetLogSymKeyFromKey(dataKey)
-	dataLog := DataLog{Owner: ownerData.Owner, Datatype: ownerData.Datatype, Service: ownerData.Service}
+	dataLog := DataLog{Owner: ownerData.Owner, Datatype: ownerData.Datatype, Service: ownerData.Service, Provenance: ownerData.Provenance, Tags: ownerData.Tags}
 	solutionLog := SolutionLog{
 		TransactionID: stub.GetTxID(),
 		Namespace:     "OMR",
@@ -667,13 +805,13 @@ func UploadOwnerData(stub cached_stub.CachedStubInterface, caller data_model.Use
 
 // DownloadOwnerDataAsOwner downloads owner data
 // Should only be used by owner or callers with access to owner
-// args = [service, datatype, latestOnly, startTimestamp, endTimestamp, maxNum, timestamp]
+// args = [service, datatype, latestOnly, startTimestamp, endTimestamp, maxNum, timestamp, provenanceFilter (optional)]
 // If latest only is true, then other filters are ignored
 func DownloadOwnerDataAsOwner(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
 	defer utils.ExitFnLog(utils.EnterFnLog())
 	logger.Debugf("args: %v", args)
 
-	if len(args) != 7 {
+	if len(args) != 7 && len(args) != 8 {
 		customErr := &custom_errors.LengthCheckingError{Type: "DownloadOwnerDataAsOwner arguments length"}
 		logger.Errorf(customErr.Error())
 		return nil, errors.WithStack(customErr)
@@ -744,6 +882,13 @@ func DownloadOwnerDataAsOwner(stub cached_stub.CachedStubInterface, caller data_
 		return nil, errors.New("Invalid Timestamp, not within possible time range")
 	}
 
+	// optional provenance filter
+	provenanceFilter, err := parseDataProvenanceFilter(args, 7)
+	if err != nil {
+		logger.Errorf("Invalid provenance filter: %v", err)
+		return nil, errors.Wrap(err, "Invalid provenance filter")
+	}
+
 	// ==============================================================
 	// Get owner and act as owner
 	// ==============================================================
@@ -795,7 +940,11 @@ func DownloadOwnerDataAsOwner(stub cached_stub.CachedStubInterface, caller data_
 			return nil, errors.WithStack(err)
 		}
 
-		ownerDatas = append(ownerDatas, data)
+		ownerDatas, err = filterOwnerDataByRule([]OwnerDataResult{data}, provenanceFilter.rule())
+		if err != nil {
+			logger.Errorf("Failed to apply provenance filter: %v", err)
+			return nil, errors.Wrap(err, "Failed to apply provenance filter")
+		}
 
 	} else {
 		startValues := []string{owner, datatype}
@@ -820,7 +969,8 @@ func DownloadOwnerDataAsOwner(stub cached_stub.CachedStubInterface, caller data_
 			endValues = append(endValues, endTimestampStr)
 		}
 
-		ownerDatas, err = GetDataInternal(stub, callerObj, []string{"owner", "datatype", "timestamp"}, startValues, endValues, int(maxNum))
+		// the provenance filter is applied by the data iterator, before maxNum
+		ownerDatas, err = GetDataInternal(stub, callerObj, []string{"owner", "datatype", "timestamp"}, startValues, endValues, int(maxNum), getDataFilterRule(provenanceFilter.rule()))
 		if err != nil {
 			customErr := &GetDatasError{FieldNames: []string{"owner", "datatype", "timestamp"}, Values: startValues}
 			logger.Errorf("%v: %v", customErr, err)
@@ -854,7 +1004,7 @@ func DownloadOwnerDataAsOwner(stub cached_stub.CachedStubInterface, caller data_
 
 	dataLogSymKey := GetLogSymKeyFromKey(dataKey)
 
-	dataLog := DataLog{Owner: owner, Datatype: datatype}
+	dataLog := DataLog{Owner: owner, Datatype: datatype, ProvenanceFilter: provenanceFilter}
 	solutionLog := SolutionLog{
 		TransactionID: stub.GetTxID(),
 		Namespace:     "OMR",
@@ -878,13 +1028,13 @@ func DownloadOwnerDataAsOwner(stub cached_stub.CachedStubInterface, caller data_
 }
 
 // DownloadOwnerDataAsRequester downloads owner data
-// args = [contractID, datatype, latestOnly, startTimestamp, endTimestamp, maxNum, timestamp]
+// args = [contractID, datatype, latestOnly, startTimestamp, endTimestamp, maxNum, timestamp, provenanceFilter (optional)]
 // If latest only is true, then other filters are ignored
 func DownloadOwnerDataAsRequester(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
 	defer utils.ExitFnLog(utils.EnterFnLog())
 	logger.Debugf("args: %v", args)
 
-	if len(args) != 7 {
+	if len(args) != 7 && len(args) != 8 {
 		customErr := &custom_errors.LengthCheckingError{Type: "DownloadOwnerDataAsRequester arguments length"}
 		logger.Errorf(customErr.Error())
 		return nil, errors.WithStack(customErr)
@@ -927,7 +1077,7 @@ func DownloadOwnerDataAsRequester(stub cached_stub.CachedStubInterface, caller d
 	}
 
 	// Return error if a contract with this ID does not exist
-	if contract.State != "downloadReady" {
+	if contract.State != ContractStateDownloadReady {
 		logger.Errorf("Download is not ready")
 		return nil, errors.New("Download is not ready")
 	}
@@ -936,27 +1086,28 @@ func DownloadOwnerDataAsRequester(stub cached_stub.CachedStubInterface, caller d
 	// Change caller
 	// ==============================================================
 	callerObj := caller
-	if solutionCaller.Org != contract.RequesterOrgID {
+	requesterServiceID, ok := getContractRequesterService(caller, contract)
+	if !ok {
 		logger.Errorf("Caller org is not the same as requester org")
 		return nil, errors.New("Caller org is not the same as requester org")
 	}
 
 	// If caller is org admin, then have to use key paths
 	if solutionCaller.SolutionInfo.IsOrgAdmin {
-		symKeyPath, prvKeyPath, err := GetUserAssetSymAndPrivateKeyPaths(stub, caller, contract.RequesterServiceID)
+		symKeyPath, prvKeyPath, err := GetUserAssetSymAndPrivateKeyPaths(stub, caller, requesterServiceID)
 		if err != nil {
 			logger.Errorf("Failed to get symKeyPath and prvKeyPath for user asset")
 			return nil, errors.Wrap(err, "Failed to get symKeyPath and prvKeyPath for user asset")
 		}
-		// act as contract owner service
-		callerObj, err = user_mgmt.GetUserData(stub, caller, contract.RequesterServiceID, true, false, symKeyPath, prvKeyPath)
+		// act as contract requester service
+		callerObj, err = user_mgmt.GetUserData(stub, caller, requesterServiceID, true, false, symKeyPath, prvKeyPath)
 		if err != nil {
 			customErr := &GetUserError{User: contract.OwnerServiceID}
 			logger.Errorf("%v: %v", customErr, err)
 			return nil, errors.Wrap(err, customErr.Error())
 		}
 	} else {
-		callerObj, err = user_mgmt.GetUserData(stub, caller, contract.RequesterServiceID, true, false)
+		callerObj, err = user_mgmt.GetUserData(stub, caller, requesterServiceID, true, false)
 		if err != nil {
 			customErr := &GetUserError{User: contract.OwnerServiceID}
 			logger.Errorf("%v: %v", customErr, err)
@@ -1019,6 +1170,43 @@ func DownloadOwnerDataAsRequester(stub cached_stub.CachedStubInterface, caller d
 		return nil, errors.New("Invalid Timestamp, not within possible time range")
 	}
 
+	if !contract.isEffective(timestamp) {
+		logger.Errorf("Contract %v is not effective at %v", contractID, timestamp)
+		return nil, errors.New("Contract is not effective, download is not allowed")
+	}
+
+	// optional provenance filter
+	provenanceFilter, err := parseDataProvenanceFilter(args, 7)
+	if err != nil {
+		logger.Errorf("Invalid provenance filter: %v", err)
+		return nil, errors.Wrap(err, "Invalid provenance filter")
+	}
+
+	// Check datatype is covered by contract, and narrow time range to datatype scope
+	if !contract.coversDatatype(datatype) {
+		logger.Errorf("Contract %v does not cover datatype %v", contractID, datatype)
+		return nil, errors.New("Contract does not cover datatype " + datatype)
+	}
+
+	scope := contract.findDatatypeScope(datatype)
+	if scope != nil {
+		if contract.requesterQuotaReached(requesterServiceID, datatype) {
+			logger.Errorf("Download quota of datatype %v is already reached", datatype)
+			return nil, errors.New("Download quota of datatype " + datatype + " is already reached")
+		}
+
+		// latest only downloads ignore the requested time range, but not the scope's
+		if latestOnlyFlag == "true" {
+			startTimestamp, endTimestamp = 0, 0
+		}
+
+		startTimestamp, endTimestamp = scope.narrowTimeRange(startTimestamp, endTimestamp)
+		if endTimestamp > 0 && startTimestamp > endTimestamp {
+			logger.Errorf("Requested time range is outside of contract scope for datatype %v", datatype)
+			return nil, errors.New("Requested time range is outside of contract scope for datatype " + datatype)
+		}
+	}
+
 	// ==============================================================
 	// Update contract and manage relationship
 	// ==============================================================
@@ -1036,8 +1224,8 @@ func DownloadOwnerDataAsRequester(stub cached_stub.CachedStubInterface, caller d
 	// Download data using index
 	// ==============================================================
 	ownerDatas := []OwnerDataResult{}
-	if contract.MaxNumDownload > contract.NumDownload {
-		if latestOnlyFlag == "true" {
+	if !contract.requesterLimitReached(requesterServiceID) {
+		if latestOnlyFlag == "true" && scope == nil {
 			assetID := GetLatestOwnerDataAssetID(stub, contract.OwnerServiceID, datatype)
 			data, err := GetDataWithAssetID(stub, callerObj, assetID, contract.OwnerServiceID, datatype)
 			if err != nil {
@@ -1045,7 +1233,11 @@ func DownloadOwnerDataAsRequester(stub cached_stub.CachedStubInterface, caller d
 				return nil, errors.WithStack(err)
 			}
 
-			ownerDatas = append(ownerDatas, data)
+			ownerDatas, err = filterOwnerDataByRule([]OwnerDataResult{data}, provenanceFilter.rule())
+			if err != nil {
+				logger.Errorf("Failed to apply provenance filter: %v", err)
+				return nil, errors.Wrap(err, "Failed to apply provenance filter")
+			}
 
 		} else {
 			startValues := []string{contract.OwnerServiceID, datatype}
@@ -1070,16 +1262,30 @@ func DownloadOwnerDataAsRequester(stub cached_stub.CachedStubInterface, caller d
 				endValues = append(endValues, endTimestampStr)
 			}
 
-			ownerDatas, err = GetDataInternal(stub, callerObj, []string{"owner", "datatype", "timestamp"}, startValues, endValues, int(maxNum))
+			// the scope filter rule and provenance filter are applied by the data iterator, before maxNum
+			var scopeFilterRule map[string]interface{}
+			if scope != nil {
+				scopeFilterRule = scope.FilterRule
+			}
+			dataFilterRule := getDataFilterRule(combineDataFilterRules(scopeFilterRule, provenanceFilter.rule()))
+
+			if latestOnlyFlag == "true" {
+				ownerDatas, err = getLatestDataInRange(stub, callerObj, contract.OwnerServiceID, datatype, startTimestamp, endTimestamp, dataFilterRule)
+			} else {
+				ownerDatas, err = GetDataInternal(stub, callerObj, []string{"owner", "datatype", "timestamp"}, startValues, endValues, int(maxNum), dataFilterRule)
+			}
 
 			if err != nil {
 				customErr := &GetDatasError{FieldNames: []string{"owner", "datatype", "timestamp"}, Values: startValues}
 				logger.Errorf("%v: %v", customErr, err)
 				return nil, errors.Wrap(err, customErr.Error())
 			}
+		}
 
+		// empty downloads do not use up the download quota
+		if len(ownerDatas) > 0 {
+			contract.recordRequesterDownload(requesterServiceID, datatype)
 		}
-		contract.NumDownload = contract.NumDownload + 1
 	}
 
 	// ==============================================================
@@ -1143,14 +1349,14 @@ func DownloadOwnerDataAsRequester(stub cached_stub.CachedStubInterface, caller d
 // Should only be used by consent target or callers with access to consent target
 // Owner should use DownloadOwnerDataAsOwner function
 //
-// args = [target, owner, datatype, latestOnly, startTimestamp, endTimestamp, maxNum, timestamp]
+// args = [target, owner, datatype, latestOnly, startTimestamp, endTimestamp, maxNum, timestamp, provenanceFilter (optional)]
 // If latest only is true, then other filters are ignored
 // Only used by consent target, owner should use DownloadOwnerDataAsOwner function
 func DownloadOwnerDataWithConsent(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
 	defer utils.ExitFnLog(utils.EnterFnLog())
 	logger.Debugf("args: %v", args)
 
-	if len(args) != 8 {
+	if len(args) != 8 && len(args) != 9 {
 		customErr := &custom_errors.LengthCheckingError{Type: "DownloadOwnerDataWithConsent arguments length"}
 		logger.Errorf(customErr.Error())
 		return nil, errors.WithStack(customErr)
@@ -1227,11 +1433,19 @@ func DownloadOwnerDataWithConsent(stub cached_stub.CachedStubInterface, caller d
 		return nil, errors.New("Invalid Timestamp, not within possible time range")
 	}
 
+	// optional provenance filter
+	provenanceFilter, err := parseDataProvenanceFilter(args, 8)
+	if err != nil {
+		logger.Errorf("Invalid provenance filter: %v", err)
+		return nil, errors.Wrap(err, "Invalid provenance filter")
+	}
+
 	// ==============================================================
 	// Check access and consent
 	// ==============================================================
 	// If caller is owner, skip checking consent
 	callerObj := caller
+	var consentFilterRule map[string]interface{}
 	if caller.ID != owner {
 		// check consent, make sure it's valid
 		consent, err := GetConsentInternal(stub, caller, target, datatype, owner)
@@ -1246,6 +1460,8 @@ func DownloadOwnerDataWithConsent(stub cached_stub.CachedStubInterface, caller d
 			return nil, errors.New("Caller does not have read consent to access owner data")
 		}
 
+		consentFilterRule = consent.FilterRule
+
 		solutionCaller := convertToSolutionUser(caller)
 		// Consent target is org, caller is org admin || consent target is service, caller is service admin
 		if solutionCaller.Org == target || utils.InList(solutionCaller.SolutionInfo.Services, target) {
@@ -1285,6 +1501,9 @@ func DownloadOwnerDataWithConsent(stub cached_stub.CachedStubInterface, caller d
 		return nil, errors.Wrap(err, "Failed getting consent key")
 	}
 
+	// consent filter rule and provenance filter are applied by the data iterator, before maxNum
+	dataFilterRule := combineDataFilterRules(consentFilterRule, provenanceFilter.rule())
+
 	// ==============================================================
 	// Download data using index
 	// ==============================================================
@@ -1297,7 +1516,11 @@ func DownloadOwnerDataWithConsent(stub cached_stub.CachedStubInterface, caller d
 			return nil, errors.WithStack(err)
 		}
 
-		ownerDatas = append(ownerDatas, data)
+		ownerDatas, err = filterOwnerDataByRule([]OwnerDataResult{data}, dataFilterRule)
+		if err != nil {
+			logger.Errorf("Failed to apply data filter rule: %v", err)
+			return nil, errors.Wrap(err, "Failed to apply data filter rule")
+		}
 	} else {
 		startValues := []string{owner, datatype}
 		if startTimestamp >= 0 {
@@ -1321,7 +1544,7 @@ func DownloadOwnerDataWithConsent(stub cached_stub.CachedStubInterface, caller d
 			endValues = append(endValues, endTimestampStr)
 		}
 
-		ownerDatas, err = GetDataInternal(stub, callerObj, []string{"owner", "datatype", "timestamp"}, startValues, endValues, int(maxNum))
+		ownerDatas, err = GetDataInternal(stub, callerObj, []string{"owner", "datatype", "timestamp"}, startValues, endValues, int(maxNum), getDataFilterRule(dataFilterRule))
 		if err != nil {
 			customErr := &GetDatasError{FieldNames: []string{"owner", "datatype", "timestamp"}, Values: startValues}
 			logger.Errorf("%v: %v", customErr, err)
@@ -1334,7 +1557,7 @@ func DownloadOwnerDataWithConsent(stub cached_stub.CachedStubInterface, caller d
 	// ==============================================================
 	consentLogSymKey := GetLogSymKeyFromKey(consentKey)
 
-	dataLog := DataLog{Owner: owner, Datatype: datatype, Target: target}
+	dataLog := DataLog{Owner: owner, Datatype: datatype, Target: target, ProvenanceFilter: provenanceFilter}
 	solutionLog := SolutionLog{
 		TransactionID: stub.GetTxID(),
 		Namespace:     "OMR",
@@ -1357,13 +1580,13 @@ func DownloadOwnerDataWithConsent(stub cached_stub.CachedStubInterface, caller d
 }
 
 // DownloadUserData downloads patient data
-// args = [service, patient, datatype, latestOnly, startTimestamp, endTimestamp, maxNum, timestamp]
+// args = [service, patient, datatype, latestOnly, startTimestamp, endTimestamp, maxNum, timestamp, provenanceFilter (optional)]
 // If latest only is true, then other filters are ignored
 func DownloadUserData(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
 	defer utils.ExitFnLog(utils.EnterFnLog())
 	logger.Debugf("args: %v", args)
 
-	if len(args) != 8 {
+	if len(args) != 8 && len(args) != 9 {
 		customErr := &custom_errors.LengthCheckingError{Type: "DownloadUserData arguments length"}
 		logger.Errorf(customErr.Error())
 		return nil, errors.WithStack(customErr)
@@ -1441,11 +1664,19 @@ func DownloadUserData(stub cached_stub.CachedStubInterface, caller data_model.Us
 		return nil, errors.New("Invalid Timestamp, not within possible time range")
 	}
 
+	// optional provenance filter
+	provenanceFilter, err := parseDataProvenanceFilter(args, 8)
+	if err != nil {
+		logger.Errorf("Invalid provenance filter: %v", err)
+		return nil, errors.Wrap(err, "Invalid provenance filter")
+	}
+
 	// ==============================================================
 	// Check access and consent
 	// ==============================================================
 	// If caller is consent owner, skip checking consent
 	callerObj := caller
+	var consentFilterRule map[string]interface{}
 	if caller.ID != patient {
 		// check consent, make sure it's valid
 		consent, err := GetConsentInternal(stub, caller, service, datatypeID, patient)
@@ -1460,6 +1691,8 @@ func DownloadUserData(stub cached_stub.CachedStubInterface, caller data_model.Us
 			return nil, errors.New("Caller does not have read consent to access patient data")
 		}
 
+		consentFilterRule = consent.FilterRule
+
 		// If caller is org admin of consent target, get consent target user and act as consent target user
 		solutionCaller := convertToSolutionUser(caller)
 		if !utils.InList(solutionCaller.SolutionInfo.Services, service) {
@@ -1492,6 +1725,9 @@ func DownloadUserData(stub cached_stub.CachedStubInterface, caller data_model.Us
 		}
 	}
 
+	// consent filter rule and provenance filter are applied by the data iterator, before maxNum
+	dataFilterRule := combineDataFilterRules(consentFilterRule, provenanceFilter.rule())
+
 	// ==============================================================
 	// Download
 	// ==============================================================
@@ -1504,7 +1740,11 @@ func DownloadUserData(stub cached_stub.CachedStubInterface, caller data_model.Us
 			return nil, errors.WithStack(err)
 		}
 
-		patientDatas = append(patientDatas, data)
+		patientDatas, err = filterOwnerDataByRule([]OwnerDataResult{data}, dataFilterRule)
+		if err != nil {
+			logger.Errorf("Failed to apply data filter rule: %v", err)
+			return nil, errors.Wrap(err, "Failed to apply data filter rule")
+		}
 
 	} else {
 		startValues := []string{patient, datatypeID}
@@ -1529,7 +1769,7 @@ func DownloadUserData(stub cached_stub.CachedStubInterface, caller data_model.Us
 			endValues = append(endValues, endTimestampStr)
 		}
 
-		patientDatas, err = GetDataInternal(stub, callerObj, []string{"owner", "datatype", "timestamp"}, startValues, endValues, int(maxNum))
+		patientDatas, err = GetDataInternal(stub, callerObj, []string{"owner", "datatype", "timestamp"}, startValues, endValues, int(maxNum), getDataFilterRule(dataFilterRule))
 		if err != nil {
 			customErr := &GetDatasError{FieldNames: []string{"owner", "datatype", "timestamp"}, Values: startValues}
 			logger.Errorf("%v: %v", customErr, err)
@@ -1570,7 +1810,7 @@ func DownloadUserData(stub cached_stub.CachedStubInterface, caller data_model.Us
 
 	enrollmentLogSymKey := GetLogSymKeyFromKey(enrollmentKey)
 
-	dataLog := DataLog{Owner: patient, Datatype: datatypeID, Target: service}
+	dataLog := DataLog{Owner: patient, Datatype: datatypeID, Target: service, ProvenanceFilter: provenanceFilter}
 	solutionLog := SolutionLog{
 		TransactionID: stub.GetTxID(),
 		Namespace:     "OMR",
@@ -1673,6 +1913,7 @@ func DownloadUserDataConsentToken(stub cached_stub.CachedStubInterface, caller d
 	// ==============================================================
 
 	callerObj := caller
+	var consentFilterRule map[string]interface{}
 	// If caller is consent owner, skip changing caller
 	if caller.ID != token.Owner {
 		// If caller is org admin of consent target, get consent target user and act as consent target user
@@ -1705,6 +1946,16 @@ func DownloadUserDataConsentToken(stub cached_stub.CachedStubInterface, caller d
 			logger.Errorf("Caller does not have access to consent target private key")
 			return nil, errors.New("Caller does not have access to consent target private key")
 		}
+
+		// token does not carry consent filter rule, look it up as consent target
+		consent, err := GetConsentInternal(stub, callerObj, token.Target, token.Datatype, token.Owner)
+		if err != nil {
+			customErr := &GetConsentError{Consent: "Consent for " + token.Target + ", " + token.Datatype}
+			logger.Errorf("%v: %v", customErr, err)
+			return nil, errors.Wrap(err, customErr.Error())
+		}
+
+		consentFilterRule = consent.FilterRule
 	}
 
 	// ==============================================================
@@ -1720,7 +1971,11 @@ func DownloadUserDataConsentToken(stub cached_stub.CachedStubInterface, caller d
 			return nil, errors.WithStack(err)
 		}
 
-		patientDatas = append(patientDatas, data)
+		patientDatas, err = filterOwnerDataByRule([]OwnerDataResult{data}, consentFilterRule)
+		if err != nil {
+			logger.Errorf("Failed to apply consent filter rule: %v", err)
+			return nil, errors.Wrap(err, "Failed to apply consent filter rule")
+		}
 
 	} else {
 		startValues := []string{token.Owner, token.Datatype}
@@ -1745,7 +2000,7 @@ func DownloadUserDataConsentToken(stub cached_stub.CachedStubInterface, caller d
 			endValues = append(endValues, endTimestampStr)
 		}
 
-		patientDatas, err = GetDataInternal(stub, callerObj, []string{"owner", "datatype"}, startValues, endValues, int(maxNum))
+		patientDatas, err = GetDataInternal(stub, callerObj, []string{"owner", "datatype"}, startValues, endValues, int(maxNum), getDataFilterRule(consentFilterRule))
 		if err != nil {
 			customErr := &GetDatasError{FieldNames: []string{"owner", "datatype", "timestamp"}, Values: startValues}
 			logger.Errorf("%v: %v", customErr, err)
@@ -1884,6 +2139,7 @@ func DownloadOwnerDataConsentToken(stub cached_stub.CachedStubInterface, caller
 	// Construct caller object
 	// ==============================================================
 	callerObj := caller
+	var consentFilterRule map[string]interface{}
 	// If caller is consent owner, skip changing caller
 	if caller.ID != token.Owner {
 		// If caller is org admin of consent target, get consent target user and act as consent target user
@@ -1916,6 +2172,16 @@ func DownloadOwnerDataConsentToken(stub cached_stub.CachedStubInterface, caller
 			logger.Errorf("Caller does not have access to consent target private key")
 			return nil, errors.New("Caller does not have access to consent target private key")
 		}
+
+		// token does not carry consent filter rule, look it up as consent target
+		consent, err := GetConsentInternal(stub, callerObj, token.Target, token.Datatype, token.Owner)
+		if err != nil {
+			customErr := &GetConsentError{Consent: "Consent for " + token.Target + ", " + token.Datatype}
+			logger.Errorf("%v: %v", customErr, err)
+			return nil, errors.Wrap(err, customErr.Error())
+		}
+
+		consentFilterRule = consent.FilterRule
 	}
 
 	// ==============================================================
@@ -1931,7 +2197,11 @@ func DownloadOwnerDataConsentToken(stub cached_stub.CachedStubInterface, caller
 			return nil, errors.WithStack(err)
 		}
 
-		ownerDatas = append(ownerDatas, data)
+		ownerDatas, err = filterOwnerDataByRule([]OwnerDataResult{data}, consentFilterRule)
+		if err != nil {
+			logger.Errorf("Failed to apply consent filter rule: %v", err)
+			return nil, errors.Wrap(err, "Failed to apply consent filter rule")
+		}
 
 	} else {
 		startValues := []string{token.Owner, token.Datatype}
@@ -1956,7 +2226,7 @@ func DownloadOwnerDataConsentToken(stub cached_stub.CachedStubInterface, caller
 			endValues = append(endValues, endTimestampStr)
 		}
 
-		ownerDatas, err = GetDataInternal(stub, callerObj, []string{"owner", "datatype"}, startValues, endValues, int(maxNum))
+		ownerDatas, err = GetDataInternal(stub, callerObj, []string{"owner", "datatype"}, startValues, endValues, int(maxNum), getDataFilterRule(consentFilterRule))
 		if err != nil {
 			customErr := &GetDatasError{FieldNames: []string{"owner", "datatype", "timestamp"}, Values: startValues}
 			logger.Errorf("%v: %v", customErr, err)
@@ -1993,59 +2263,955 @@ func DownloadOwnerDataConsentToken(stub cached_stub.CachedStubInterface, caller
 	return json.Marshal(&returnData)
 }
 
-// DeleteUserData deletes patient data
-// Only data owner can delete data
-func DeleteUserData(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+// DownloadOwnerDataByTag downloads owner data carrying the given tag using the owner,datatype,tag index
+// Should only be used by owner or callers with access to owner
+// args = [owner, datatype, tag, startTimestamp, endTimestamp, maxNum, timestamp]
+func DownloadOwnerDataByTag(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
 	defer utils.ExitFnLog(utils.EnterFnLog())
 	logger.Debugf("args: %v", args)
-	return nil, nil
-}
 
-func convertOwnerDataToAsset(stub cached_stub.CachedStubInterface, data OwnerData) (data_model.Asset, error) {
-	defer utils.ExitFnLog(utils.EnterFnLog())
-	asset := data_model.Asset{}
-	asset.AssetId = asset_mgmt.GetAssetId(OwnerDataNamespace, data.DataID)
-	asset.Datatypes = []string{data.Datatype}
-	metaData := make(map[string]string)
-	metaData["namespace"] = OwnerDataNamespace
-	asset.Metadata = metaData
-	var publicData interface{}
-	asset.PublicData, _ = json.Marshal(&publicData)
-	asset.PrivateData, _ = json.Marshal(&data)
-	asset.OwnerIds = []string{data.Owner}
-	asset.IndexTableName = IndexData
+	if len(args) != 7 {
+		customErr := &custom_errors.LengthCheckingError{Type: "DownloadOwnerDataByTag arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
 
-	// save asset to offchain-datastore, if one is setup
-	dsConnectionID, err := GetActiveConnectionID(stub)
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	owner := args[0]
+	if utils.IsStringEmpty(owner) {
+		customErr := &custom_errors.LengthCheckingError{Type: "owner"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	datatype := args[1]
+	if utils.IsStringEmpty(datatype) {
+		customErr := &custom_errors.LengthCheckingError{Type: "datatype"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	tag := args[2]
+	if utils.IsStringEmpty(tag) {
+		customErr := &custom_errors.LengthCheckingError{Type: "tag"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	startTimestamp, err := strconv.ParseInt(args[3], 10, 64)
 	if err != nil {
-		errMsg := "Failed to GetActiveConnectionID"
-		logger.Errorf("%v: %v", errMsg, err)
-		return data_model.Asset{}, errors.Wrap(err, errMsg)
+		logger.Errorf("Error converting startTimestamp to type int64")
+		return nil, errors.Wrap(err, "Error converting startTimestamp to type int64")
 	}
-	if !utils.IsStringEmpty(dsConnectionID) {
-		asset.SetDatastoreConnectionID(dsConnectionID)
+
+	endTimestamp, err := strconv.ParseInt(args[4], 10, 64)
+	if err != nil {
+		logger.Errorf("Error converting endTimestamp to type int64")
+		return nil, errors.Wrap(err, "Error converting endTimestamp to type int64")
 	}
 
-	return asset, nil
-}
+	maxNum, err := strconv.ParseInt(args[5], 10, 64)
+	if err != nil {
+		logger.Errorf("Error converting maxNum to type int")
+		return nil, errors.Wrap(err, "Error converting maxNum to type int")
+	}
 
-// private function that converts asset to data
-func convertOwnerDataFromAsset(asset *data_model.Asset) OwnerDataResult {
-	defer utils.ExitFnLog(utils.EnterFnLog())
-	ownerData := OwnerDataResult{}
-	json.Unmarshal(asset.PrivateData, &ownerData)
-	return ownerData
+	if maxNum < 0 {
+		logger.Errorf("Max num must be greater than 0")
+		return nil, errors.New("Max num must be greater than 0")
+	}
+
+	timestamp, err := strconv.ParseInt(args[6], 10, 64)
+	if err != nil {
+		logger.Errorf("Error converting timestamp to type int64")
+		return nil, errors.Wrap(err, "Error converting timestamp to type int64")
+	}
+
+	// Check timestamp is within 10 mins of current time
+	currTime := time.Now().Unix()
+	if currTime-timestamp > 10*60 || currTime-timestamp < -10*60 {
+		logger.Errorf("Invalid Timestamp (current time: %v)  %v", currTime, timestamp)
+		return nil, errors.New("Invalid Timestamp, not within possible time range")
+	}
+
+	// ==============================================================
+	// Get owner and act as owner
+	// ==============================================================
+	callerObj, err := GetOwnerCaller(stub, caller, owner)
+	if err != nil {
+		customErr := &GetUserError{User: owner}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	// ==============================================================
+	// Download data using tag index
+	// ==============================================================
+	ownerDatas, err := GetDataByTagInternal(stub, callerObj, owner, datatype, tag, startTimestamp, endTimestamp, int(maxNum), nil)
+	if err != nil {
+		customErr := &GetDatasError{FieldNames: []string{"owner", "datatype", "tag"}, Values: []string{owner, datatype, tag}}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	// ==============================================================
+	// Logging
+	// ==============================================================
+	dataLog := DataLog{Owner: owner, Datatype: datatype, Target: owner, Tags: []string{tag}}
+	solutionLog := SolutionLog{
+		TransactionID: stub.GetTxID(),
+		Namespace:     "OMR",
+		FunctionName:  "DownloadOwnerDataByTag",
+		CallerID:      caller.ID,
+		Timestamp:     timestamp,
+		Data:          dataLog}
+	exportableLog, err := GenerateExportableSolutionLog(stub, caller, solutionLog, callerObj.GetLogSymKey())
+	if err != nil {
+		customErr := &GenerateExportableTransactionLogError{Function: solutionLog.FunctionName}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	returnData := OwnerDataResultWithLog{}
+	returnData.OwnerDatas = ownerDatas
+	returnData.TransactionLog = exportableLog
+	logger.Infof("got owner data: %v", len(ownerDatas))
+
+	return json.Marshal(&returnData)
 }
 
-// SetupDataIndex sets up data index table for data operations
-func SetupDataIndex(stub cached_stub.CachedStubInterface) error {
+// DownloadOwnerDataByTagWithConsent downloads owner or patient data carrying the given tag with consent
+// Should only be used by owner, consent target or callers with access to consent target
+// Consent filter rule is applied on top of the tag, before maxNum
+// args = [target, owner, datatype, tag, startTimestamp, endTimestamp, maxNum, timestamp]
+func DownloadOwnerDataByTagWithConsent(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
 	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
 
-	dataTable := index.GetTable(stub, IndexData, "data_id")
-	dataTable.AddIndex([]string{"owner", "datatype", "timestamp", "data_id"}, false)
-	err := dataTable.SaveToLedger()
-	if err != nil {
-		return err
+	if len(args) != 8 {
+		customErr := &custom_errors.LengthCheckingError{Type: "DownloadOwnerDataByTagWithConsent arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
 	}
-	return nil
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	target := args[0]
+	if utils.IsStringEmpty(target) {
+		customErr := &custom_errors.LengthCheckingError{Type: "target"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	owner := args[1]
+	if utils.IsStringEmpty(owner) {
+		customErr := &custom_errors.LengthCheckingError{Type: "owner"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	datatype := args[2]
+	if utils.IsStringEmpty(datatype) {
+		customErr := &custom_errors.LengthCheckingError{Type: "datatype"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	tag := args[3]
+	if utils.IsStringEmpty(tag) {
+		customErr := &custom_errors.LengthCheckingError{Type: "tag"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	startTimestamp, err := strconv.ParseInt(args[4], 10, 64)
+	if err != nil {
+		logger.Errorf("Error converting startTimestamp to type int64")
+		return nil, errors.Wrap(err, "Error converting startTimestamp to type int64")
+	}
+
+	endTimestamp, err := strconv.ParseInt(args[5], 10, 64)
+	if err != nil {
+		logger.Errorf("Error converting endTimestamp to type int64")
+		return nil, errors.Wrap(err, "Error converting endTimestamp to type int64")
+	}
+
+	maxNum, err := strconv.ParseInt(args[6], 10, 64)
+	if err != nil {
+		logger.Errorf("Error converting maxNum to type int")
+		return nil, errors.Wrap(err, "Error converting maxNum to type int")
+	}
+
+	if maxNum < 0 {
+		logger.Errorf("Max num must be greater than 0")
+		return nil, errors.New("Max num must be greater than 0")
+	}
+
+	timestamp, err := strconv.ParseInt(args[7], 10, 64)
+	if err != nil {
+		logger.Errorf("Error converting timestamp to type int64")
+		return nil, errors.Wrap(err, "Error converting timestamp to type int64")
+	}
+
+	// Check timestamp is within 10 mins of current time
+	currTime := time.Now().Unix()
+	if currTime-timestamp > 10*60 || currTime-timestamp < -10*60 {
+		logger.Errorf("Invalid Timestamp (current time: %v)  %v", currTime, timestamp)
+		return nil, errors.New("Invalid Timestamp, not within possible time range")
+	}
+
+	// ==============================================================
+	// Check access and consent
+	// ==============================================================
+	// If caller is owner, skip checking consent
+	callerObj := caller
+	var consentFilterRule map[string]interface{}
+	if caller.ID != owner {
+		consent, err := GetConsentInternal(stub, caller, target, datatype, owner)
+		if err != nil {
+			customErr := &GetConsentError{Consent: "Consent for " + target + ", " + datatype}
+			logger.Errorf("%v: %v", customErr, err)
+			return nil, errors.Wrap(err, customErr.Error())
+		}
+
+		if !utils.InList(consent.Option, consentOptionRead) && !utils.InList(consent.Option, consentOptionWrite) {
+			logger.Errorf("Caller does not have read consent to access owner data")
+			return nil, errors.New("Caller does not have read consent to access owner data")
+		}
+
+		consentFilterRule = consent.FilterRule
+
+		callerObj, err = GetOwnerCaller(stub, caller, target)
+		if err != nil {
+			customErr := &GetUserError{User: target}
+			logger.Errorf("%v: %v", customErr, err)
+			return nil, errors.Wrap(err, customErr.Error())
+		}
+	}
+
+	// Need to get consent key for logging
+	consentKey, err := GetConsentKeyInternal(stub, callerObj, target, datatype, owner)
+	if err != nil {
+		logger.Errorf("Failed getting consent key")
+		return nil, errors.Wrap(err, "Failed getting consent key")
+	}
+
+	// ==============================================================
+	// Download data using tag index
+	// ==============================================================
+	// consent filter rule is applied to each record before maxNum
+	ownerDatas, err := GetDataByTagInternal(stub, callerObj, owner, datatype, tag, startTimestamp, endTimestamp, int(maxNum), getDataFilterRule(consentFilterRule))
+	if err != nil {
+		customErr := &GetDatasError{FieldNames: []string{"owner", "datatype", "tag"}, Values: []string{owner, datatype, tag}}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	// ==============================================================
+	// Logging
+	// ==============================================================
+	consentLogSymKey := GetLogSymKeyFromKey(consentKey)
+
+	dataLog := DataLog{Owner: owner, Datatype: datatype, Target: target, Tags: []string{tag}}
+	solutionLog := SolutionLog{
+		TransactionID: stub.GetTxID(),
+		Namespace:     "OMR",
+		FunctionName:  "DownloadOwnerDataByTagWithConsent",
+		CallerID:      caller.ID,
+		Timestamp:     timestamp,
+		Data:          dataLog}
+	exportableLog, err := GenerateExportableSolutionLog(stub, caller, solutionLog, consentLogSymKey)
+	if err != nil {
+		customErr := &GenerateExportableTransactionLogError{Function: solutionLog.FunctionName}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	returnData := OwnerDataResultWithLog{}
+	returnData.OwnerDatas = ownerDatas
+	returnData.TransactionLog = exportableLog
+	logger.Infof("got owner data: %v", len(ownerDatas))
+	return json.Marshal(&returnData)
+}
+
+// GetDataIntegrityProof returns the hash recorded when the data was uploaded, the upload transaction,
+// and whether the current copy of the data (which may be stored off-chain) still matches the recorded hash
+// Caller must be the owner or have access to the owner
+// args = [owner, datatype, dataTimestamp, timestamp]
+func GetDataIntegrityProof(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 4 {
+		customErr := &custom_errors.LengthCheckingError{Type: "GetDataIntegrityProof arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	owner := args[0]
+	if utils.IsStringEmpty(owner) {
+		customErr := &custom_errors.LengthCheckingError{Type: "owner"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	datatype := args[1]
+	if utils.IsStringEmpty(datatype) {
+		customErr := &custom_errors.LengthCheckingError{Type: "datatype"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	dataTimestamp, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		logger.Errorf("Error converting dataTimestamp to type int64")
+		return nil, errors.Wrap(err, "Error converting dataTimestamp to type int64")
+	}
+
+	timestamp, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil {
+		logger.Errorf("Error converting timestamp to type int64")
+		return nil, errors.Wrap(err, "Error converting timestamp to type int64")
+	}
+
+	// Check timestamp is within 10 mins of current time
+	currTime := time.Now().Unix()
+	if currTime-timestamp > 10*60 || currTime-timestamp < -10*60 {
+		logger.Errorf("Invalid Timestamp (current time: %v)  %v", currTime, timestamp)
+		return nil, errors.New("Invalid Timestamp, not within possible time range")
+	}
+
+	// ==============================================================
+	// Get owner and act as owner
+	// ==============================================================
+	callerObj, err := GetOwnerCaller(stub, caller, owner)
+	if err != nil {
+		logger.Errorf("Failed to get owner caller: %v", err)
+		return nil, errors.Wrap(err, "Failed to get owner caller")
+	}
+
+	// ==============================================================
+	// Get data asset and compare hash
+	// ==============================================================
+	dataID := GetOwnerDataID(owner, datatype, dataTimestamp)
+	assetID := asset_mgmt.GetAssetId(OwnerDataNamespace, dataID)
+	keyPath, err := GetKeyPath(stub, callerObj, assetID)
+	if err != nil || len(keyPath) <= 0 {
+		customErr := &GetKeyPathError{Caller: caller.ID, AssetID: assetID}
+		logger.Errorf(customErr.Error())
+		return nil, errors.New(customErr.Error())
+	}
+
+	assetManager := asset_mgmt.GetAssetManager(stub, callerObj)
+	dataKey, err := assetManager.GetAssetKey(assetID, keyPath)
+	if err != nil {
+		customErr := &GetDataKeyError{KeyID: assetID}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	dataAsset, err := assetManager.GetAsset(assetID, dataKey)
+	if err != nil {
+		customErr := &custom_errors.GetAssetDataError{AssetId: assetID}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	if utils.IsStringEmpty(dataAsset.AssetId) {
+		customErr := &custom_errors.GetAssetDataError{AssetId: assetID}
+		logger.Errorf(customErr.Error())
+		return nil, errors.New(customErr.Error())
+	}
+
+	if data_model.IsEncryptedData(dataAsset.PrivateData) {
+		logger.Errorf("Failed to decrypt data asset")
+		return nil, errors.New("Failed to decrypt data asset")
+	}
+
+	publicData := ownerDataPublicData{}
+	json.Unmarshal(dataAsset.PublicData, &publicData)
+	if utils.IsStringEmpty(publicData.DataHash) {
+		logger.Errorf("No integrity hash was recorded for data %v", dataID)
+		return nil, errors.New("No integrity hash was recorded for data " + dataID)
+	}
+
+	proof := DataIntegrityProof{}
+	proof.DataID = dataID
+	proof.Owner = owner
+	proof.Datatype = datatype
+	proof.Timestamp = dataTimestamp
+	proof.RecordedHash = publicData.DataHash
+	proof.CurrentHash = GetOwnerDataHash(dataAsset.PrivateData, dataKey)
+	proof.TxID = publicData.TxID
+	proof.TxTimestamp = publicData.TxTimestamp
+	proof.DatastoreConnectionID = publicData.DatastoreConnectionID
+	proof.OffChain = !utils.IsStringEmpty(publicData.DatastoreConnectionID)
+	proof.Shredded = publicData.Shredded
+	proof.Matches = proof.RecordedHash == proof.CurrentHash
+
+	proof.BlockNumber, err = GetBlockNumberByTxID(stub, publicData.TxID)
+	if err != nil {
+		logger.Errorf("Failed to get block of transaction %v: %v", publicData.TxID, err)
+		return nil, errors.Wrap(err, "Failed to get block of transaction "+publicData.TxID)
+	}
+
+	return json.Marshal(&proof)
+}
+
+// validateDataProvenance validates provenance of uploaded data, if provided
+// Ingest timestamp is always the transaction timestamp; author is always the caller
+// A signature must be a base64 encoded signature of the JSON encoded data field by the signer, see verifySignature
+// The signer is the device or source system, registered as a user so its public key can be looked up
+func validateDataProvenance(stub cached_stub.CachedStubInterface, data *OwnerData, caller data_model.User) error {
+	if data.Provenance == nil {
+		return nil
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil || txTimestamp == nil {
+		logger.Errorf("Failed to get transaction timestamp: %v", err)
+		return errors.New("Failed to get transaction timestamp")
+	}
+	data.Provenance.IngestTimestamp = txTimestamp.Seconds
+
+	if !utils.IsStringEmpty(data.Provenance.Author) && data.Provenance.Author != caller.ID {
+		logger.Errorf("Invalid provenance author: %v, caller: %v", data.Provenance.Author, caller.ID)
+		return errors.New("Provenance author must be the caller")
+	}
+	data.Provenance.Author = caller.ID
+
+	if data.Provenance.OriginalTimestamp <= 0 {
+		data.Provenance.OriginalTimestamp = data.Timestamp
+	}
+
+	// original timestamp cannot be after the record timestamp, which is checked against current time
+	if data.Provenance.OriginalTimestamp > data.Timestamp {
+		logger.Errorf("Invalid original timestamp: %v, record timestamp: %v", data.Provenance.OriginalTimestamp, data.Timestamp)
+		return errors.New("Original timestamp cannot be after record timestamp")
+	}
+
+	if utils.IsStringEmpty(data.Provenance.Signature) {
+		if !utils.IsStringEmpty(data.Provenance.SignerID) {
+			logger.Errorf("Provenance signer %v given without signature", data.Provenance.SignerID)
+			return errors.New("Provenance signer cannot be set without signature")
+		}
+
+		return nil
+	}
+
+	if utils.IsStringEmpty(data.Provenance.SignerID) {
+		logger.Errorf("Provenance signature given without signer")
+		return errors.New("Provenance signer must be set with signature")
+	}
+
+	signer, err := user_mgmt.GetUserData(stub, caller, data.Provenance.SignerID, false, false)
+	if err != nil || utils.IsStringEmpty(signer.ID) {
+		customErr := &GetUserError{User: data.Provenance.SignerID}
+		logger.Errorf("%v: %v", customErr, err)
+		return errors.New(customErr.Error())
+	}
+
+	payload, err := json.Marshal(data.Data)
+	if err != nil {
+		customErr := &custom_errors.MarshalError{Type: "data"}
+		logger.Errorf("%v: %v", customErr, err)
+		return errors.Wrap(err, customErr.Error())
+	}
+
+	err = verifySignature(signer.PublicKey, payload, data.Provenance.Signature)
+	if err != nil {
+		logger.Errorf("Failed to verify provenance signature of %v: %v", signer.ID, err)
+		return errors.Wrap(err, "Invalid provenance signature")
+	}
+
+	return nil
+}
+
+// parseDataProvenanceFilter parses optional provenance filter at args[index]
+// returns nil if filter is not provided
+func parseDataProvenanceFilter(args []string, index int) (*DataProvenanceFilter, error) {
+	if len(args) <= index || utils.IsStringEmpty(args[index]) {
+		return nil, nil
+	}
+
+	filter := DataProvenanceFilter{}
+	err := json.Unmarshal([]byte(args[index]), &filter)
+	if err != nil {
+		customErr := &custom_errors.UnmarshalError{Type: "provenanceFilter"}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	return &filter, nil
+}
+
+// rule returns the data filter rule of the provenance filter, or nil if no field of the filter is set
+// The rule is evaluated against the record as private_data, see dataFilterRuleAllows
+// Data without provenance does not match a filter with any field set
+func (filter *DataProvenanceFilter) rule() map[string]interface{} {
+	if filter == nil {
+		return nil
+	}
+
+	fieldRules := []interface{}{}
+	fields := map[string]string{"source_system": filter.SourceSystem, "device_id": filter.DeviceID, "author": filter.Author}
+	for _, field := range []string{"source_system", "device_id", "author"} {
+		if !utils.IsStringEmpty(fields[field]) {
+			fieldRules = append(fieldRules, simple_rule.R("==", simple_rule.R("var", "private_data.provenance."+field), fields[field]))
+		}
+	}
+
+	// signature is missing or empty on unsigned records, both are falsy
+	if filter.SignedOnly {
+		fieldRules = append(fieldRules, simple_rule.R("!", simple_rule.R("!", simple_rule.R("var", "private_data.provenance.signature"))))
+	}
+
+	if len(fieldRules) == 0 {
+		return nil
+	}
+
+	return simple_rule.R("and", fieldRules...)
+}
+
+// combineDataFilterRules returns a data filter rule allowing records allowed by all given rules, or nil if none is set
+func combineDataFilterRules(rules ...map[string]interface{}) map[string]interface{} {
+	setRules := []interface{}{}
+	for _, rule := range rules {
+		if len(rule) > 0 {
+			setRules = append(setRules, rule)
+		}
+	}
+
+	if len(setRules) == 0 {
+		return nil
+	}
+
+	if len(setRules) == 1 {
+		return setRules[0].(map[string]interface{})
+	}
+
+	return simple_rule.R("and", setRules...)
+}
+
+// validateDataTags trims tags of uploaded data and removes duplicates
+func validateDataTags(data *OwnerData) error {
+	if len(data.Tags) > maxDataTags {
+		logger.Errorf("Too many tags: %v", len(data.Tags))
+		return errors.Errorf("Data cannot have more than %v tags", maxDataTags)
+	}
+
+	tags := []string{}
+	for _, tag := range data.Tags {
+		tag = strings.TrimSpace(tag)
+		if utils.IsStringEmpty(tag) {
+			return errors.New("Tag cannot be empty")
+		}
+
+		// tags are part of composite index keys
+		if strings.ContainsAny(tag, "\x00\U0010FFFF") {
+			return errors.New("Tag contains invalid characters")
+		}
+
+		if !utils.InList(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+
+	if len(tags) == 0 {
+		data.Tags = nil
+	} else {
+		data.Tags = tags
+	}
+
+	return nil
+}
+
+// validateDataFilterRule returns an error if a data filter rule is set but cannot be evaluated
+// The rule is evaluated against a sample record, so unknown operators are rejected up front
+func validateDataFilterRule(filterRule map[string]interface{}) error {
+	_, err := dataFilterRuleAllows(filterRule, OwnerDataResult{Tags: []string{"tag"}})
+	return err
+}
+
+// getDataFilterRule returns a data filter rule to pass to the data asset iterator, or nil if none is set
+func getDataFilterRule(filterRule map[string]interface{}) *simple_rule.Rule {
+	if len(filterRule) == 0 {
+		return nil
+	}
+
+	rule := simple_rule.NewRule(filterRule)
+	return &rule
+}
+
+// dataFilterRuleAllows evaluates a data filter rule against a record
+func dataFilterRuleAllows(filterRule map[string]interface{}, data OwnerDataResult) (bool, error) {
+	rule := getDataFilterRule(filterRule)
+	if rule == nil {
+		return true, nil
+	}
+
+	return applyDataFilterRule(*rule, data)
+}
+
+// applyDataFilterRule evaluates a data filter rule against a record
+// The record is passed as private_data, the same way the data asset iterator sees it
+func applyDataFilterRule(rule simple_rule.Rule, data OwnerDataResult) (bool, error) {
+	dataBytes, _ := json.Marshal(&data)
+	privateData := make(map[string]interface{})
+	json.Unmarshal(dataBytes, &privateData)
+
+	result, err := rule.Apply(map[string]interface{}{"private_data": privateData})
+	if err != nil {
+		logger.Errorf("Failed to evaluate data filter rule: %v", err)
+		return false, errors.Wrap(err, "Failed to evaluate data filter rule")
+	}
+
+	return result["$result"] == true, nil
+}
+
+// getLatestDataInRange returns the latest record of owner and datatype in the time range allowed by filterRule, if any
+// The latest copy of a record has no timestamp, so it cannot be checked against a range or a filter rule;
+// instead the range is searched back from its end in time windows that double in size,
+// so only records newer than the latest match are read rather than every record in range
+// endTimestamp of 0 or less means up to current time
+func getLatestDataInRange(stub cached_stub.CachedStubInterface, caller data_model.User, owner string, datatype string, startTimestamp int64, endTimestamp int64, filterRule *simple_rule.Rule) ([]OwnerDataResult, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+
+	if startTimestamp < 0 {
+		startTimestamp = 0
+	}
+
+	if endTimestamp <= 0 {
+		txTimestamp, err := stub.GetTxTimestamp()
+		if err != nil || txTimestamp == nil {
+			logger.Errorf("Failed to get transaction timestamp: %v", err)
+			return nil, errors.New("Failed to get transaction timestamp")
+		}
+
+		// uploaded data can be timestamped up to 10 mins ahead of current time
+		endTimestamp = txTimestamp.Seconds + 10*60
+	}
+
+	window := int64(latestDataScanWindow)
+	windowEnd := endTimestamp
+	for windowEnd >= startTimestamp {
+		windowStart := windowEnd - window
+		if windowStart < startTimestamp {
+			windowStart = startTimestamp
+		}
+
+		windowStartStr, err := utils.ConvertToString(windowStart)
+		if err != nil {
+			errMsg := "Failed to ConvertToString for startTimestamp"
+			logger.Errorf("%v: %v", errMsg, err)
+			return nil, errors.Wrap(err, errMsg)
+		}
+
+		windowEndStr, err := utils.ConvertToString(windowEnd)
+		if err != nil {
+			errMsg := "Failed to ConvertToString for endTimestamp"
+			logger.Errorf("%v: %v", errMsg, err)
+			return nil, errors.Wrap(err, errMsg)
+		}
+
+		datas, err := GetDataInternal(stub, caller, []string{"owner", "datatype", "timestamp"}, []string{owner, datatype, windowStartStr}, []string{owner, datatype, windowEndStr}, -1, filterRule)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(datas) > 0 {
+			return datas[len(datas)-1:], nil
+		}
+
+		if windowStart == startTimestamp {
+			break
+		}
+
+		windowEnd = windowStart
+		window *= 2
+	}
+
+	return []OwnerDataResult{}, nil
+}
+
+// filterOwnerDataByRule returns data allowed by a data filter rule, such as a consent filter rule
+// Used for data not read through the data asset iterator, which applies the rule itself
+func filterOwnerDataByRule(datas []OwnerDataResult, filterRule map[string]interface{}) ([]OwnerDataResult, error) {
+	if len(filterRule) == 0 {
+		return datas, nil
+	}
+
+	filtered := []OwnerDataResult{}
+	for _, data := range datas {
+		allowed, err := dataFilterRuleAllows(filterRule, data)
+		if err != nil {
+			return nil, err
+		}
+
+		if allowed {
+			filtered = append(filtered, data)
+		}
+	}
+
+	return filtered, nil
+}
+
+// DeleteUserData deletes patient data
+// Only data owner can delete data
+func DeleteUserData(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+	return nil, nil
+}
+
+func convertOwnerDataToAsset(stub cached_stub.CachedStubInterface, data OwnerData) (data_model.Asset, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	asset := data_model.Asset{}
+	asset.AssetId = asset_mgmt.GetAssetId(OwnerDataNamespace, data.DataID)
+	asset.Datatypes = []string{data.Datatype}
+	metaData := make(map[string]string)
+	metaData["namespace"] = OwnerDataNamespace
+	asset.Metadata = metaData
+	asset.PrivateData, _ = json.Marshal(&data)
+	asset.OwnerIds = []string{data.Owner}
+	asset.IndexTableName = IndexData
+
+	// save asset to offchain-datastore, if one is setup
+	dsConnectionID, err := GetActiveConnectionID(stub)
+	if err != nil {
+		errMsg := "Failed to GetActiveConnectionID"
+		logger.Errorf("%v: %v", errMsg, err)
+		return data_model.Asset{}, errors.Wrap(err, errMsg)
+	}
+	if !utils.IsStringEmpty(dsConnectionID) {
+		asset.SetDatastoreConnectionID(dsConnectionID)
+	}
+
+	// hash of the payload is recorded by setOwnerDataHash once the data key is known
+	publicData := ownerDataPublicData{}
+	publicData.DataID = data.DataID
+	publicData.Timestamp = data.Timestamp
+	publicData.TxID = stub.GetTxID()
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err == nil && txTimestamp != nil {
+		publicData.TxTimestamp = txTimestamp.Seconds
+	}
+	publicData.DatastoreConnectionID = dsConnectionID
+	asset.PublicData, _ = json.Marshal(&publicData)
+
+	return asset, nil
+}
+
+// GetOwnerDataHash returns hex encoded HMAC-SHA256 of owner data asset's private data, keyed by the data key
+// A plain hash would be public, and low-entropy health records could be confirmed by guessing
+func GetOwnerDataHash(privateData []byte, dataKey data_model.Key) string {
+	mac := hmac.New(sha256.New, dataKey.KeyBytes)
+	mac.Write(privateData)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// setOwnerDataHash records the hash of the payload in public data of an owner data asset,
+// so the off-chain copy can be verified later
+func setOwnerDataHash(asset *data_model.Asset, dataKey data_model.Key) {
+	publicData := ownerDataPublicData{}
+	json.Unmarshal(asset.PublicData, &publicData)
+	publicData.DataHash = GetOwnerDataHash(asset.PrivateData, dataKey)
+	asset.PublicData, _ = json.Marshal(&publicData)
+}
+
+// private function that converts asset to data
+func convertOwnerDataFromAsset(asset *data_model.Asset) OwnerDataResult {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	ownerData := OwnerDataResult{}
+	json.Unmarshal(asset.PrivateData, &ownerData)
+	return ownerData
+}
+
+// SetupDataIndex sets up data index table for data operations
+func SetupDataIndex(stub cached_stub.CachedStubInterface) error {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+
+	dataTable := index.GetTable(stub, IndexData, "data_id")
+	dataTable.AddIndex([]string{"owner", "datatype", "timestamp", "data_id"}, false)
+	dataTable.AddIndex([]string{"service", "datatype", "timestamp", "data_id"}, false)
+	err := dataTable.SaveToLedger()
+	if err != nil {
+		return err
+	}
+
+	// a record can have several tags, so each tag is stored as its own asset, see putDataTagIndex
+	dataTagTable := index.GetTable(stub, IndexDataTag, "tag_id")
+	dataTagTable.AddIndex([]string{"owner", "datatype", "tag", "timestamp", "data_id"}, false)
+	err = dataTagTable.SaveToLedger()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// dataTag is stored as an asset for each tag of a record, so records can be found by tag using the tag index
+// It is encrypted with the data key of the record, so only callers with access to the data can read it
+type dataTag struct {
+	TagID     string `json:"tag_id"`
+	Owner     string `json:"owner"`
+	Datatype  string `json:"datatype"`
+	Tag       string `json:"tag"`
+	Timestamp int64  `json:"timestamp"`
+	DataID    string `json:"data_id"`
+}
+
+// GetDataTagID composes data tag ID of a tag of a record
+func GetDataTagID(dataID string, tag string) string {
+	tagIDHash := sha256.Sum256([]byte(dataID + "\x00" + tag))
+	return hex.EncodeToString(tagIDHash[:])
+}
+
+// convertDataTagToAsset converts a tag of a record to an asset
+func convertDataTagToAsset(data OwnerData, tag string) data_model.Asset {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+
+	tagAsset := dataTag{TagID: GetDataTagID(data.DataID, tag), Owner: data.Owner, Datatype: data.Datatype, Tag: tag, Timestamp: data.Timestamp, DataID: data.DataID}
+	asset := data_model.Asset{}
+	asset.AssetId = asset_mgmt.GetAssetId(DataTagNamespace, tagAsset.TagID)
+	asset.Datatypes = []string{data.Datatype}
+	metaData := make(map[string]string)
+	metaData["namespace"] = DataTagNamespace
+	asset.Metadata = metaData
+	asset.PrivateData, _ = json.Marshal(&tagAsset)
+	asset.PublicData, _ = json.Marshal(map[string]string{"tag_id": tagAsset.TagID})
+	asset.OwnerIds = []string{data.Owner}
+	asset.IndexTableName = IndexDataTag
+	return asset
+}
+
+// putDataTagIndex adds tag index entries for a record
+func putDataTagIndex(stub cached_stub.CachedStubInterface, caller data_model.User, data OwnerData, dataKey data_model.Key) error {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+
+	assetManager := asset_mgmt.GetAssetManager(stub, caller)
+	for _, tag := range data.Tags {
+		tagAsset := convertDataTagToAsset(data, tag)
+		err := assetManager.AddAsset(tagAsset, dataKey, false)
+		if err != nil {
+			customErr := &PutAssetError{Asset: tagAsset.AssetId}
+			logger.Errorf("%v: %v", customErr, err)
+			return errors.Wrap(err, customErr.Error())
+		}
+	}
+
+	return nil
+}
+
+// deleteDataTagIndex removes tag index entries of a record
+func deleteDataTagIndex(stub cached_stub.CachedStubInterface, caller data_model.User, data OwnerData, dataKey data_model.Key) error {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+
+	assetManager := asset_mgmt.GetAssetManager(stub, caller)
+	for _, tag := range data.Tags {
+		tagAssetID := asset_mgmt.GetAssetId(DataTagNamespace, GetDataTagID(data.DataID, tag))
+		err := assetManager.DeleteAsset(tagAssetID, dataKey)
+		if err != nil {
+			customErr := &DeleteAssetError{Asset: tagAssetID}
+			logger.Errorf("%v: %v", customErr, err)
+			return errors.Wrap(err, customErr.Error())
+		}
+	}
+
+	return nil
+}
+
+// GetDataByTagInternal returns data of owner and datatype carrying tag, using the tag index
+// Timestamps less than or equal to 0 are ignored; maxNum of 0 means no limit
+// filterRule, if not nil, is applied to each record before it counts toward maxNum
+// Tag index entries do not hold record fields, so the rule is applied to the records rather than in the tag iterator
+// Assume caller is owner or consent target
+func GetDataByTagInternal(stub cached_stub.CachedStubInterface, caller data_model.User, owner string, datatype string, tag string, startTimestamp int64, endTimestamp int64, maxNum int, filterRule *simple_rule.Rule) ([]OwnerDataResult, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+
+	startValues := []string{owner, datatype, tag}
+	if startTimestamp > 0 {
+		startTimestampStr, err := utils.ConvertToString(startTimestamp)
+		if err != nil {
+			errMsg := "Failed to ConvertToString for startTimestamp"
+			logger.Errorf("%v: %v", errMsg, err)
+			return nil, errors.Wrap(err, errMsg)
+		}
+		startValues = append(startValues, startTimestampStr)
+	}
+
+	endValues := []string{owner, datatype, tag}
+	if endTimestamp > 0 {
+		endTimestampStr, err := utils.ConvertToString(endTimestamp)
+		if err != nil {
+			errMsg := "Failed to ConvertToString for endTimestamp"
+			logger.Errorf("%v: %v", errMsg, err)
+			return nil, errors.Wrap(err, errMsg)
+		}
+		endValues = append(endValues, endTimestampStr)
+	}
+
+	// records filtered out do not count toward maxNum, so the tag iterator cannot be limited
+	limit := maxNum
+	if limit <= 0 || filterRule != nil {
+		limit = -1
+	}
+
+	iter, err := asset_mgmt.GetAssetManager(stub, caller).GetAssetIter(DataTagNamespace, IndexDataTag, []string{"owner", "datatype", "tag", "timestamp", "data_id"}, startValues, endValues, true, false, KeyPathFunc, "", limit, nil)
+	if err != nil {
+		logger.Errorf("GetAssets failed: %v", err)
+		return nil, errors.Wrap(err, "GetAssets failed")
+	}
+
+	defer iter.Close()
+	datas := []OwnerDataResult{}
+	for iter.HasNext() {
+		tagAsset, err := iter.Next()
+		if err != nil {
+			customErr := &custom_errors.IterError{}
+			logger.Errorf("%v: %v", customErr, err)
+			return nil, errors.Wrap(err, customErr.Error())
+		}
+
+		if utils.IsStringEmpty(tagAsset.AssetId) {
+			continue
+		}
+
+		if data_model.IsEncryptedData(tagAsset.PrivateData) {
+			logger.Errorf("Caller does not have access to data tag %v", tagAsset.AssetId)
+			return nil, errors.New("Caller does not have access to data tag " + tagAsset.AssetId)
+		}
+
+		tagData := dataTag{}
+		json.Unmarshal(tagAsset.PrivateData, &tagData)
+		assetID := asset_mgmt.GetAssetId(OwnerDataNamespace, tagData.DataID)
+		data, err := GetDataWithAssetID(stub, caller, assetID, owner, datatype)
+		if err != nil {
+			logger.Errorf("Failed to get data with assetID %v: %v", assetID, err)
+			return nil, errors.Wrap(err, "Failed to get data with assetID "+assetID)
+		}
+
+		if filterRule != nil {
+			allowed, err := applyDataFilterRule(*filterRule, data)
+			if err != nil {
+				return nil, err
+			}
+
+			if !allowed {
+				continue
+			}
+		}
+
+		datas = append(datas, data)
+		if maxNum > 0 && len(datas) >= maxNum {
+			break
+		}
+	}
+
+	return datas, nil
 }
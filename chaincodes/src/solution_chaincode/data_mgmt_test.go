@@ -10,6 +10,12 @@
 package main
 
 import (
+	gocrypto "crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+
 	"common/bchcls/asset_mgmt"
 	"common/bchcls/cached_stub"
 	"common/bchcls/consent_mgmt"
@@ -17,9 +23,11 @@ import (
 	"common/bchcls/data_model"
 	"common/bchcls/datastore/datastore_manager"
 	"common/bchcls/init_common"
+	"common/bchcls/simple_rule"
 	"common/bchcls/test_utils"
 	"common/bchcls/user_access_ctrl"
 	"common/bchcls/user_mgmt"
+	"common/bchcls/utils"
 	"net/url"
 
 	"encoding/json"
@@ -27,7 +35,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/common"
+	"github.com/hyperledger/fabric/protos/peer"
 )
 
 func GeneratePatientData(Owner string, Datatype string, Service string) OwnerData {
@@ -44,6 +55,15 @@ func GeneratePatientData(Owner string, Datatype string, Service string) OwnerDat
 	return patientData
 }
 
+// GenerateDataProvenanceSignatureTest signs the data field of a record as the signer of its provenance
+func GenerateDataProvenanceSignatureTest(t *testing.T, signer data_model.User, data interface{}) string {
+	payload, _ := json.Marshal(data)
+	hash := sha256.Sum256(payload)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, signer.PrivateKey, gocrypto.SHA256, hash[:])
+	test_utils.AssertTrue(t, err == nil, "Expected SignPKCS1v15 to succeed")
+	return base64.StdEncoding.EncodeToString(signature)
+}
+
 func GenerateOwnerData(Owner string, Datatype string) OwnerData {
 	ownerData := OwnerData{}
 	ownerData.Owner = Owner
@@ -480,7 +500,7 @@ func TestUploadUserData_OffChain(t *testing.T) {
 	// get user data to make sure it was registered
 	mstub.MockTransactionStart("t123")
 	stub = cached_stub.NewCachedStub(mstub)
-	ownerDatas, err := GetDataInternal(stub, service1Subgroup, []string{"owner", "datatype", "timestamp"}, []string{patientData.Owner, patientData.Datatype}, []string{patientData.Owner, patientData.Datatype}, 1)
+	ownerDatas, err := GetDataInternal(stub, service1Subgroup, []string{"owner", "datatype", "timestamp"}, []string{patientData.Owner, patientData.Datatype}, []string{patientData.Owner, patientData.Datatype}, 1, nil)
 	test_utils.AssertTrue(t, err == nil, "Expected GetDataInternal to succeed")
 	test_utils.AssertTrue(t, len(ownerDatas) == 1, "Expected 1 user data")
 	test_utils.AssertTrue(t, ownerDatas[0].Owner == patientData.Owner, "Expected Owner")
@@ -572,7 +592,7 @@ func TestUploadUserData_OffChain(t *testing.T) {
 	// attempt to get user data
 	mstub.MockTransactionStart("t123")
 	stub = cached_stub.NewCachedStub(mstub)
-	ownerDatas, err = GetDataInternal(stub, service1Subgroup, []string{"owner", "datatype", "timestamp"}, []string{patientData.Owner, patientData.Datatype}, []string{patientData.Owner, patientData.Datatype}, 1)
+	ownerDatas, err = GetDataInternal(stub, service1Subgroup, []string{"owner", "datatype", "timestamp"}, []string{patientData.Owner, patientData.Datatype}, []string{patientData.Owner, patientData.Datatype}, 1, nil)
 	test_utils.AssertTrue(t, err == nil, "Expected GetDataInternal to succeed")
 	test_utils.AssertTrue(t, len(ownerDatas) == 0, "Expected no user data")
 	mstub.MockTransactionEnd("t123")
@@ -2165,3 +2185,447 @@ func TestDownloadOwnerDataAsOwner(t *testing.T) {
 	test_utils.AssertTrue(t, dataResult.OwnerDatas[0].Owner == "service1", "Got owner data correctly")
 	mstub.MockTransactionEnd("10")
 }
+
+// mockQscc answers GetBlockByTxID with a block of a fixed number, and records the requested transaction ID
+type mockQscc struct {
+	blockNumber uint64
+	txID        string
+}
+
+func (q *mockQscc) Init(stub shim.ChaincodeStubInterface) peer.Response {
+	return shim.Success(nil)
+}
+
+func (q *mockQscc) Invoke(stub shim.ChaincodeStubInterface) peer.Response {
+	args := stub.GetArgs()
+	if len(args) != 3 || string(args[0]) != "GetBlockByTxID" {
+		return shim.Error("unsupported qscc function")
+	}
+
+	q.txID = string(args[2])
+	blockBytes, _ := proto.Marshal(&common.Block{Header: &common.BlockHeader{Number: q.blockNumber}})
+	return shim.Success(blockBytes)
+}
+
+func TestGetDataIntegrityProof(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestGetDataIntegrityProof function called")
+
+	// create a MockStub
+	mstub := SetupIndexesAndGetStub(t)
+	qscc := &mockQscc{blockNumber: 17}
+	mstub.MockPeerChaincode("qscc", shim.NewMockStub("qscc", qscc))
+
+	// register admin user
+	mstub.MockTransactionStart("t123")
+	stub := cached_stub.NewCachedStub(mstub)
+	init_common.Init(stub)
+	err := SetupDataIndex(stub)
+	systemAdmin := test_utils.CreateTestUser("systemAdmin")
+	systemAdmin.Role = SOLUTION_ROLE_SYSTEM
+	systemAdminBytes, _ := json.Marshal(&systemAdmin)
+	_, err = RegisterUser(stub, systemAdmin, []string{string(systemAdminBytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterUser to succeed")
+	mstub.MockTransactionEnd("t123")
+
+	// setup off-chain datastore
+	datastoreConnectionID := "cloudant1"
+	err = setupDatastore(mstub, systemAdmin, datastoreConnectionID)
+	test_utils.AssertTrue(t, err == nil, "Expected setupDatastore to succeed")
+
+	// Register system datatypes
+	mstub.MockTransactionStart("init")
+	stub = cached_stub.NewCachedStub(mstub)
+	RegisterSystemDatatypeTest(t, stub, systemAdmin)
+	mstub.MockTransactionEnd("init")
+
+	// register org
+	mstub.MockTransactionStart("t123")
+	stub = cached_stub.NewCachedStub(mstub)
+	org1 := test_utils.CreateTestGroup("org1")
+	org1Bytes, _ := json.Marshal(&org1)
+	_, err = RegisterOrg(stub, org1, []string{string(org1Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterOrg to succeed")
+	mstub.MockTransactionEnd("t123")
+
+	//  register datatype
+	mstub.MockTransactionStart("t123")
+	stub = cached_stub.NewCachedStub(mstub)
+	datatype1 := Datatype{DatatypeID: "datatype1", Description: "datatype1"}
+	datatype1Bytes, _ := json.Marshal(&datatype1)
+	org1Caller, _ := user_mgmt.GetUserData(stub, org1, org1.ID, true, true)
+	_, err = RegisterDatatype(stub, org1Caller, []string{string(datatype1Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterDatatype to succeed")
+	mstub.MockTransactionEnd("t123")
+
+	//  register service
+	mstub.MockTransactionStart("t123")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	serviceDatatype1 := GenerateServiceDatatypeForTesting("datatype1", "service1", []string{consentOptionWrite, consentOptionRead})
+	service1 := GenerateServiceForTesting("service1", "org1", []ServiceDatatype{serviceDatatype1})
+	service1Bytes, _ := json.Marshal(&service1)
+	_, err = RegisterService(stub, org1Caller, []string{string(service1Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterService to succeed")
+	mstub.MockTransactionEnd("t123")
+
+	// upload owner data as default service admin
+	mstub.MockTransactionStart("4")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	ownerData := GenerateOwnerData("service1", "datatype1")
+	ownerDataBytes, _ := json.Marshal(&ownerData)
+	dataKey := test_utils.GenerateSymKey()
+	dataKeyB64 := crypto.EncodeToB64String(dataKey)
+	serviceSubgroup, _ := user_mgmt.GetUserData(stub, org1Caller, "service1", true, true)
+	_, err = UploadOwnerData(stub, serviceSubgroup, []string{string(ownerDataBytes), dataKeyB64})
+	test_utils.AssertTrue(t, err == nil, "Expected UploadOwnerData to succeed")
+	mstub.MockTransactionEnd("4")
+
+	// get proof as service
+	mstub.MockTransactionStart("5")
+	stub = cached_stub.NewCachedStub(mstub)
+	dataTimestampStr := strconv.FormatInt(ownerData.Timestamp, 10)
+	proofBytes, err := GetDataIntegrityProof(stub, serviceSubgroup, []string{"service1", "datatype1", dataTimestampStr, strconv.FormatInt(time.Now().Unix(), 10)})
+	test_utils.AssertTrue(t, err == nil, "Expected GetDataIntegrityProof to succeed")
+	proof := DataIntegrityProof{}
+	json.Unmarshal(proofBytes, &proof)
+	test_utils.AssertTrue(t, proof.Matches, "Expected data to match recorded hash")
+	test_utils.AssertTrue(t, proof.OffChain, "Expected data to be stored off-chain")
+	test_utils.AssertTrue(t, proof.DatastoreConnectionID == datastoreConnectionID, "Expected datastore connection ID")
+	test_utils.AssertTrue(t, proof.TxID == "4", "Expected upload transaction ID")
+	test_utils.AssertTrue(t, qscc.txID == "4", "Expected block lookup by upload transaction ID")
+	test_utils.AssertTrue(t, proof.BlockNumber == 17, "Expected block of upload transaction")
+	test_utils.AssertTrue(t, len(proof.RecordedHash) > 0, "Expected recorded hash")
+	mstub.MockTransactionEnd("5")
+
+	// get proof as org admin
+	mstub.MockTransactionStart("6")
+	stub = cached_stub.NewCachedStub(mstub)
+	proofBytes, err = GetDataIntegrityProof(stub, org1Caller, []string{"service1", "datatype1", dataTimestampStr, strconv.FormatInt(time.Now().Unix(), 10)})
+	test_utils.AssertTrue(t, err == nil, "Expected GetDataIntegrityProof to succeed")
+	proof = DataIntegrityProof{}
+	json.Unmarshal(proofBytes, &proof)
+	test_utils.AssertTrue(t, proof.Matches, "Expected data to match recorded hash")
+	mstub.MockTransactionEnd("6")
+
+	// get proof for data that does not exist
+	mstub.MockTransactionStart("7")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = GetDataIntegrityProof(stub, serviceSubgroup, []string{"service1", "datatype1", "12345", strconv.FormatInt(time.Now().Unix(), 10)})
+	test_utils.AssertTrue(t, err != nil, "Expected GetDataIntegrityProof to fail")
+	mstub.MockTransactionEnd("7")
+
+	// get proof as unrelated user
+	mstub.MockTransactionStart("8")
+	stub = cached_stub.NewCachedStub(mstub)
+	patient1 := test_utils.CreateTestUser("patient1")
+	patient1Bytes, _ := json.Marshal(&patient1)
+	_, err = user_mgmt.RegisterUser(stub, org1Caller, []string{string(patient1Bytes), "false"})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterUser to succeed")
+	mstub.MockTransactionEnd("8")
+
+	mstub.MockTransactionStart("9")
+	stub = cached_stub.NewCachedStub(mstub)
+	patient1Caller, _ := user_mgmt.GetUserData(stub, patient1, patient1.ID, true, true)
+	_, err = GetDataIntegrityProof(stub, patient1Caller, []string{"service1", "datatype1", dataTimestampStr, strconv.FormatInt(time.Now().Unix(), 10)})
+	test_utils.AssertTrue(t, err != nil, "Expected GetDataIntegrityProof to fail")
+	mstub.MockTransactionEnd("9")
+}
+
+func TestOwnerDataProvenance(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestOwnerDataProvenance function called")
+
+	// create a MockStub
+	mstub := SetupIndexesAndGetStub(t)
+
+	// register admin user
+	mstub.MockTransactionStart("t123")
+	stub := cached_stub.NewCachedStub(mstub)
+	init_common.Init(stub)
+	err := SetupDataIndex(stub)
+	systemAdmin := test_utils.CreateTestUser("systemAdmin")
+	systemAdmin.Role = SOLUTION_ROLE_SYSTEM
+	systemAdminBytes, _ := json.Marshal(&systemAdmin)
+	_, err = RegisterUser(stub, systemAdmin, []string{string(systemAdminBytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterUser to succeed")
+	mstub.MockTransactionEnd("t123")
+
+	// Register system datatypes
+	mstub.MockTransactionStart("init")
+	stub = cached_stub.NewCachedStub(mstub)
+	RegisterSystemDatatypeTest(t, stub, systemAdmin)
+	mstub.MockTransactionEnd("init")
+
+	// register org
+	mstub.MockTransactionStart("t123")
+	stub = cached_stub.NewCachedStub(mstub)
+	org1 := test_utils.CreateTestGroup("org1")
+	org1Bytes, _ := json.Marshal(&org1)
+	_, err = RegisterOrg(stub, org1, []string{string(org1Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterOrg to succeed")
+	mstub.MockTransactionEnd("t123")
+
+	//  register datatype
+	mstub.MockTransactionStart("t123")
+	stub = cached_stub.NewCachedStub(mstub)
+	datatype1 := Datatype{DatatypeID: "datatype1", Description: "datatype1"}
+	datatype1Bytes, _ := json.Marshal(&datatype1)
+	org1Caller, _ := user_mgmt.GetUserData(stub, org1, org1.ID, true, true)
+	_, err = RegisterDatatype(stub, org1Caller, []string{string(datatype1Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterDatatype to succeed")
+	mstub.MockTransactionEnd("t123")
+
+	//  register service
+	mstub.MockTransactionStart("t123")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	serviceDatatype1 := GenerateServiceDatatypeForTesting("datatype1", "service1", []string{consentOptionWrite, consentOptionRead})
+	service1 := GenerateServiceForTesting("service1", "org1", []ServiceDatatype{serviceDatatype1})
+	service1Bytes, _ := json.Marshal(&service1)
+	_, err = RegisterService(stub, org1Caller, []string{string(service1Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterService to succeed")
+	mstub.MockTransactionEnd("t123")
+
+	// register wearable device that signs its readings
+	mstub.MockTransactionStart("t123")
+	stub = cached_stub.NewCachedStub(mstub)
+	device1 := test_utils.CreateTestUser("device1")
+	device1Bytes, _ := json.Marshal(&device1)
+	_, err = user_mgmt.RegisterUser(stub, org1Caller, []string{string(device1Bytes), "false"})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterUser to succeed")
+	mstub.MockTransactionEnd("t123")
+
+	// upload with original timestamp after record timestamp fails
+	mstub.MockTransactionStart("1")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	serviceSubgroup, _ := user_mgmt.GetUserData(stub, org1Caller, "service1", true, true)
+	ownerData := GenerateOwnerData("service1", "datatype1")
+	ownerData.Provenance = &DataProvenance{SourceSystem: "ehr1", OriginalTimestamp: ownerData.Timestamp + 100}
+	ownerDataBytes, _ := json.Marshal(&ownerData)
+	dataKeyB64 := crypto.EncodeToB64String(test_utils.GenerateSymKey())
+	_, err = UploadOwnerData(stub, serviceSubgroup, []string{string(ownerDataBytes), dataKeyB64})
+	test_utils.AssertTrue(t, err != nil, "Expected UploadOwnerData to fail")
+	mstub.MockTransactionEnd("1")
+
+	// upload record from EHR
+	mstub.MockTransactionStart("2")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	ownerData = GenerateOwnerData("service1", "datatype1")
+	ownerData.Provenance = &DataProvenance{SourceSystem: "ehr1", OriginalTimestamp: ownerData.Timestamp - 3600}
+	ownerDataBytes, _ = json.Marshal(&ownerData)
+	_, err = UploadOwnerData(stub, serviceSubgroup, []string{string(ownerDataBytes), dataKeyB64})
+	test_utils.AssertTrue(t, err == nil, "Expected UploadOwnerData to succeed")
+	mstub.MockTransactionEnd("2")
+
+	// upload with another author, an invalid signature, a signature by the uploader or without signer fails
+	mstub.MockTransactionStart("3")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	ownerData = GenerateOwnerData("service1", "datatype1")
+	ownerData.Timestamp++
+	ownerData.Provenance = &DataProvenance{SourceSystem: "wearable", DeviceID: "device1", Author: org1Caller.ID}
+	ownerDataBytes, _ = json.Marshal(&ownerData)
+	_, err = UploadOwnerData(stub, serviceSubgroup, []string{string(ownerDataBytes)})
+	test_utils.AssertTrue(t, err != nil, "Expected UploadOwnerData with other author to fail")
+	ownerData.Provenance = &DataProvenance{SourceSystem: "wearable", DeviceID: "device1", SignerID: "device1", Signature: crypto.EncodeToB64String([]byte("signature"))}
+	ownerDataBytes, _ = json.Marshal(&ownerData)
+	_, err = UploadOwnerData(stub, serviceSubgroup, []string{string(ownerDataBytes)})
+	test_utils.AssertTrue(t, err != nil, "Expected UploadOwnerData with invalid signature to fail")
+	ownerData.Provenance = &DataProvenance{SourceSystem: "wearable", DeviceID: "device1", SignerID: "device1", Signature: GenerateDataProvenanceSignatureTest(t, serviceSubgroup, ownerData.Data)}
+	ownerDataBytes, _ = json.Marshal(&ownerData)
+	_, err = UploadOwnerData(stub, serviceSubgroup, []string{string(ownerDataBytes)})
+	test_utils.AssertTrue(t, err != nil, "Expected UploadOwnerData with signature by uploader to fail")
+	ownerData.Provenance = &DataProvenance{SourceSystem: "wearable", DeviceID: "device1", Signature: GenerateDataProvenanceSignatureTest(t, device1, ownerData.Data)}
+	ownerDataBytes, _ = json.Marshal(&ownerData)
+	_, err = UploadOwnerData(stub, serviceSubgroup, []string{string(ownerDataBytes)})
+	test_utils.AssertTrue(t, err != nil, "Expected UploadOwnerData without signer to fail")
+	mstub.MockTransactionEnd("3")
+
+	// upload signed record from wearable device, and a record without provenance
+	mstub.MockTransactionStart("3a")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	ownerData.Provenance = &DataProvenance{SourceSystem: "wearable", DeviceID: "device1", SignerID: "device1", Signature: GenerateDataProvenanceSignatureTest(t, device1, ownerData.Data)}
+	ownerDataBytes, _ = json.Marshal(&ownerData)
+	_, err = UploadOwnerData(stub, serviceSubgroup, []string{string(ownerDataBytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected UploadOwnerData to succeed")
+	ownerData = GenerateOwnerData("service1", "datatype1")
+	ownerData.Timestamp += 2
+	ownerDataBytes, _ = json.Marshal(&ownerData)
+	_, err = UploadOwnerData(stub, serviceSubgroup, []string{string(ownerDataBytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected UploadOwnerData to succeed")
+	mstub.MockTransactionEnd("3a")
+
+	// download without filter, and with an empty filter
+	mstub.MockTransactionStart("4")
+	stub = cached_stub.NewCachedStub(mstub)
+	timestampStr := strconv.FormatInt(time.Now().Unix(), 10)
+	dataResultBytes, err := DownloadOwnerDataAsOwner(stub, serviceSubgroup, []string{"service1", "datatype1", "false", "0", "0", "1000", timestampStr})
+	test_utils.AssertTrue(t, err == nil, "Expected DownloadOwnerDataAsOwner to succeed")
+	dataResult := OwnerDataResultWithLog{}
+	json.Unmarshal(dataResultBytes, &dataResult)
+	test_utils.AssertTrue(t, len(dataResult.OwnerDatas) == 3, "Expected 3 records")
+	test_utils.AssertTrue(t, dataResult.OwnerDatas[0].Provenance != nil, "Expected provenance")
+	test_utils.AssertTrue(t, dataResult.OwnerDatas[0].Provenance.Author == serviceSubgroup.ID, "Expected author to be caller")
+	txTimestamp, _ := mstub.GetTxTimestamp()
+	test_utils.AssertTrue(t, dataResult.OwnerDatas[0].Provenance.IngestTimestamp > 0 && dataResult.OwnerDatas[0].Provenance.IngestTimestamp <= txTimestamp.Seconds, "Expected ingest timestamp of upload transaction")
+
+	filterBytes, _ := json.Marshal(&DataProvenanceFilter{})
+	dataResultBytes, err = DownloadOwnerDataAsOwner(stub, serviceSubgroup, []string{"service1", "datatype1", "false", "0", "0", "1000", timestampStr, string(filterBytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected DownloadOwnerDataAsOwner to succeed")
+	dataResult = OwnerDataResultWithLog{}
+	json.Unmarshal(dataResultBytes, &dataResult)
+	test_utils.AssertTrue(t, len(dataResult.OwnerDatas) == 3, "Expected empty filter to keep records without provenance")
+	mstub.MockTransactionEnd("4")
+
+	// download with source system filter, filter is applied before maxNum
+	mstub.MockTransactionStart("5")
+	stub = cached_stub.NewCachedStub(mstub)
+	filterBytes, _ = json.Marshal(&DataProvenanceFilter{SourceSystem: "wearable"})
+	dataResultBytes, err = DownloadOwnerDataAsOwner(stub, serviceSubgroup, []string{"service1", "datatype1", "false", "0", "0", "1", timestampStr, string(filterBytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected DownloadOwnerDataAsOwner to succeed")
+	dataResult = OwnerDataResultWithLog{}
+	json.Unmarshal(dataResultBytes, &dataResult)
+	test_utils.AssertTrue(t, len(dataResult.OwnerDatas) == 1, "Expected 1 record")
+	test_utils.AssertTrue(t, dataResult.OwnerDatas[0].Provenance.DeviceID == "device1", "Expected wearable record")
+	mstub.MockTransactionEnd("5")
+
+	// download signed records only
+	mstub.MockTransactionStart("6")
+	stub = cached_stub.NewCachedStub(mstub)
+	filterBytes, _ = json.Marshal(&DataProvenanceFilter{SourceSystem: "ehr1", SignedOnly: true})
+	dataResultBytes, err = DownloadOwnerDataAsOwner(stub, serviceSubgroup, []string{"service1", "datatype1", "false", "0", "0", "1000", timestampStr, string(filterBytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected DownloadOwnerDataAsOwner to succeed")
+	dataResult = OwnerDataResultWithLog{}
+	json.Unmarshal(dataResultBytes, &dataResult)
+	test_utils.AssertTrue(t, len(dataResult.OwnerDatas) == 0, "Expected 0 records")
+	mstub.MockTransactionEnd("6")
+}
+
+func TestDownloadOwnerDataByTag(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestDownloadOwnerDataByTag function called")
+
+	// create a MockStub
+	mstub := SetupIndexesAndGetStub(t)
+
+	// register admin user
+	mstub.MockTransactionStart("t123")
+	stub := cached_stub.NewCachedStub(mstub)
+	init_common.Init(stub)
+	err := SetupDataIndex(stub)
+	systemAdmin := test_utils.CreateTestUser("systemAdmin")
+	systemAdmin.Role = SOLUTION_ROLE_SYSTEM
+	systemAdminBytes, _ := json.Marshal(&systemAdmin)
+	_, err = RegisterUser(stub, systemAdmin, []string{string(systemAdminBytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterUser to succeed")
+	mstub.MockTransactionEnd("t123")
+
+	// Register system datatypes
+	mstub.MockTransactionStart("init")
+	stub = cached_stub.NewCachedStub(mstub)
+	RegisterSystemDatatypeTest(t, stub, systemAdmin)
+	mstub.MockTransactionEnd("init")
+
+	// register org
+	mstub.MockTransactionStart("t123")
+	stub = cached_stub.NewCachedStub(mstub)
+	org1 := test_utils.CreateTestGroup("org1")
+	org1Bytes, _ := json.Marshal(&org1)
+	_, err = RegisterOrg(stub, org1, []string{string(org1Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterOrg to succeed")
+	mstub.MockTransactionEnd("t123")
+
+	//  register datatype
+	mstub.MockTransactionStart("t123")
+	stub = cached_stub.NewCachedStub(mstub)
+	datatype1 := Datatype{DatatypeID: "datatype1", Description: "datatype1"}
+	datatype1Bytes, _ := json.Marshal(&datatype1)
+	org1Caller, _ := user_mgmt.GetUserData(stub, org1, org1.ID, true, true)
+	_, err = RegisterDatatype(stub, org1Caller, []string{string(datatype1Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterDatatype to succeed")
+	mstub.MockTransactionEnd("t123")
+
+	//  register service
+	mstub.MockTransactionStart("t123")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	serviceDatatype1 := GenerateServiceDatatypeForTesting("datatype1", "service1", []string{consentOptionWrite, consentOptionRead})
+	service1 := GenerateServiceForTesting("service1", "org1", []ServiceDatatype{serviceDatatype1})
+	service1Bytes, _ := json.Marshal(&service1)
+	_, err = RegisterService(stub, org1Caller, []string{string(service1Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterService to succeed")
+	mstub.MockTransactionEnd("t123")
+
+	// empty tag is rejected
+	mstub.MockTransactionStart("1")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	serviceSubgroup, _ := user_mgmt.GetUserData(stub, org1Caller, "service1", true, true)
+	ownerData := GenerateOwnerData("service1", "datatype1")
+	ownerData.Tags = []string{"fasting", " "}
+	ownerDataBytes, _ := json.Marshal(&ownerData)
+	dataKeyB64 := crypto.EncodeToB64String(test_utils.GenerateSymKey())
+	_, err = UploadOwnerData(stub, serviceSubgroup, []string{string(ownerDataBytes), dataKeyB64})
+	test_utils.AssertTrue(t, err != nil, "Expected UploadOwnerData to fail")
+	mstub.MockTransactionEnd("1")
+
+	// upload 3 records with different tags
+	now := time.Now().Unix()
+	tags := [][]string{{"fasting"}, {"post-op", "fasting", "fasting"}, nil}
+	for i, recordTags := range tags {
+		txID := "upload" + strconv.Itoa(i)
+		mstub.MockTransactionStart(txID)
+		stub = cached_stub.NewCachedStub(mstub, true, true, true)
+		ownerData = GenerateOwnerData("service1", "datatype1")
+		ownerData.Timestamp = now - int64(len(tags)-i)
+		ownerData.Tags = recordTags
+		ownerDataBytes, _ = json.Marshal(&ownerData)
+		args := []string{string(ownerDataBytes)}
+		if i == 0 {
+			args = append(args, dataKeyB64)
+		}
+		_, err = UploadOwnerData(stub, serviceSubgroup, args)
+		test_utils.AssertTrue(t, err == nil, "Expected UploadOwnerData to succeed")
+		mstub.MockTransactionEnd(txID)
+	}
+
+	// download by tag
+	mstub.MockTransactionStart("2")
+	stub = cached_stub.NewCachedStub(mstub)
+	timestampStr := strconv.FormatInt(time.Now().Unix(), 10)
+	dataResultBytes, err := DownloadOwnerDataByTag(stub, serviceSubgroup, []string{"service1", "datatype1", "fasting", "0", "0", "1000", timestampStr})
+	test_utils.AssertTrue(t, err == nil, "Expected DownloadOwnerDataByTag to succeed")
+	dataResult := OwnerDataResultWithLog{}
+	json.Unmarshal(dataResultBytes, &dataResult)
+	test_utils.AssertTrue(t, len(dataResult.OwnerDatas) == 2, "Expected 2 records")
+	test_utils.AssertTrue(t, len(dataResult.OwnerDatas[1].Tags) == 2, "Expected duplicate tag to be removed")
+
+	dataResultBytes, err = DownloadOwnerDataByTag(stub, serviceSubgroup, []string{"service1", "datatype1", "post-op", "0", "0", "1000", timestampStr})
+	test_utils.AssertTrue(t, err == nil, "Expected DownloadOwnerDataByTag to succeed")
+	dataResult = OwnerDataResultWithLog{}
+	json.Unmarshal(dataResultBytes, &dataResult)
+	test_utils.AssertTrue(t, len(dataResult.OwnerDatas) == 1, "Expected 1 record")
+	mstub.MockTransactionEnd("2")
+
+	// time range and max num are applied
+	mstub.MockTransactionStart("3")
+	stub = cached_stub.NewCachedStub(mstub)
+	dataResultBytes, err = DownloadOwnerDataByTag(stub, serviceSubgroup, []string{"service1", "datatype1", "fasting", strconv.FormatInt(now-2, 10), "0", "1000", timestampStr})
+	test_utils.AssertTrue(t, err == nil, "Expected DownloadOwnerDataByTag to succeed")
+	dataResult = OwnerDataResultWithLog{}
+	json.Unmarshal(dataResultBytes, &dataResult)
+	test_utils.AssertTrue(t, len(dataResult.OwnerDatas) == 1, "Expected 1 record")
+
+	dataResultBytes, err = DownloadOwnerDataByTag(stub, serviceSubgroup, []string{"service1", "datatype1", "fasting", "0", "0", "1", timestampStr})
+	test_utils.AssertTrue(t, err == nil, "Expected DownloadOwnerDataByTag to succeed")
+	dataResult = OwnerDataResultWithLog{}
+	json.Unmarshal(dataResultBytes, &dataResult)
+	test_utils.AssertTrue(t, len(dataResult.OwnerDatas) == 1, "Expected 1 record")
+	mstub.MockTransactionEnd("3")
+
+	// filter rule is applied before max num
+	mstub.MockTransactionStart("4")
+	stub = cached_stub.NewCachedStub(mstub)
+	filterRule := simple_rule.R("in", "post-op", simple_rule.R("var", "private_data.tags"))
+	ownerDatas, err := GetDataByTagInternal(stub, serviceSubgroup, "service1", "datatype1", "fasting", 0, 0, 1, getDataFilterRule(filterRule))
+	test_utils.AssertTrue(t, err == nil, "Expected GetDataByTagInternal to succeed")
+	test_utils.AssertTrue(t, len(ownerDatas) == 1, "Expected 1 record")
+	test_utils.AssertTrue(t, utils.InList(ownerDatas[0].Tags, "post-op"), "Expected post-op record")
+	mstub.MockTransactionEnd("4")
+}
@@ -0,0 +1,799 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
+	"common/bchcls/asset_mgmt"
+	"common/bchcls/cached_stub"
+	"common/bchcls/custom_errors"
+	"common/bchcls/data_model"
+	"common/bchcls/datatype"
+	"common/bchcls/key_mgmt"
+	"common/bchcls/user_access_ctrl"
+	"common/bchcls/utils"
+
+	"github.com/pkg/errors"
+)
+
+const retentionActionDelete = "delete"
+const retentionActionShred = "shred"
+const retentionCursorPrefix = "OMR.RetentionCursor."
+const dataKeyVersionPrefix = "OMR.DataKeyVersion."
+const maxRetentionBatchSize = 500
+
+// RetentionCursor keeps track of where the previous applyRetention batch stopped for a service
+type RetentionCursor struct {
+	ServiceID string `json:"service_id"`
+	Datatype  string `json:"datatype"`
+	Timestamp int64  `json:"timestamp"`
+	DataID    string `json:"data_id"`
+}
+
+// RetentionReport is returned by ApplyRetention and stored in the retention log
+type RetentionReport struct {
+	ServiceID string          `json:"service_id"`
+	Action    string          `json:"action"`
+	Datatypes []string        `json:"datatypes"`
+	Processed int             `json:"processed"`
+	Deleted   int             `json:"deleted"`
+	Shredded  int             `json:"shredded"`
+	Skipped   int             `json:"skipped"`
+	Complete  bool            `json:"complete"`
+	Cursor    RetentionCursor `json:"cursor"`
+	Timestamp int64           `json:"timestamp"`
+}
+
+// ApplyRetention removes data of a service that is older than the retention period of its datatype
+// Can only be called by service admin or org admin of the service
+// Action "delete" deletes the data asset; action "shred" overwrites the data with an empty payload.
+// All data of an owner and datatype pair share the same data key, so the key cannot be destroyed per record.
+// Once the latest data and every other record of the pair are past retention, the latest copy is deleted and
+// access to the data key is revoked, so earlier versions of the records on ledger can no longer be decrypted.
+// Data uploaded before the service index existed must be reindexed with ReindexRetentionData first.
+// At most batchSize records are processed per call. Progress is saved on ledger, so calling the function again
+// continues where the previous call stopped, until the report says complete.
+// args = [serviceID, action, batchSize, timestamp]
+func ApplyRetention(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 4 {
+		customErr := &custom_errors.LengthCheckingError{Type: "ApplyRetention arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	serviceID := args[0]
+	if utils.IsStringEmpty(serviceID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "serviceID"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	action := args[1]
+	if action != retentionActionDelete && action != retentionActionShred {
+		logger.Errorf("Invalid retention action: %v", action)
+		return nil, errors.New("Invalid retention action, must be delete or shred")
+	}
+
+	batchSize, err := strconv.Atoi(args[2])
+	if err != nil {
+		logger.Errorf("Error converting batchSize to type int")
+		return nil, errors.Wrap(err, "Error converting batchSize to type int")
+	}
+
+	if batchSize <= 0 || batchSize > maxRetentionBatchSize {
+		logger.Errorf("Invalid batch size: %v", batchSize)
+		return nil, errors.New("Batch size must be between 1 and " + strconv.Itoa(maxRetentionBatchSize))
+	}
+
+	timestamp, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil {
+		logger.Errorf("Error converting timestamp to type int64")
+		return nil, errors.Wrap(err, "Error converting timestamp to type int64")
+	}
+
+	// Check timestamp is within 10 mins of current time
+	currTime := time.Now().Unix()
+	if currTime-timestamp > 10*60 || currTime-timestamp < -10*60 {
+		logger.Errorf("Invalid Timestamp (current time: %v)  %v", currTime, timestamp)
+		return nil, errors.New("Invalid Timestamp, not within possible time range")
+	}
+
+	service, err := GetServiceInternal(stub, caller, serviceID, false)
+	if err != nil {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	if utils.IsStringEmpty(service.ServiceID) {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	if !CallerIsAdminOfService(caller, service.ServiceID, service.OrgID) {
+		logger.Errorf("Caller must be admin of service")
+		return nil, errors.New("Caller must be admin of service")
+	}
+
+	// ==============================================================
+	// Act as service
+	// ==============================================================
+	callerObj, err := GetOwnerCaller(stub, caller, serviceID)
+	if err != nil {
+		logger.Errorf("Failed to get service caller: %v", err)
+		return nil, errors.Wrap(err, "Failed to get service caller")
+	}
+
+	// ==============================================================
+	// Apply retention, one batch at a time
+	// ==============================================================
+	cursor, err := getRetentionCursor(stub, serviceID)
+	if err != nil {
+		logger.Errorf("Failed to get retention cursor: %v", err)
+		return nil, errors.Wrap(err, "Failed to get retention cursor")
+	}
+
+	// datatype was removed from service since last batch, start over
+	if !utils.IsStringEmpty(cursor.Datatype) && !service.hasDatatype(cursor.Datatype) {
+		cursor = RetentionCursor{ServiceID: serviceID}
+	}
+
+	report := RetentionReport{ServiceID: serviceID, Action: action, Datatypes: []string{}, Timestamp: timestamp}
+	remaining := batchSize
+	resumed := utils.IsStringEmpty(cursor.Datatype)
+	for _, serviceDatatype := range service.Datatypes {
+		datatypeID := serviceDatatype.DatatypeID
+
+		// skip datatypes already finished by previous batches
+		if !resumed {
+			if datatypeID != cursor.Datatype {
+				continue
+			}
+			resumed = true
+		} else {
+			// check before moving the cursor, so a full batch resumes where it stopped
+			if remaining <= 0 {
+				break
+			}
+			cursor = RetentionCursor{ServiceID: serviceID, Datatype: datatypeID}
+		}
+
+		retentionPeriod := service.GetRetentionPeriod(datatypeID)
+		if retentionPeriod <= 0 {
+			continue
+		}
+
+		report.Datatypes = append(report.Datatypes, datatypeID)
+		cursor, remaining, err = applyRetentionToDatatype(stub, callerObj, cursor, timestamp-retentionPeriod, action, remaining, &report)
+		if err != nil {
+			logger.Errorf("Failed to apply retention to datatype %v: %v", datatypeID, err)
+			return nil, errors.Wrap(err, "Failed to apply retention to datatype "+datatypeID)
+		}
+	}
+
+	// batch stopped before reaching the end, save cursor so the next call can resume
+	if remaining <= 0 {
+		report.Cursor = cursor
+		err = putRetentionCursor(stub, cursor)
+	} else {
+		report.Complete = true
+		err = stub.DelState(retentionCursorPrefix + serviceID)
+	}
+	if err != nil {
+		customErr := &custom_errors.PutLedgerError{LedgerKey: retentionCursorPrefix + serviceID}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	// ==============================================================
+	// Logging
+	// ==============================================================
+	logSymKey := callerObj.GetLogSymKey()
+	dataLog := DataLog{Owner: serviceID, Service: serviceID, Data: report}
+	solutionLog := SolutionLog{
+		TransactionID: stub.GetTxID(),
+		Namespace:     "OMR",
+		FunctionName:  "ApplyRetention",
+		CallerID:      caller.ID,
+		Timestamp:     timestamp,
+		Data:          dataLog}
+
+	err = AddLogWithParams(stub, callerObj, solutionLog, logSymKey)
+	if err != nil {
+		customErr := &AddSolutionLogError{FunctionName: solutionLog.FunctionName}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	return json.Marshal(&report)
+}
+
+// applyRetentionToDatatype walks data of a service and datatype by timestamp, up to cutoff,
+// and examines at most limit records
+// returns cursor pointing at the last record examined and the number of records that can still be examined
+// if the returned limit is greater than 0, there is no more data past retention for this datatype
+func applyRetentionToDatatype(stub cached_stub.CachedStubInterface, caller data_model.User, cursor RetentionCursor, cutoff int64, action string, limit int, report *RetentionReport) (RetentionCursor, int, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+
+	startValues := []string{cursor.ServiceID, cursor.Datatype}
+	if !utils.IsStringEmpty(cursor.DataID) {
+		startTimestampStr, err := utils.ConvertToString(cursor.Timestamp)
+		if err != nil {
+			errMsg := "Failed to ConvertToString for cursor timestamp"
+			logger.Errorf("%v: %v", errMsg, err)
+			return cursor, limit, errors.Wrap(err, errMsg)
+		}
+		startValues = append(startValues, startTimestampStr, cursor.DataID)
+	}
+
+	cutoffStr, err := utils.ConvertToString(cutoff)
+	if err != nil {
+		errMsg := "Failed to ConvertToString for cutoff"
+		logger.Errorf("%v: %v", errMsg, err)
+		return cursor, limit, errors.Wrap(err, errMsg)
+	}
+	endValues := []string{cursor.ServiceID, cursor.Datatype, cutoffStr}
+
+	// fetch one extra record, since start of range includes the record the cursor points at
+	iter, err := asset_mgmt.GetAssetManager(stub, caller).GetAssetIter(OwnerDataNamespace, IndexData, []string{"service", "datatype", "timestamp", "data_id"}, startValues, endValues, true, false, KeyPathFunc, "", limit+1, nil)
+	if err != nil {
+		logger.Errorf("GetAssets failed: %v", err)
+		return cursor, limit, errors.Wrap(err, "GetAssets failed")
+	}
+
+	defer iter.Close()
+	for limit > 0 && iter.HasNext() {
+		dataAsset, err := iter.Next()
+		if err != nil {
+			customErr := &custom_errors.IterError{}
+			logger.Errorf("%v: %v", customErr, err)
+			return cursor, limit, errors.Wrap(err, customErr.Error())
+		}
+
+		if utils.IsStringEmpty(dataAsset.AssetId) {
+			continue
+		}
+
+		publicData := ownerDataPublicData{}
+		json.Unmarshal(dataAsset.PublicData, &publicData)
+
+		// record pointed at by cursor was handled by previous batch
+		if !utils.IsStringEmpty(cursor.DataID) && publicData.DataID == cursor.DataID {
+			continue
+		}
+
+		limit--
+		if !utils.IsStringEmpty(publicData.DataID) {
+			cursor.Timestamp = publicData.Timestamp
+			cursor.DataID = publicData.DataID
+		}
+
+		// shredded records can no longer be decrypted once the data key is destroyed
+		if action == retentionActionShred && publicData.Shredded {
+			continue
+		}
+
+		if data_model.IsEncryptedData(dataAsset.PrivateData) {
+			// caller cannot access this record, leave it for the owner
+			logger.Warningf("Skipping data asset %v, caller does not have access", dataAsset.AssetId)
+			report.Skipped++
+			continue
+		}
+
+		ownerData := OwnerData{}
+		json.Unmarshal(dataAsset.PrivateData, &ownerData)
+
+		// latest copy is handled together with the record it copies
+		if ownerData.Timestamp < 0 || ownerData.Timestamp > cutoff {
+			continue
+		}
+
+		err = applyRetentionToData(stub, caller, dataAsset, ownerData, action)
+		if err != nil {
+			logger.Errorf("Failed to apply retention to %v: %v", dataAsset.AssetId, err)
+			return cursor, limit, errors.Wrap(err, "Failed to apply retention to "+dataAsset.AssetId)
+		}
+
+		if action == retentionActionDelete {
+			report.Deleted++
+		} else {
+			report.Shredded++
+		}
+		report.Processed++
+	}
+
+	return cursor, limit, nil
+}
+
+// applyRetentionToData deletes or shreds a single data asset
+// if the latest copy of the data was written in the same transaction, it is shredded as well
+// once the latest copy is shredded and no other record of the owner and datatype is left, the data key is destroyed
+func applyRetentionToData(stub cached_stub.CachedStubInterface, caller data_model.User, dataAsset *data_model.Asset, ownerData OwnerData, action string) error {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+
+	assetManager := asset_mgmt.GetAssetManager(stub, caller)
+	dataKey, err := getOwnerDataAssetKey(stub, caller, dataAsset.AssetId)
+	if err != nil {
+		return err
+	}
+
+	if action == retentionActionDelete {
+		err = assetManager.DeleteAsset(dataAsset.AssetId, dataKey)
+		if err != nil {
+			customErr := &DeleteAssetError{Asset: dataAsset.AssetId}
+			logger.Errorf("%v: %v", customErr, err)
+			return errors.Wrap(err, customErr.Error())
+		}
+	} else {
+		err = shredOwnerDataAsset(stub, caller, dataAsset, dataKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = deleteDataTagIndex(stub, caller, ownerData, dataKey)
+	if err != nil {
+		return err
+	}
+
+	// shred latest copy if it holds the same data
+	publicData := ownerDataPublicData{}
+	json.Unmarshal(dataAsset.PublicData, &publicData)
+	latestAssetID := GetLatestOwnerDataAssetID(stub, ownerData.Owner, ownerData.Datatype)
+	latestAsset, err := assetManager.GetAsset(latestAssetID, dataKey)
+	if err != nil {
+		customErr := &custom_errors.GetAssetDataError{AssetId: latestAssetID}
+		logger.Errorf("%v: %v", customErr, err)
+		return errors.Wrap(err, customErr.Error())
+	}
+
+	if utils.IsStringEmpty(latestAsset.AssetId) {
+		return nil
+	}
+
+	latestPublicData := ownerDataPublicData{}
+	json.Unmarshal(latestAsset.PublicData, &latestPublicData)
+	if !latestPublicData.Shredded {
+		if utils.IsStringEmpty(publicData.TxID) || latestPublicData.TxID != publicData.TxID {
+			return nil
+		}
+
+		err = shredOwnerDataAsset(stub, caller, latestAsset, dataKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	// data key can only be destroyed when no record of the owner and datatype can still be read
+	readable, err := hasReadableOwnerData(stub, caller, ownerData.Owner, ownerData.Datatype)
+	if err != nil {
+		return err
+	}
+
+	if readable {
+		return nil
+	}
+
+	return destroyOwnerDataKey(stub, caller, ownerData.Owner, ownerData.Datatype, latestAssetID, dataKey)
+}
+
+// getOwnerDataAssetKey returns the data key of an owner data asset, using the caller's key path
+func getOwnerDataAssetKey(stub cached_stub.CachedStubInterface, caller data_model.User, assetID string) (data_model.Key, error) {
+	keyPath, err := GetKeyPath(stub, caller, assetID)
+	if err != nil || len(keyPath) <= 0 {
+		customErr := &GetKeyPathError{Caller: caller.ID, AssetID: assetID}
+		logger.Errorf(customErr.Error())
+		return data_model.Key{}, errors.New(customErr.Error())
+	}
+
+	dataKey, err := asset_mgmt.GetAssetManager(stub, caller).GetAssetKey(assetID, keyPath)
+	if err != nil {
+		customErr := &GetDataKeyError{KeyID: assetID}
+		logger.Errorf("%v: %v", customErr, err)
+		return data_model.Key{}, errors.Wrap(err, customErr.Error())
+	}
+
+	return dataKey, nil
+}
+
+// hasReadableOwnerData returns true if the owner has a record of the datatype that was neither deleted nor shredded
+// the latest copy is not counted
+func hasReadableOwnerData(stub cached_stub.CachedStubInterface, caller data_model.User, ownerID string, datatypeID string) (bool, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+
+	// only public data is needed, so records are not decrypted
+	iter, err := asset_mgmt.GetAssetManager(stub, caller).GetAssetIter(OwnerDataNamespace, IndexData, []string{"owner", "datatype", "timestamp", "data_id"}, []string{ownerID, datatypeID}, []string{ownerID, datatypeID}, false, false, KeyPathFunc, "", -1, nil)
+	if err != nil {
+		logger.Errorf("GetAssets failed: %v", err)
+		return false, errors.Wrap(err, "GetAssets failed")
+	}
+
+	defer iter.Close()
+	for iter.HasNext() {
+		dataAsset, err := iter.Next()
+		if err != nil {
+			customErr := &custom_errors.IterError{}
+			logger.Errorf("%v: %v", customErr, err)
+			return false, errors.Wrap(err, customErr.Error())
+		}
+
+		if utils.IsStringEmpty(dataAsset.AssetId) {
+			continue
+		}
+
+		publicData := ownerDataPublicData{}
+		json.Unmarshal(dataAsset.PublicData, &publicData)
+		if publicData.Timestamp >= 0 && !publicData.Shredded {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// destroyOwnerDataKey deletes the latest copy of the data and revokes access to the data key of an owner and datatype
+// from the owner and from the owner's datatype key
+// the data key version is bumped, so the next upload of the owner and datatype starts over with a new data key ID
+func destroyOwnerDataKey(stub cached_stub.CachedStubInterface, caller data_model.User, ownerID string, datatypeID string, latestAssetID string, dataKey data_model.Key) error {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+
+	err := asset_mgmt.GetAssetManager(stub, caller).DeleteAsset(latestAssetID, dataKey)
+	if err != nil {
+		customErr := &DeleteAssetError{Asset: latestAssetID}
+		logger.Errorf("%v: %v", customErr, err)
+		return errors.Wrap(err, customErr.Error())
+	}
+
+	owner := data_model.User{ID: ownerID}
+	userAccessManager := user_access_ctrl.GetUserAccessManager(stub, caller)
+	err = userAccessManager.RemoveAccessByKey(owner.GetPubPrivKeyId(), dataKey.ID)
+	if err != nil {
+		customErr := &custom_errors.AddAccessError{Key: "owner pub key to data key"}
+		logger.Errorf("%v: %v", customErr, err)
+		return errors.Wrap(err, customErr.Error())
+	}
+
+	err = userAccessManager.RemoveAccessByKey(datatype.GetDatatypeKeyID(datatypeID, ownerID), dataKey.ID)
+	if err != nil {
+		customErr := &custom_errors.AddAccessError{Key: "datatype key to data key"}
+		logger.Errorf("%v: %v", customErr, err)
+		return errors.Wrap(err, customErr.Error())
+	}
+
+	version, err := getDataKeyVersion(stub, ownerID, datatypeID)
+	if err != nil {
+		return err
+	}
+
+	err = stub.PutState(dataKeyVersionPrefix+ownerID+"."+datatypeID, []byte(strconv.Itoa(version+1)))
+	if err != nil {
+		customErr := &custom_errors.PutLedgerError{LedgerKey: dataKeyVersionPrefix + ownerID + "." + datatypeID}
+		logger.Errorf("%v: %v", customErr, err)
+		return errors.Wrap(err, customErr.Error())
+	}
+
+	return nil
+}
+
+// GetOwnerDataKeyID returns the ID of the data key used for new data of an owner and datatype
+// Version 0 keeps the original key ID, so data uploaded before any key was destroyed stays readable
+func GetOwnerDataKeyID(stub cached_stub.CachedStubInterface, ownerID string, datatypeID string) (string, error) {
+	version, err := getDataKeyVersion(stub, ownerID, datatypeID)
+	if err != nil {
+		return "", err
+	}
+
+	if version == 0 {
+		return key_mgmt.GetSymKeyId(ownerID + datatypeID), nil
+	}
+
+	return key_mgmt.GetSymKeyId(ownerID + datatypeID + "." + strconv.Itoa(version)), nil
+}
+
+// getDataKeyVersion returns the number of times the data key of an owner and datatype was destroyed
+func getDataKeyVersion(stub cached_stub.CachedStubInterface, ownerID string, datatypeID string) (int, error) {
+	ledgerKey := dataKeyVersionPrefix + ownerID + "." + datatypeID
+	versionBytes, err := stub.GetState(ledgerKey)
+	if err != nil {
+		customErr := &custom_errors.GetLedgerError{LedgerKey: ledgerKey, LedgerItem: "DataKeyVersion"}
+		logger.Errorf("%v: %v", customErr, err)
+		return 0, errors.Wrap(err, customErr.Error())
+	}
+
+	if len(versionBytes) == 0 {
+		return 0, nil
+	}
+
+	version, err := strconv.Atoi(string(versionBytes))
+	if err != nil {
+		logger.Errorf("Error converting data key version to type int")
+		return 0, errors.Wrap(err, "Error converting data key version to type int")
+	}
+
+	return version, nil
+}
+
+// shredOwnerDataAsset overwrites the data payload and tags, keeping owner, datatype and timestamp
+// Hash and transaction recorded at upload time are kept, so the record still proves what was uploaded
+func shredOwnerDataAsset(stub cached_stub.CachedStubInterface, caller data_model.User, dataAsset *data_model.Asset, dataKey data_model.Key) error {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+
+	ownerData := OwnerData{}
+	json.Unmarshal(dataAsset.PrivateData, &ownerData)
+	ownerData.Data = nil
+	ownerData.Tags = nil
+	shreddedAsset, err := convertOwnerDataToAsset(stub, ownerData)
+	if err != nil {
+		customErr := &ConvertToAssetError{Asset: "ownerDataAsset"}
+		logger.Errorf("%v: %v", customErr, err)
+		return errors.Wrap(err, customErr.Error())
+	}
+
+	uploadPublicData := ownerDataPublicData{}
+	json.Unmarshal(dataAsset.PublicData, &uploadPublicData)
+	publicData := ownerDataPublicData{}
+	json.Unmarshal(shreddedAsset.PublicData, &publicData)
+	publicData.DataHash = uploadPublicData.DataHash
+	publicData.TxID = uploadPublicData.TxID
+	publicData.TxTimestamp = uploadPublicData.TxTimestamp
+	publicData.Shredded = true
+	shreddedAsset.PublicData, _ = json.Marshal(&publicData)
+
+	err = asset_mgmt.GetAssetManager(stub, caller).UpdateAsset(shreddedAsset, dataKey, true)
+	if err != nil {
+		customErr := &PutAssetError{Asset: shreddedAsset.AssetId}
+		logger.Errorf("%v: %v", customErr, err)
+		return errors.Wrap(err, customErr.Error())
+	}
+
+	return nil
+}
+
+// RetentionReindexResult is returned by ReindexRetentionData
+// Bookmark is the last owner reindexed, pass it to continue; empty when all owners are done
+type RetentionReindexResult struct {
+	ServiceID string   `json:"service_id"`
+	Owners    []string `json:"owners"`
+	Reindexed int      `json:"reindexed"`
+	Skipped   int      `json:"skipped"`
+	Bookmark  string   `json:"bookmark"`
+}
+
+// ReindexRetentionData adds data of a service uploaded before the service index existed to the index used by ApplyRetention
+// Can only be called by service admin or org admin of the service
+// Owners are the service itself and the patients enrolled in the service; at most batchSize owners are reindexed per call,
+// in order of owner ID, starting after bookmark
+// Records the service cannot decrypt are skipped
+// args = [serviceID, batchSize, bookmark, timestamp]
+func ReindexRetentionData(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 4 {
+		customErr := &custom_errors.LengthCheckingError{Type: "ReindexRetentionData arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	serviceID := args[0]
+	if utils.IsStringEmpty(serviceID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "serviceID"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	batchSize, err := strconv.Atoi(args[1])
+	if err != nil {
+		logger.Errorf("Error converting batchSize to type int")
+		return nil, errors.Wrap(err, "Error converting batchSize to type int")
+	}
+
+	if batchSize <= 0 || batchSize > maxRetentionBatchSize {
+		logger.Errorf("Invalid batch size: %v", batchSize)
+		return nil, errors.New("Batch size must be between 1 and " + strconv.Itoa(maxRetentionBatchSize))
+	}
+
+	bookmark := args[2]
+
+	timestamp, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil {
+		logger.Errorf("Error converting timestamp to type int64")
+		return nil, errors.Wrap(err, "Error converting timestamp to type int64")
+	}
+
+	// Check timestamp is within 10 mins of current time
+	currTime := time.Now().Unix()
+	if currTime-timestamp > 10*60 || currTime-timestamp < -10*60 {
+		logger.Errorf("Invalid Timestamp (current time: %v)  %v", currTime, timestamp)
+		return nil, errors.New("Invalid Timestamp, not within possible time range")
+	}
+
+	service, err := GetServiceInternal(stub, caller, serviceID, false)
+	if err != nil {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	if utils.IsStringEmpty(service.ServiceID) {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	if !CallerIsAdminOfService(caller, service.ServiceID, service.OrgID) {
+		logger.Errorf("Caller must be admin of service")
+		return nil, errors.New("Caller must be admin of service")
+	}
+
+	// ==============================================================
+	// Act as service
+	// ==============================================================
+	callerObj, err := GetOwnerCaller(stub, caller, serviceID)
+	if err != nil {
+		logger.Errorf("Failed to get service caller: %v", err)
+		return nil, errors.Wrap(err, "Failed to get service caller")
+	}
+
+	// ==============================================================
+	// Find owners of data of the service
+	// ==============================================================
+	enrollmentsBytes, err := GetServiceEnrollments(stub, caller, []string{serviceID})
+	if err != nil {
+		logger.Errorf("Failed to get enrollments of service %v: %v", serviceID, err)
+		return nil, errors.Wrap(err, "Failed to get enrollments of service "+serviceID)
+	}
+
+	enrollments := []EnrollmentResult{}
+	err = json.Unmarshal(enrollmentsBytes, &enrollments)
+	if err != nil {
+		customErr := &custom_errors.UnmarshalError{Type: "enrollments"}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	owners := []string{serviceID}
+	for _, enrollment := range enrollments {
+		if !utils.InList(owners, enrollment.UserID) {
+			owners = append(owners, enrollment.UserID)
+		}
+	}
+	sort.Strings(owners)
+
+	// ==============================================================
+	// Reindex data of each owner, starting after bookmark
+	// ==============================================================
+	result := RetentionReindexResult{ServiceID: serviceID, Owners: []string{}}
+	for _, ownerID := range owners {
+		if ownerID <= bookmark {
+			continue
+		}
+
+		if len(result.Owners) == batchSize {
+			result.Bookmark = result.Owners[len(result.Owners)-1]
+			break
+		}
+
+		for _, serviceDatatype := range service.Datatypes {
+			err = reindexOwnerData(stub, callerObj, serviceID, ownerID, serviceDatatype.DatatypeID, &result)
+			if err != nil {
+				logger.Errorf("Failed to reindex data of %v: %v", ownerID, err)
+				return nil, errors.Wrap(err, "Failed to reindex data of "+ownerID)
+			}
+		}
+		result.Owners = append(result.Owners, ownerID)
+	}
+
+	logger.Infof("reindexed %v records of %v owners", result.Reindexed, len(result.Owners))
+
+	return json.Marshal(&result)
+}
+
+// reindexOwnerData saves every record of an owner and datatype uploaded through a service again,
+// so index rows missing from the service index are added
+func reindexOwnerData(stub cached_stub.CachedStubInterface, caller data_model.User, serviceID string, ownerID string, datatypeID string, result *RetentionReindexResult) error {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+
+	assetManager := asset_mgmt.GetAssetManager(stub, caller)
+	iter, err := assetManager.GetAssetIter(OwnerDataNamespace, IndexData, []string{"owner", "datatype", "timestamp", "data_id"}, []string{ownerID, datatypeID}, []string{ownerID, datatypeID}, true, false, KeyPathFunc, "", -1, nil)
+	if err != nil {
+		logger.Errorf("GetAssets failed: %v", err)
+		return errors.Wrap(err, "GetAssets failed")
+	}
+
+	defer iter.Close()
+	for iter.HasNext() {
+		dataAsset, err := iter.Next()
+		if err != nil {
+			customErr := &custom_errors.IterError{}
+			logger.Errorf("%v: %v", customErr, err)
+			return errors.Wrap(err, customErr.Error())
+		}
+
+		if utils.IsStringEmpty(dataAsset.AssetId) {
+			continue
+		}
+
+		if data_model.IsEncryptedData(dataAsset.PrivateData) {
+			logger.Warningf("Skipping data asset %v, caller does not have access", dataAsset.AssetId)
+			result.Skipped++
+			continue
+		}
+
+		ownerData := OwnerData{}
+		json.Unmarshal(dataAsset.PrivateData, &ownerData)
+		if ownerData.Service != serviceID {
+			continue
+		}
+
+		dataKey, err := getOwnerDataAssetKey(stub, caller, dataAsset.AssetId)
+		if err != nil {
+			return err
+		}
+
+		err = assetManager.UpdateAsset(*dataAsset, dataKey, true)
+		if err != nil {
+			customErr := &PutAssetError{Asset: dataAsset.AssetId}
+			logger.Errorf("%v: %v", customErr, err)
+			return errors.Wrap(err, customErr.Error())
+		}
+		result.Reindexed++
+	}
+
+	return nil
+}
+
+func getRetentionCursor(stub cached_stub.CachedStubInterface, serviceID string) (RetentionCursor, error) {
+	cursor := RetentionCursor{ServiceID: serviceID}
+	cursorBytes, err := stub.GetState(retentionCursorPrefix + serviceID)
+	if err != nil {
+		customErr := &custom_errors.GetLedgerError{LedgerKey: retentionCursorPrefix + serviceID, LedgerItem: "RetentionCursor"}
+		logger.Errorf("%v: %v", customErr, err)
+		return cursor, errors.Wrap(err, customErr.Error())
+	}
+
+	if len(cursorBytes) == 0 {
+		return cursor, nil
+	}
+
+	err = json.Unmarshal(cursorBytes, &cursor)
+	if err != nil {
+		customErr := &custom_errors.UnmarshalError{Type: "RetentionCursor"}
+		logger.Errorf("%v: %v", customErr, err)
+		return cursor, errors.Wrap(err, customErr.Error())
+	}
+
+	return cursor, nil
+}
+
+func putRetentionCursor(stub cached_stub.CachedStubInterface, cursor RetentionCursor) error {
+	cursorBytes, err := json.Marshal(&cursor)
+	if err != nil {
+		customErr := &custom_errors.MarshalError{Type: "RetentionCursor"}
+		logger.Errorf("%v: %v", customErr, err)
+		return errors.Wrap(err, customErr.Error())
+	}
+
+	return stub.PutState(retentionCursorPrefix+cursor.ServiceID, cursorBytes)
+}
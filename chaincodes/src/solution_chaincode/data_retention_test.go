@@ -0,0 +1,226 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"common/bchcls/asset_mgmt"
+	"common/bchcls/cached_stub"
+	"common/bchcls/crypto"
+	"common/bchcls/init_common"
+	"common/bchcls/key_mgmt"
+	"common/bchcls/test_utils"
+	"common/bchcls/user_mgmt"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestApplyRetention(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestApplyRetention function called")
+
+	// create a MockStub
+	mstub := SetupIndexesAndGetStub(t)
+
+	// register admin user
+	mstub.MockTransactionStart("t123")
+	stub := cached_stub.NewCachedStub(mstub)
+	init_common.Init(stub)
+	err := SetupDataIndex(stub)
+	systemAdmin := test_utils.CreateTestUser("systemAdmin")
+	systemAdmin.Role = SOLUTION_ROLE_SYSTEM
+	systemAdminBytes, _ := json.Marshal(&systemAdmin)
+	_, err = RegisterUser(stub, systemAdmin, []string{string(systemAdminBytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterUser to succeed")
+	mstub.MockTransactionEnd("t123")
+
+	// Register system datatypes
+	mstub.MockTransactionStart("init")
+	stub = cached_stub.NewCachedStub(mstub)
+	RegisterSystemDatatypeTest(t, stub, systemAdmin)
+	mstub.MockTransactionEnd("init")
+
+	// register org
+	mstub.MockTransactionStart("t123")
+	stub = cached_stub.NewCachedStub(mstub)
+	org1 := test_utils.CreateTestGroup("org1")
+	org1Bytes, _ := json.Marshal(&org1)
+	_, err = RegisterOrg(stub, org1, []string{string(org1Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterOrg to succeed")
+	mstub.MockTransactionEnd("t123")
+
+	//  register datatype
+	mstub.MockTransactionStart("t123")
+	stub = cached_stub.NewCachedStub(mstub)
+	datatype1 := Datatype{DatatypeID: "datatype1", Description: "datatype1"}
+	datatype1Bytes, _ := json.Marshal(&datatype1)
+	org1Caller, _ := user_mgmt.GetUserData(stub, org1, org1.ID, true, true)
+	_, err = RegisterDatatype(stub, org1Caller, []string{string(datatype1Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterDatatype to succeed")
+	mstub.MockTransactionEnd("t123")
+
+	// register service with negative retention period
+	mstub.MockTransactionStart("t123")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	serviceDatatype1 := GenerateServiceDatatypeForTesting("datatype1", "service1", []string{consentOptionWrite, consentOptionRead})
+	service1 := GenerateServiceForTesting("service1", "org1", []ServiceDatatype{serviceDatatype1})
+	service1["retention_period"] = -1
+	service1Bytes, _ := json.Marshal(&service1)
+	_, err = RegisterService(stub, org1Caller, []string{string(service1Bytes)})
+	test_utils.AssertTrue(t, err != nil, "Expected RegisterService to fail")
+	mstub.MockTransactionEnd("t123")
+
+	// register service with datatype retention period of 1 minute
+	mstub.MockTransactionStart("t123")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	serviceDatatype1.RetentionPeriod = 60
+	service1 = GenerateServiceForTesting("service1", "org1", []ServiceDatatype{serviceDatatype1})
+	service1Bytes, _ = json.Marshal(&service1)
+	_, err = RegisterService(stub, org1Caller, []string{string(service1Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterService to succeed")
+	mstub.MockTransactionEnd("t123")
+
+	// upload 2 old records and 1 new record
+	serviceSubgroup, _ := user_mgmt.GetUserData(stub, org1Caller, "service1", true, true)
+	now := time.Now().Unix()
+	for i, ts := range []int64{now - 300, now - 200, now} {
+		txID := "upload" + strconv.Itoa(i)
+		mstub.MockTransactionStart(txID)
+		stub = cached_stub.NewCachedStub(mstub, true, true, true)
+		ownerData := GenerateOwnerData("service1", "datatype1")
+		ownerData.Timestamp = ts
+		ownerDataBytes, _ := json.Marshal(&ownerData)
+		args := []string{string(ownerDataBytes)}
+		if i == 0 {
+			args = append(args, crypto.EncodeToB64String(test_utils.GenerateSymKey()))
+		}
+		_, err = UploadOwnerData(stub, serviceSubgroup, args)
+		test_utils.AssertTrue(t, err == nil, "Expected UploadOwnerData to succeed")
+		mstub.MockTransactionEnd(txID)
+	}
+
+	// invalid action
+	mstub.MockTransactionStart("1")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	_, err = ApplyRetention(stub, serviceSubgroup, []string{"service1", "archive", "1", strconv.FormatInt(now, 10)})
+	test_utils.AssertTrue(t, err != nil, "Expected ApplyRetention to fail")
+	mstub.MockTransactionEnd("1")
+
+	// patient cannot apply retention
+	mstub.MockTransactionStart("2")
+	stub = cached_stub.NewCachedStub(mstub)
+	patient1 := test_utils.CreateTestUser("patient1")
+	patient1Bytes, _ := json.Marshal(&patient1)
+	_, err = user_mgmt.RegisterUser(stub, org1Caller, []string{string(patient1Bytes), "false"})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterUser to succeed")
+	mstub.MockTransactionEnd("2")
+
+	mstub.MockTransactionStart("3")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	patient1Caller, _ := user_mgmt.GetUserData(stub, patient1, patient1.ID, true, true)
+	_, err = ApplyRetention(stub, patient1Caller, []string{"service1", retentionActionDelete, "1", strconv.FormatInt(now, 10)})
+	test_utils.AssertTrue(t, err != nil, "Expected ApplyRetention to fail")
+	mstub.MockTransactionEnd("3")
+
+	// first batch deletes one record and is not complete
+	mstub.MockTransactionStart("4")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	reportBytes, err := ApplyRetention(stub, org1Caller, []string{"service1", retentionActionDelete, "1", strconv.FormatInt(now, 10)})
+	test_utils.AssertTrue(t, err == nil, "Expected ApplyRetention to succeed")
+	report := RetentionReport{}
+	json.Unmarshal(reportBytes, &report)
+	test_utils.AssertTrue(t, report.Deleted == 1, "Expected 1 record to be deleted")
+	test_utils.AssertTrue(t, !report.Complete, "Expected retention to be incomplete")
+	mstub.MockTransactionEnd("4")
+
+	// second batch resumes and completes
+	mstub.MockTransactionStart("5")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	reportBytes, err = ApplyRetention(stub, org1Caller, []string{"service1", retentionActionDelete, "10", strconv.FormatInt(now, 10)})
+	test_utils.AssertTrue(t, err == nil, "Expected ApplyRetention to succeed")
+	report = RetentionReport{}
+	json.Unmarshal(reportBytes, &report)
+	test_utils.AssertTrue(t, report.Deleted == 1, "Expected 1 record to be deleted")
+	test_utils.AssertTrue(t, report.Complete, "Expected retention to be complete")
+	mstub.MockTransactionEnd("5")
+
+	// only the new record is left
+	mstub.MockTransactionStart("6")
+	stub = cached_stub.NewCachedStub(mstub)
+	dataResultBytes, err := DownloadOwnerDataAsOwner(stub, serviceSubgroup, []string{"service1", "datatype1", "false", "0", "0", "1000", strconv.FormatInt(time.Now().Unix(), 10)})
+	test_utils.AssertTrue(t, err == nil, "Expected DownloadOwnerDataAsOwner to succeed")
+	dataResult := OwnerDataResultWithLog{}
+	json.Unmarshal(dataResultBytes, &dataResult)
+	test_utils.AssertTrue(t, len(dataResult.OwnerDatas) == 1, "Expected 1 record")
+	test_utils.AssertTrue(t, dataResult.OwnerDatas[0].Timestamp == now, "Expected new record")
+	mstub.MockTransactionEnd("6")
+
+	// reindex the remaining record and its latest copy
+	mstub.MockTransactionStart("7")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	_, err = ReindexRetentionData(stub, patient1Caller, []string{"service1", "10", "", strconv.FormatInt(now, 10)})
+	test_utils.AssertTrue(t, err != nil, "Expected ReindexRetentionData to fail")
+	reindexBytes, err := ReindexRetentionData(stub, org1Caller, []string{"service1", "10", "", strconv.FormatInt(now, 10)})
+	test_utils.AssertTrue(t, err == nil, "Expected ReindexRetentionData to succeed")
+	reindexResult := RetentionReindexResult{}
+	json.Unmarshal(reindexBytes, &reindexResult)
+	test_utils.AssertTrue(t, reindexResult.Reindexed == 2, "Expected 2 records to be reindexed")
+	test_utils.AssertTrue(t, reindexResult.Bookmark == "", "Expected all owners to be reindexed")
+	mstub.MockTransactionEnd("7")
+
+	// shredding the last record destroys the data key
+	mstub.MockTransactionStart("8")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	reportBytes, err = ApplyRetention(stub, org1Caller, []string{"service1", retentionActionShred, "10", strconv.FormatInt(now+300, 10)})
+	test_utils.AssertTrue(t, err == nil, "Expected ApplyRetention to succeed")
+	report = RetentionReport{}
+	json.Unmarshal(reportBytes, &report)
+	test_utils.AssertTrue(t, report.Shredded == 1, "Expected 1 record to be shredded")
+	mstub.MockTransactionEnd("8")
+
+	// next upload needs a new data key
+	mstub.MockTransactionStart("9")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	ownerData := GenerateOwnerData("service1", "datatype1")
+	ownerDataBytes, _ := json.Marshal(&ownerData)
+	_, err = UploadOwnerData(stub, serviceSubgroup, []string{string(ownerDataBytes)})
+	test_utils.AssertTrue(t, err != nil, "Expected UploadOwnerData without data key to fail")
+	_, err = UploadOwnerData(stub, serviceSubgroup, []string{string(ownerDataBytes), crypto.EncodeToB64String(test_utils.GenerateSymKey())})
+	test_utils.AssertTrue(t, err == nil, "Expected UploadOwnerData with new data key to succeed")
+	mstub.MockTransactionEnd("9")
+
+	// new data uses a new data key ID, the destroyed key can no longer be reached by the owner
+	mstub.MockTransactionStart("10")
+	stub = cached_stub.NewCachedStub(mstub)
+	oldDataKeyID := key_mgmt.GetSymKeyId("service1" + "datatype1")
+	newDataKeyID, err := GetOwnerDataKeyID(stub, "service1", "datatype1")
+	test_utils.AssertTrue(t, err == nil, "Expected GetOwnerDataKeyID to succeed")
+	test_utils.AssertTrue(t, newDataKeyID != oldDataKeyID, "Expected a new data key ID")
+	latestKeyID, err := asset_mgmt.GetAssetKeyId(stub, GetLatestOwnerDataAssetID(stub, "service1", "datatype1"))
+	test_utils.AssertTrue(t, err == nil, "Expected GetAssetKeyId to succeed")
+	test_utils.AssertTrue(t, latestKeyID == newDataKeyID, "Expected latest data to use the new data key")
+	pathExists, err := key_mgmt.VerifyAccessPath(stub, []string{serviceSubgroup.GetPubPrivKeyId(), oldDataKeyID})
+	test_utils.AssertTrue(t, err == nil, "Expected VerifyAccessPath to succeed")
+	test_utils.AssertTrue(t, !pathExists, "Expected old data key to be unreachable")
+	pathExists, err = key_mgmt.VerifyAccessPath(stub, []string{serviceSubgroup.GetPubPrivKeyId(), newDataKeyID})
+	test_utils.AssertTrue(t, err == nil, "Expected VerifyAccessPath to succeed")
+	test_utils.AssertTrue(t, pathExists, "Expected new data key to be reachable")
+
+	dataResultBytes, err = DownloadOwnerDataAsOwner(stub, serviceSubgroup, []string{"service1", "datatype1", "false", "0", "0", "1000", strconv.FormatInt(time.Now().Unix(), 10)})
+	test_utils.AssertTrue(t, err == nil, "Expected DownloadOwnerDataAsOwner to succeed")
+	dataResult = OwnerDataResultWithLog{}
+	json.Unmarshal(dataResultBytes, &dataResult)
+	test_utils.AssertTrue(t, len(dataResult.OwnerDatas) == 1, "Expected only the new record")
+	test_utils.AssertTrue(t, dataResult.OwnerDatas[0].Timestamp == ownerData.Timestamp, "Expected new record")
+	mstub.MockTransactionEnd("10")
+}
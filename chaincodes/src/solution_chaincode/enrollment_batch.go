@@ -0,0 +1,119 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"common/bchcls/cached_stub"
+	"common/bchcls/custom_errors"
+	"common/bchcls/data_model"
+	"common/bchcls/utils"
+	"encoding/json"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// EnrollmentBatchResult is the outcome of one enrollment of EnrollPatientsBatch
+// Row is the index of the enrollment in the batch
+type EnrollmentBatchResult struct {
+	Row     int    `json:"row"`
+	UserID  string `json:"user_id"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// EnrollPatientsBatch enrolls many patients in one service in a single transaction
+// Can only be called by service admin or org admin of the service
+// enrollmentSymKeysB64 is a list of enrollment sym keys in the same order as enrollments
+// Enrollments that fail validation, including patients who are already enrolled, are reported and skipped,
+// the other enrollments are saved
+// args = [ serviceID, enrollmentsBytes, enrollmentSymKeysB64Bytes ]
+func EnrollPatientsBatch(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 3 {
+		customErr := &custom_errors.LengthCheckingError{Type: "EnrollPatientsBatch arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	enrollments := []Enrollment{}
+	err := json.Unmarshal([]byte(args[1]), &enrollments)
+	if err != nil {
+		customErr := &custom_errors.UnmarshalError{Type: "[]Enrollment"}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	enrollmentSymKeysB64 := []string{}
+	err = json.Unmarshal([]byte(args[2]), &enrollmentSymKeysB64)
+	if err != nil {
+		customErr := &custom_errors.UnmarshalError{Type: "enrollmentSymKeysB64"}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	if len(enrollments) != len(enrollmentSymKeysB64) {
+		logger.Errorf("Got %v enrollments and %v enrollment sym keys", len(enrollments), len(enrollmentSymKeysB64))
+		return nil, errors.New("Number of enrollments and enrollment sym keys must match")
+	}
+
+	// service keys are looked up once for the whole batch
+	service, err := getEnrollmentService(stub, caller, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// ==============================================================
+	// Enroll patients
+	// ==============================================================
+	results := []EnrollmentBatchResult{}
+	enrolledUsers := make(map[string]bool)
+	for i, enrollment := range enrollments {
+		result := EnrollmentBatchResult{Row: i, UserID: enrollment.UserID}
+
+		enrollmentKey, existingUser, err := service.validateEnrollment(stub, caller, &enrollment, enrollmentSymKeysB64[i])
+		if err == nil && enrolledUsers[enrollment.UserID] {
+			err = errors.New("Patient appears more than once in batch")
+		}
+
+		if err == nil {
+			var enrollmentExists bool
+			enrollmentExists, err = CheckEnrollmentExists(stub, caller, enrollment.EnrollmentID)
+			if err == nil && enrollmentExists {
+				err = errors.New("Patient is already enrolled in service " + enrollment.ServiceID)
+			}
+		}
+
+		if err != nil {
+			logger.Infof("Skipping enrollment in row %v: %v", i, err)
+			result.Error = err.Error()
+			results = append(results, result)
+			continue
+		}
+
+		// a failure while saving would leave a partial enrollment, so it fails the whole batch
+		err = service.addEnrollment(stub, caller, enrollment, enrollmentKey, existingUser, "")
+		if err != nil {
+			logger.Errorf("Failed to enroll patient in row %v: %v", i, err)
+			return nil, errors.Wrap(err, "Failed to enroll patient in row "+strconv.Itoa(i))
+		}
+
+		enrolledUsers[enrollment.UserID] = true
+		result.Success = true
+		results = append(results, result)
+	}
+
+	return json.Marshal(&results)
+}
@@ -0,0 +1,89 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"common/bchcls/cached_stub"
+	"common/bchcls/crypto"
+	"common/bchcls/test_utils"
+	"common/bchcls/user_mgmt"
+	"encoding/json"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestEnrollPatientsBatch(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestEnrollPatientsBatch function called")
+
+	mstub := SetupIndexesAndGetStub(t)
+	org1Caller, service1Subgroup, patient1 := SetupEnrollmentServiceTest(t, mstub)
+
+	mstub.MockTransactionStart("1")
+	stub := cached_stub.NewCachedStub(mstub)
+	patient2 := test_utils.CreateTestUser("patient2")
+	patient2Bytes, _ := json.Marshal(&patient2)
+	_, err := user_mgmt.RegisterUser(stub, org1Caller, []string{string(patient2Bytes), "false"})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterUser to succeed")
+	mstub.MockTransactionEnd("1")
+
+	// enroll patient1 before the batch
+	mstub.MockTransactionStart("2")
+	stub = cached_stub.NewCachedStub(mstub)
+	enrollment1 := GenerateEnrollmentTest(patient1.ID, "service1")
+	enrollment1Bytes, _ := json.Marshal(&enrollment1)
+	_, err = EnrollPatient(stub, service1Subgroup, []string{string(enrollment1Bytes), crypto.EncodeToB64String(test_utils.GenerateSymKey())})
+	test_utils.AssertTrue(t, err == nil, "Expected EnrollPatient to succeed")
+	mstub.MockTransactionEnd("2")
+
+	enrollments := []Enrollment{
+		GenerateEnrollmentTest("patient2", "service1"),
+		GenerateEnrollmentTest(patient1.ID, "service1"),
+		GenerateEnrollmentTest("unknownPatient", "service1"),
+		GenerateEnrollmentTest("patient2", "service1")}
+	enrollmentSymKeys := []string{}
+	for range enrollments {
+		enrollmentSymKeys = append(enrollmentSymKeys, crypto.EncodeToB64String(test_utils.GenerateSymKey()))
+	}
+	enrollmentsBytes, _ := json.Marshal(&enrollments)
+	enrollmentSymKeysBytes, _ := json.Marshal(&enrollmentSymKeys)
+
+	// number of keys must match number of enrollments
+	mstub.MockTransactionStart("3")
+	stub = cached_stub.NewCachedStub(mstub)
+	shortKeysBytes, _ := json.Marshal(enrollmentSymKeys[:1])
+	_, err = EnrollPatientsBatch(stub, service1Subgroup, []string{"service1", string(enrollmentsBytes), string(shortKeysBytes)})
+	test_utils.AssertTrue(t, err != nil, "Expected EnrollPatientsBatch to fail")
+	_, err = EnrollPatientsBatch(stub, patient1, []string{"service1", string(enrollmentsBytes), string(enrollmentSymKeysBytes)})
+	test_utils.AssertTrue(t, err != nil, "Expected EnrollPatientsBatch by non admin to fail")
+	mstub.MockTransactionEnd("3")
+
+	mstub.MockTransactionStart("4")
+	stub = cached_stub.NewCachedStub(mstub)
+	resultsBytes, err := EnrollPatientsBatch(stub, service1Subgroup, []string{"service1", string(enrollmentsBytes), string(enrollmentSymKeysBytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected EnrollPatientsBatch to succeed")
+	mstub.MockTransactionEnd("4")
+
+	results := []EnrollmentBatchResult{}
+	json.Unmarshal(resultsBytes, &results)
+	test_utils.AssertTrue(t, len(results) == 4, "Expected 4 results")
+	test_utils.AssertTrue(t, results[0].Success && results[0].UserID == "patient2", "Expected patient2 to be enrolled")
+	test_utils.AssertTrue(t, !results[1].Success && len(results[1].Error) > 0, "Expected already enrolled patient1 to fail")
+	test_utils.AssertTrue(t, !results[2].Success && len(results[2].Error) > 0, "Expected unknown patient to fail")
+	test_utils.AssertTrue(t, !results[3].Success && results[3].Row == 3, "Expected duplicate patient2 to fail")
+
+	mstub.MockTransactionStart("5")
+	stub = cached_stub.NewCachedStub(mstub)
+	enrollmentResult, err := GetEnrollmentInternal(stub, service1Subgroup, "patient2", "service1")
+	test_utils.AssertTrue(t, err == nil, "Expected GetEnrollmentInternal to succeed")
+	test_utils.AssertTrue(t, enrollmentResult.Status == EnrollmentStatusActive, "Expected enrollment status to be active")
+	mstub.MockTransactionEnd("5")
+}
@@ -0,0 +1,185 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"common/bchcls/cached_stub"
+	"common/bchcls/custom_errors"
+	"common/bchcls/data_model"
+	"common/bchcls/simple_rule"
+	"common/bchcls/user_mgmt"
+	"common/bchcls/utils"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// EligibilityResult is returned by CheckEligibility
+// FailingClause is the first clause of the service eligibility rule the patient does not meet
+type EligibilityResult struct {
+	ServiceID     string      `json:"service_id"`
+	UserID        string      `json:"user_id"`
+	Eligible      bool        `json:"eligible"`
+	FailingClause interface{} `json:"failing_clause,omitempty"`
+}
+
+// eligibilityClauses returns the clauses of the eligibility rule
+// A top level "and" is split so that the failing clause can be reported
+func (s Service) eligibilityClauses() []interface{} {
+	if len(s.EligibilityRule) == 1 {
+		if clauses, ok := s.EligibilityRule["and"].([]interface{}); ok {
+			return clauses
+		}
+	}
+	return []interface{}{s.EligibilityRule}
+}
+
+// validateEligibilityRule returns an error if the eligibility rule is set but is not made of rule expressions
+func (s Service) validateEligibilityRule() error {
+	if len(s.EligibilityRule) == 0 {
+		return nil
+	}
+
+	for _, clause := range s.eligibilityClauses() {
+		if _, ok := clause.(map[string]interface{}); !ok {
+			logger.Errorf("Invalid eligibility rule clause: %v", clause)
+			return errors.New("Invalid eligibility rule, each clause must be a rule expression")
+		}
+	}
+
+	return nil
+}
+
+// findFailingEligibilityClause evaluates the eligibility rule against the patient's solution public data
+// Returns the first failing clause, or nil if the patient is eligible
+func (s Service) findFailingEligibilityClause(patient data_model.User) (interface{}, error) {
+	if len(s.EligibilityRule) == 0 {
+		return nil, nil
+	}
+
+	patientData, ok := patient.SolutionPublicData.(map[string]interface{})
+	if !ok {
+		patientData = make(map[string]interface{})
+	}
+
+	for _, clause := range s.eligibilityClauses() {
+		clauseExpr, ok := clause.(map[string]interface{})
+		if !ok {
+			logger.Errorf("Invalid eligibility rule clause: %v", clause)
+			return nil, errors.New("Invalid eligibility rule clause")
+		}
+
+		rule := simple_rule.NewRule(clauseExpr)
+		result, err := rule.Apply(patientData)
+		if err != nil {
+			logger.Errorf("Failed to evaluate eligibility rule of service %v: %v", s.ServiceID, err)
+			return nil, errors.Wrap(err, "Failed to evaluate eligibility rule of service "+s.ServiceID)
+		}
+
+		if result["$result"] != true {
+			return clause, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// checkPatientEligibility returns an error with the failing clause if the patient does not meet the service eligibility rule
+func (s Service) checkPatientEligibility(patient data_model.User) error {
+	failingClause, err := s.findFailingEligibilityClause(patient)
+	if err != nil {
+		return err
+	}
+
+	if failingClause == nil {
+		return nil
+	}
+
+	clauseBytes, _ := json.Marshal(failingClause)
+	logger.Errorf("Patient %v is not eligible for service %v, failing clause: %v", patient.ID, s.ServiceID, string(clauseBytes))
+	return errors.New("Patient is not eligible for service " + s.ServiceID + ", failing clause: " + string(clauseBytes))
+}
+
+// CheckEligibility evaluates the service eligibility rule for a patient without enrolling them
+// Can be called by service admin, org admin of the service, or the patient
+// args = [ serviceID, userID ]
+func CheckEligibility(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 2 {
+		customErr := &custom_errors.LengthCheckingError{Type: "CheckEligibility arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	serviceID := args[0]
+	if utils.IsStringEmpty(serviceID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "ServiceID"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	userID := args[1]
+	if utils.IsStringEmpty(userID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "userID"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	service, err := GetServiceInternal(stub, caller, serviceID, false)
+	if err != nil {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	if utils.IsStringEmpty(service.ServiceID) {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	if caller.ID != userID && !CallerIsAdminOfService(caller, serviceID, service.OrgID) {
+		logger.Error("Caller is not admin of the service")
+		return nil, errors.New("Caller is not admin of the service")
+	}
+
+	patient, err := user_mgmt.GetUserData(stub, caller, userID, false, false)
+	if err != nil {
+		customErr := &GetUserError{User: userID}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	if utils.IsStringEmpty(patient.ID) {
+		customErr := &GetUserError{User: userID}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Evaluate eligibility rule
+	// ==============================================================
+	failingClause, err := service.findFailingEligibilityClause(patient)
+	if err != nil {
+		return nil, err
+	}
+
+	result := EligibilityResult{
+		ServiceID:     serviceID,
+		UserID:        userID,
+		Eligible:      failingClause == nil,
+		FailingClause: failingClause}
+	return json.Marshal(&result)
+}
@@ -0,0 +1,106 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"common/bchcls/cached_stub"
+	"common/bchcls/crypto"
+	"common/bchcls/simple_rule"
+	"common/bchcls/test_utils"
+	"common/bchcls/user_mgmt"
+	"encoding/json"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestEnrollmentEligibility(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestEnrollmentEligibility function called")
+
+	mstub := SetupIndexesAndGetStub(t)
+	org1Caller, _, _ := SetupEnrollmentServiceTest(t, mstub)
+
+	// register a trial service for adults in EU
+	mstub.MockTransactionStart("1")
+	stub := cached_stub.NewCachedStub(mstub, true, true, true)
+	serviceDatatype1 := GenerateServiceDatatypeForTesting("datatype1", "trial1", []string{consentOptionWrite, consentOptionRead})
+	trial1 := GenerateServiceForTesting("trial1", "org1", []ServiceDatatype{serviceDatatype1})
+	trial1["eligibility_rule"] = simple_rule.R("and",
+		simple_rule.R(">=", simple_rule.R("var", "age"), 18),
+		simple_rule.R("==", simple_rule.R("var", "region"), "EU"))
+	trial1Bytes, _ := json.Marshal(&trial1)
+	_, err := RegisterService(stub, org1Caller, []string{string(trial1Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterService to succeed")
+	mstub.MockTransactionEnd("1")
+
+	// register patients
+	mstub.MockTransactionStart("2")
+	stub = cached_stub.NewCachedStub(mstub)
+	minor := test_utils.CreateTestUser("minor")
+	minor.SolutionPublicData = map[string]interface{}{"age": 16, "region": "EU"}
+	minorBytes, _ := json.Marshal(&minor)
+	_, err = user_mgmt.RegisterUser(stub, org1Caller, []string{string(minorBytes), "false"})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterUser to succeed")
+	adult := test_utils.CreateTestUser("adult")
+	adult.SolutionPublicData = map[string]interface{}{"age": 40, "region": "EU"}
+	adultBytes, _ := json.Marshal(&adult)
+	_, err = user_mgmt.RegisterUser(stub, org1Caller, []string{string(adultBytes), "false"})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterUser to succeed")
+	mstub.MockTransactionEnd("2")
+
+	// dry run reports the failing clause
+	mstub.MockTransactionStart("3")
+	stub = cached_stub.NewCachedStub(mstub)
+	trial1Subgroup, _ := user_mgmt.GetUserData(stub, org1Caller, "trial1", true, true)
+	resultBytes, err := CheckEligibility(stub, trial1Subgroup, []string{"trial1", "minor"})
+	test_utils.AssertTrue(t, err == nil, "Expected CheckEligibility to succeed")
+	result := EligibilityResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, !result.Eligible, "Expected minor not to be eligible")
+	_, failsOnAge := result.FailingClause.(map[string]interface{})[">="]
+	test_utils.AssertTrue(t, failsOnAge, "Expected age clause to fail")
+
+	resultBytes, err = CheckEligibility(stub, adult, []string{"trial1", "adult"})
+	test_utils.AssertTrue(t, err == nil, "Expected CheckEligibility by patient to succeed")
+	result = EligibilityResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, result.Eligible && result.FailingClause == nil, "Expected adult to be eligible")
+
+	_, err = CheckEligibility(stub, minor, []string{"trial1", "adult"})
+	test_utils.AssertTrue(t, err != nil, "Expected CheckEligibility for another patient to fail")
+	mstub.MockTransactionEnd("3")
+
+	// only eligible patients can be enrolled
+	mstub.MockTransactionStart("4")
+	stub = cached_stub.NewCachedStub(mstub)
+	enrollment1 := GenerateEnrollmentTest("minor", "trial1")
+	enrollment1Bytes, _ := json.Marshal(&enrollment1)
+	_, err = EnrollPatient(stub, trial1Subgroup, []string{string(enrollment1Bytes), crypto.EncodeToB64String(test_utils.GenerateSymKey())})
+	test_utils.AssertTrue(t, err != nil, "Expected EnrollPatient of minor to fail")
+	enrollment2 := GenerateEnrollmentTest("adult", "trial1")
+	enrollment2Bytes, _ := json.Marshal(&enrollment2)
+	_, err = EnrollPatient(stub, trial1Subgroup, []string{string(enrollment2Bytes), crypto.EncodeToB64String(test_utils.GenerateSymKey())})
+	test_utils.AssertTrue(t, err == nil, "Expected EnrollPatient of adult to succeed")
+	mstub.MockTransactionEnd("4")
+
+	// services without eligibility rule accept any patient
+	mstub.MockTransactionStart("5")
+	stub = cached_stub.NewCachedStub(mstub)
+	enrollment3 := GenerateEnrollmentTest("minor", "service1")
+	enrollment3Bytes, _ := json.Marshal(&enrollment3)
+	_, err = EnrollPatient(stub, org1Caller, []string{string(enrollment3Bytes), crypto.EncodeToB64String(test_utils.GenerateSymKey())})
+	test_utils.AssertTrue(t, err == nil, "Expected EnrollPatient to succeed")
+	mstub.MockTransactionEnd("5")
+
+	// eligibility rule must be made of rule expressions
+	invalidService := Service{ServiceID: "trial2", OrgID: "org1", EligibilityRule: map[string]interface{}{"and": []interface{}{"age"}}}
+	test_utils.AssertTrue(t, invalidService.validateEligibilityRule() != nil, "Expected invalid eligibility rule")
+}
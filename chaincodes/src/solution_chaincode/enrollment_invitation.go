@@ -0,0 +1,594 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+
+	"common/bchcls/asset_mgmt"
+	"common/bchcls/cached_stub"
+	"common/bchcls/crypto"
+	"common/bchcls/custom_errors"
+	"common/bchcls/data_model"
+	"common/bchcls/key_mgmt"
+	"common/bchcls/user_access_ctrl"
+	"common/bchcls/user_mgmt"
+	"common/bchcls/utils"
+
+	"github.com/pkg/errors"
+)
+
+// invitations are kept as composite keys of service and invitation ID; only hashes of the code and patient are stored
+const enrollmentInvitationObjectType = "OMR.EnrollmentInvitation"
+
+// invitations are readable on the ledger, so codes must be long enough to resist guessing against the stored hash
+const (
+	minInvitationCodeLength = 12
+	minInvitationSaltLength = 16
+)
+
+// Enrollment invitation statuses
+const (
+	invitationStatusPending  = "pending"
+	invitationStatusAccepted = "accepted"
+	invitationStatusRevoked  = "revoked"
+)
+
+// EnrollmentInvitation lets a patient enroll in a service with a one-time code
+// Salt is a hex encoded random value chosen by the service for each invitation
+// CodeHash is GetInvitationHash of the salt and the code, which the service hands to the patient off chain
+// UserIDHash optionally restricts the invitation to one patient, it is GetInvitationHash of the salt and the patient's user ID
+// AcceptedByHash is set the same way when the invitation is accepted
+type EnrollmentInvitation struct {
+	InvitationID   string `json:"invitation_id"`
+	ServiceID      string `json:"service_id"`
+	UserIDHash     string `json:"user_id_hash"`
+	Salt           string `json:"salt"`
+	CodeHash       string `json:"code_hash"`
+	ExpirationDate int64  `json:"expiration_date"`
+	Status         string `json:"status"`
+	IssuedBy       string `json:"issued_by"`
+	IssueDate      int64  `json:"issue_date"`
+	AcceptedByHash string `json:"accepted_by_hash"`
+	UpdateDate     int64  `json:"update_date"`
+}
+
+// GetInvitationHash returns the hex encoded HMAC-SHA256 of value keyed with the invitation salt
+func GetInvitationHash(salt []byte, value string) string {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// matchesHash returns true if value hashes to the given invitation hash
+func (invitation EnrollmentInvitation) matchesHash(hash string, value string) bool {
+	salt, err := hex.DecodeString(invitation.Salt)
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal([]byte(GetInvitationHash(salt, value)), []byte(hash))
+}
+
+// isExpired returns true if the invitation can no longer be accepted at timestamp
+func (invitation EnrollmentInvitation) isExpired(timestamp int64) bool {
+	return invitation.ExpirationDate <= timestamp
+}
+
+// IssueEnrollmentInvitation stores a new enrollment invitation for a service
+// Can only be called by service admin or org admin of the service
+// invitation must have invitation_id, service_id, salt, code_hash and expiration_date, and optionally user_id_hash
+// args = [invitation, timestamp]
+func IssueEnrollmentInvitation(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 2 {
+		customErr := &custom_errors.LengthCheckingError{Type: "IssueEnrollmentInvitation arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	invitation := EnrollmentInvitation{}
+	err := json.Unmarshal([]byte(args[0]), &invitation)
+	if err != nil {
+		customErr := &custom_errors.UnmarshalError{Type: "EnrollmentInvitation"}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	timestamp, err := ParseTimestamp(args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if utils.IsStringEmpty(invitation.InvitationID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "InvitationID"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	salt, err := hex.DecodeString(invitation.Salt)
+	if err != nil || len(salt) < minInvitationSaltLength {
+		logger.Errorf("Invalid invitation salt")
+		return nil, errors.New("Invitation salt must be hex encoded and at least " + strconv.Itoa(minInvitationSaltLength) + " bytes")
+	}
+
+	codeHash, err := hex.DecodeString(invitation.CodeHash)
+	if err != nil || len(codeHash) != sha256.Size {
+		logger.Errorf("Invalid invitation code hash: %v", invitation.CodeHash)
+		return nil, errors.New("Invitation code hash must be a hex encoded HMAC-SHA256 hash")
+	}
+
+	if !utils.IsStringEmpty(invitation.UserIDHash) {
+		userIDHash, err := hex.DecodeString(invitation.UserIDHash)
+		if err != nil || len(userIDHash) != sha256.Size {
+			logger.Errorf("Invalid invitation user ID hash: %v", invitation.UserIDHash)
+			return nil, errors.New("Invitation user ID hash must be a hex encoded HMAC-SHA256 hash")
+		}
+	}
+
+	if invitation.ExpirationDate <= timestamp {
+		logger.Errorf("Invalid invitation expiration date: %v", invitation.ExpirationDate)
+		return nil, errors.New("Invalid invitation expiration date, must be in the future")
+	}
+
+	err = checkInvitationServiceAdmin(stub, caller, invitation.ServiceID)
+	if err != nil {
+		return nil, err
+	}
+
+	existingInvitation, err := getEnrollmentInvitation(stub, invitation.ServiceID, invitation.InvitationID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !utils.IsStringEmpty(existingInvitation.InvitationID) {
+		logger.Errorf("An invitation with this ID already exists")
+		return nil, errors.New("An invitation with this ID already exists")
+	}
+
+	// ==============================================================
+	// Save invitation
+	// ==============================================================
+	invitation.Status = invitationStatusPending
+	invitation.IssuedBy = caller.ID
+	invitation.IssueDate = timestamp
+	invitation.AcceptedByHash = ""
+	invitation.UpdateDate = timestamp
+
+	return nil, putEnrollmentInvitation(stub, invitation)
+}
+
+// RevokeEnrollmentInvitation revokes a pending enrollment invitation
+// Can only be called by service admin or org admin of the service
+// args = [serviceID, invitationID, timestamp]
+func RevokeEnrollmentInvitation(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 3 {
+		customErr := &custom_errors.LengthCheckingError{Type: "RevokeEnrollmentInvitation arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	serviceID := args[0]
+	timestamp, err := ParseTimestamp(args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkInvitationServiceAdmin(stub, caller, serviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	invitation, err := getPendingEnrollmentInvitation(stub, serviceID, args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	// ==============================================================
+	// Save invitation
+	// ==============================================================
+	invitation.Status = invitationStatusRevoked
+	invitation.UpdateDate = timestamp
+
+	return nil, putEnrollmentInvitation(stub, invitation)
+}
+
+// GetEnrollmentInvitations returns all enrollment invitations of a service
+// Can only be called by service admin or org admin of the service
+// args = [serviceID]
+func GetEnrollmentInvitations(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 1 {
+		customErr := &custom_errors.LengthCheckingError{Type: "GetEnrollmentInvitations arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	serviceID := args[0]
+	err := checkInvitationServiceAdmin(stub, caller, serviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	iter, err := stub.GetStateByPartialCompositeKey(enrollmentInvitationObjectType, []string{serviceID})
+	if err != nil {
+		logger.Errorf("Failed to get enrollment invitations: %v", err)
+		return nil, errors.Wrap(err, "Failed to get enrollment invitations")
+	}
+
+	defer iter.Close()
+	invitations := []EnrollmentInvitation{}
+	for iter.HasNext() {
+		kv, err := iter.Next()
+		if err != nil {
+			customErr := &custom_errors.IterError{}
+			logger.Errorf("%v: %v", customErr, err)
+			return nil, errors.Wrap(err, customErr.Error())
+		}
+
+		invitation := EnrollmentInvitation{}
+		err = json.Unmarshal(kv.GetValue(), &invitation)
+		if err != nil {
+			customErr := &custom_errors.UnmarshalError{Type: "EnrollmentInvitation"}
+			logger.Errorf("%v: %v", customErr, err)
+			return nil, errors.Wrap(err, customErr.Error())
+		}
+
+		invitations = append(invitations, invitation)
+	}
+
+	return json.Marshal(&invitations)
+}
+
+// AcceptEnrollmentInvitation redeems an enrollment invitation and enrolls the caller in the service
+// Can only be called by the patient enrolling, who generates the enrollment sym key
+// Patient must meet the eligibility rule of the service, if it has one
+// The service gets access to the enrollment through its public key, so it never handles the patient's keys
+// args = [serviceID, invitationID, code, enrollmentSymKeyB64, timestamp]
+func AcceptEnrollmentInvitation(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 5 {
+		customErr := &custom_errors.LengthCheckingError{Type: "AcceptEnrollmentInvitation arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	serviceID := args[0]
+	code := args[2]
+	if len(code) < minInvitationCodeLength {
+		logger.Errorf("Invitation code is shorter than %v characters", minInvitationCodeLength)
+		return nil, errors.New("Invitation code must be at least " + strconv.Itoa(minInvitationCodeLength) + " characters")
+	}
+
+	timestamp, err := ParseTimestamp(args[4])
+	if err != nil {
+		return nil, err
+	}
+
+	if caller.IsGroup {
+		logger.Errorf("Caller must be the patient enrolling, not an org or service")
+		return nil, errors.New("Caller must be the patient enrolling, not an org or service")
+	}
+
+	invitation, err := getPendingEnrollmentInvitation(stub, serviceID, args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if invitation.isExpired(timestamp) {
+		logger.Errorf("Invitation %v expired", invitation.InvitationID)
+		return nil, errors.New("Invitation " + invitation.InvitationID + " expired")
+	}
+
+	if !utils.IsStringEmpty(invitation.UserIDHash) && !invitation.matchesHash(invitation.UserIDHash, caller.ID) {
+		logger.Errorf("Invitation %v is not for caller", invitation.InvitationID)
+		return nil, errors.New("Invitation " + invitation.InvitationID + " is not for caller")
+	}
+
+	if !invitation.matchesHash(invitation.CodeHash, code) {
+		logger.Errorf("Invalid invitation code")
+		return nil, errors.New("Invalid invitation code")
+	}
+
+	enrollmentID := GetEnrollmentID(caller.ID, serviceID)
+	enrollmentKey := data_model.Key{ID: key_mgmt.GetSymKeyId(enrollmentID), Type: key_mgmt.KEY_TYPE_SYM}
+	enrollmentKey.KeyBytes, err = crypto.ParseSymKeyB64(args[3])
+	if err != nil || enrollmentKey.KeyBytes == nil {
+		logger.Errorf("Invalid enrollmentSymKey")
+		return nil, errors.New("Invalid enrollmentSymKey")
+	}
+
+	existingService, err := user_mgmt.GetUserData(stub, caller, serviceID, false, false)
+	if err != nil {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	if utils.IsStringEmpty(existingService.ID) {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	service, err := GetServiceInternal(stub, caller, serviceID, false)
+	if err != nil {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	err = service.checkNotRetiring()
+	if err != nil {
+		return nil, err
+	}
+
+	err = service.checkPatientEligibility(caller)
+	if err != nil {
+		return nil, err
+	}
+
+	enrollmentExists, err := CheckEnrollmentExists(stub, caller, enrollmentID)
+	if err != nil {
+		customErr := &GetEnrollmentError{Enrollment: enrollmentID}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	if enrollmentExists {
+		logger.Errorf("Patient is already enrolled in service %v", serviceID)
+		return nil, errors.New("Patient is already enrolled in service " + serviceID)
+	}
+
+	// ==============================================================
+	// Save enrollment as asset
+	// ==============================================================
+	enrollment := Enrollment{
+		EnrollmentID: enrollmentID,
+		UserID:       caller.ID,
+		UserName:     caller.Name,
+		ServiceID:    serviceID,
+		ServiceName:  existingService.Name,
+		EnrollDate:   timestamp,
+		TermsVersion: service.TermsVersion}
+	err = enrollment.changeStatus(EnrollmentStatusActive, caller.ID, "invitation "+invitation.InvitationID, timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	enrollmentAsset, err := convertEnrollmentToAsset(stub, enrollment)
+	if err != nil {
+		customErr := &ConvertToAssetError{Asset: "enrollmentAsset"}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	assetManager := asset_mgmt.GetAssetManager(stub, caller)
+	err = assetManager.AddAsset(enrollmentAsset, enrollmentKey, false)
+	if err != nil {
+		customErr := &PutAssetError{Asset: enrollmentID}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	// patient needs write access to be able to unenroll
+	err = addEnrollmentWriteAccess(stub, caller, enrollmentAsset, enrollmentKey, caller.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// ==============================================================
+	// Establish key relationships
+	// ==============================================================
+	servicePubKey := existingService.GetPublicKey()
+	userPubKey := caller.GetPublicKey()
+
+	// add access from servicePubKey to enrollmentSymKey
+	userAccessManager := user_access_ctrl.GetUserAccessManager(stub, caller)
+	err = userAccessManager.AddAccessByKey(servicePubKey, enrollmentKey)
+	if err != nil {
+		customErr := &custom_errors.AddAccessError{Key: "service pub key to enrollment key"}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	// add access from userPubKey to enrollmentSymKey
+	err = userAccessManager.AddAccessByKey(userPubKey, enrollmentKey)
+	if err != nil {
+		customErr := &custom_errors.AddAccessError{Key: "user pub key to enrollment key"}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	// ==============================================================
+	// Add access to enrollmentLogSymKey
+	// ==============================================================
+	// the patient cannot reach the service log sym key used by EnrollPatient,
+	// so the service reads enrollment logs through its pub key instead
+	enrollmentLogSymKey := GetLogSymKeyFromKey(enrollmentKey)
+	err = userAccessManager.AddAccessByKey(servicePubKey, enrollmentLogSymKey)
+	if err != nil {
+		customErr := &custom_errors.AddAccessError{Key: "service pub key to enrollment log sym key"}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	err = userAccessManager.AddAccessByKey(caller.GetLogSymKey(), enrollmentLogSymKey)
+	if err != nil {
+		customErr := &custom_errors.AddAccessError{Key: "user log sym key to enrollment log sym key"}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	// ==============================================================
+	// Logging
+	// ==============================================================
+	data := make(map[string]interface{})
+	data["status"] = EnrollmentStatusActive
+	data["invitation_id"] = invitation.InvitationID
+	consentLog := ConsentLog{Owner: caller.ID, Target: serviceID, Service: serviceID, Data: data}
+	solutionLog := SolutionLog{
+		TransactionID: stub.GetTxID(),
+		Namespace:     "OMR",
+		FunctionName:  "AcceptEnrollmentInvitation",
+		CallerID:      caller.ID,
+		Timestamp:     timestamp,
+		Data:          consentLog}
+	err = AddLogWithParams(stub, caller, solutionLog, enrollmentLogSymKey)
+	if err != nil {
+		customErr := &AddSolutionLogError{FunctionName: solutionLog.FunctionName}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	// ==============================================================
+	// Save invitation
+	// ==============================================================
+	invitation.Status = invitationStatusAccepted
+	invitation.AcceptedByHash = invitation.UserIDHash
+	if utils.IsStringEmpty(invitation.AcceptedByHash) {
+		salt, _ := hex.DecodeString(invitation.Salt)
+		invitation.AcceptedByHash = GetInvitationHash(salt, caller.ID)
+	}
+	invitation.UpdateDate = timestamp
+
+	return nil, putEnrollmentInvitation(stub, invitation)
+}
+
+// checkInvitationServiceAdmin returns an error if the caller is not admin of the service
+func checkInvitationServiceAdmin(stub cached_stub.CachedStubInterface, caller data_model.User, serviceID string) error {
+	if utils.IsStringEmpty(serviceID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "ServiceID"}
+		logger.Errorf(customErr.Error())
+		return errors.WithStack(customErr)
+	}
+
+	service, err := GetServiceInternal(stub, caller, serviceID, false)
+	if err != nil {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf("%v: %v", customErr, err)
+		return errors.Wrap(err, customErr.Error())
+	}
+
+	if utils.IsStringEmpty(service.ServiceID) {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf(customErr.Error())
+		return errors.WithStack(customErr)
+	}
+
+	if !CallerIsAdminOfService(caller, serviceID, service.OrgID) {
+		logger.Error("Caller is not admin of the service")
+		return errors.New("Caller is not admin of the service")
+	}
+
+	return nil
+}
+
+// getPendingEnrollmentInvitation returns an invitation, or an error if it does not exist or is no longer pending
+func getPendingEnrollmentInvitation(stub cached_stub.CachedStubInterface, serviceID string, invitationID string) (EnrollmentInvitation, error) {
+	if utils.IsStringEmpty(invitationID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "invitationID"}
+		logger.Errorf(customErr.Error())
+		return EnrollmentInvitation{}, errors.WithStack(customErr)
+	}
+
+	invitation, err := getEnrollmentInvitation(stub, serviceID, invitationID)
+	if err != nil {
+		return EnrollmentInvitation{}, err
+	}
+
+	if utils.IsStringEmpty(invitation.InvitationID) {
+		logger.Errorf("Invitation %v of service %v not found", invitationID, serviceID)
+		return EnrollmentInvitation{}, errors.New("Invitation " + invitationID + " of service " + serviceID + " not found")
+	}
+
+	if invitation.Status != invitationStatusPending {
+		logger.Errorf("Invitation %v is %v", invitationID, invitation.Status)
+		return EnrollmentInvitation{}, errors.New("Invitation " + invitationID + " is " + invitation.Status)
+	}
+
+	return invitation, nil
+}
+
+// getEnrollmentInvitation returns an invitation, or an empty invitation if it does not exist
+func getEnrollmentInvitation(stub cached_stub.CachedStubInterface, serviceID string, invitationID string) (EnrollmentInvitation, error) {
+	invitation := EnrollmentInvitation{}
+	key, err := stub.CreateCompositeKey(enrollmentInvitationObjectType, []string{serviceID, invitationID})
+	if err != nil {
+		logger.Errorf("Failed to create enrollment invitation key: %v", err)
+		return invitation, errors.Wrap(err, "Failed to create enrollment invitation key")
+	}
+
+	invitationBytes, err := stub.GetState(key)
+	if err != nil {
+		customErr := &custom_errors.GetLedgerError{LedgerKey: key, LedgerItem: "EnrollmentInvitation"}
+		logger.Errorf("%v: %v", customErr, err)
+		return invitation, errors.Wrap(err, customErr.Error())
+	}
+
+	if len(invitationBytes) == 0 {
+		return invitation, nil
+	}
+
+	err = json.Unmarshal(invitationBytes, &invitation)
+	if err != nil {
+		customErr := &custom_errors.UnmarshalError{Type: "EnrollmentInvitation"}
+		logger.Errorf("%v: %v", customErr, err)
+		return invitation, errors.Wrap(err, customErr.Error())
+	}
+
+	return invitation, nil
+}
+
+func putEnrollmentInvitation(stub cached_stub.CachedStubInterface, invitation EnrollmentInvitation) error {
+	key, err := stub.CreateCompositeKey(enrollmentInvitationObjectType, []string{invitation.ServiceID, invitation.InvitationID})
+	if err != nil {
+		logger.Errorf("Failed to create enrollment invitation key: %v", err)
+		return errors.Wrap(err, "Failed to create enrollment invitation key")
+	}
+
+	invitationBytes, err := json.Marshal(&invitation)
+	if err != nil {
+		customErr := &custom_errors.MarshalError{Type: "EnrollmentInvitation"}
+		logger.Errorf("%v: %v", customErr, err)
+		return errors.Wrap(err, customErr.Error())
+	}
+
+	err = stub.PutState(key, invitationBytes)
+	if err != nil {
+		customErr := &custom_errors.PutLedgerError{LedgerKey: key}
+		logger.Errorf("%v: %v", customErr, err)
+		return errors.Wrap(err, customErr.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,184 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"common/bchcls/cached_stub"
+	"common/bchcls/crypto"
+	"common/bchcls/data_model"
+	"common/bchcls/init_common"
+	"common/bchcls/test_utils"
+	"common/bchcls/user_mgmt"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// SetupEnrollmentServiceTest registers org1 with service1 and patient1, and returns org1Caller, service1Subgroup and patient1
+func SetupEnrollmentServiceTest(t *testing.T, mstub *test_utils.NewMockStub) (data_model.User, data_model.User, data_model.User) {
+	mstub.MockTransactionStart("setup")
+	stub := cached_stub.NewCachedStub(mstub)
+	init_common.Init(stub)
+	systemAdmin := test_utils.CreateTestUser("systemAdmin")
+	systemAdmin.Role = SOLUTION_ROLE_SYSTEM
+	systemAdminBytes, _ := json.Marshal(&systemAdmin)
+	_, err := RegisterUser(stub, systemAdmin, []string{string(systemAdminBytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterUser to succeed")
+	mstub.MockTransactionEnd("setup")
+
+	mstub.MockTransactionStart("setup")
+	stub = cached_stub.NewCachedStub(mstub)
+	RegisterSystemDatatypeTest(t, stub, systemAdmin)
+	mstub.MockTransactionEnd("setup")
+
+	mstub.MockTransactionStart("setup")
+	stub = cached_stub.NewCachedStub(mstub)
+	org1 := test_utils.CreateTestGroup("org1")
+	org1Bytes, _ := json.Marshal(&org1)
+	_, err = RegisterOrg(stub, org1, []string{string(org1Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterOrg to succeed")
+	mstub.MockTransactionEnd("setup")
+
+	mstub.MockTransactionStart("setup")
+	stub = cached_stub.NewCachedStub(mstub)
+	datatype1 := Datatype{DatatypeID: "datatype1", Description: "datatype1"}
+	datatype1Bytes, _ := json.Marshal(&datatype1)
+	org1Caller, _ := user_mgmt.GetUserData(stub, org1, org1.ID, true, true)
+	_, err = RegisterDatatype(stub, org1Caller, []string{string(datatype1Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterDatatype to succeed")
+	mstub.MockTransactionEnd("setup")
+
+	mstub.MockTransactionStart("setup")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	serviceDatatype1 := GenerateServiceDatatypeForTesting("datatype1", "service1", []string{consentOptionWrite, consentOptionRead})
+	service1 := GenerateServiceForTesting("service1", "org1", []ServiceDatatype{serviceDatatype1})
+	service1Bytes, _ := json.Marshal(&service1)
+	_, err = RegisterService(stub, org1Caller, []string{string(service1Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterService to succeed")
+	mstub.MockTransactionEnd("setup")
+
+	mstub.MockTransactionStart("setup")
+	stub = cached_stub.NewCachedStub(mstub)
+	patient1 := test_utils.CreateTestUser("patient1")
+	patient1Bytes, _ := json.Marshal(&patient1)
+	_, err = user_mgmt.RegisterUser(stub, org1Caller, []string{string(patient1Bytes), "false"})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterUser to succeed")
+	service1Subgroup, _ := user_mgmt.GetUserData(stub, org1Caller, "service1", true, true)
+	mstub.MockTransactionEnd("setup")
+
+	return org1Caller, service1Subgroup, patient1
+}
+
+// GenerateEnrollmentInvitationTest returns an invitation for service1 redeemable with code
+func GenerateEnrollmentInvitationTest(invitationID string, code string, expirationDate int64) EnrollmentInvitation {
+	salt := test_utils.GenerateSymKey()
+	return EnrollmentInvitation{
+		InvitationID:   invitationID,
+		ServiceID:      "service1",
+		Salt:           hex.EncodeToString(salt),
+		CodeHash:       GetInvitationHash(salt, code),
+		ExpirationDate: expirationDate}
+}
+
+func TestEnrollmentInvitation(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestEnrollmentInvitation function called")
+
+	mstub := SetupIndexesAndGetStub(t)
+	org1Caller, service1Subgroup, patient1 := SetupEnrollmentServiceTest(t, mstub)
+	now := time.Now().Unix()
+	nowStr := strconv.FormatInt(now, 10)
+	enrollmentKeyB64 := crypto.EncodeToB64String(test_utils.GenerateSymKey())
+
+	// only service admins can issue invitations
+	mstub.MockTransactionStart("1")
+	stub := cached_stub.NewCachedStub(mstub)
+	invitation1 := GenerateEnrollmentInvitationTest("invitation1", "invitation-code1", now+3600)
+	invitation1Bytes, _ := json.Marshal(&invitation1)
+	_, err := IssueEnrollmentInvitation(stub, patient1, []string{string(invitation1Bytes), nowStr})
+	test_utils.AssertTrue(t, err != nil, "Expected IssueEnrollmentInvitation to fail")
+	unsaltedInvitation := GenerateEnrollmentInvitationTest("invitation1", "invitation-code1", now+3600)
+	unsaltedInvitation.Salt = ""
+	unsaltedInvitationBytes, _ := json.Marshal(&unsaltedInvitation)
+	_, err = IssueEnrollmentInvitation(stub, service1Subgroup, []string{string(unsaltedInvitationBytes), nowStr})
+	test_utils.AssertTrue(t, err != nil, "Expected IssueEnrollmentInvitation without salt to fail")
+	_, err = IssueEnrollmentInvitation(stub, service1Subgroup, []string{string(invitation1Bytes), nowStr})
+	test_utils.AssertTrue(t, err == nil, "Expected IssueEnrollmentInvitation to succeed")
+	invitation2 := GenerateEnrollmentInvitationTest("invitation2", "invitation-code2", now+3600)
+	invitation2Bytes, _ := json.Marshal(&invitation2)
+	_, err = IssueEnrollmentInvitation(stub, org1Caller, []string{string(invitation2Bytes), nowStr})
+	test_utils.AssertTrue(t, err == nil, "Expected IssueEnrollmentInvitation to succeed")
+	mstub.MockTransactionEnd("1")
+
+	mstub.MockTransactionStart("2")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = IssueEnrollmentInvitation(stub, service1Subgroup, []string{string(invitation1Bytes), nowStr})
+	test_utils.AssertTrue(t, err != nil, "Expected duplicate IssueEnrollmentInvitation to fail")
+	_, err = RevokeEnrollmentInvitation(stub, service1Subgroup, []string{"service1", "invitation2", nowStr})
+	test_utils.AssertTrue(t, err == nil, "Expected RevokeEnrollmentInvitation to succeed")
+	mstub.MockTransactionEnd("2")
+
+	// revoked, expired, short and wrong codes cannot be redeemed
+	mstub.MockTransactionStart("3")
+	stub = cached_stub.NewCachedStub(mstub)
+	invitation3 := GenerateEnrollmentInvitationTest("invitation3", "code3", now+3600)
+	invitation3Bytes, _ := json.Marshal(&invitation3)
+	_, err = IssueEnrollmentInvitation(stub, service1Subgroup, []string{string(invitation3Bytes), nowStr})
+	test_utils.AssertTrue(t, err == nil, "Expected IssueEnrollmentInvitation to succeed")
+	_, err = AcceptEnrollmentInvitation(stub, patient1, []string{"service1", "invitation3", "code3", enrollmentKeyB64, nowStr})
+	test_utils.AssertTrue(t, err != nil, "Expected AcceptEnrollmentInvitation with short code to fail")
+	_, err = AcceptEnrollmentInvitation(stub, patient1, []string{"service1", "invitation2", "invitation-code2", enrollmentKeyB64, nowStr})
+	test_utils.AssertTrue(t, err != nil, "Expected AcceptEnrollmentInvitation of revoked invitation to fail")
+	_, err = AcceptEnrollmentInvitation(stub, patient1, []string{"service1", "invitation1", "invitation-code2", enrollmentKeyB64, nowStr})
+	test_utils.AssertTrue(t, err != nil, "Expected AcceptEnrollmentInvitation with wrong code to fail")
+	laterStr := strconv.FormatInt(now+3600, 10)
+	_, err = AcceptEnrollmentInvitation(stub, patient1, []string{"service1", "invitation1", "invitation-code1", enrollmentKeyB64, laterStr})
+	test_utils.AssertTrue(t, err != nil, "Expected AcceptEnrollmentInvitation of expired invitation to fail")
+	mstub.MockTransactionEnd("3")
+
+	mstub.MockTransactionStart("4")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = AcceptEnrollmentInvitation(stub, patient1, []string{"service1", "invitation1", "invitation-code1", enrollmentKeyB64, nowStr})
+	test_utils.AssertTrue(t, err == nil, "Expected AcceptEnrollmentInvitation to succeed")
+	mstub.MockTransactionEnd("4")
+
+	// enrollment is visible to the patient and the service, and the code is used up
+	mstub.MockTransactionStart("5")
+	stub = cached_stub.NewCachedStub(mstub)
+	enrollmentResult, err := GetEnrollmentInternal(stub, service1Subgroup, "patient1", "service1")
+	test_utils.AssertTrue(t, err == nil, "Expected GetEnrollmentInternal to succeed")
+	test_utils.AssertTrue(t, enrollmentResult.Status == "active", "Expected enrollment status to be active")
+	enrollmentResult, err = GetEnrollmentInternal(stub, patient1, "patient1", "service1")
+	test_utils.AssertTrue(t, err == nil, "Expected GetEnrollmentInternal to succeed")
+	test_utils.AssertTrue(t, enrollmentResult.ServiceName == "service1 Name", "Got service name correctly")
+
+	_, err = AcceptEnrollmentInvitation(stub, patient1, []string{"service1", "invitation1", "invitation-code1", enrollmentKeyB64, nowStr})
+	test_utils.AssertTrue(t, err != nil, "Expected second AcceptEnrollmentInvitation to fail")
+
+	invitationsBytes, err := GetEnrollmentInvitations(stub, service1Subgroup, []string{"service1"})
+	test_utils.AssertTrue(t, err == nil, "Expected GetEnrollmentInvitations to succeed")
+	invitations := []EnrollmentInvitation{}
+	json.Unmarshal(invitationsBytes, &invitations)
+	test_utils.AssertTrue(t, len(invitations) == 3, "Expected 3 invitations")
+	for _, invitation := range invitations {
+		if invitation.InvitationID == "invitation1" {
+			test_utils.AssertTrue(t, invitation.Status == invitationStatusAccepted && invitation.matchesHash(invitation.AcceptedByHash, "patient1"), "Expected invitation1 accepted by patient1")
+			test_utils.AssertTrue(t, !strings.Contains(string(invitationsBytes), "patient1"), "Expected patient ID not to be stored")
+		} else if invitation.InvitationID == "invitation2" {
+			test_utils.AssertTrue(t, invitation.Status == invitationStatusRevoked, "Expected invitation2 revoked")
+		}
+	}
+	mstub.MockTransactionEnd("5")
+}
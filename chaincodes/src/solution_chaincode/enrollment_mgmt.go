@@ -13,6 +13,7 @@ import (
 	"common/bchcls/asset_mgmt"
 	"common/bchcls/asset_mgmt/asset_manager"
 	"common/bchcls/cached_stub"
+	"common/bchcls/consent_mgmt"
 	"common/bchcls/crypto"
 	"common/bchcls/custom_errors"
 	"common/bchcls/data_model"
@@ -36,23 +37,39 @@ const EnrollmentAssetNamespace = "EnrollmentAsset"
 //   - UserName
 //   - ServiceID
 //   - ServiceName
+//
+// TransferredTo points to the service the enrollment was moved to by TransferEnrollments
+// PendingConsents are consents carried over by TransferEnrollments that the patient has not approved yet
+//
+// TermsVersion is the version of the service terms the patient accepted
+// TermsAcknowledgementRequired is set when the service terms changed materially since then
 type Enrollment struct {
-	EnrollmentID string `json:"enrollment_id"`
-	UserID       string `json:"user_id"`
-	UserName     string `json:"user_name"`
-	ServiceID    string `json:"service_id"`
-	ServiceName  string `json:"service_name"`
-	EnrollDate   int64  `json:"enroll_date"`
-	Status       string `json:"status"`
+	EnrollmentID                 string                     `json:"enrollment_id"`
+	UserID                       string                     `json:"user_id"`
+	UserName                     string                     `json:"user_name"`
+	ServiceID                    string                     `json:"service_id"`
+	ServiceName                  string                     `json:"service_name"`
+	EnrollDate                   int64                      `json:"enroll_date"`
+	Status                       string                     `json:"status"`
+	History                      []EnrollmentStatusChange   `json:"history"`
+	TransferredTo                string                     `json:"transferred_to,omitempty"`
+	PendingConsents              []EnrollmentPendingConsent `json:"pending_consents,omitempty"`
+	TermsVersion                 int                        `json:"terms_version"`
+	TermsAcknowledgementRequired bool                       `json:"terms_acknowledgement_required"`
 }
 
 type EnrollmentResult struct {
-	UserID      string `json:"user_id"`
-	UserName    string `json:"user_name"`
-	ServiceID   string `json:"service_id"`
-	ServiceName string `json:"service_name"`
-	EnrollDate  int64  `json:"enroll_date"`
-	Status      string `json:"status"`
+	UserID                       string                     `json:"user_id"`
+	UserName                     string                     `json:"user_name"`
+	ServiceID                    string                     `json:"service_id"`
+	ServiceName                  string                     `json:"service_name"`
+	EnrollDate                   int64                      `json:"enroll_date"`
+	Status                       string                     `json:"status"`
+	History                      []EnrollmentStatusChange   `json:"history"`
+	TransferredTo                string                     `json:"transferred_to,omitempty"`
+	PendingConsents              []EnrollmentPendingConsent `json:"pending_consents,omitempty"`
+	TermsVersion                 int                        `json:"terms_version"`
+	TermsAcknowledgementRequired bool                       `json:"terms_acknowledgement_required"`
 }
 
 type enrollmentPublicData struct {
@@ -64,11 +81,18 @@ type enrollmentPublicData struct {
 }
 
 type enrollmentPrivateData struct {
-	EnrollDate int64  `json:"enroll_date"`
-	Status     string `json:"status"`
+	EnrollDate                   int64                      `json:"enroll_date"`
+	Status                       string                     `json:"status"`
+	History                      []EnrollmentStatusChange   `json:"history"`
+	TransferredTo                string                     `json:"transferred_to,omitempty"`
+	PendingConsents              []EnrollmentPendingConsent `json:"pending_consents,omitempty"`
+	TermsVersion                 int                        `json:"terms_version"`
+	TermsAcknowledgementRequired bool                       `json:"terms_acknowledgement_required"`
 }
 
 // Enroll patient
+// Enrollment status must be pending or active
+// Patient must meet the eligibility rule of the service, if it has one
 // 1) Validate enrollmentSymKey and enrollment object
 // 2) Encrypt enrollmentKey with serviceSymKey
 // 3) Encrypt enrollmentKey with userSymKey
@@ -96,101 +120,174 @@ func EnrollPatient(stub cached_stub.CachedStubInterface, caller data_model.User,
 		return nil, errors.Wrap(err, customErr.Error())
 	}
 
+	service, err := getEnrollmentService(stub, caller, enrollment.ServiceID)
+	if err != nil {
+		return nil, err
+	}
+
+	enrollmentKey, existingUser, err := service.validateEnrollment(stub, caller, &enrollment, args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	// ==============================================================
+	// Check existing enrollment
+	// ==============================================================
+	enrollmentExists, err := CheckEnrollmentExists(stub, caller, enrollment.EnrollmentID)
+	if err != nil {
+		customErr := &GetEnrollmentError{Enrollment: enrollment.EnrollmentID}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	// Already enrolled, just return
+	if enrollmentExists {
+		return UpdateEnrollmentInternal(stub, caller, enrollment, "", enrollment.EnrollDate)
+	}
+
+	return nil, service.addEnrollment(stub, caller, enrollment, enrollmentKey, existingUser, "")
+}
+
+// enrollmentService is the service patients are enrolled in
+// It is looked up once, so that enrolling many patients does not repeat the service key path work
+type enrollmentService struct {
+	subgroup data_model.User
+	service  Service
+}
+
+// getEnrollmentService returns the service with its keys, and checks that caller is service admin or org admin of it
+func getEnrollmentService(stub cached_stub.CachedStubInterface, caller data_model.User, serviceID string) (enrollmentService, error) {
+	if utils.IsStringEmpty(serviceID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "ServiceID"}
+		logger.Errorf(customErr.Error())
+		return enrollmentService{}, errors.WithStack(customErr)
+	}
+
+	existingService, err := user_mgmt.GetUserData(stub, caller, serviceID, true, false)
+	if err != nil {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf("%v: %v", customErr, err)
+		return enrollmentService{}, errors.Wrap(err, customErr.Error())
+	}
+
+	serviceOrg := GetOrgIDFromServiceSubgroup(existingService)
+	if utils.IsStringEmpty(serviceOrg) {
+		customErr := &custom_errors.LengthCheckingError{Type: "serviceOrg"}
+		logger.Errorf(customErr.Error())
+		return enrollmentService{}, errors.WithStack(customErr)
+	}
+
+	// Check that caller is an service admin or org admin of this service
+	if !CallerIsAdminOfService(caller, serviceID, serviceOrg) {
+		logger.Error("Caller is not admin of the service")
+		return enrollmentService{}, errors.New("Caller is not admin of the service")
+	}
+
+	// service asset is needed for the eligibility rule
+	service, err := GetServiceInternal(stub, caller, serviceID, false)
+	if err != nil {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf("%v: %v", customErr, err)
+		return enrollmentService{}, errors.Wrap(err, customErr.Error())
+	}
+
+	// retiring services do not take new patients
+	err = service.checkNotRetiring()
+	if err != nil {
+		return enrollmentService{}, err
+	}
+
+	return enrollmentService{subgroup: existingService, service: service}, nil
+}
+
+// validateEnrollment checks an incoming enrollment of the service and its sym key
+// Enrollment ID, user name and service name are filled in
+// Returns the enrollment key and the patient
+func (es enrollmentService) validateEnrollment(stub cached_stub.CachedStubInterface, caller data_model.User, enrollment *Enrollment, enrollmentSymKeyB64 string) (data_model.Key, data_model.User, error) {
 	if utils.IsStringEmpty(enrollment.UserID) {
 		customErr := &custom_errors.LengthCheckingError{Type: "UserID"}
 		logger.Errorf(customErr.Error())
-		return nil, errors.WithStack(customErr)
+		return data_model.Key{}, data_model.User{}, errors.WithStack(customErr)
 	}
 
 	if enrollment.UserID == caller.ID {
 		logger.Errorf("Caller and enrolled patient must be different")
-		return nil, errors.New("Caller and enrolled patient must be different")
+		return data_model.Key{}, data_model.User{}, errors.New("Caller and enrolled patient must be different")
+	}
+
+	if enrollment.ServiceID != es.subgroup.ID {
+		logger.Errorf("Enrollment service %v does not match %v", enrollment.ServiceID, es.subgroup.ID)
+		return data_model.Key{}, data_model.User{}, errors.New("Enrollment service does not match " + es.subgroup.ID)
 	}
 
 	// check that EnrollDate is within 10 mins of current time
 	currTime := time.Now().Unix()
 	if currTime-enrollment.EnrollDate > 10*60 || currTime-enrollment.EnrollDate < -10*60 {
 		logger.Errorf("Invalid EnrollDate (current time: %v)  %v", currTime, enrollment.EnrollDate)
-		return nil, errors.New("Invalid EnrollDate, not within possible time range")
+		return data_model.Key{}, data_model.User{}, errors.New("Invalid EnrollDate, not within possible time range")
 	}
 
 	enrollmentID := GetEnrollmentID(enrollment.UserID, enrollment.ServiceID)
 	enrollment.EnrollmentID = enrollmentID
 	enrollmentKey := data_model.Key{ID: key_mgmt.GetSymKeyId(enrollmentID), Type: key_mgmt.KEY_TYPE_SYM}
-	enrollmentKey.KeyBytes, err = crypto.ParseSymKeyB64(args[1])
+	keyBytes, err := crypto.ParseSymKeyB64(enrollmentSymKeyB64)
 	if err != nil {
 		logger.Errorf("Invalid enrollmentSymKey")
-		return nil, errors.Wrap(err, "Invalid enrollmentSymKey")
+		return data_model.Key{}, data_model.User{}, errors.Wrap(err, "Invalid enrollmentSymKey")
 	}
 
-	if enrollmentKey.KeyBytes == nil {
+	if keyBytes == nil {
 		logger.Errorf("Invalid enrollmentSymKey")
-		return nil, errors.New("Invalid enrollmentSymKey")
+		return data_model.Key{}, data_model.User{}, errors.New("Invalid enrollmentSymKey")
 	}
 
+	enrollmentKey.KeyBytes = keyBytes
+
 	// make sure user exists
 	// also get enrollment username from existing user
 	existingUser, err := user_mgmt.GetUserData(stub, caller, enrollment.UserID, false, false)
 	if err != nil {
 		customErr := &GetUserError{User: "enrollment user"}
 		logger.Errorf("%v: %v", customErr, err)
-		return nil, errors.Wrap(err, customErr.Error())
+		return data_model.Key{}, data_model.User{}, errors.Wrap(err, customErr.Error())
 	}
 
 	if utils.IsStringEmpty(existingUser.ID) {
 		customErr := &custom_errors.LengthCheckingError{Type: "existingUser.UserID"}
 		logger.Errorf(customErr.Error())
-		return nil, errors.WithStack(customErr)
+		return data_model.Key{}, data_model.User{}, errors.WithStack(customErr)
 	}
 
 	enrollment.UserName = existingUser.Name
+	enrollment.ServiceName = es.subgroup.Name
 
-	if utils.IsStringEmpty(enrollment.ServiceID) {
-		customErr := &custom_errors.LengthCheckingError{Type: "ServiceID"}
-		logger.Errorf(customErr.Error())
-		return nil, errors.WithStack(customErr)
-	}
+	// patient is enrolled under the current service terms
+	enrollment.TermsVersion = es.service.TermsVersion
+	enrollment.TermsAcknowledgementRequired = false
 
-	existingService, err := user_mgmt.GetUserData(stub, caller, enrollment.ServiceID, true, false)
-	if err != nil {
-		customErr := &GetServiceError{Service: enrollment.ServiceID}
-		logger.Errorf("%v: %v", customErr, err)
-		return nil, errors.Wrap(err, customErr.Error())
+	if enrollment.Status != EnrollmentStatusPending && enrollment.Status != EnrollmentStatusActive {
+		logger.Error("Enrollment status must be pending or active")
+		return data_model.Key{}, data_model.User{}, errors.New("Enrollment status must be pending or active")
 	}
 
-	serviceOrg := GetOrgIDFromServiceSubgroup(existingService)
-	if utils.IsStringEmpty(serviceOrg) {
-		customErr := &custom_errors.LengthCheckingError{Type: "serviceOrg"}
-		logger.Errorf(customErr.Error())
-		return nil, errors.WithStack(customErr)
-	}
-
-	// Check that caller is an service admin or org admin of this service
-	if !CallerIsAdminOfService(caller, enrollment.ServiceID, serviceOrg) {
-		logger.Error("Caller is not admin of the service")
-		return nil, errors.New("Caller is not admin of the service")
+	// Check that patient meets the service eligibility rule
+	err = es.service.checkPatientEligibility(existingUser)
+	if err != nil {
+		return data_model.Key{}, data_model.User{}, err
 	}
 
-	enrollment.ServiceName = existingService.Name
-
-	if enrollment.Status != "active" {
-		logger.Error("Enrollment status must be active")
-		return nil, errors.New("Enrollment status must be active")
-	}
+	return enrollmentKey, existingUser, nil
+}
 
-	// ==============================================================
-	// Check existing enrollment
-	// ==============================================================
-	enrollmentExists, err := CheckEnrollmentExists(stub, caller, enrollmentID)
+// addEnrollment saves a new validated enrollment as asset and gives the service and the patient access to it
+// reason is recorded with the first status of the enrollment
+func (es enrollmentService) addEnrollment(stub cached_stub.CachedStubInterface, caller data_model.User, enrollment Enrollment, enrollmentKey data_model.Key, existingUser data_model.User, reason string) error {
+	status := enrollment.Status
+	enrollment.Status = ""
+	enrollment.History = nil
+	err := enrollment.changeStatus(status, caller.ID, reason, enrollment.EnrollDate)
 	if err != nil {
-		customErr := &GetEnrollmentError{Enrollment: enrollmentID}
-		logger.Errorf("%v: %v", customErr, err)
-		return nil, errors.Wrap(err, customErr.Error())
-	}
-
-	// Already enrolled, just return
-	if enrollmentExists {
-		return UpdateEnrollmentInternal(stub, caller, enrollment)
+		return err
 	}
 
 	// ==============================================================
@@ -201,21 +298,27 @@ func EnrollPatient(stub cached_stub.CachedStubInterface, caller data_model.User,
 	if err != nil {
 		customErr := &ConvertToAssetError{Asset: "enrollmentAsset"}
 		logger.Errorf("%v: %v", customErr, err)
-		return nil, errors.Wrap(err, customErr.Error())
+		return errors.Wrap(err, customErr.Error())
 	}
 
 	assetManager := asset_mgmt.GetAssetManager(stub, caller)
 	err = assetManager.AddAsset(enrollmentAsset, enrollmentKey, false)
 	if err != nil {
-		customErr := &PutAssetError{Asset: enrollmentID}
+		customErr := &PutAssetError{Asset: enrollment.EnrollmentID}
 		logger.Errorf("%v: %v", customErr, err)
-		return nil, errors.Wrap(err, customErr.Error())
+		return errors.Wrap(err, customErr.Error())
+	}
+
+	// patient needs write access to be able to unenroll
+	err = addEnrollmentWriteAccess(stub, caller, enrollmentAsset, enrollmentKey, enrollment.UserID)
+	if err != nil {
+		return err
 	}
 
 	// ==============================================================
 	// Establish key relationships
 	// ==============================================================
-	servicePubKey := existingService.GetPublicKey()
+	servicePubKey := es.subgroup.GetPublicKey()
 	userPubKey := existingUser.GetPublicKey()
 
 	// add access from servicePubKey to enrollmentSymKey
@@ -224,7 +327,7 @@ func EnrollPatient(stub cached_stub.CachedStubInterface, caller data_model.User,
 	if err != nil {
 		customErr := &custom_errors.AddAccessError{Key: "service pub key to enrollment key"}
 		logger.Errorf("%v: %v", customErr, err)
-		return nil, errors.Wrap(err, customErr.Error())
+		return errors.Wrap(err, customErr.Error())
 	}
 
 	// add access from userPubKey to enrollmentSymKey
@@ -232,32 +335,36 @@ func EnrollPatient(stub cached_stub.CachedStubInterface, caller data_model.User,
 	if err != nil {
 		customErr := &custom_errors.AddAccessError{Key: "user pub key to enrollment key"}
 		logger.Errorf("%v: %v", customErr, err)
-		return nil, errors.Wrap(err, customErr.Error())
+		return errors.Wrap(err, customErr.Error())
 	}
 
 	// ==============================================================
 	// Add access from service log sym key to enrollmentLogSymKey
 	// ==============================================================
 	// EnrollmentLogSymKey is used as log sym key for PutConsent
-	serviceLogSymKey := existingService.GetLogSymKey()
+	serviceLogSymKey := es.subgroup.GetLogSymKey()
 	enrollmentLogSymKey := GetLogSymKeyFromKey(enrollmentKey)
 	err = userAccessManager.AddAccessByKey(serviceLogSymKey, enrollmentLogSymKey)
 	if err != nil {
 		customErr := &custom_errors.AddAccessError{Key: "service log sym key to enrollment log sym key"}
 		logger.Errorf("%v: %v", customErr, err)
-		return nil, errors.Wrap(err, customErr.Error())
+		return errors.Wrap(err, customErr.Error())
 	}
 
-	return nil, nil
+	return nil
 }
 
 // Unenroll patient
-// args = [ serviceID, userID ]
+// Can be called by service admin, org admin of the service, or the patient
+// Enrollment becomes withdrawn if the patient unenrolls, inactive otherwise
+// If denyConsents is "true", every consent the patient gave to the service is moved to deny in the same transaction
+// args = [ serviceID, userID ] or [ serviceID, userID, denyConsents, timestamp ]
+// The transaction timestamp is used when no timestamp is given
 func UnenrollPatient(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
 	defer utils.ExitFnLog(utils.EnterFnLog())
 	logger.Debugf("args: %v", args)
 
-	if len(args) != 2 {
+	if len(args) != 2 && len(args) != 4 {
 		customErr := &custom_errors.LengthCheckingError{Type: "UnenrollPatient arguments length"}
 		logger.Errorf(customErr.Error())
 		return nil, errors.New(customErr.Error())
@@ -281,6 +388,25 @@ func UnenrollPatient(stub cached_stub.CachedStubInterface, caller data_model.Use
 		return nil, errors.WithStack(customErr)
 	}
 
+	// without a timestamp argument, the transaction timestamp is recorded, so all peers record the same history
+	denyConsents := false
+	var timestamp int64
+	if len(args) == 4 {
+		denyConsents = args[2] == "true"
+		var err error
+		timestamp, err = ParseTimestamp(args[3])
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		txTimestamp, err := stub.GetTxTimestamp()
+		if err != nil || txTimestamp == nil {
+			logger.Errorf("Failed to get transaction timestamp: %v", err)
+			return nil, errors.New("Failed to get transaction timestamp")
+		}
+		timestamp = txTimestamp.Seconds
+	}
+
 	// make sure service exists
 	existingService, err := GetServiceInternal(stub, caller, serviceID, false)
 	if err != nil {
@@ -295,7 +421,8 @@ func UnenrollPatient(stub cached_stub.CachedStubInterface, caller data_model.Use
 		return nil, errors.WithStack(customErr)
 	}
 
-	if !CallerIsAdminOfService(caller, serviceID, existingService.OrgID) {
+	// patients can always leave a service themselves
+	if caller.ID != userID && !CallerIsAdminOfService(caller, serviceID, existingService.OrgID) {
 		logger.Error("Caller is not admin of the service")
 		return nil, errors.New("Caller is not admin of the service")
 	}
@@ -307,12 +434,128 @@ func UnenrollPatient(stub cached_stub.CachedStubInterface, caller data_model.Use
 		return nil, errors.New(customErr.Error())
 	}
 
-	enrollment.Status = "inactive"
-	return UpdateEnrollmentInternal(stub, caller, enrollment)
+	enrollment.Status = EnrollmentStatusInactive
+	if caller.ID == userID {
+		enrollment.Status = EnrollmentStatusWithdrawn
+	}
+
+	_, err = UpdateEnrollmentInternal(stub, caller, enrollment, "", timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	if denyConsents {
+		_, err = denyEnrollmentConsents(stub, caller, existingService, enrollment, nil, "UnenrollPatient", timestamp)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+// denyEnrollmentConsents moves every consent the patient gave to the service to deny,
+// including consents for reference datatypes of other services, and adds a single log for all of them
+// If datatypes is not nil, only consents for those datatypes are denied
+// functionName is the function the log is recorded for
+// Returns the denied datatypes
+func denyEnrollmentConsents(stub cached_stub.CachedStubInterface, caller data_model.User, service Service, enrollment Enrollment, datatypes []string, functionName string, timestamp int64) ([]string, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+
+	consents, err := GetConsentsInternal(stub, caller, enrollment.UserID, service.ServiceID)
+	if err != nil {
+		logger.Errorf("Failed to get consents: %v", err)
+		return nil, errors.Wrap(err, "Failed to get consents")
+	}
+
+	deniedDatatypes := []string{}
+	for _, consent := range consents {
+		if utils.InList(consent.Option, consentOptionDeny) {
+			continue
+		}
+
+		if datatypes != nil && !utils.InList(datatypes, consent.Datatype) {
+			continue
+		}
+
+		consent.Option = []string{consentOptionDeny}
+		consent.Timestamp = timestamp
+		consentCommon, err := convertToConsentCommon(stub, consent)
+		if err != nil {
+			errMsg := "Failed to convertToConsentCommon"
+			logger.Errorf("%v: %v", errMsg, err)
+			return nil, errors.Wrap(err, errMsg)
+		}
+
+		consentCommonBytes, err := json.Marshal(&consentCommon)
+		if err != nil {
+			customErr := &custom_errors.MarshalError{Type: "Consent [Common]"}
+			logger.Errorf("%v: %v", customErr, err)
+			return nil, errors.Wrap(err, customErr.Error())
+		}
+
+		_, err = consent_mgmt.PutConsent(stub, caller, []string{string(consentCommonBytes)})
+		if err != nil {
+			logger.Errorf("Failed to deny consent for datatype %v: %v", consent.Datatype, err)
+			return nil, errors.Wrap(err, "Failed to deny consent for datatype "+consent.Datatype)
+		}
+
+		deniedDatatypes = append(deniedDatatypes, consent.Datatype)
+	}
+
+	if len(deniedDatatypes) == 0 {
+		return deniedDatatypes, nil
+	}
+
+	// ==============================================================
+	// Logging
+	// ==============================================================
+	assetManager := asset_mgmt.GetAssetManager(stub, caller)
+	enrollmentAssetID := asset_mgmt.GetAssetId(EnrollmentAssetNamespace, enrollment.EnrollmentID)
+	keyPath, err := GetKeyPath(stub, caller, enrollmentAssetID)
+	if err != nil || len(keyPath) <= 0 {
+		customErr := &GetKeyPathError{Caller: caller.ID, AssetID: enrollmentAssetID}
+		logger.Errorf(customErr.Error())
+		return nil, errors.New(customErr.Error())
+	}
+
+	enrollmentKey, err := assetManager.GetAssetKey(enrollmentAssetID, keyPath)
+	if err != nil {
+		logger.Errorf("Failed to GetAssetKey for enrollmentKey: %v", err)
+		return nil, errors.Wrap(err, "Failed to GetAssetKey for enrollmentKey")
+	}
+
+	data := make(map[string]interface{})
+	data["option"] = []string{consentOptionDeny}
+	data["datatypes"] = deniedDatatypes
+	consentLog := ConsentLog{Owner: enrollment.UserID, Target: service.ServiceID, Service: service.ServiceID, Data: data}
+	solutionLog := SolutionLog{
+		TransactionID: stub.GetTxID(),
+		Namespace:     "OMR",
+		FunctionName:  functionName,
+		CallerID:      caller.ID,
+		Timestamp:     timestamp,
+		Data:          consentLog}
+	err = AddLogWithParams(stub, caller, solutionLog, GetLogSymKeyFromKey(enrollmentKey))
+	if err != nil {
+		customErr := &AddSolutionLogError{FunctionName: solutionLog.FunctionName}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	return deniedDatatypes, nil
 }
 
 // Internal function for updating enrollment
-func UpdateEnrollmentInternal(stub cached_stub.CachedStubInterface, caller data_model.User, enrollment Enrollment) ([]byte, error) {
+// If the status changes, the change is checked and added to the history of the stored enrollment with reason and timestamp
+// Terms acknowledgement is always taken from the stored enrollment
+func UpdateEnrollmentInternal(stub cached_stub.CachedStubInterface, caller data_model.User, enrollment Enrollment, reason string, timestamp int64) ([]byte, error) {
+	return updateEnrollment(stub, caller, enrollment, reason, timestamp, false)
+}
+
+// updateEnrollment saves changes to an enrollment, see UpdateEnrollmentInternal
+// If updateTerms is true, terms acknowledgement of enrollment replaces the stored one
+func updateEnrollment(stub cached_stub.CachedStubInterface, caller data_model.User, enrollment Enrollment, reason string, timestamp int64, updateTerms bool) ([]byte, error) {
 	defer utils.ExitFnLog(utils.EnterFnLog())
 
 	// have to update as either default org admin or default service admin
@@ -321,7 +564,10 @@ func UpdateEnrollmentInternal(stub cached_stub.CachedStubInterface, caller data_
 	callerObj := caller
 	// if caller is org admin, use org as caller
 	solutionCaller := convertToSolutionUser(caller)
-	if solutionCaller.SolutionInfo.IsOrgAdmin {
+	if caller.ID == enrollment.UserID {
+		// the patient has write access to own enrollment, no substitution needed
+		callerObj = caller
+	} else if solutionCaller.SolutionInfo.IsOrgAdmin {
 		orgCaller, err := user_mgmt.GetUserData(stub, caller, solutionCaller.Org, true, false)
 		if err != nil {
 			customErr := &GetOrgError{Org: solutionCaller.Org}
@@ -378,6 +624,33 @@ func UpdateEnrollmentInternal(stub cached_stub.CachedStubInterface, caller data_
 		return nil, errors.Wrap(err, "Failed to GetAssetKey for enrollmentKey")
 	}
 
+	// history is always taken from the stored enrollment, transfer details are kept unless they are replaced
+	existingAsset, err := assetManager.GetAsset(enrollmentAssetID, enrollmentKey)
+	if err != nil {
+		customErr := &custom_errors.GetAssetDataError{AssetId: enrollmentAssetID}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	existingEnrollment := convertEnrollmentFromAsset(existingAsset)
+	status := enrollment.Status
+	enrollment.Status = existingEnrollment.Status
+	enrollment.History = existingEnrollment.History
+	if utils.IsStringEmpty(enrollment.TransferredTo) {
+		enrollment.TransferredTo = existingEnrollment.TransferredTo
+	}
+	if enrollment.PendingConsents == nil {
+		enrollment.PendingConsents = existingEnrollment.PendingConsents
+	}
+	if !updateTerms {
+		enrollment.TermsVersion = existingEnrollment.TermsVersion
+		enrollment.TermsAcknowledgementRequired = existingEnrollment.TermsAcknowledgementRequired
+	}
+	err = enrollment.changeStatus(status, caller.ID, reason, timestamp)
+	if err != nil {
+		return nil, err
+	}
+
 	// Convert enrollment object to Asset
 	enrollmentAsset, err := convertEnrollmentToAsset(stub, enrollment)
 	if err != nil {
@@ -399,7 +672,7 @@ func UpdateEnrollmentInternal(stub cached_stub.CachedStubInterface, caller data_
 
 // GetPatientEnrollments gets all enrollments of an user
 // args = [ userID, statusFilter ]
-// statusFilter is an optional parameter for filtering enrollment status
+// statusFilter is an optional parameter for filtering by any enrollment status
 func GetPatientEnrollments(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
 	defer utils.ExitFnLog(utils.EnterFnLog())
 	logger.Debugf("args: %v", args)
@@ -427,9 +700,9 @@ func GetPatientEnrollments(stub cached_stub.CachedStubInterface, caller data_mod
 
 	// Validate status filter
 	if !utils.IsStringEmpty(statusFilter) {
-		if statusFilter != "active" && statusFilter != "inactive" {
-			logger.Error("Invalid status filter, must be active or inactive")
-			return nil, errors.New("Invalid status filter, must be active or inactive")
+		if !isValidEnrollmentStatus(statusFilter) {
+			logger.Errorf("Invalid status filter: %v", statusFilter)
+			return nil, errors.New("Invalid status filter: " + statusFilter)
 		}
 	}
 
@@ -473,7 +746,7 @@ func GetPatientEnrollments(stub cached_stub.CachedStubInterface, caller data_mod
 
 // GetServiceEnrollments gets all enrollments of a service
 // args = [ serviceID, statusFilter ]
-// statusFilter is an optional parameter for filtering enrollment status
+// statusFilter is an optional parameter for filtering by any enrollment status
 func GetServiceEnrollments(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
 	defer utils.ExitFnLog(utils.EnterFnLog())
 	logger.Debugf("args: %v", args)
@@ -501,9 +774,9 @@ func GetServiceEnrollments(stub cached_stub.CachedStubInterface, caller data_mod
 
 	// Validate status filter
 	if !utils.IsStringEmpty(statusFilter) {
-		if statusFilter != "active" && statusFilter != "inactive" {
-			logger.Error("Invalid status filter, must be active or inactive")
-			return nil, errors.New("Invalid status filter, must be active or inactive")
+		if !isValidEnrollmentStatus(statusFilter) {
+			logger.Errorf("Invalid status filter: %v", statusFilter)
+			return nil, errors.New("Invalid status filter: " + statusFilter)
 		}
 	}
 
@@ -595,6 +868,169 @@ func GetEnrollmentInternal(stub cached_stub.CachedStubInterface, caller data_mod
 	return enrollment, nil
 }
 
+// getServiceEnrollmentsInternal returns all enrollments of the service
+// Caller must be service admin or org admin of the service
+func getServiceEnrollmentsInternal(stub cached_stub.CachedStubInterface, caller data_model.User, serviceID string) ([]Enrollment, error) {
+	// if caller is org admin, org ID is needed to find the enrollments
+	options := []string{}
+	solutionCaller := convertToSolutionUser(caller)
+	if solutionCaller.SolutionInfo.IsOrgAdmin {
+		options = append(options, solutionCaller.Org)
+	}
+
+	enrollmentsBytes, err := GetServiceEnrollments(stub, caller, []string{serviceID})
+	if err != nil {
+		logger.Errorf("Failed to get enrollments of service %v: %v", serviceID, err)
+		return nil, errors.Wrap(err, "Failed to get enrollments of service "+serviceID)
+	}
+
+	enrollmentResults := []EnrollmentResult{}
+	err = json.Unmarshal(enrollmentsBytes, &enrollmentResults)
+	if err != nil {
+		customErr := &custom_errors.UnmarshalError{Type: "enrollments"}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	enrollments := []Enrollment{}
+	for _, enrollmentResult := range enrollmentResults {
+		enrollment, err := GetEnrollmentInternal(stub, caller, enrollmentResult.UserID, serviceID, options...)
+		if err != nil {
+			customErr := &GetEnrollmentError{Enrollment: GetEnrollmentID(enrollmentResult.UserID, serviceID)}
+			logger.Errorf("%v: %v", customErr, err)
+			return nil, errors.Wrap(err, customErr.Error())
+		}
+
+		enrollments = append(enrollments, enrollment)
+	}
+
+	return enrollments, nil
+}
+
+// addEnrollmentWriteAccess gives the enrolled patient write access to the enrollment asset
+func addEnrollmentWriteAccess(stub cached_stub.CachedStubInterface, caller data_model.User, enrollmentAsset data_model.Asset, enrollmentKey data_model.Key, userID string) error {
+	assetManager := asset_mgmt.GetAssetManager(stub, caller)
+	accessControl := data_model.AccessControl{}
+	accessControl.UserId = userID
+	accessControl.AssetId = enrollmentAsset.AssetId
+	accessControl.Access = user_access_ctrl.ACCESS_WRITE
+	accessControl.AssetKey = &enrollmentKey
+
+	err := assetManager.AddAccessToAsset(accessControl, true)
+	if err != nil {
+		customErr := &custom_errors.AddAccessError{Key: enrollmentKey.ID}
+		logger.Errorf("%v: %v", customErr, err)
+		return errors.Wrap(err, customErr.Error())
+	}
+
+	return nil
+}
+
+// MigrateEnrollmentWriteAccess gives patients write access to their enrollments of a service
+// Enrollments created before patients could update their own enrollment only gave patients read access,
+// so patients of those enrollments cannot unenroll or acknowledge service terms until this has run once
+// Can only be called by service admin or org admin of the service
+// args = [ serviceID ]
+func MigrateEnrollmentWriteAccess(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 1 {
+		customErr := &custom_errors.LengthCheckingError{Type: "MigrateEnrollmentWriteAccess arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	serviceID := args[0]
+	if utils.IsStringEmpty(serviceID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "serviceID"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	service, err := GetServiceInternal(stub, caller, serviceID, false)
+	if err != nil {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	if utils.IsStringEmpty(service.ServiceID) {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	if !CallerIsAdminOfService(caller, service.ServiceID, service.OrgID) {
+		logger.Errorf("Caller must be admin of service")
+		return nil, errors.New("Caller must be admin of service")
+	}
+
+	// enrollments are added by the service, so the service gives access
+	serviceCaller, err := GetOwnerCaller(stub, caller, serviceID)
+	if err != nil {
+		logger.Errorf("Failed to get service caller: %v", err)
+		return nil, errors.Wrap(err, "Failed to get service caller")
+	}
+
+	// ==============================================================
+	// Give write access for each enrollment of the service
+	// ==============================================================
+	assetManager := asset_mgmt.GetAssetManager(stub, serviceCaller)
+	iter, err := assetManager.GetAssetIter(EnrollmentAssetNamespace, IndexEnrollment, []string{"service_id"}, []string{serviceID}, []string{serviceID}, true, false, KeyPathFunc, "", -1, nil)
+	if err != nil {
+		logger.Errorf("GetServiceAssets failed: %v", err)
+		return nil, errors.Wrap(err, "GetServiceAssets failed")
+	}
+
+	defer iter.Close()
+	migrated := []string{}
+	for iter.HasNext() {
+		enrollmentAsset, err := iter.Next()
+		if err != nil {
+			customErr := &custom_errors.IterError{}
+			logger.Errorf("%v: %v", customErr, err)
+			return nil, errors.Wrap(err, customErr.Error())
+		}
+
+		if utils.IsStringEmpty(enrollmentAsset.AssetId) {
+			continue
+		}
+
+		if data_model.IsEncryptedData(enrollmentAsset.PrivateData) {
+			logger.Errorf("Service does not have access to enrollment %v", enrollmentAsset.AssetId)
+			return nil, errors.New("Service does not have access to enrollment " + enrollmentAsset.AssetId)
+		}
+
+		keyPath, err := GetKeyPath(stub, serviceCaller, enrollmentAsset.AssetId)
+		if err != nil || len(keyPath) <= 0 {
+			customErr := &GetKeyPathError{Caller: serviceCaller.ID, AssetID: enrollmentAsset.AssetId}
+			logger.Errorf(customErr.Error())
+			return nil, errors.New(customErr.Error())
+		}
+
+		enrollmentKey, err := assetManager.GetAssetKey(enrollmentAsset.AssetId, keyPath)
+		if err != nil {
+			logger.Errorf("Failed to GetAssetKey for enrollmentKey: %v", err)
+			return nil, errors.Wrap(err, "Failed to GetAssetKey for enrollmentKey")
+		}
+
+		enrollment := convertEnrollmentFromAsset(enrollmentAsset)
+		err = addEnrollmentWriteAccess(stub, serviceCaller, *enrollmentAsset, enrollmentKey, enrollment.UserID)
+		if err != nil {
+			return nil, err
+		}
+		migrated = append(migrated, enrollment.UserID)
+	}
+
+	logger.Infof("gave write access to %v enrollments of service %v", len(migrated), serviceID)
+
+	return json.Marshal(&migrated)
+}
+
 func GetEnrollmentID(UserID string, ServiceID string) string {
 	defer utils.ExitFnLog(utils.EnterFnLog())
 	return EnrollmentPrefix + "-" + UserID + "-" + ServiceID
@@ -658,6 +1094,11 @@ func convertEnrollmentFromAsset(asset *data_model.Asset) Enrollment {
 	enrollment.ServiceName = publicData.ServiceName
 	enrollment.EnrollDate = privateData.EnrollDate
 	enrollment.Status = privateData.Status
+	enrollment.History = privateData.History
+	enrollment.TransferredTo = privateData.TransferredTo
+	enrollment.PendingConsents = privateData.PendingConsents
+	enrollment.TermsVersion = privateData.TermsVersion
+	enrollment.TermsAcknowledgementRequired = privateData.TermsAcknowledgementRequired
 	return enrollment
 }
 
@@ -676,6 +1117,11 @@ func convertEnrollmentResultFromAsset(asset *data_model.Asset) EnrollmentResult
 	enrollment.ServiceName = publicData.ServiceName
 	enrollment.EnrollDate = privateData.EnrollDate
 	enrollment.Status = privateData.Status
+	enrollment.History = privateData.History
+	enrollment.TransferredTo = privateData.TransferredTo
+	enrollment.PendingConsents = privateData.PendingConsents
+	enrollment.TermsVersion = privateData.TermsVersion
+	enrollment.TermsAcknowledgementRequired = privateData.TermsAcknowledgementRequired
 	return enrollment
 }
 
@@ -703,6 +1149,11 @@ func getEnrollmentAssetPrivateData(enrollment Enrollment) ([]byte, error) {
 	privateData := enrollmentPrivateData{}
 	privateData.EnrollDate = enrollment.EnrollDate
 	privateData.Status = enrollment.Status
+	privateData.History = enrollment.History
+	privateData.TransferredTo = enrollment.TransferredTo
+	privateData.PendingConsents = enrollment.PendingConsents
+	privateData.TermsVersion = enrollment.TermsVersion
+	privateData.TermsAcknowledgementRequired = enrollment.TermsAcknowledgementRequired
 	privateBytes, err := json.Marshal(&privateData)
 	if err != nil {
 		customErr := &custom_errors.MarshalError{Type: "privateData"}
@@ -19,6 +19,7 @@ import (
 	"common/bchcls/test_utils"
 	"common/bchcls/user_mgmt"
 	"encoding/json"
+	"strconv"
 	"testing"
 	"time"
 
@@ -680,6 +681,7 @@ func TestUnenrollPatient(t *testing.T) {
 	stub = cached_stub.NewCachedStub(mstub)
 	_, err = UnenrollPatient(stub, org1Caller, []string{"service1", "patient1"})
 	test_utils.AssertTrue(t, err == nil, "Expected UnenrollPatient to succeed")
+	txTimestamp, _ := mstub.GetTxTimestamp()
 	mstub.MockTransactionEnd("t123")
 
 	// get enrollment back, see status is inactive
@@ -688,6 +690,79 @@ func TestUnenrollPatient(t *testing.T) {
 	enrollmentResult, err := GetEnrollmentInternal(stub, org1, "patient1", "service1")
 	test_utils.AssertTrue(t, err == nil, "Expected GetEnrollmentInternal to succeed")
 	test_utils.AssertTrue(t, enrollmentResult.Status == "inactive", "Expected enrollment status to be inactive")
+	lastChange := enrollmentResult.History[len(enrollmentResult.History)-1]
+	test_utils.AssertTrue(t, lastChange.Timestamp == txTimestamp.Seconds, "Expected transaction timestamp in history")
+	mstub.MockTransactionEnd("t123")
+}
+
+func TestUnenrollPatientDenyConsents(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestUnenrollPatientDenyConsents function called")
+
+	mstub := SetupIndexesAndGetStub(t)
+	org1Caller, service1Subgroup, patient1 := SetupEnrollmentServiceTest(t, mstub)
+	nowStr := strconv.FormatInt(time.Now().Unix(), 10)
+
+	// enroll patient
+	mstub.MockTransactionStart("t123")
+	stub := cached_stub.NewCachedStub(mstub)
+	enrollment1 := GenerateEnrollmentTest("patient1", "service1")
+	enrollment1Bytes, _ := json.Marshal(&enrollment1)
+	enrollmentKey1B64 := crypto.EncodeToB64String(test_utils.GenerateSymKey())
+	_, err := EnrollPatient(stub, org1Caller, []string{string(enrollment1Bytes), enrollmentKey1B64})
+	test_utils.AssertTrue(t, err == nil, "Expected EnrollPatient to succeed")
+	mstub.MockTransactionEnd("t123")
+
+	// patient gives consent
+	mstub.MockTransactionStart("t123")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	patient1Caller, _ := user_mgmt.GetUserData(stub, patient1, "patient1", true, true)
+	consent := Consent{Owner: "patient1", Service: "service1", Target: "service1", Datatype: "datatype1", Option: []string{consentOptionWrite, consentOptionRead}, Timestamp: time.Now().Unix()}
+	consentBytes, _ := json.Marshal(&consent)
+	_, err = PutConsentPatientData(stub, patient1Caller, []string{string(consentBytes), crypto.EncodeToB64String(test_utils.GenerateSymKey())})
+	test_utils.AssertTrue(t, err == nil, "Expected PutConsentPatientData to succeed")
+	mstub.MockTransactionEnd("t123")
+
+	// other users cannot unenroll the patient
+	mstub.MockTransactionStart("t123")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	patient2 := test_utils.CreateTestUser("patient2")
+	patient2Bytes, _ := json.Marshal(&patient2)
+	_, err = user_mgmt.RegisterUser(stub, org1Caller, []string{string(patient2Bytes), "false"})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterUser to succeed")
+	_, err = UnenrollPatient(stub, patient2, []string{"service1", "patient1", "true", nowStr})
+	test_utils.AssertTrue(t, err != nil, "Expected UnenrollPatient to fail")
+	mstub.MockTransactionEnd("t123")
+
+	// access migration is only for admins of the service, and can be run again
+	mstub.MockTransactionStart("t123")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	_, err = MigrateEnrollmentWriteAccess(stub, patient1Caller, []string{"service1"})
+	test_utils.AssertTrue(t, err != nil, "Expected MigrateEnrollmentWriteAccess to fail")
+	migratedBytes, err := MigrateEnrollmentWriteAccess(stub, service1Subgroup, []string{"service1"})
+	test_utils.AssertTrue(t, err == nil, "Expected MigrateEnrollmentWriteAccess to succeed")
+	migrated := []string{}
+	json.Unmarshal(migratedBytes, &migrated)
+	test_utils.AssertSetsEqual(t, []string{"patient1"}, migrated)
+	mstub.MockTransactionEnd("t123")
+
+	// patient unenrolls and denies all consents
+	mstub.MockTransactionStart("t123")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	_, err = UnenrollPatient(stub, patient1Caller, []string{"service1", "patient1", "true", nowStr})
+	test_utils.AssertTrue(t, err == nil, "Expected UnenrollPatient to succeed")
+	mstub.MockTransactionEnd("t123")
+
+	mstub.MockTransactionStart("t123")
+	stub = cached_stub.NewCachedStub(mstub)
+	enrollmentResult, err := GetEnrollmentInternal(stub, service1Subgroup, "patient1", "service1")
+	test_utils.AssertTrue(t, err == nil, "Expected GetEnrollmentInternal to succeed")
+	test_utils.AssertTrue(t, enrollmentResult.Status == EnrollmentStatusWithdrawn, "Expected enrollment status to be withdrawn")
+	consentResultBytes, err := GetConsent(stub, patient1Caller, []string{"patient1", "service1", "datatype1"})
+	test_utils.AssertTrue(t, err == nil, "Expected GetConsent to succeed")
+	consentResult := Consent{}
+	json.Unmarshal(consentResultBytes, &consentResult)
+	test_utils.AssertSetsEqual(t, []string{consentOptionDeny}, consentResult.Option)
 	mstub.MockTransactionEnd("t123")
 }
 
@@ -0,0 +1,167 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"common/bchcls/cached_stub"
+	"common/bchcls/custom_errors"
+	"common/bchcls/data_model"
+	"common/bchcls/utils"
+
+	"github.com/pkg/errors"
+)
+
+// Enrollment statuses
+// inactive is kept for enrollments ended by the service before the other statuses existed
+const (
+	EnrollmentStatusPending   = "pending"
+	EnrollmentStatusActive    = "active"
+	EnrollmentStatusSuspended = "suspended"
+	EnrollmentStatusWithdrawn = "withdrawn"
+	EnrollmentStatusCompleted = "completed"
+	EnrollmentStatusInactive  = "inactive"
+)
+
+// enrollmentTransitions maps an enrollment status to the statuses it can move to
+// ended enrollments can only be made active again
+var enrollmentTransitions = map[string][]string{
+	EnrollmentStatusPending:   {EnrollmentStatusActive, EnrollmentStatusWithdrawn, EnrollmentStatusInactive},
+	EnrollmentStatusActive:    {EnrollmentStatusSuspended, EnrollmentStatusWithdrawn, EnrollmentStatusCompleted, EnrollmentStatusInactive},
+	EnrollmentStatusSuspended: {EnrollmentStatusActive, EnrollmentStatusWithdrawn, EnrollmentStatusCompleted, EnrollmentStatusInactive},
+	EnrollmentStatusWithdrawn: {EnrollmentStatusActive},
+	EnrollmentStatusCompleted: {EnrollmentStatusActive},
+	EnrollmentStatusInactive:  {EnrollmentStatusActive},
+}
+
+// EnrollmentStatusChange is an entry of the enrollment status history
+type EnrollmentStatusChange struct {
+	Status         string `json:"status"`
+	PreviousStatus string `json:"previous_status"`
+	Actor          string `json:"actor"`
+	Reason         string `json:"reason"`
+	Timestamp      int64  `json:"timestamp"`
+}
+
+// isValidEnrollmentStatus returns true if status is one of the enrollment statuses
+func isValidEnrollmentStatus(status string) bool {
+	_, ok := enrollmentTransitions[status]
+	return ok
+}
+
+// hasEnded returns true if the patient left the service or the service ended the enrollment
+func (enrollment Enrollment) hasEnded() bool {
+	return enrollment.Status == EnrollmentStatusWithdrawn ||
+		enrollment.Status == EnrollmentStatusCompleted ||
+		enrollment.Status == EnrollmentStatusInactive
+}
+
+// changeStatus moves the enrollment to status and records the change in its history
+// Nothing is recorded if the status does not change
+func (enrollment *Enrollment) changeStatus(status string, actor string, reason string, timestamp int64) error {
+	if !isValidEnrollmentStatus(status) {
+		logger.Errorf("Invalid enrollment status: %v", status)
+		return errors.New("Invalid enrollment status: " + status)
+	}
+
+	if enrollment.Status == status {
+		return nil
+	}
+
+	// enrollments stored before the status history existed have no previous status to check
+	if !utils.IsStringEmpty(enrollment.Status) && !utils.InList(enrollmentTransitions[enrollment.Status], status) {
+		logger.Errorf("Enrollment cannot move from %v to %v", enrollment.Status, status)
+		return errors.New("Enrollment cannot move from " + enrollment.Status + " to " + status)
+	}
+
+	enrollment.History = append(enrollment.History, EnrollmentStatusChange{
+		Status:         status,
+		PreviousStatus: enrollment.Status,
+		Actor:          actor,
+		Reason:         reason,
+		Timestamp:      timestamp})
+	enrollment.Status = status
+	return nil
+}
+
+// UpdateEnrollmentStatus moves an enrollment to a new status
+// Service admin or org admin of the service can set any status allowed from the current one
+// The patient can only withdraw
+// args = [ serviceID, userID, status, reason, timestamp ]
+func UpdateEnrollmentStatus(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 5 {
+		customErr := &custom_errors.LengthCheckingError{Type: "UpdateEnrollmentStatus arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	serviceID := args[0]
+	if utils.IsStringEmpty(serviceID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "ServiceID"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	userID := args[1]
+	if utils.IsStringEmpty(userID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "userID"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	status := args[2]
+	if !isValidEnrollmentStatus(status) {
+		logger.Errorf("Invalid enrollment status: %v", status)
+		return nil, errors.New("Invalid enrollment status: " + status)
+	}
+
+	timestamp, err := ParseTimestamp(args[4])
+	if err != nil {
+		return nil, err
+	}
+
+	service, err := GetServiceInternal(stub, caller, serviceID, false)
+	if err != nil {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	if utils.IsStringEmpty(service.ServiceID) {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	if caller.ID == userID {
+		if status != EnrollmentStatusWithdrawn {
+			logger.Errorf("Patient can only withdraw from a service")
+			return nil, errors.New("Patient can only withdraw from a service")
+		}
+	} else if !CallerIsAdminOfService(caller, serviceID, service.OrgID) {
+		logger.Error("Caller is not admin of the service")
+		return nil, errors.New("Caller is not admin of the service")
+	}
+
+	enrollment, err := GetEnrollmentInternal(stub, caller, userID, serviceID)
+	if err != nil {
+		customErr := &GetEnrollmentError{Enrollment: GetEnrollmentID(userID, serviceID)}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	enrollment.Status = status
+	return UpdateEnrollmentInternal(stub, caller, enrollment, args[3], timestamp)
+}
@@ -0,0 +1,111 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"common/bchcls/cached_stub"
+	"common/bchcls/crypto"
+	"common/bchcls/test_utils"
+	"common/bchcls/user_mgmt"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestEnrollmentStatusTransitions(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestEnrollmentStatusTransitions function called")
+
+	enrollment := Enrollment{}
+	err := enrollment.changeStatus(EnrollmentStatusPending, "service1", "", 1)
+	test_utils.AssertTrue(t, err == nil, "Expected pending to succeed")
+	err = enrollment.changeStatus(EnrollmentStatusCompleted, "service1", "", 2)
+	test_utils.AssertTrue(t, err != nil, "Expected pending to completed to fail")
+	err = enrollment.changeStatus(EnrollmentStatusActive, "service1", "", 2)
+	test_utils.AssertTrue(t, err == nil, "Expected pending to active to succeed")
+	err = enrollment.changeStatus(EnrollmentStatusActive, "service1", "", 3)
+	test_utils.AssertTrue(t, err == nil, "Expected unchanged status to succeed")
+	err = enrollment.changeStatus(EnrollmentStatusCompleted, "service1", "study ended", 4)
+	test_utils.AssertTrue(t, err == nil, "Expected active to completed to succeed")
+	err = enrollment.changeStatus(EnrollmentStatusWithdrawn, "patient1", "", 5)
+	test_utils.AssertTrue(t, err != nil, "Expected completed to withdrawn to fail")
+	err = enrollment.changeStatus("unknown", "service1", "", 5)
+	test_utils.AssertTrue(t, err != nil, "Expected unknown status to fail")
+
+	test_utils.AssertTrue(t, len(enrollment.History) == 3, "Expected 3 status changes")
+	last := enrollment.History[2]
+	test_utils.AssertTrue(t, last.PreviousStatus == EnrollmentStatusActive && last.Status == EnrollmentStatusCompleted, "Expected active to completed")
+	test_utils.AssertTrue(t, last.Reason == "study ended" && last.Timestamp == 4, "Expected reason and timestamp")
+	test_utils.AssertTrue(t, enrollment.hasEnded(), "Expected completed enrollment to have ended")
+}
+
+func TestUpdateEnrollmentStatus(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestUpdateEnrollmentStatus function called")
+
+	mstub := SetupIndexesAndGetStub(t)
+	org1Caller, service1Subgroup, patient1 := SetupEnrollmentServiceTest(t, mstub)
+	nowStr := strconv.FormatInt(time.Now().Unix(), 10)
+
+	// enroll patient as pending
+	mstub.MockTransactionStart("1")
+	stub := cached_stub.NewCachedStub(mstub)
+	enrollment1 := GenerateEnrollmentTest("patient1", "service1")
+	enrollment1.Status = EnrollmentStatusPending
+	enrollment1Bytes, _ := json.Marshal(&enrollment1)
+	_, err := EnrollPatient(stub, org1Caller, []string{string(enrollment1Bytes), crypto.EncodeToB64String(test_utils.GenerateSymKey())})
+	test_utils.AssertTrue(t, err == nil, "Expected EnrollPatient to succeed")
+	mstub.MockTransactionEnd("1")
+
+	mstub.MockTransactionStart("2")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = UpdateEnrollmentStatus(stub, service1Subgroup, []string{"service1", "patient1", EnrollmentStatusCompleted, "", nowStr})
+	test_utils.AssertTrue(t, err != nil, "Expected pending to completed to fail")
+	_, err = UpdateEnrollmentStatus(stub, service1Subgroup, []string{"service1", "patient1", EnrollmentStatusActive, "screening passed", nowStr})
+	test_utils.AssertTrue(t, err == nil, "Expected UpdateEnrollmentStatus to succeed")
+	mstub.MockTransactionEnd("2")
+
+	// patient can only withdraw
+	mstub.MockTransactionStart("3")
+	stub = cached_stub.NewCachedStub(mstub)
+	patient1Caller, _ := user_mgmt.GetUserData(stub, patient1, "patient1", true, true)
+	_, err = UpdateEnrollmentStatus(stub, patient1Caller, []string{"service1", "patient1", EnrollmentStatusSuspended, "", nowStr})
+	test_utils.AssertTrue(t, err != nil, "Expected UpdateEnrollmentStatus by patient to fail")
+	_, err = UpdateEnrollmentStatus(stub, patient1Caller, []string{"service1", "patient1", EnrollmentStatusWithdrawn, "moved away", nowStr})
+	test_utils.AssertTrue(t, err == nil, "Expected UpdateEnrollmentStatus by patient to succeed")
+	mstub.MockTransactionEnd("3")
+
+	mstub.MockTransactionStart("4")
+	stub = cached_stub.NewCachedStub(mstub)
+	enrollmentResult, err := GetEnrollmentInternal(stub, service1Subgroup, "patient1", "service1")
+	test_utils.AssertTrue(t, err == nil, "Expected GetEnrollmentInternal to succeed")
+	test_utils.AssertTrue(t, enrollmentResult.Status == EnrollmentStatusWithdrawn, "Expected enrollment status to be withdrawn")
+	test_utils.AssertTrue(t, len(enrollmentResult.History) == 3, "Expected 3 status changes")
+	withdrawal := enrollmentResult.History[2]
+	test_utils.AssertTrue(t, withdrawal.Actor == "patient1" && withdrawal.Reason == "moved away", "Expected withdrawal by patient1")
+
+	// filter service enrollments by status
+	enrollmentsBytes, err := GetServiceEnrollments(stub, service1Subgroup, []string{"service1", EnrollmentStatusWithdrawn})
+	test_utils.AssertTrue(t, err == nil, "Expected GetServiceEnrollments to succeed")
+	enrollments := []EnrollmentResult{}
+	json.Unmarshal(enrollmentsBytes, &enrollments)
+	test_utils.AssertTrue(t, len(enrollments) == 1 && enrollments[0].UserID == "patient1", "Expected 1 withdrawn enrollment")
+	enrollmentsBytes, err = GetServiceEnrollments(stub, service1Subgroup, []string{"service1", EnrollmentStatusActive})
+	test_utils.AssertTrue(t, err == nil, "Expected GetServiceEnrollments to succeed")
+	enrollments = []EnrollmentResult{}
+	json.Unmarshal(enrollmentsBytes, &enrollments)
+	test_utils.AssertTrue(t, len(enrollments) == 0, "Expected no active enrollments")
+	_, err = GetServiceEnrollments(stub, service1Subgroup, []string{"service1", "unknown"})
+	test_utils.AssertTrue(t, err != nil, "Expected GetServiceEnrollments with unknown status to fail")
+	mstub.MockTransactionEnd("4")
+}
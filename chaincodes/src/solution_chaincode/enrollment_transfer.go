@@ -0,0 +1,380 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+
+	"common/bchcls/cached_stub"
+	"common/bchcls/custom_errors"
+	"common/bchcls/data_model"
+	"common/bchcls/utils"
+
+	"github.com/pkg/errors"
+)
+
+// EnrollmentPendingConsent is a consent the patient gave to SourceService
+// that was carried over to a new service and waits for the patient's approval
+type EnrollmentPendingConsent struct {
+	Datatype      string   `json:"datatype"`
+	Option        []string `json:"option"`
+	SourceService string   `json:"source_service"`
+}
+
+// EnrollmentTransferResult is the outcome of moving one patient in TransferEnrollments
+type EnrollmentTransferResult struct {
+	UserID  string `json:"user_id"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// TransferEnrollments moves enrollments from a source service to a destination service of the same org
+// Caller must be admin of both services
+// enrollmentSymKeysB64 maps each patient to transfer to the sym key of the new enrollment
+// If reissueConsents is "true", consents the patient gave to the source service for datatypes
+// the destination service also uses are added to the new enrollment as pending consents;
+// the patient reviews them with ReviewPendingConsents
+// Carried over consents stay given to the source service until the patient reviews them,
+// so a patient who does not review them keeps consent with the source service
+// The old enrollment becomes inactive and points to the destination service
+// Patients who cannot be moved are reported and skipped, the other patients are moved
+// args = [ sourceServiceID, destServiceID, enrollmentSymKeysB64Bytes, reissueConsents, timestamp ]
+func TransferEnrollments(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 5 {
+		customErr := &custom_errors.LengthCheckingError{Type: "TransferEnrollments arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	sourceServiceID := args[0]
+	if utils.IsStringEmpty(sourceServiceID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "sourceServiceID"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	destServiceID := args[1]
+	if sourceServiceID == destServiceID {
+		logger.Errorf("Source and destination service must be different")
+		return nil, errors.New("Source and destination service must be different")
+	}
+
+	enrollmentSymKeysB64 := make(map[string]string)
+	err := json.Unmarshal([]byte(args[2]), &enrollmentSymKeysB64)
+	if err != nil {
+		customErr := &custom_errors.UnmarshalError{Type: "enrollmentSymKeysB64"}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	reissueConsents := args[3] == "true"
+
+	timestamp, err := ParseTimestamp(args[4])
+	if err != nil {
+		return nil, err
+	}
+
+	destService, err := getEnrollmentService(stub, caller, destServiceID)
+	if err != nil {
+		return nil, err
+	}
+
+	sourceService, err := GetServiceInternal(stub, caller, sourceServiceID, false)
+	if err != nil {
+		customErr := &GetServiceError{Service: sourceServiceID}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	if utils.IsStringEmpty(sourceService.ServiceID) {
+		customErr := &GetServiceError{Service: sourceServiceID}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	if sourceService.OrgID != destService.service.OrgID {
+		logger.Errorf("Services %v and %v belong to different orgs", sourceServiceID, destServiceID)
+		return nil, errors.New("Enrollments can only be transferred between services of the same org")
+	}
+
+	if !CallerIsAdminOfService(caller, sourceServiceID, sourceService.OrgID) {
+		logger.Error("Caller is not admin of the source service")
+		return nil, errors.New("Caller is not admin of the source service")
+	}
+
+	// if caller is org admin, org ID is needed to find the source enrollments
+	options := []string{}
+	solutionCaller := convertToSolutionUser(caller)
+	if solutionCaller.SolutionInfo.IsOrgAdmin {
+		options = append(options, solutionCaller.Org)
+	}
+
+	// options of the destination service per datatype, used to narrow reissued consents
+	destAccess := make(map[string][]string)
+	for _, serviceDatatype := range destService.service.Datatypes {
+		destAccess[serviceDatatype.DatatypeID] = serviceDatatype.Access
+	}
+
+	// ==============================================================
+	// Transfer enrollments
+	// ==============================================================
+	// map order is random, patients are moved in a fixed order so all peers write the same
+	userIDs := []string{}
+	for userID := range enrollmentSymKeysB64 {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+
+	results := []EnrollmentTransferResult{}
+	for _, userID := range userIDs {
+		result := EnrollmentTransferResult{UserID: userID}
+
+		oldEnrollment, err := GetEnrollmentInternal(stub, caller, userID, sourceServiceID, options...)
+		if err == nil && oldEnrollment.Status != EnrollmentStatusPending && oldEnrollment.Status != EnrollmentStatusActive {
+			err = errors.New("Enrollment in service " + sourceServiceID + " is " + oldEnrollment.Status)
+		}
+
+		enrollment := Enrollment{UserID: userID, ServiceID: destServiceID, EnrollDate: timestamp, Status: oldEnrollment.Status}
+		var enrollmentKey data_model.Key
+		var existingUser data_model.User
+		if err == nil {
+			enrollmentKey, existingUser, err = destService.validateEnrollment(stub, caller, &enrollment, enrollmentSymKeysB64[userID])
+		}
+
+		if err == nil {
+			var enrollmentExists bool
+			enrollmentExists, err = CheckEnrollmentExists(stub, caller, enrollment.EnrollmentID)
+			if err == nil && enrollmentExists {
+				err = errors.New("Patient is already enrolled in service " + destServiceID)
+			}
+		}
+
+		if err == nil && reissueConsents {
+			enrollment.PendingConsents, err = getTransferredConsents(stub, caller, userID, sourceServiceID, destAccess)
+		}
+
+		if err != nil {
+			logger.Infof("Skipping transfer of patient %v: %v", userID, err)
+			result.Error = err.Error()
+			results = append(results, result)
+			continue
+		}
+
+		// a failure while saving would leave a partial transfer, so it fails the whole transaction
+		err = destService.addEnrollment(stub, caller, enrollment, enrollmentKey, existingUser, "transferred from "+sourceServiceID)
+		if err != nil {
+			logger.Errorf("Failed to enroll patient %v: %v", userID, err)
+			return nil, errors.Wrap(err, "Failed to enroll patient "+userID)
+		}
+
+		oldEnrollment.Status = EnrollmentStatusInactive
+		oldEnrollment.TransferredTo = destServiceID
+		_, err = UpdateEnrollmentInternal(stub, caller, oldEnrollment, "transferred to "+destServiceID, timestamp)
+		if err != nil {
+			logger.Errorf("Failed to update enrollment of patient %v: %v", userID, err)
+			return nil, errors.Wrap(err, "Failed to update enrollment of patient "+userID)
+		}
+
+		result.Success = true
+		results = append(results, result)
+	}
+
+	return json.Marshal(&results)
+}
+
+// ReviewPendingConsents approves or rejects the pending consents of an enrollment
+// Can only be called by the enrolled patient
+// approvedConsentKeysB64 maps each approved datatype to a consent sym key, which is only needed if the patient
+// has not given consent to the service for the datatype before; pending consents of other datatypes are rejected
+// Approved consents are given to the service like PutConsentPatientData, then all pending consents are cleared
+// Reviewed consents, approved or rejected, are denied for the source service they were carried over from
+// args = [ serviceID, approvedConsentKeysB64Bytes, timestamp ]
+func ReviewPendingConsents(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 3 {
+		customErr := &custom_errors.LengthCheckingError{Type: "ReviewPendingConsents arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	serviceID := args[0]
+	if utils.IsStringEmpty(serviceID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "serviceID"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	approvedConsentKeysB64 := make(map[string]string)
+	err := json.Unmarshal([]byte(args[1]), &approvedConsentKeysB64)
+	if err != nil {
+		customErr := &custom_errors.UnmarshalError{Type: "approvedConsentKeysB64"}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	timestamp, err := ParseTimestamp(args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	enrollmentID := GetEnrollmentID(caller.ID, serviceID)
+	enrollment, err := GetEnrollmentInternal(stub, caller, caller.ID, serviceID)
+	if err != nil {
+		customErr := &GetEnrollmentError{Enrollment: enrollmentID}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	if len(enrollment.PendingConsents) == 0 {
+		logger.Errorf("Enrollment %v has no pending consents", enrollmentID)
+		return nil, errors.New("Enrollment has no pending consents")
+	}
+
+	pendingDatatypes := []string{}
+	for _, pendingConsent := range enrollment.PendingConsents {
+		pendingDatatypes = append(pendingDatatypes, pendingConsent.Datatype)
+	}
+
+	for datatypeID := range approvedConsentKeysB64 {
+		if !utils.InList(pendingDatatypes, datatypeID) {
+			logger.Errorf("Enrollment %v has no pending consent for datatype %v", enrollmentID, datatypeID)
+			return nil, errors.New("Enrollment has no pending consent for datatype " + datatypeID)
+		}
+	}
+
+	// ==============================================================
+	// Give approved consents
+	// ==============================================================
+	for _, pendingConsent := range enrollment.PendingConsents {
+		consentKeyB64, ok := approvedConsentKeysB64[pendingConsent.Datatype]
+		if !ok {
+			continue
+		}
+
+		consent := Consent{
+			Owner:     caller.ID,
+			Service:   serviceID,
+			Target:    serviceID,
+			Datatype:  pendingConsent.Datatype,
+			Option:    pendingConsent.Option,
+			Timestamp: timestamp}
+		consentBytes, err := json.Marshal(&consent)
+		if err != nil {
+			customErr := &custom_errors.MarshalError{Type: "Consent"}
+			logger.Errorf("%v: %v", customErr, err)
+			return nil, errors.Wrap(err, customErr.Error())
+		}
+
+		consentArgs := []string{string(consentBytes)}
+		if !utils.IsStringEmpty(consentKeyB64) {
+			consentArgs = append(consentArgs, consentKeyB64)
+		}
+
+		_, err = PutConsentPatientData(stub, caller, consentArgs)
+		if err != nil {
+			logger.Errorf("Failed to approve pending consent for datatype %v: %v", pendingConsent.Datatype, err)
+			return nil, errors.Wrap(err, "Failed to approve pending consent for datatype "+pendingConsent.Datatype)
+		}
+	}
+
+	// ==============================================================
+	// Deny reviewed consents for source services
+	// ==============================================================
+	sourceServiceIDs := []string{}
+	sourceDatatypes := make(map[string][]string)
+	for _, pendingConsent := range enrollment.PendingConsents {
+		if _, ok := sourceDatatypes[pendingConsent.SourceService]; !ok {
+			sourceServiceIDs = append(sourceServiceIDs, pendingConsent.SourceService)
+		}
+		sourceDatatypes[pendingConsent.SourceService] = append(sourceDatatypes[pendingConsent.SourceService], pendingConsent.Datatype)
+	}
+
+	for _, sourceServiceID := range sourceServiceIDs {
+		sourceService, err := GetServiceInternal(stub, caller, sourceServiceID, false)
+		if err != nil {
+			customErr := &GetServiceError{Service: sourceServiceID}
+			logger.Errorf("%v: %v", customErr, err)
+			return nil, errors.Wrap(err, customErr.Error())
+		}
+
+		sourceEnrollment, err := GetEnrollmentInternal(stub, caller, caller.ID, sourceServiceID)
+		if err != nil {
+			customErr := &GetEnrollmentError{Enrollment: GetEnrollmentID(caller.ID, sourceServiceID)}
+			logger.Errorf("%v: %v", customErr, err)
+			return nil, errors.Wrap(err, customErr.Error())
+		}
+
+		_, err = denyEnrollmentConsents(stub, caller, sourceService, sourceEnrollment, sourceDatatypes[sourceServiceID], "ReviewPendingConsents", timestamp)
+		if err != nil {
+			logger.Errorf("Failed to deny consents for source service %v: %v", sourceServiceID, err)
+			return nil, errors.Wrap(err, "Failed to deny consents for source service "+sourceServiceID)
+		}
+	}
+
+	// ==============================================================
+	// Clear pending consents
+	// ==============================================================
+	// nil keeps the stored pending consents, an empty list clears them
+	enrollment.PendingConsents = []EnrollmentPendingConsent{}
+	_, err = UpdateEnrollmentInternal(stub, caller, enrollment, "pending consents reviewed", timestamp)
+	if err != nil {
+		logger.Errorf("Failed to update enrollment %v: %v", enrollmentID, err)
+		return nil, errors.Wrap(err, "Failed to update enrollment "+enrollmentID)
+	}
+
+	return nil, nil
+}
+
+// getTransferredConsents returns the consents the patient gave to the source service
+// for datatypes in destAccess, limited to the options the destination service uses
+// Denied consents are not carried over
+func getTransferredConsents(stub cached_stub.CachedStubInterface, caller data_model.User, userID string, sourceServiceID string, destAccess map[string][]string) ([]EnrollmentPendingConsent, error) {
+	consents, err := GetConsentsInternal(stub, caller, userID, sourceServiceID)
+	if err != nil {
+		logger.Errorf("Failed to get consents: %v", err)
+		return nil, errors.Wrap(err, "Failed to get consents")
+	}
+
+	pendingConsents := []EnrollmentPendingConsent{}
+	for _, consent := range consents {
+		access, ok := destAccess[consent.Datatype]
+		if !ok || utils.InList(consent.Option, consentOptionDeny) {
+			continue
+		}
+
+		options := []string{}
+		for _, option := range consent.Option {
+			if utils.InList(access, option) {
+				options = append(options, option)
+			}
+		}
+
+		if len(options) > 0 {
+			pendingConsents = append(pendingConsents, EnrollmentPendingConsent{
+				Datatype:      consent.Datatype,
+				Option:        options,
+				SourceService: sourceServiceID})
+		}
+	}
+
+	return pendingConsents, nil
+}
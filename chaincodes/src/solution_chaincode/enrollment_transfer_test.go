@@ -0,0 +1,142 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"common/bchcls/cached_stub"
+	"common/bchcls/crypto"
+	"common/bchcls/test_utils"
+	"common/bchcls/user_mgmt"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestTransferEnrollments(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestTransferEnrollments function called")
+
+	mstub := SetupIndexesAndGetStub(t)
+	org1Caller, service1Subgroup, patient1 := SetupEnrollmentServiceTest(t, mstub)
+	nowStr := strconv.FormatInt(time.Now().Unix(), 10)
+
+	// service2 shares datatype1 with service1, but only reads it
+	mstub.MockTransactionStart("1")
+	stub := cached_stub.NewCachedStub(mstub, true, true, true)
+	serviceDatatype2 := GenerateServiceDatatypeForTesting("datatype1", "service2", []string{consentOptionRead})
+	service2 := GenerateServiceForTesting("service2", "org1", []ServiceDatatype{serviceDatatype2})
+	service2Bytes, _ := json.Marshal(&service2)
+	_, err := RegisterService(stub, org1Caller, []string{string(service2Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterService to succeed")
+	mstub.MockTransactionEnd("1")
+
+	// enroll patient1 in service1 and give consent
+	mstub.MockTransactionStart("2")
+	stub = cached_stub.NewCachedStub(mstub)
+	enrollment1 := GenerateEnrollmentTest(patient1.ID, "service1")
+	enrollment1Bytes, _ := json.Marshal(&enrollment1)
+	_, err = EnrollPatient(stub, service1Subgroup, []string{string(enrollment1Bytes), crypto.EncodeToB64String(test_utils.GenerateSymKey())})
+	test_utils.AssertTrue(t, err == nil, "Expected EnrollPatient to succeed")
+	mstub.MockTransactionEnd("2")
+
+	mstub.MockTransactionStart("3")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	patient1Caller, _ := user_mgmt.GetUserData(stub, patient1, "patient1", true, true)
+	consent := Consent{Owner: "patient1", Service: "service1", Target: "service1", Datatype: "datatype1", Option: []string{consentOptionWrite, consentOptionRead}, Timestamp: time.Now().Unix()}
+	consentBytes, _ := json.Marshal(&consent)
+	_, err = PutConsentPatientData(stub, patient1Caller, []string{string(consentBytes), crypto.EncodeToB64String(test_utils.GenerateSymKey())})
+	test_utils.AssertTrue(t, err == nil, "Expected PutConsentPatientData to succeed")
+	mstub.MockTransactionEnd("3")
+
+	enrollmentSymKeys := map[string]string{
+		"patient1":       crypto.EncodeToB64String(test_utils.GenerateSymKey()),
+		"unknownPatient": crypto.EncodeToB64String(test_utils.GenerateSymKey())}
+	enrollmentSymKeysBytes, _ := json.Marshal(&enrollmentSymKeys)
+
+	// service admin of only one of the services cannot transfer
+	mstub.MockTransactionStart("4")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	_, err = TransferEnrollments(stub, service1Subgroup, []string{"service1", "service2", string(enrollmentSymKeysBytes), "true", nowStr})
+	test_utils.AssertTrue(t, err != nil, "Expected TransferEnrollments by service1 admin to fail")
+	mstub.MockTransactionEnd("4")
+
+	// org admin transfers, unknown patient is reported
+	mstub.MockTransactionStart("5")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	resultsBytes, err := TransferEnrollments(stub, org1Caller, []string{"service1", "service2", string(enrollmentSymKeysBytes), "true", nowStr})
+	test_utils.AssertTrue(t, err == nil, "Expected TransferEnrollments to succeed")
+	results := []EnrollmentTransferResult{}
+	json.Unmarshal(resultsBytes, &results)
+	test_utils.AssertTrue(t, len(results) == 2, "Expected 2 results")
+	test_utils.AssertTrue(t, results[0].UserID == "patient1" && results[0].Success, "Expected patient1 to be transferred")
+	test_utils.AssertTrue(t, results[1].UserID == "unknownPatient" && !results[1].Success, "Expected unknownPatient to fail")
+	mstub.MockTransactionEnd("5")
+
+	mstub.MockTransactionStart("6")
+	stub = cached_stub.NewCachedStub(mstub)
+	oldEnrollment, err := GetEnrollmentInternal(stub, patient1Caller, "patient1", "service1")
+	test_utils.AssertTrue(t, err == nil, "Expected GetEnrollmentInternal to succeed")
+	test_utils.AssertTrue(t, oldEnrollment.Status == EnrollmentStatusInactive, "Expected old enrollment to be inactive")
+	test_utils.AssertTrue(t, oldEnrollment.TransferredTo == "service2", "Expected old enrollment to point to service2")
+
+	newEnrollment, err := GetEnrollmentInternal(stub, patient1Caller, "patient1", "service2")
+	test_utils.AssertTrue(t, err == nil, "Expected GetEnrollmentInternal to succeed")
+	test_utils.AssertTrue(t, newEnrollment.Status == enrollment1.Status, "Expected new enrollment to keep status")
+	test_utils.AssertTrue(t, len(newEnrollment.PendingConsents) == 1, "Expected 1 pending consent")
+	test_utils.AssertTrue(t, newEnrollment.PendingConsents[0].Datatype == "datatype1", "Expected pending consent for datatype1")
+	test_utils.AssertSetsEqual(t, []string{consentOptionRead}, newEnrollment.PendingConsents[0].Option)
+
+	// carried over consent stays given to the source service until the patient reviews it
+	sourceConsent, err := GetConsentInternal(stub, patient1Caller, "service1", "datatype1", "patient1")
+	test_utils.AssertTrue(t, err == nil, "Expected GetConsentInternal to succeed")
+	test_utils.AssertSetsEqual(t, []string{consentOptionWrite, consentOptionRead}, sourceConsent.Option)
+	mstub.MockTransactionEnd("6")
+
+	// patient approves the pending consent, which becomes a consent to service2 and is denied for service1
+	mstub.MockTransactionStart("6a")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	approvedConsentKeys := map[string]string{"datatype2": crypto.EncodeToB64String(test_utils.GenerateSymKey())}
+	approvedConsentKeysBytes, _ := json.Marshal(&approvedConsentKeys)
+	_, err = ReviewPendingConsents(stub, patient1Caller, []string{"service2", string(approvedConsentKeysBytes), nowStr})
+	test_utils.AssertTrue(t, err != nil, "Expected ReviewPendingConsents of a datatype without pending consent to fail")
+	approvedConsentKeys = map[string]string{"datatype1": crypto.EncodeToB64String(test_utils.GenerateSymKey())}
+	approvedConsentKeysBytes, _ = json.Marshal(&approvedConsentKeys)
+	_, err = ReviewPendingConsents(stub, patient1Caller, []string{"service2", string(approvedConsentKeysBytes), nowStr})
+	test_utils.AssertTrue(t, err == nil, "Expected ReviewPendingConsents to succeed")
+	mstub.MockTransactionEnd("6a")
+
+	mstub.MockTransactionStart("6b")
+	stub = cached_stub.NewCachedStub(mstub)
+	newConsent, err := GetConsentInternal(stub, patient1Caller, "service2", "datatype1", "patient1")
+	test_utils.AssertTrue(t, err == nil, "Expected GetConsentInternal to succeed")
+	test_utils.AssertSetsEqual(t, []string{consentOptionRead}, newConsent.Option)
+	sourceConsent, err = GetConsentInternal(stub, patient1Caller, "service1", "datatype1", "patient1")
+	test_utils.AssertTrue(t, err == nil, "Expected GetConsentInternal to succeed")
+	test_utils.AssertSetsEqual(t, []string{consentOptionDeny}, sourceConsent.Option)
+	newEnrollment, err = GetEnrollmentInternal(stub, patient1Caller, "patient1", "service2")
+	test_utils.AssertTrue(t, err == nil, "Expected GetEnrollmentInternal to succeed")
+	test_utils.AssertTrue(t, len(newEnrollment.PendingConsents) == 0, "Expected pending consents to be cleared")
+	_, err = ReviewPendingConsents(stub, patient1Caller, []string{"service2", "{}", nowStr})
+	test_utils.AssertTrue(t, err != nil, "Expected second ReviewPendingConsents to fail")
+	mstub.MockTransactionEnd("6b")
+
+	// patient can only be transferred once
+	mstub.MockTransactionStart("7")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	resultsBytes, err = TransferEnrollments(stub, org1Caller, []string{"service1", "service2", string(enrollmentSymKeysBytes), "false", nowStr})
+	test_utils.AssertTrue(t, err == nil, "Expected TransferEnrollments to succeed")
+	results = []EnrollmentTransferResult{}
+	json.Unmarshal(resultsBytes, &results)
+	test_utils.AssertTrue(t, len(results) == 2 && !results[0].Success, "Expected patient1 transfer to fail")
+	mstub.MockTransactionEnd("7")
+}
@@ -55,5 +55,12 @@ func InitIndices(stub cached_stub.CachedStubInterface) error {
 		return err
 	}
 
+	err = SetupContractTemplateIndex(stub)
+	if err != nil {
+		err = errors.Wrap(err, "Failed to create contract template indices")
+		logger.Error(err.Error())
+		return err
+	}
+
 	return nil
 }
@@ -0,0 +1,435 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"common/bchcls/asset_mgmt"
+	"common/bchcls/cached_stub"
+	"common/bchcls/custom_errors"
+	"common/bchcls/data_model"
+	"common/bchcls/key_mgmt"
+	"common/bchcls/utils"
+
+	"github.com/pkg/errors"
+)
+
+const maxServiceCatalogPageSize = 100
+
+// IndexServiceCatalogEntry is the index of services by each datatype they offer
+const IndexServiceCatalogEntry = "ServiceCatalogEntryTable"
+
+// ServiceCatalogEntryNamespace is the namespace of service catalog entry assets
+const ServiceCatalogEntryNamespace = "ServiceCatalogEntryAsset"
+
+// serviceCatalogAny is the datatype of the catalog entries that match any datatype
+const serviceCatalogAny = "*"
+
+// serviceCatalogEntry is a catalog entry of a service for one of its datatypes
+// A service offers several datatypes, so each datatype is stored as its own asset, see putServiceCatalogIndex;
+// every service also has an entry for serviceCatalogAny, so a search without datatype filter finds each service once
+// Entries carry the public data of the service, so the catalog is searched without reading the service assets
+type serviceCatalogEntry struct {
+	EntryID  string `json:"entry_id"`
+	Datatype string `json:"datatype"`
+	ServicePublicData
+}
+
+// ServiceCatalogReindexResult is returned by ReindexServiceCatalog
+type ServiceCatalogReindexResult struct {
+	ServiceID string   `json:"service_id"`
+	Datatypes []string `json:"datatypes"`
+}
+
+// ServiceCatalogFilter selects services for SearchServiceCatalog
+// All fields are optional
+// Status defaults to active, PaymentRequired is yes or no
+// Datatypes lists datatypes a service must all offer
+// Keyword is matched case insensitively against service name and summary
+type ServiceCatalogFilter struct {
+	OrgID           string   `json:"org_id"`
+	Status          string   `json:"status"`
+	PaymentRequired string   `json:"payment_required"`
+	Datatypes       []string `json:"datatypes"`
+	Keyword         string   `json:"keyword"`
+}
+
+// ServiceCatalogResult is returned by SearchServiceCatalog
+// Only public data of the services is returned
+// Bookmark is the last service returned, pass it to get the next page; empty when there are no more pages
+type ServiceCatalogResult struct {
+	Services []ServicePublicData `json:"services"`
+	Bookmark string              `json:"bookmark"`
+}
+
+// validate checks the catalog filter
+func (filter ServiceCatalogFilter) validate() error {
+	if !utils.InList([]string{"active", "inactive", ServiceStatusRetiring, ServiceStatusRetired}, filter.Status) {
+		return errors.New("Invalid service catalog status: " + filter.Status)
+	}
+
+	if !utils.IsStringEmpty(filter.PaymentRequired) && filter.PaymentRequired != "yes" && filter.PaymentRequired != "no" {
+		return errors.New("Invalid service catalog payment required (must be yes or no): " + filter.PaymentRequired)
+	}
+
+	return nil
+}
+
+// matches returns true if the service passes the filters that are not covered by the index
+// The index covers the first datatype of the filter only, and keywords are matched anywhere in name and summary
+func (filter ServiceCatalogFilter) matches(service ServicePublicData) bool {
+	// payment is only covered by the index when searching without org
+	if !utils.IsStringEmpty(filter.PaymentRequired) && service.PaymentRequired != filter.PaymentRequired {
+		return false
+	}
+
+	offered := []string{}
+	for _, datatype := range service.Datatypes {
+		offered = append(offered, datatype.DatatypeID)
+	}
+
+	for _, datatypeID := range filter.Datatypes {
+		if !utils.InList(offered, datatypeID) {
+			return false
+		}
+	}
+
+	if !utils.IsStringEmpty(filter.Keyword) {
+		keyword := strings.ToLower(filter.Keyword)
+		if !strings.Contains(strings.ToLower(service.ServiceName), keyword) && !strings.Contains(strings.ToLower(service.Summary), keyword) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SearchServiceCatalog returns a page of services of all orgs matching a catalog filter
+// Can be called by any registered user, so patients and requester orgs can discover services
+// Services are ordered by service name, then service ID
+// Filters not covered by the index are checked before the page is filled, so only the last page is short
+// args = [filter, pageSize, bookmark]
+func SearchServiceCatalog(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 3 {
+		customErr := &custom_errors.LengthCheckingError{Type: "SearchServiceCatalog arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	filter := ServiceCatalogFilter{}
+	err := json.Unmarshal([]byte(args[0]), &filter)
+	if err != nil {
+		customErr := &custom_errors.UnmarshalError{Type: "ServiceCatalogFilter"}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	if utils.IsStringEmpty(filter.Status) {
+		filter.Status = "active"
+	}
+
+	err = filter.validate()
+	if err != nil {
+		logger.Errorf("Invalid service catalog filter: %v", err)
+		return nil, errors.Wrap(err, "Invalid service catalog filter")
+	}
+
+	pageSize, err := strconv.Atoi(args[1])
+	if err != nil {
+		logger.Errorf("Error converting pageSize to type int")
+		return nil, errors.Wrap(err, "Error converting pageSize to type int")
+	}
+
+	if pageSize <= 0 || pageSize > maxServiceCatalogPageSize {
+		logger.Errorf("Invalid page size: %v", pageSize)
+		return nil, errors.New("Page size must be between 1 and " + strconv.Itoa(maxServiceCatalogPageSize))
+	}
+
+	bookmark := args[2]
+
+	// ==============================================================
+	// Get a page of services, starting at bookmark
+	// ==============================================================
+	services, nextBookmark, err := searchServiceCatalogInternal(stub, caller, filter, pageSize, bookmark)
+	if err != nil {
+		logger.Errorf("Failed to search service catalog: %v", err)
+		return nil, errors.Wrap(err, "Failed to search service catalog")
+	}
+
+	result := ServiceCatalogResult{Services: services, Bookmark: nextBookmark}
+	logger.Infof("found %v services in catalog", len(result.Services))
+
+	return json.Marshal(&result)
+}
+
+// searchServiceCatalogInternal returns public data of services matching filter, ordered by service name,
+// starting after the bookmark service
+// Returns at most pageSize services, and the bookmark of the next page, empty when there are no more services
+func searchServiceCatalogInternal(stub cached_stub.CachedStubInterface, caller data_model.User, filter ServiceCatalogFilter, pageSize int, bookmark string) ([]ServicePublicData, string, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+
+	// datatype is always part of the range, since every service has an entry matching any datatype;
+	// org narrows the index range when given, otherwise payment does
+	datatype := serviceCatalogAny
+	if len(filter.Datatypes) > 0 {
+		datatype = filter.Datatypes[0]
+	}
+
+	fieldNames := []string{"datatype", "status", "service_name", "service_id"}
+	prefix := []string{datatype, filter.Status}
+	if !utils.IsStringEmpty(filter.OrgID) {
+		fieldNames = []string{"datatype", "org_id", "status", "service_name", "service_id"}
+		prefix = []string{datatype, filter.OrgID, filter.Status}
+	} else if !utils.IsStringEmpty(filter.PaymentRequired) {
+		fieldNames = []string{"datatype", "status", "payment_required", "service_name", "service_id"}
+		prefix = append(prefix, filter.PaymentRequired)
+	}
+
+	startValues := append([]string{}, prefix...)
+	endValues := append([]string{}, prefix...)
+	if !utils.IsStringEmpty(bookmark) {
+		bookmarkAssetID := asset_mgmt.GetAssetId(ServiceAssetNamespace, bookmark)
+		bookmarkAsset, err := asset_mgmt.GetEncryptedAssetData(stub, bookmarkAssetID)
+		if err != nil {
+			customErr := &custom_errors.GetAssetDataError{AssetId: bookmarkAssetID}
+			logger.Errorf("%v: %v", customErr, err)
+			return nil, "", errors.Wrap(err, customErr.Error())
+		}
+
+		bookmarkPublicData := ServicePublicData{}
+		json.Unmarshal(bookmarkAsset.PublicData, &bookmarkPublicData)
+		if bookmarkPublicData.ServiceID != bookmark {
+			logger.Errorf("Invalid bookmark: %v", bookmark)
+			return nil, "", errors.New("Invalid bookmark: " + bookmark)
+		}
+		startValues = append(startValues, bookmarkPublicData.ServiceName, bookmark)
+	}
+
+	// private data is not decrypted, since the catalog only returns public data
+	services := []ServicePublicData{}
+	matchEntry := func(entryAsset *data_model.Asset) (string, bool) {
+		entry := serviceCatalogEntry{}
+		json.Unmarshal(entryAsset.PublicData, &entry)
+		return entry.ServiceID, filter.matches(entry.ServicePublicData)
+	}
+	collectService := func(entryAsset *data_model.Asset) (bool, error) {
+		entry := serviceCatalogEntry{}
+		json.Unmarshal(entryAsset.PublicData, &entry)
+		services = append(services, entry.ServicePublicData)
+		return true, nil
+	}
+
+	nextBookmark, err := getAssetPage(stub, caller, ServiceCatalogEntryNamespace, IndexServiceCatalogEntry, fieldNames, startValues, endValues, false, OMRServiceAssetKeyPathFunc, pageSize, bookmark, matchEntry, collectService)
+	if err != nil {
+		logger.Errorf("Failed to get page of services: %v", err)
+		return nil, "", errors.Wrap(err, "Failed to get page of services")
+	}
+
+	return services, nextBookmark, nil
+}
+
+// getServiceCatalogEntryID composes the ID of a catalog entry of a service
+func getServiceCatalogEntryID(serviceID string, datatype string) string {
+	entryIDHash := sha256.Sum256([]byte(serviceID + "\x00" + datatype))
+	return hex.EncodeToString(entryIDHash[:])
+}
+
+// catalogEntries returns the catalog entries of the service, one for each datatype it offers and one for any datatype
+func (service Service) catalogEntries() ([]serviceCatalogEntry, error) {
+	publicDataBytes, err := getServiceAssetPublicData(service)
+	if err != nil {
+		logger.Errorf("getServiceAssetPublicData failed: %v", err)
+		return nil, errors.Wrap(err, "getServiceAssetPublicData failed")
+	}
+
+	publicData := ServicePublicData{}
+	json.Unmarshal(publicDataBytes, &publicData)
+
+	entries := []serviceCatalogEntry{}
+	datatypeIDs := []string{serviceCatalogAny}
+	for _, serviceDatatype := range service.Datatypes {
+		datatypeIDs = append(datatypeIDs, serviceDatatype.DatatypeID)
+	}
+	for _, datatypeID := range datatypeIDs {
+		entries = append(entries, serviceCatalogEntry{
+			EntryID:           getServiceCatalogEntryID(service.ServiceID, datatypeID),
+			Datatype:          datatypeID,
+			ServicePublicData: publicData})
+	}
+
+	return entries, nil
+}
+
+// convertServiceCatalogEntryToAsset converts a catalog entry of a service to an asset
+func convertServiceCatalogEntryToAsset(entry serviceCatalogEntry) data_model.Asset {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+
+	asset := data_model.Asset{}
+	asset.AssetId = asset_mgmt.GetAssetId(ServiceCatalogEntryNamespace, entry.EntryID)
+	asset.Datatypes = []string{}
+	metaData := make(map[string]string)
+	metaData["namespace"] = ServiceCatalogEntryNamespace
+	asset.Metadata = metaData
+	asset.PublicData, _ = json.Marshal(&entry)
+	asset.PrivateData, _ = json.Marshal(map[string]string{"entry_id": entry.EntryID})
+	asset.OwnerIds = []string{entry.OrgID}
+	asset.IndexTableName = IndexServiceCatalogEntry
+	return asset
+}
+
+// putServiceCatalogIndex adds or updates the catalog entries of a service
+// Must be called every time the service asset is saved, so the entries follow the service
+// callerObj is the org or the service itself
+func putServiceCatalogIndex(stub cached_stub.CachedStubInterface, callerObj data_model.User, service Service, serviceAssetKey data_model.Key) error {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+
+	entries, err := service.catalogEntries()
+	if err != nil {
+		return errors.Wrap(err, "Failed to get catalog entries of service")
+	}
+
+	assetManager := asset_mgmt.GetAssetManager(stub, callerObj)
+	for _, entry := range entries {
+		entryAsset := convertServiceCatalogEntryToAsset(entry)
+		existingAsset, err := asset_mgmt.GetEncryptedAssetData(stub, entryAsset.AssetId)
+		if err != nil {
+			customErr := &custom_errors.GetAssetDataError{AssetId: entryAsset.AssetId}
+			logger.Errorf("%v: %v", customErr, err)
+			return errors.Wrap(err, customErr.Error())
+		}
+
+		if utils.IsStringEmpty(existingAsset.AssetId) {
+			err = assetManager.AddAsset(entryAsset, serviceAssetKey, false)
+		} else {
+			err = assetManager.UpdateAsset(entryAsset, serviceAssetKey, true)
+		}
+		if err != nil {
+			customErr := &PutAssetError{Asset: entryAsset.AssetId}
+			logger.Errorf("%v: %v", customErr, err)
+			return errors.Wrap(err, customErr.Error())
+		}
+	}
+
+	return nil
+}
+
+// deleteServiceCatalogEntry removes the catalog entry of a datatype the service no longer offers
+func deleteServiceCatalogEntry(stub cached_stub.CachedStubInterface, callerObj data_model.User, serviceID string, datatypeID string, serviceAssetKey data_model.Key) error {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+
+	entryAssetID := asset_mgmt.GetAssetId(ServiceCatalogEntryNamespace, getServiceCatalogEntryID(serviceID, datatypeID))
+	existingAsset, err := asset_mgmt.GetEncryptedAssetData(stub, entryAssetID)
+	if err != nil {
+		customErr := &custom_errors.GetAssetDataError{AssetId: entryAssetID}
+		logger.Errorf("%v: %v", customErr, err)
+		return errors.Wrap(err, customErr.Error())
+	}
+
+	// services saved before the catalog index existed have no entries until they are reindexed
+	if utils.IsStringEmpty(existingAsset.AssetId) {
+		return nil
+	}
+
+	err = asset_mgmt.GetAssetManager(stub, callerObj).DeleteAsset(entryAssetID, serviceAssetKey)
+	if err != nil {
+		customErr := &DeleteAssetError{Asset: entryAssetID}
+		logger.Errorf("%v: %v", customErr, err)
+		return errors.Wrap(err, customErr.Error())
+	}
+
+	return nil
+}
+
+// ReindexServiceCatalog adds a service registered before the catalog index existed to the catalog
+// Can only be called by service admin or org admin of the service
+// args = [serviceID]
+func ReindexServiceCatalog(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 1 {
+		customErr := &custom_errors.LengthCheckingError{Type: "ReindexServiceCatalog arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	serviceID := args[0]
+	if utils.IsStringEmpty(serviceID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "serviceID"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	service, err := GetServiceInternal(stub, caller, serviceID, false)
+	if err != nil {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	if utils.IsStringEmpty(service.ServiceID) {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	if !CallerIsAdminOfService(caller, service.ServiceID, service.OrgID) {
+		logger.Errorf("Caller must be admin of service")
+		return nil, errors.New("Caller must be admin of service")
+	}
+
+	// ==============================================================
+	// Act as service
+	// ==============================================================
+	callerObj, err := GetOwnerCaller(stub, caller, serviceID)
+	if err != nil {
+		logger.Errorf("Failed to get service caller: %v", err)
+		return nil, errors.Wrap(err, "Failed to get service caller")
+	}
+
+	// ==============================================================
+	// Reindex service
+	// ==============================================================
+	serviceAssetID := asset_mgmt.GetAssetId(ServiceAssetNamespace, serviceID)
+	assetManager := asset_mgmt.GetAssetManager(stub, callerObj)
+	serviceAssetKey, err := assetManager.GetAssetKey(serviceAssetID, GetKeyPathFromCallerToServiceAsset(stub, callerObj, key_mgmt.GetSymKeyId(serviceID)))
+	if err != nil {
+		logger.Errorf("Failed to GetAssetKey for serviceAssetKey: %v", err)
+		return nil, errors.Wrap(err, "Failed to GetAssetKey for serviceAssetKey")
+	}
+
+	err = putServiceCatalogIndex(stub, callerObj, service, serviceAssetKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to reindex service "+serviceID)
+	}
+
+	result := ServiceCatalogReindexResult{ServiceID: serviceID, Datatypes: []string{}}
+	for _, serviceDatatype := range service.Datatypes {
+		result.Datatypes = append(result.Datatypes, serviceDatatype.DatatypeID)
+	}
+
+	logger.Infof("reindexed service %v in catalog", serviceID)
+
+	return json.Marshal(&result)
+}
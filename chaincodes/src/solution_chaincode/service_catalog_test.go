@@ -0,0 +1,212 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"common/bchcls/cached_stub"
+	"common/bchcls/test_utils"
+	"encoding/json"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestSearchServiceCatalog(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestSearchServiceCatalog function called")
+
+	mstub := SetupIndexesAndGetStub(t)
+	mstub.MockTransactionStart("index")
+	stub := cached_stub.NewCachedStub(mstub)
+	err := SetupServiceIndex(stub)
+	test_utils.AssertTrue(t, err == nil, "Expected SetupServiceIndex to succeed")
+	mstub.MockTransactionEnd("index")
+
+	org1Caller, _, patient1 := SetupEnrollmentServiceTest(t, mstub)
+
+	// service2 is free, service3 only reads datatype1 and is about cardiology
+	mstub.MockTransactionStart("1")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	serviceDatatype2 := GenerateServiceDatatypeForTesting("datatype1", "service2", []string{consentOptionWrite, consentOptionRead})
+	service2 := GenerateServiceForTesting("service2", "org1", []ServiceDatatype{serviceDatatype2})
+	service2["payment_required"] = "no"
+	service2Bytes, _ := json.Marshal(&service2)
+	_, err = RegisterService(stub, org1Caller, []string{string(service2Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterService to succeed")
+	serviceDatatype3 := GenerateServiceDatatypeForTesting("datatype1", "service3", []string{consentOptionRead})
+	service3 := GenerateServiceForTesting("service3", "org1", []ServiceDatatype{serviceDatatype3})
+	service3["summary"] = "Cardiology follow-up"
+	service3Bytes, _ := json.Marshal(&service3)
+	_, err = RegisterService(stub, org1Caller, []string{string(service3Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterService to succeed")
+	mstub.MockTransactionEnd("1")
+
+	// patient pages through all active services
+	mstub.MockTransactionStart("2")
+	stub = cached_stub.NewCachedStub(mstub)
+	filterBytes, _ := json.Marshal(&ServiceCatalogFilter{})
+	resultBytes, err := SearchServiceCatalog(stub, patient1, []string{string(filterBytes), "2", ""})
+	test_utils.AssertTrue(t, err == nil, "Expected SearchServiceCatalog to succeed")
+	result := ServiceCatalogResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, len(result.Services) == 2, "Expected 2 services")
+	test_utils.AssertTrue(t, result.Services[0].ServiceID == "service1", "Expected services ordered by name")
+	test_utils.AssertTrue(t, result.Bookmark == "service2", "Expected bookmark service2")
+
+	resultBytes, err = SearchServiceCatalog(stub, patient1, []string{string(filterBytes), "2", result.Bookmark})
+	test_utils.AssertTrue(t, err == nil, "Expected SearchServiceCatalog to succeed")
+	result = ServiceCatalogResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, len(result.Services) == 1 && result.Services[0].ServiceID == "service3", "Expected service3")
+	test_utils.AssertTrue(t, result.Bookmark == "", "Expected no more pages")
+	mstub.MockTransactionEnd("2")
+
+	// filters on payment, keyword, datatype access and org
+	mstub.MockTransactionStart("3")
+	stub = cached_stub.NewCachedStub(mstub)
+	filterBytes, _ = json.Marshal(&ServiceCatalogFilter{PaymentRequired: "no"})
+	resultBytes, err = SearchServiceCatalog(stub, patient1, []string{string(filterBytes), "10", ""})
+	test_utils.AssertTrue(t, err == nil, "Expected SearchServiceCatalog to succeed")
+	result = ServiceCatalogResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, len(result.Services) == 1 && result.Services[0].ServiceID == "service2", "Expected service2")
+
+	filterBytes, _ = json.Marshal(&ServiceCatalogFilter{OrgID: "org1", Keyword: "cardio"})
+	resultBytes, err = SearchServiceCatalog(stub, patient1, []string{string(filterBytes), "10", ""})
+	test_utils.AssertTrue(t, err == nil, "Expected SearchServiceCatalog to succeed")
+	result = ServiceCatalogResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, len(result.Services) == 1 && result.Services[0].ServiceID == "service3", "Expected service3")
+
+	filterBytes, _ = json.Marshal(&ServiceCatalogFilter{Datatypes: []string{"datatype2"}})
+	resultBytes, err = SearchServiceCatalog(stub, patient1, []string{string(filterBytes), "10", ""})
+	test_utils.AssertTrue(t, err == nil, "Expected SearchServiceCatalog to succeed")
+	result = ServiceCatalogResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, len(result.Services) == 0, "Expected no services")
+
+	filterBytes, _ = json.Marshal(&ServiceCatalogFilter{OrgID: "org2"})
+	resultBytes, err = SearchServiceCatalog(stub, patient1, []string{string(filterBytes), "10", ""})
+	test_utils.AssertTrue(t, err == nil, "Expected SearchServiceCatalog to succeed")
+	result = ServiceCatalogResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, len(result.Services) == 0, "Expected no services of org2")
+	mstub.MockTransactionEnd("3")
+
+	// invalid filter and page size
+	mstub.MockTransactionStart("4")
+	stub = cached_stub.NewCachedStub(mstub)
+	filterBytes, _ = json.Marshal(&ServiceCatalogFilter{Status: "deleted"})
+	_, err = SearchServiceCatalog(stub, patient1, []string{string(filterBytes), "10", ""})
+	test_utils.AssertTrue(t, err != nil, "Expected SearchServiceCatalog with invalid status to fail")
+	filterBytes, _ = json.Marshal(&ServiceCatalogFilter{})
+	_, err = SearchServiceCatalog(stub, patient1, []string{string(filterBytes), "1000", ""})
+	test_utils.AssertTrue(t, err != nil, "Expected SearchServiceCatalog with too large page to fail")
+	mstub.MockTransactionEnd("4")
+
+	// service3 offers datatype2, the catalog follows added and removed datatypes
+	mstub.MockTransactionStart("5")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	datatype2 := Datatype{DatatypeID: "datatype2", Description: "datatype2"}
+	datatype2Bytes, _ := json.Marshal(&datatype2)
+	_, err = RegisterDatatype(stub, org1Caller, []string{string(datatype2Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterDatatype to succeed")
+	serviceDatatype3b := GenerateServiceDatatypeForTesting("datatype2", "service3", []string{consentOptionRead})
+	serviceDatatype3bBytes, _ := json.Marshal(&serviceDatatype3b)
+	_, err = AddDatatypeToService(stub, org1Caller, []string{"service3", string(serviceDatatype3bBytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected AddDatatypeToService to succeed")
+	mstub.MockTransactionEnd("5")
+
+	mstub.MockTransactionStart("6")
+	stub = cached_stub.NewCachedStub(mstub)
+	filterBytes, _ = json.Marshal(&ServiceCatalogFilter{Datatypes: []string{"datatype2"}})
+	resultBytes, err = SearchServiceCatalog(stub, patient1, []string{string(filterBytes), "10", ""})
+	test_utils.AssertTrue(t, err == nil, "Expected SearchServiceCatalog to succeed")
+	result = ServiceCatalogResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, len(result.Services) == 1 && result.Services[0].ServiceID == "service3", "Expected service3")
+
+	filterBytes, _ = json.Marshal(&ServiceCatalogFilter{Datatypes: []string{"datatype1", "datatype2"}})
+	resultBytes, err = SearchServiceCatalog(stub, patient1, []string{string(filterBytes), "10", ""})
+	test_utils.AssertTrue(t, err == nil, "Expected SearchServiceCatalog to succeed")
+	result = ServiceCatalogResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, len(result.Services) == 1 && result.Services[0].ServiceID == "service3", "Expected service3")
+
+	// services filtered out in memory do not count toward the page
+	filterBytes, _ = json.Marshal(&ServiceCatalogFilter{Keyword: "cardio"})
+	resultBytes, err = SearchServiceCatalog(stub, patient1, []string{string(filterBytes), "1", ""})
+	test_utils.AssertTrue(t, err == nil, "Expected SearchServiceCatalog to succeed")
+	result = ServiceCatalogResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, len(result.Services) == 1 && result.Services[0].ServiceID == "service3", "Expected service3 on first page")
+	test_utils.AssertTrue(t, result.Bookmark == "", "Expected no more pages")
+	mstub.MockTransactionEnd("6")
+
+	mstub.MockTransactionStart("7")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	_, err = RemoveDatatypeFromService(stub, org1Caller, []string{"service3", "datatype2"})
+	test_utils.AssertTrue(t, err == nil, "Expected RemoveDatatypeFromService to succeed")
+	mstub.MockTransactionEnd("7")
+
+	mstub.MockTransactionStart("8")
+	stub = cached_stub.NewCachedStub(mstub)
+	filterBytes, _ = json.Marshal(&ServiceCatalogFilter{Datatypes: []string{"datatype2"}})
+	resultBytes, err = SearchServiceCatalog(stub, patient1, []string{string(filterBytes), "10", ""})
+	test_utils.AssertTrue(t, err == nil, "Expected SearchServiceCatalog to succeed")
+	result = ServiceCatalogResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, len(result.Services) == 0, "Expected no services after datatype removed")
+	mstub.MockTransactionEnd("8")
+
+	// reindex is only allowed for admins of the service
+	mstub.MockTransactionStart("9")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	_, err = ReindexServiceCatalog(stub, patient1, []string{"service3"})
+	test_utils.AssertTrue(t, err != nil, "Expected ReindexServiceCatalog as patient to fail")
+	reindexBytes, err := ReindexServiceCatalog(stub, org1Caller, []string{"service3"})
+	test_utils.AssertTrue(t, err == nil, "Expected ReindexServiceCatalog to succeed")
+	reindexResult := ServiceCatalogReindexResult{}
+	json.Unmarshal(reindexBytes, &reindexResult)
+	test_utils.AssertTrue(t, len(reindexResult.Datatypes) == 1 && reindexResult.Datatypes[0] == "datatype1", "Expected service3 reindexed with datatype1")
+	mstub.MockTransactionEnd("9")
+
+	// datatype dropped by updateService is removed from the catalog
+	mstub.MockTransactionStart("10")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	_, err = AddDatatypeToService(stub, org1Caller, []string{"service3", string(serviceDatatype3bBytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected AddDatatypeToService to succeed")
+	mstub.MockTransactionEnd("10")
+
+	mstub.MockTransactionStart("11")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	service3["service_name"] = "service3 new name"
+	service3Bytes, _ = json.Marshal(&service3)
+	_, err = UpdateService(stub, org1Caller, []string{string(service3Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected UpdateService to succeed")
+	mstub.MockTransactionEnd("11")
+
+	mstub.MockTransactionStart("12")
+	stub = cached_stub.NewCachedStub(mstub)
+	filterBytes, _ = json.Marshal(&ServiceCatalogFilter{Datatypes: []string{"datatype2"}})
+	resultBytes, err = SearchServiceCatalog(stub, patient1, []string{string(filterBytes), "10", ""})
+	test_utils.AssertTrue(t, err == nil, "Expected SearchServiceCatalog to succeed")
+	result = ServiceCatalogResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, len(result.Services) == 0, "Expected no services after datatype removed by update")
+
+	filterBytes, _ = json.Marshal(&ServiceCatalogFilter{Datatypes: []string{"datatype1"}, Keyword: "cardio"})
+	resultBytes, err = SearchServiceCatalog(stub, patient1, []string{string(filterBytes), "10", ""})
+	test_utils.AssertTrue(t, err == nil, "Expected SearchServiceCatalog to succeed")
+	result = ServiceCatalogResult{}
+	json.Unmarshal(resultBytes, &result)
+	test_utils.AssertTrue(t, len(result.Services) == 1 && result.Services[0].ServiceName == "service3 new name", "Expected updated service3")
+	mstub.MockTransactionEnd("12")
+}
@@ -37,19 +37,27 @@ const ServiceAssetNamespace = "ServiceAsset"
 //   - ServiceID
 //   - ServiceName
 //   - OrgID
+//
+// EligibilityRule is an optional simple_rule expression evaluated against the patient's solution public data on enrollment
 type Service struct {
-	ServiceID           string            `json:"service_id"`
-	ServiceName         string            `json:"service_name"`
-	Datatypes           []ServiceDatatype `json:"datatypes"`
-	OrgID               string            `json:"org_id"`
-	Email               string            `json:"email"`
-	Summary             string            `json:"summary"`
-	Terms               interface{}       `json:"terms"`
-	PaymentRequired     string            `json:"payment_required"`
-	Status              string            `json:"status"`
-	SolutionPrivateData interface{}       `json:"solution_private_data"`
-	CreateDate          int64             `json:"create_date"`
-	UpdateDate          int64             `json:"update_date"`
+	ServiceID           string                 `json:"service_id"`
+	ServiceName         string                 `json:"service_name"`
+	Datatypes           []ServiceDatatype      `json:"datatypes"`
+	OrgID               string                 `json:"org_id"`
+	Email               string                 `json:"email"`
+	Summary             string                 `json:"summary"`
+	Terms               interface{}            `json:"terms"`
+	TermsVersion        int                    `json:"terms_version"`
+	TermsDate           int64                  `json:"terms_date"`
+	PreviousTerms       []ServiceTermsVersion  `json:"previous_terms,omitempty"`
+	PaymentRequired     string                 `json:"payment_required"`
+	Status              string                 `json:"status"`
+	RetentionPeriod     int64                  `json:"retention_period"`
+	EligibilityRule     map[string]interface{} `json:"eligibility_rule,omitempty"`
+	Retirement          *ServiceRetirement     `json:"retirement,omitempty"`
+	SolutionPrivateData interface{}            `json:"solution_private_data"`
+	CreateDate          int64                  `json:"create_date"`
+	UpdateDate          int64                  `json:"update_date"`
 }
 
 // Private structs used for conversion between service and asset
@@ -59,24 +67,32 @@ type servicePrivateData struct {
 }
 
 type ServicePublicData struct {
-	ServiceID       string            `json:"service_id"`
-	ServiceName     string            `json:"service_name"`
-	Datatypes       []ServiceDatatype `json:"datatypes"`
-	OrgID           string            `json:"org_id"`
-	Summary         string            `json:"summary"`
-	Terms           interface{}       `json:"terms"`
-	PaymentRequired string            `json:"payment_required"`
-	Status          string            `json:"status"`
-	CreateDate      int64             `json:"create_date"`
-	UpdateDate      int64             `json:"update_date"`
+	ServiceID       string                 `json:"service_id"`
+	ServiceName     string                 `json:"service_name"`
+	Datatypes       []ServiceDatatype      `json:"datatypes"`
+	OrgID           string                 `json:"org_id"`
+	Summary         string                 `json:"summary"`
+	Terms           interface{}            `json:"terms"`
+	TermsVersion    int                    `json:"terms_version"`
+	TermsDate       int64                  `json:"terms_date"`
+	PreviousTerms   []ServiceTermsVersion  `json:"previous_terms,omitempty"`
+	PaymentRequired string                 `json:"payment_required"`
+	Status          string                 `json:"status"`
+	RetentionPeriod int64                  `json:"retention_period"`
+	EligibilityRule map[string]interface{} `json:"eligibility_rule,omitempty"`
+	Retirement      *ServiceRetirement     `json:"retirement,omitempty"`
+	CreateDate      int64                  `json:"create_date"`
+	UpdateDate      int64                  `json:"update_date"`
 }
 
 // datatypes attached to a service
+// RetentionPeriod is in seconds and overrides the service's retention period; 0 means use the service's
 // TODO: merge this with datatype struct in datatype_mgmt
 type ServiceDatatype struct {
-	DatatypeID string   `json:"datatype_id"`
-	ServiceID  string   `json:"service_id"`
-	Access     []string `json:"access"`
+	DatatypeID      string   `json:"datatype_id"`
+	ServiceID       string   `json:"service_id"`
+	Access          []string `json:"access"`
+	RetentionPeriod int64    `json:"retention_period"`
 }
 
 // RegisterService
@@ -218,6 +234,18 @@ func RegisterService(stub cached_stub.CachedStubInterface, caller data_model.Use
 		return nil, errors.New("Invalid status, must be active")
 	}
 
+	// Validate retention periods
+	if !service.hasValidRetentionPeriods() {
+		logger.Error("Retention period cannot be negative")
+		return nil, errors.New("Retention period cannot be negative")
+	}
+
+	// Validate eligibility rule
+	err = service.validateEligibilityRule()
+	if err != nil {
+		return nil, err
+	}
+
 	// check that createDate is within 10 mins of current time
 	currTime := time.Now().Unix()
 	if currTime-service.CreateDate > 10*60 || currTime-service.CreateDate < -10*60 {
@@ -228,6 +256,12 @@ func RegisterService(stub cached_stub.CachedStubInterface, caller data_model.Use
 	// Set service update date
 	service.UpdateDate = service.CreateDate
 
+	// Terms versions and retirement are managed by the chaincode
+	service.TermsVersion = 1
+	service.TermsDate = service.CreateDate
+	service.PreviousTerms = nil
+	service.Retirement = nil
+
 	// ==============================================================
 	// Call user mgmt to register service as subgroup of org
 	// ==============================================================
@@ -282,6 +316,11 @@ func RegisterService(stub cached_stub.CachedStubInterface, caller data_model.Use
 		return nil, errors.Wrap(err, customErr.Error())
 	}
 
+	err = putServiceCatalogIndex(stub, callerObj, service, serviceAssetKey)
+	if err != nil {
+		return nil, err
+	}
+
 	// ==============================================================
 	// Create datatype symkey between service and all datatypes
 	// ==============================================================
@@ -300,12 +339,15 @@ func RegisterService(stub cached_stub.CachedStubInterface, caller data_model.Use
 // UpdateService
 // 1) update service in user_mgmt
 // 2) update service asset
-// args = [ serviceBytes ]
+// A change of terms creates a new terms version
+// If materialTermsChange is "true", enrolled patients have to accept the new terms again
+// args = [ serviceBytes, materialTermsChange ]
+// materialTermsChange is optional
 func UpdateService(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
 	defer utils.ExitFnLog(utils.EnterFnLog())
 	logger.Debugf("args: %v", args)
 
-	if len(args) != 1 {
+	if len(args) != 1 && len(args) != 2 {
 		customErr := &custom_errors.LengthCheckingError{Type: "UpdateService arguments length"}
 		logger.Errorf(customErr.Error())
 		return nil, errors.New(customErr.Error())
@@ -381,6 +423,12 @@ func UpdateService(stub cached_stub.CachedStubInterface, caller data_model.User,
 		return nil, errors.WithStack(customErr)
 	}
 
+	// services in retirement can only be changed by the retirement flow
+	err = existingService.checkNotRetiring()
+	if err != nil {
+		return nil, err
+	}
+
 	// Validate service name
 	if utils.IsStringEmpty(service.ServiceName) {
 		customErr := &custom_errors.LengthCheckingError{Type: "ServiceName"}
@@ -446,6 +494,18 @@ func UpdateService(stub cached_stub.CachedStubInterface, caller data_model.User,
 		return nil, errors.New("Payment status must be active or inactive")
 	}
 
+	// Validate retention periods
+	if !service.hasValidRetentionPeriods() {
+		logger.Error("Retention period cannot be negative")
+		return nil, errors.New("Retention period cannot be negative")
+	}
+
+	// Validate eligibility rule
+	err = service.validateEligibilityRule()
+	if err != nil {
+		return nil, err
+	}
+
 	// check that updateDate is within 10 mins of current time
 	currTime := time.Now().Unix()
 	if currTime-service.UpdateDate > 10*60 || currTime-service.UpdateDate < -10*60 {
@@ -453,15 +513,34 @@ func UpdateService(stub cached_stub.CachedStubInterface, caller data_model.User,
 		return nil, errors.New("Invalid create date, not within possible time range")
 	}
 
+	// Datatypes dropped from the service lose their catalog entries
+	removedDatatypeIDs := []string{}
+	for _, existingDatatype := range existingService.Datatypes {
+		if !service.hasDatatype(existingDatatype.DatatypeID) {
+			removedDatatypeIDs = append(removedDatatypeIDs, existingDatatype.DatatypeID)
+		}
+	}
+
 	// Update service fields
 	existingService.UpdateDate = service.UpdateDate
 	existingService.PaymentRequired = service.PaymentRequired
 	existingService.Datatypes = service.Datatypes
 	existingService.SolutionPrivateData = service.SolutionPrivateData
-	existingService.Terms = service.Terms
+	termsChanged, err := existingService.updateTerms(service.Terms, service.UpdateDate)
+	if err != nil {
+		return nil, err
+	}
+
+	materialTermsChange := len(args) == 2 && args[1] == "true"
+	if materialTermsChange && !termsChanged {
+		logger.Error("Material terms change requested but terms did not change")
+		return nil, errors.New("Material terms change requested but terms did not change")
+	}
 	existingService.Summary = service.Summary
 	existingService.ServiceName = service.ServiceName
 	existingService.Status = service.Status
+	existingService.RetentionPeriod = service.RetentionPeriod
+	existingService.EligibilityRule = service.EligibilityRule
 
 	// ==============================================================
 	// Call user mgmt to update subgroup
@@ -495,30 +574,70 @@ func UpdateService(stub cached_stub.CachedStubInterface, caller data_model.User,
 		return nil, errors.Wrap(err, customErr.Error())
 	}
 
+	err = updateServiceAsset(stub, callerObj, existingService)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(removedDatatypeIDs) > 0 {
+		serviceAssetKey, err := asset_mgmt.GetAssetManager(stub, callerObj).GetAssetKey(
+			asset_mgmt.GetAssetId(ServiceAssetNamespace, existingService.ServiceID),
+			GetKeyPathFromCallerToServiceAsset(stub, callerObj, key_mgmt.GetSymKeyId(existingService.ServiceID)))
+		if err != nil {
+			logger.Errorf("Failed to GetAssetKey for serviceAssetKey: %v", err)
+			return nil, errors.Wrap(err, "Failed to GetAssetKey for serviceAssetKey")
+		}
+
+		for _, datatypeID := range removedDatatypeIDs {
+			err = deleteServiceCatalogEntry(stub, callerObj, existingService.ServiceID, datatypeID, serviceAssetKey)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if materialTermsChange {
+		err = requireTermsAcknowledgement(stub, caller, existingService, service.UpdateDate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+// updateServiceAsset saves changes to an existing service asset
+// callerObj must be the org or the service itself
+func updateServiceAsset(stub cached_stub.CachedStubInterface, callerObj data_model.User, service Service) error {
 	// Convert to Asset
-	serviceAsset, err := convertServiceToAsset(stub, existingService, callerObj.ID)
+	serviceAsset, err := convertServiceToAsset(stub, service, callerObj.ID)
 	if err != nil {
 		customErr := &ConvertToAssetError{Asset: "serviceAsset"}
 		logger.Errorf("%v: %v", customErr, err)
-		return nil, errors.Wrap(err, customErr.Error())
+		return errors.Wrap(err, customErr.Error())
 	}
-	serviceAsset.AssetKeyId = serviceSubgroup.GetSymKeyId()
+	serviceAsset.AssetKeyId = key_mgmt.GetSymKeyId(service.ServiceID)
 
 	assetManager := asset_mgmt.GetAssetManager(stub, callerObj)
 	serviceAssetKey, err := assetManager.GetAssetKey(serviceAsset.AssetId, GetKeyPathFromCallerToServiceAsset(stub, callerObj, serviceAsset.AssetKeyId))
 	if err != nil {
 		logger.Errorf("Failed to GetAssetKey for serviceAssetKey: %v", err)
-		return nil, errors.Wrap(err, "Failed to GetAssetKey for serviceAssetKey")
+		return errors.Wrap(err, "Failed to GetAssetKey for serviceAssetKey")
 	}
 
 	err = assetManager.UpdateAsset(serviceAsset, serviceAssetKey, true)
 	if err != nil {
 		customErr := &PutAssetError{Asset: service.ServiceID}
 		logger.Errorf("%v: %v", customErr, err)
-		return nil, errors.Wrap(err, customErr.Error())
+		return errors.Wrap(err, customErr.Error())
 	}
 
-	return nil, nil
+	err = putServiceCatalogIndex(stub, callerObj, service, serviceAssetKey)
+	if err != nil {
+		return err
+	}
+
+	return nil
 }
 
 // Get service
@@ -774,6 +893,11 @@ func AddDatatypeToService(stub cached_stub.CachedStubInterface, caller data_mode
 		return nil, errors.WithStack(customErr)
 	}
 
+	err = existingService.checkNotRetiring()
+	if err != nil {
+		return nil, err
+	}
+
 	// Validate datatype
 	serviceDatatype := ServiceDatatype{}
 	serviceDatatypeBytes := []byte(args[1])
@@ -786,6 +910,11 @@ func AddDatatypeToService(stub cached_stub.CachedStubInterface, caller data_mode
 
 	serviceDatatype.ServiceID = existingService.ServiceID
 
+	if serviceDatatype.RetentionPeriod < 0 {
+		logger.Error("Retention period cannot be negative")
+		return nil, errors.New("Retention period cannot be negative")
+	}
+
 	valid, err := ValidateDatatype(stub, callerObj, serviceDatatype)
 	if err != nil {
 		customErr := &ValidateDatatypeError{Datatype: serviceDatatype.DatatypeID}
@@ -834,6 +963,11 @@ func AddDatatypeToService(stub cached_stub.CachedStubInterface, caller data_mode
 		return nil, errors.Wrap(err, customErr.Error())
 	}
 
+	err = putServiceCatalogIndex(stub, callerObj, existingService, serviceAssetKey)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create datatype symkey between service and datatype
 	_, err = datatype.AddDatatypeSymKey(stub, callerObj, serviceDatatype.DatatypeID, existingService.ServiceID)
 	if err != nil {
@@ -916,6 +1050,11 @@ func RemoveDatatypeFromService(stub cached_stub.CachedStubInterface, caller data
 		return nil, errors.WithStack(customErr)
 	}
 
+	err = existingService.checkNotRetiring()
+	if err != nil {
+		return nil, err
+	}
+
 	// Check if existing service actually contains this datatype
 	datatypeID := args[1]
 	if !existingService.hasDatatype(datatypeID) {
@@ -954,6 +1093,16 @@ func RemoveDatatypeFromService(stub cached_stub.CachedStubInterface, caller data
 		return nil, errors.Wrap(err, customErr.Error())
 	}
 
+	err = putServiceCatalogIndex(stub, callerObj, existingService, serviceAssetKey)
+	if err != nil {
+		return nil, err
+	}
+
+	err = deleteServiceCatalogEntry(stub, callerObj, serviceID, datatypeID, serviceAssetKey)
+	if err != nil {
+		return nil, err
+	}
+
 	return nil, nil
 }
 
@@ -1062,8 +1211,14 @@ func convertServiceFromAsset(asset *data_model.Asset) Service {
 	service.OrgID = publicData.OrgID
 	service.Summary = publicData.Summary
 	service.Terms = publicData.Terms
+	service.TermsVersion = publicData.TermsVersion
+	service.TermsDate = publicData.TermsDate
+	service.PreviousTerms = publicData.PreviousTerms
 	service.PaymentRequired = publicData.PaymentRequired
 	service.Status = publicData.Status
+	service.RetentionPeriod = publicData.RetentionPeriod
+	service.EligibilityRule = publicData.EligibilityRule
+	service.Retirement = publicData.Retirement
 	service.CreateDate = publicData.CreateDate
 	service.UpdateDate = publicData.UpdateDate
 
@@ -1141,8 +1296,14 @@ func getServiceAssetPublicData(service Service) ([]byte, error) {
 	publicData.OrgID = service.OrgID
 	publicData.Summary = service.Summary
 	publicData.Terms = service.Terms
+	publicData.TermsVersion = service.TermsVersion
+	publicData.TermsDate = service.TermsDate
+	publicData.PreviousTerms = service.PreviousTerms
 	publicData.PaymentRequired = service.PaymentRequired
 	publicData.Status = service.Status
+	publicData.RetentionPeriod = service.RetentionPeriod
+	publicData.EligibilityRule = service.EligibilityRule
+	publicData.Retirement = service.Retirement
 	publicData.CreateDate = service.CreateDate
 	publicData.UpdateDate = service.UpdateDate
 
@@ -1183,6 +1344,31 @@ func (s Service) hasDatatype(datatype string) bool {
 	return false
 }
 
+// GetRetentionPeriod returns the retention period in seconds for the given datatype
+// Datatype level retention period overrides service level retention period; 0 means data is kept forever
+func (s Service) GetRetentionPeriod(datatype string) int64 {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+
+	for _, dt := range s.Datatypes {
+		if dt.DatatypeID == datatype && dt.RetentionPeriod > 0 {
+			return dt.RetentionPeriod
+		}
+	}
+	return s.RetentionPeriod
+}
+
+func (s Service) hasValidRetentionPeriods() bool {
+	if s.RetentionPeriod < 0 {
+		return false
+	}
+	for _, dt := range s.Datatypes {
+		if dt.RetentionPeriod < 0 {
+			return false
+		}
+	}
+	return true
+}
+
 func RemoveDatatypeFromList(list []ServiceDatatype, datatypeID string) []ServiceDatatype {
 	defer utils.ExitFnLog(utils.EnterFnLog())
 
@@ -1207,6 +1393,17 @@ func SetupServiceIndex(stub cached_stub.CachedStubInterface) error {
 		return err
 	}
 
+	// Service catalog entry indices
+	catalogEntryTable := index.GetTable(stub, IndexServiceCatalogEntry, "entry_id")
+	catalogEntryTable.AddIndex([]string{"datatype", "status", "service_name", "service_id"}, false)
+	catalogEntryTable.AddIndex([]string{"datatype", "status", "payment_required", "service_name", "service_id"}, false)
+	catalogEntryTable.AddIndex([]string{"datatype", "org_id", "status", "service_name", "service_id"}, false)
+	err = catalogEntryTable.SaveToLedger()
+
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -0,0 +1,339 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"common/bchcls/cached_stub"
+	"common/bchcls/custom_errors"
+	"common/bchcls/data_model"
+	"common/bchcls/user_groups"
+	"common/bchcls/user_mgmt"
+	"common/bchcls/utils"
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Service statuses set by the retirement flow
+// An "inactive" service can be made active again and its admins keep their access,
+// a retired service cannot be changed anymore
+const (
+	ServiceStatusRetiring = "retiring"
+	ServiceStatusRetired  = "retired"
+)
+
+// serviceRetirementEvent is the name of the event sent when the retirement of a service starts
+const serviceRetirementEvent = "service_retirement"
+
+// ServiceRetirement records the retirement of a service
+// Patients can export their data until Deadline
+type ServiceRetirement struct {
+	Reason       string `json:"reason"`
+	StartDate    int64  `json:"start_date"`
+	Deadline     int64  `json:"deadline"`
+	CompleteDate int64  `json:"complete_date,omitempty"`
+}
+
+// ServiceRetirementReport is returned by RetireService and CompleteServiceRetirement
+// NotifiedPatients are only set when the retirement starts,
+// the other lists are only set when the retirement is complete
+type ServiceRetirementReport struct {
+	ServiceID        string                     `json:"service_id"`
+	Status           string                     `json:"status"`
+	Retirement       ServiceRetirement          `json:"retirement"`
+	NotifiedPatients []string                   `json:"notified_patients,omitempty"`
+	EndedEnrollments []string                   `json:"ended_enrollments,omitempty"`
+	DeniedConsents   []ServiceRetirementConsent `json:"denied_consents,omitempty"`
+	RemovedAdmins    []string                   `json:"removed_admins,omitempty"`
+}
+
+// ServiceRetirementConsent lists the datatypes a patient's consents were denied for
+type ServiceRetirementConsent struct {
+	UserID    string   `json:"user_id"`
+	Datatypes []string `json:"datatypes"`
+}
+
+// serviceRetirementEventPayload is the payload of the service retirement event
+// Events can be read by anyone listening on the channel, so the payload does not identify patients
+type serviceRetirementEventPayload struct {
+	ServiceID string `json:"service_id"`
+	Deadline  int64  `json:"deadline"`
+}
+
+// isRetiring returns true if the service is being retired or is retired
+func (s Service) isRetiring() bool {
+	return s.Status == ServiceStatusRetiring || s.Status == ServiceStatusRetired
+}
+
+// checkNotRetiring returns an error if the service is being retired or is retired
+func (s Service) checkNotRetiring() error {
+	if s.isRetiring() {
+		logger.Errorf("Service %v is %v", s.ServiceID, s.Status)
+		return errors.New("Service " + s.ServiceID + " is " + s.Status)
+	}
+
+	return nil
+}
+
+// RetireService starts the retirement of a service
+// New enrollments and contracts of the service are blocked from now on
+// An event announces the retirement, and patients with a pending, active or suspended enrollment are listed in the report
+// so the org can notify them; they can export their data during the grace period
+// Can only be called by org admin of the service
+// gracePeriod is in seconds
+// args = [ serviceID, gracePeriod, reason, timestamp ]
+func RetireService(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 4 {
+		customErr := &custom_errors.LengthCheckingError{Type: "RetireService arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	gracePeriod, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		logger.Errorf("Error converting gracePeriod to type int64")
+		return nil, errors.Wrap(err, "Error converting gracePeriod to type int64")
+	}
+
+	if gracePeriod <= 0 {
+		logger.Errorf("Invalid grace period: %v", gracePeriod)
+		return nil, errors.New("Grace period must be greater than 0")
+	}
+
+	timestamp, err := ParseTimestamp(args[3])
+	if err != nil {
+		return nil, err
+	}
+
+	service, orgCaller, err := getServiceForRetirement(stub, caller, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	err = service.checkNotRetiring()
+	if err != nil {
+		return nil, err
+	}
+
+	// ==============================================================
+	// Start retirement
+	// ==============================================================
+	service.Status = ServiceStatusRetiring
+	service.Retirement = &ServiceRetirement{Reason: args[2], StartDate: timestamp, Deadline: timestamp + gracePeriod}
+	service.UpdateDate = timestamp
+	err = updateServiceAsset(stub, orgCaller, service)
+	if err != nil {
+		return nil, err
+	}
+
+	enrollments, err := getServiceEnrollmentsInternal(stub, caller, service.ServiceID)
+	if err != nil {
+		return nil, err
+	}
+
+	report := ServiceRetirementReport{ServiceID: service.ServiceID, Status: service.Status, Retirement: *service.Retirement, NotifiedPatients: []string{}}
+	for _, enrollment := range enrollments {
+		if !enrollment.hasEnded() {
+			report.NotifiedPatients = append(report.NotifiedPatients, enrollment.UserID)
+		}
+	}
+
+	payload := serviceRetirementEventPayload{ServiceID: service.ServiceID, Deadline: service.Retirement.Deadline}
+	payloadBytes, err := json.Marshal(&payload)
+	if err != nil {
+		customErr := &custom_errors.MarshalError{Type: "serviceRetirementEventPayload"}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	err = stub.SetEvent(serviceRetirementEvent, payloadBytes)
+	if err != nil {
+		logger.Errorf("Failed to set service retirement event: %v", err)
+		return nil, errors.Wrap(err, "Failed to set service retirement event")
+	}
+
+	return json.Marshal(&report)
+}
+
+// CompleteServiceRetirement retires a service once the grace period is over
+// Consents patients gave to the service are denied, remaining enrollments become inactive,
+// and all service admins lose their permission
+// Can only be called by org admin of the service
+// args = [ serviceID, timestamp ]
+func CompleteServiceRetirement(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 2 {
+		customErr := &custom_errors.LengthCheckingError{Type: "CompleteServiceRetirement arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	timestamp, err := ParseTimestamp(args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	service, orgCaller, err := getServiceForRetirement(stub, caller, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if service.Status != ServiceStatusRetiring || service.Retirement == nil {
+		logger.Errorf("Service %v is not being retired", service.ServiceID)
+		return nil, errors.New("Service " + service.ServiceID + " is not being retired")
+	}
+
+	if timestamp < service.Retirement.Deadline {
+		logger.Errorf("Grace period of service %v ends at %v", service.ServiceID, service.Retirement.Deadline)
+		return nil, errors.New("Grace period of service " + service.ServiceID + " is not over")
+	}
+
+	report := ServiceRetirementReport{
+		ServiceID:        service.ServiceID,
+		EndedEnrollments: []string{},
+		DeniedConsents:   []ServiceRetirementConsent{},
+		RemovedAdmins:    []string{}}
+
+	// ==============================================================
+	// Deny consents and end enrollments
+	// ==============================================================
+	enrollments, err := getServiceEnrollmentsInternal(stub, caller, service.ServiceID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, enrollment := range enrollments {
+		// patients who left earlier may still have consents in place
+		deniedDatatypes, err := denyEnrollmentConsents(stub, caller, service, enrollment, nil, "CompleteServiceRetirement", timestamp)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(deniedDatatypes) > 0 {
+			report.DeniedConsents = append(report.DeniedConsents, ServiceRetirementConsent{UserID: enrollment.UserID, Datatypes: deniedDatatypes})
+		}
+
+		if enrollment.hasEnded() {
+			continue
+		}
+
+		enrollment.Status = EnrollmentStatusInactive
+		_, err = UpdateEnrollmentInternal(stub, caller, enrollment, "service retired", timestamp)
+		if err != nil {
+			return nil, err
+		}
+
+		report.EndedEnrollments = append(report.EndedEnrollments, enrollment.UserID)
+	}
+
+	// ==============================================================
+	// Remove service admins
+	// ==============================================================
+	memberIDs, err := user_groups.SlowGetGroupMemberIDs(stub, service.OrgID)
+	if err != nil {
+		logger.Errorf("Failed to get members of org %v: %v", service.OrgID, err)
+		return nil, errors.Wrap(err, "Failed to get members of org "+service.OrgID)
+	}
+
+	sort.Strings(memberIDs)
+	for _, memberID := range memberIDs {
+		member, err := GetSolutionUserWithParams(stub, orgCaller, memberID, false, true)
+		if err != nil {
+			customErr := &GetUserError{User: memberID}
+			logger.Errorf("%v: %v", customErr, err)
+			return nil, errors.Wrap(err, customErr.Error())
+		}
+
+		if !utils.InList(member.SolutionInfo.Services, service.ServiceID) {
+			continue
+		}
+
+		_, err = RemovePermissionServiceAdmin(stub, caller, []string{memberID, service.ServiceID})
+		if err != nil {
+			logger.Errorf("Failed to remove service admin %v: %v", memberID, err)
+			return nil, errors.Wrap(err, "Failed to remove service admin "+memberID)
+		}
+
+		report.RemovedAdmins = append(report.RemovedAdmins, memberID)
+	}
+
+	// ==============================================================
+	// Complete retirement
+	// ==============================================================
+	service.Status = ServiceStatusRetired
+	service.Retirement.CompleteDate = timestamp
+	service.UpdateDate = timestamp
+	err = updateServiceAsset(stub, orgCaller, service)
+	if err != nil {
+		return nil, err
+	}
+
+	report.Status = service.Status
+	report.Retirement = *service.Retirement
+	return json.Marshal(&report)
+}
+
+// getServiceForRetirement returns the service and its org as caller
+// Returns an error if caller is not org admin of the service
+func getServiceForRetirement(stub cached_stub.CachedStubInterface, caller data_model.User, serviceID string) (Service, data_model.User, error) {
+	if utils.IsStringEmpty(serviceID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "serviceID"}
+		logger.Errorf(customErr.Error())
+		return Service{}, data_model.User{}, errors.WithStack(customErr)
+	}
+
+	service, err := GetServiceInternal(stub, caller, serviceID, true)
+	if err != nil {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf("%v: %v", customErr, err)
+		return Service{}, data_model.User{}, errors.Wrap(err, customErr.Error())
+	}
+
+	if utils.IsStringEmpty(service.ServiceID) {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf(customErr.Error())
+		return Service{}, data_model.User{}, errors.WithStack(customErr)
+	}
+
+	// service admins cannot retire their own service, since they lose their access
+	solutionCaller := convertToSolutionUser(caller)
+	if !solutionCaller.SolutionInfo.IsOrgAdmin || solutionCaller.Org != service.OrgID {
+		logger.Error("Caller is not org admin of the service")
+		return Service{}, data_model.User{}, errors.New("Caller is not org admin of the service")
+	}
+
+	orgCaller, err := user_mgmt.GetUserData(stub, caller, service.OrgID, true, false)
+	if err != nil {
+		customErr := &GetOrgError{Org: service.OrgID}
+		logger.Errorf("%v: %v", customErr, err)
+		return Service{}, data_model.User{}, errors.Wrap(err, customErr.Error())
+	}
+
+	if orgCaller.PrivateKey == nil {
+		errMsg := "Caller does not have access to org private key"
+		logger.Errorf(errMsg)
+		return Service{}, data_model.User{}, errors.New(errMsg)
+	}
+
+	return service, orgCaller, nil
+}
@@ -0,0 +1,133 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"common/bchcls/cached_stub"
+	"common/bchcls/crypto"
+	"common/bchcls/test_utils"
+	"common/bchcls/user_groups"
+	"common/bchcls/user_mgmt"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestServiceRetirement(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestServiceRetirement function called")
+
+	mstub := SetupIndexesAndGetStub(t)
+	org1Caller, service1Subgroup, patient1 := SetupEnrollmentServiceTest(t, mstub)
+	now := time.Now().Unix()
+	nowStr := strconv.FormatInt(now, 10)
+
+	// register a service admin for service1
+	mstub.MockTransactionStart("1")
+	stub := cached_stub.NewCachedStub(mstub)
+	orgUser1 := CreateTestSolutionUser("orgUser1")
+	orgUser1.Org = "org1"
+	orgUser1Bytes, _ := json.Marshal(&orgUser1)
+	_, err := RegisterUser(stub, org1Caller, []string{string(orgUser1Bytes)})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterUser to succeed")
+	_, err = PutUserInOrg(stub, org1Caller, []string{orgUser1.ID, "org1", "false"})
+	test_utils.AssertTrue(t, err == nil, "Expected PutUserInOrg to succeed")
+	mstub.MockTransactionEnd("1")
+
+	mstub.MockTransactionStart("2")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = AddPermissionServiceAdmin(stub, org1Caller, []string{orgUser1.ID, "service1"})
+	test_utils.AssertTrue(t, err == nil, "Expected AddPermissionServiceAdmin to succeed")
+	mstub.MockTransactionEnd("2")
+
+	// enroll patient1 and give consent
+	mstub.MockTransactionStart("3")
+	stub = cached_stub.NewCachedStub(mstub)
+	enrollment1 := GenerateEnrollmentTest(patient1.ID, "service1")
+	enrollment1Bytes, _ := json.Marshal(&enrollment1)
+	_, err = EnrollPatient(stub, service1Subgroup, []string{string(enrollment1Bytes), crypto.EncodeToB64String(test_utils.GenerateSymKey())})
+	test_utils.AssertTrue(t, err == nil, "Expected EnrollPatient to succeed")
+	mstub.MockTransactionEnd("3")
+
+	mstub.MockTransactionStart("4")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	patient1Caller, _ := user_mgmt.GetUserData(stub, patient1, "patient1", true, true)
+	consent := Consent{Owner: "patient1", Service: "service1", Target: "service1", Datatype: "datatype1", Option: []string{consentOptionWrite, consentOptionRead}, Timestamp: now}
+	consentBytes, _ := json.Marshal(&consent)
+	_, err = PutConsentPatientData(stub, patient1Caller, []string{string(consentBytes), crypto.EncodeToB64String(test_utils.GenerateSymKey())})
+	test_utils.AssertTrue(t, err == nil, "Expected PutConsentPatientData to succeed")
+	mstub.MockTransactionEnd("4")
+
+	// only org admin can retire a service
+	startStr := strconv.FormatInt(now-5*60, 10)
+	mstub.MockTransactionStart("5")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	_, err = RetireService(stub, service1Subgroup, []string{"service1", "60", "replaced by service2", startStr})
+	test_utils.AssertTrue(t, err != nil, "Expected RetireService by service admin to fail")
+	_, err = RetireService(stub, org1Caller, []string{"service1", "0", "replaced by service2", startStr})
+	test_utils.AssertTrue(t, err != nil, "Expected RetireService without grace period to fail")
+	reportBytes, err := RetireService(stub, org1Caller, []string{"service1", "60", "replaced by service2", startStr})
+	test_utils.AssertTrue(t, err == nil, "Expected RetireService to succeed")
+	report := ServiceRetirementReport{}
+	json.Unmarshal(reportBytes, &report)
+	test_utils.AssertTrue(t, report.Status == ServiceStatusRetiring, "Expected service to be retiring")
+	test_utils.AssertSetsEqual(t, []string{"patient1"}, report.NotifiedPatients)
+	mstub.MockTransactionEnd("5")
+
+	// retiring service cannot take new patients or be retired again
+	mstub.MockTransactionStart("6")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	patient2 := test_utils.CreateTestUser("patient2")
+	patient2Bytes, _ := json.Marshal(&patient2)
+	_, err = user_mgmt.RegisterUser(stub, org1Caller, []string{string(patient2Bytes), "false"})
+	test_utils.AssertTrue(t, err == nil, "Expected RegisterUser to succeed")
+	enrollment2 := GenerateEnrollmentTest("patient2", "service1")
+	enrollment2Bytes, _ := json.Marshal(&enrollment2)
+	_, err = EnrollPatient(stub, service1Subgroup, []string{string(enrollment2Bytes), crypto.EncodeToB64String(test_utils.GenerateSymKey())})
+	test_utils.AssertTrue(t, err != nil, "Expected EnrollPatient to fail")
+	service, err := GetServiceInternal(stub, org1Caller, "service1", false)
+	test_utils.AssertTrue(t, err == nil, "Expected GetServiceInternal to succeed")
+	test_utils.AssertTrue(t, service.Retirement != nil && service.Retirement.Deadline == now-5*60+60, "Expected retirement deadline")
+	_, err = RetireService(stub, org1Caller, []string{"service1", "60", "replaced by service2", nowStr})
+	test_utils.AssertTrue(t, err != nil, "Expected second RetireService to fail")
+	mstub.MockTransactionEnd("6")
+
+	// grace period is over, retirement can be completed
+	mstub.MockTransactionStart("7")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	_, err = CompleteServiceRetirement(stub, org1Caller, []string{"service1", strconv.FormatInt(now-5*60+30, 10)})
+	test_utils.AssertTrue(t, err != nil, "Expected CompleteServiceRetirement during grace period to fail")
+	reportBytes, err = CompleteServiceRetirement(stub, org1Caller, []string{"service1", nowStr})
+	test_utils.AssertTrue(t, err == nil, "Expected CompleteServiceRetirement to succeed")
+	report = ServiceRetirementReport{}
+	json.Unmarshal(reportBytes, &report)
+	test_utils.AssertTrue(t, report.Status == ServiceStatusRetired, "Expected service to be retired")
+	test_utils.AssertSetsEqual(t, []string{"patient1"}, report.EndedEnrollments)
+	test_utils.AssertTrue(t, len(report.DeniedConsents) == 1 && report.DeniedConsents[0].UserID == "patient1", "Expected consent of patient1 to be denied")
+	test_utils.AssertSetsEqual(t, []string{orgUser1.ID}, report.RemovedAdmins)
+	mstub.MockTransactionEnd("7")
+
+	mstub.MockTransactionStart("8")
+	stub = cached_stub.NewCachedStub(mstub)
+	enrollmentResult, err := GetEnrollmentInternal(stub, patient1Caller, "patient1", "service1")
+	test_utils.AssertTrue(t, err == nil, "Expected GetEnrollmentInternal to succeed")
+	test_utils.AssertTrue(t, enrollmentResult.Status == EnrollmentStatusInactive, "Expected enrollment to be inactive")
+	consentResultBytes, err := GetConsent(stub, patient1Caller, []string{"patient1", "service1", "datatype1"})
+	test_utils.AssertTrue(t, err == nil, "Expected GetConsent to succeed")
+	consentResult := Consent{}
+	json.Unmarshal(consentResultBytes, &consentResult)
+	test_utils.AssertSetsEqual(t, []string{consentOptionDeny}, consentResult.Option)
+	isAdmin, _, err := user_groups.IsUserAdminOfGroup(stub, orgUser1.ID, "service1")
+	test_utils.AssertTrue(t, err == nil && !isAdmin, "Expected orgUser1 to no longer be service admin")
+	mstub.MockTransactionEnd("8")
+}
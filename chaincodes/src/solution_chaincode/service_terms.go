@@ -0,0 +1,155 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"common/bchcls/cached_stub"
+	"common/bchcls/custom_errors"
+	"common/bchcls/data_model"
+	"common/bchcls/utils"
+	"encoding/json"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// ServiceTermsVersion is a version of the service terms that was replaced
+// EffectiveDate is when the version took effect
+type ServiceTermsVersion struct {
+	Version       int         `json:"version"`
+	Terms         interface{} `json:"terms"`
+	EffectiveDate int64       `json:"effective_date"`
+}
+
+// updateTerms replaces the service terms with a new version if they changed
+// Returns true if the terms changed
+func (s *Service) updateTerms(terms interface{}, timestamp int64) (bool, error) {
+	currentBytes, err := json.Marshal(s.Terms)
+	if err != nil {
+		customErr := &custom_errors.MarshalError{Type: "Terms"}
+		logger.Errorf("%v: %v", customErr, err)
+		return false, errors.Wrap(err, customErr.Error())
+	}
+
+	newBytes, err := json.Marshal(terms)
+	if err != nil {
+		customErr := &custom_errors.MarshalError{Type: "Terms"}
+		logger.Errorf("%v: %v", customErr, err)
+		return false, errors.Wrap(err, customErr.Error())
+	}
+
+	// maps are marshalled with sorted keys, so equal terms give equal bytes
+	if bytes.Equal(currentBytes, newBytes) {
+		return false, nil
+	}
+
+	// services registered before terms were versioned start at version 0
+	s.PreviousTerms = append(s.PreviousTerms, ServiceTermsVersion{Version: s.TermsVersion, Terms: s.Terms, EffectiveDate: s.TermsDate})
+	s.Terms = terms
+	s.TermsVersion++
+	s.TermsDate = timestamp
+	return true, nil
+}
+
+// requireTermsAcknowledgement marks every current enrollment of the service as needing
+// the patient to accept the current terms version
+func requireTermsAcknowledgement(stub cached_stub.CachedStubInterface, caller data_model.User, service Service, timestamp int64) error {
+	enrollments, err := getServiceEnrollmentsInternal(stub, caller, service.ServiceID)
+	if err != nil {
+		return err
+	}
+
+	for _, enrollment := range enrollments {
+		if enrollment.hasEnded() || enrollment.TermsVersion >= service.TermsVersion {
+			continue
+		}
+
+		enrollment.TermsAcknowledgementRequired = true
+		_, err = updateEnrollment(stub, caller, enrollment, "", timestamp, true)
+		if err != nil {
+			logger.Errorf("Failed to update enrollment of patient %v: %v", enrollment.UserID, err)
+			return errors.Wrap(err, "Failed to update enrollment of patient "+enrollment.UserID)
+		}
+	}
+
+	return nil
+}
+
+// AcknowledgeServiceTerms records that the patient accepted the current terms of a service
+// Write access to the patient's data is denied while an acknowledgement is required
+// Can only be called by the enrolled patient, who needs write access to the enrollment;
+// enrollments created before patients were given write access need MigrateEnrollmentWriteAccess first
+// termsVersion must be the current terms version of the service
+// args = [ serviceID, termsVersion, timestamp ]
+func AcknowledgeServiceTerms(stub cached_stub.CachedStubInterface, caller data_model.User, args []string) ([]byte, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+	logger.Debugf("args: %v", args)
+
+	if len(args) != 3 {
+		customErr := &custom_errors.LengthCheckingError{Type: "AcknowledgeServiceTerms arguments length"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// ==============================================================
+	// Validation
+	// ==============================================================
+	serviceID := args[0]
+	if utils.IsStringEmpty(serviceID) {
+		customErr := &custom_errors.LengthCheckingError{Type: "ServiceID"}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	termsVersion, err := strconv.Atoi(args[1])
+	if err != nil {
+		logger.Errorf("Error converting termsVersion to type int")
+		return nil, errors.Wrap(err, "Error converting termsVersion to type int")
+	}
+
+	timestamp, err := ParseTimestamp(args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	service, err := GetServiceInternal(stub, caller, serviceID, false)
+	if err != nil {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	if utils.IsStringEmpty(service.ServiceID) {
+		customErr := &GetServiceError{Service: serviceID}
+		logger.Errorf(customErr.Error())
+		return nil, errors.WithStack(customErr)
+	}
+
+	// the patient must have seen the terms that are in effect
+	if termsVersion != service.TermsVersion {
+		logger.Errorf("Terms version %v is not the current version %v", termsVersion, service.TermsVersion)
+		return nil, errors.New("Terms version " + args[1] + " is not the current terms version of service " + serviceID)
+	}
+
+	enrollment, err := GetEnrollmentInternal(stub, caller, caller.ID, serviceID)
+	if err != nil {
+		customErr := &GetEnrollmentError{Enrollment: GetEnrollmentID(caller.ID, serviceID)}
+		logger.Errorf("%v: %v", customErr, err)
+		return nil, errors.Wrap(err, customErr.Error())
+	}
+
+	// ==============================================================
+	// Save acknowledgement
+	// ==============================================================
+	enrollment.TermsVersion = termsVersion
+	enrollment.TermsAcknowledgementRequired = false
+	return updateEnrollment(stub, caller, enrollment, "", timestamp, true)
+}
@@ -0,0 +1,124 @@
+/*******************************************************************************
+ *
+ *
+ * (c) Copyright Merative US L.P. and others 2020-2022 
+ *
+ * SPDX-Licence-Identifier: Apache 2.0
+ *
+ *******************************************************************************/
+
+package main
+
+import (
+	"common/bchcls/cached_stub"
+	"common/bchcls/crypto"
+	"common/bchcls/test_utils"
+	"common/bchcls/user_mgmt"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// GenerateServiceTermsUpdateTest returns service1 with the given terms
+func GenerateServiceTermsUpdateTest(privacyNotice string) string {
+	serviceDatatype1 := GenerateServiceDatatypeForTesting("datatype1", "service1", []string{consentOptionWrite, consentOptionRead})
+	service1 := GenerateServiceForTesting("service1", "org1", []ServiceDatatype{serviceDatatype1})
+	service1["terms"] = map[string]interface{}{"privacy_notice": privacyNotice}
+	service1Bytes, _ := json.Marshal(&service1)
+	return string(service1Bytes)
+}
+
+func TestServiceTerms(t *testing.T) {
+	logger.SetLevel(shim.LogDebug)
+	logger.Info("TestServiceTerms function called")
+
+	mstub := SetupIndexesAndGetStub(t)
+	org1Caller, service1Subgroup, patient1 := SetupEnrollmentServiceTest(t, mstub)
+	nowStr := strconv.FormatInt(time.Now().Unix(), 10)
+
+	// enroll patient1 and give write consent
+	mstub.MockTransactionStart("1")
+	stub := cached_stub.NewCachedStub(mstub)
+	enrollment1 := GenerateEnrollmentTest(patient1.ID, "service1")
+	enrollment1Bytes, _ := json.Marshal(&enrollment1)
+	_, err := EnrollPatient(stub, service1Subgroup, []string{string(enrollment1Bytes), crypto.EncodeToB64String(test_utils.GenerateSymKey())})
+	test_utils.AssertTrue(t, err == nil, "Expected EnrollPatient to succeed")
+	mstub.MockTransactionEnd("1")
+
+	mstub.MockTransactionStart("2")
+	stub = cached_stub.NewCachedStub(mstub, true, true, true)
+	patient1Caller, _ := user_mgmt.GetUserData(stub, patient1, "patient1", true, true)
+	consent := Consent{Owner: "patient1", Service: "service1", Target: "service1", Datatype: "datatype1", Option: []string{consentOptionWrite, consentOptionRead}, Timestamp: time.Now().Unix()}
+	consentBytes, _ := json.Marshal(&consent)
+	_, err = PutConsentPatientData(stub, patient1Caller, []string{string(consentBytes), crypto.EncodeToB64String(test_utils.GenerateSymKey())})
+	test_utils.AssertTrue(t, err == nil, "Expected PutConsentPatientData to succeed")
+	enrollmentResult, err := GetEnrollmentInternal(stub, patient1Caller, "patient1", "service1")
+	test_utils.AssertTrue(t, err == nil, "Expected GetEnrollmentInternal to succeed")
+	test_utils.AssertTrue(t, enrollmentResult.TermsVersion == 1, "Expected enrollment to accept terms version 1")
+	mstub.MockTransactionEnd("2")
+
+	// minor terms change creates a new version without re-acknowledgement
+	mstub.MockTransactionStart("3")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = UpdateService(stub, org1Caller, []string{GenerateServiceTermsUpdateTest("v2"), "false"})
+	test_utils.AssertTrue(t, err == nil, "Expected UpdateService to succeed")
+	mstub.MockTransactionEnd("3")
+
+	mstub.MockTransactionStart("4")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = UpdateService(stub, org1Caller, []string{GenerateServiceTermsUpdateTest("v2"), "true"})
+	test_utils.AssertTrue(t, err != nil, "Expected material UpdateService without terms change to fail")
+	service, err := GetServiceInternal(stub, org1Caller, "service1", false)
+	test_utils.AssertTrue(t, err == nil, "Expected GetServiceInternal to succeed")
+	test_utils.AssertTrue(t, service.TermsVersion == 2, "Expected terms version 2")
+	test_utils.AssertTrue(t, len(service.PreviousTerms) == 1 && service.PreviousTerms[0].Version == 1, "Expected terms version 1 to be kept")
+	enrollmentResult, err = GetEnrollmentInternal(stub, patient1Caller, "patient1", "service1")
+	test_utils.AssertTrue(t, err == nil, "Expected GetEnrollmentInternal to succeed")
+	test_utils.AssertTrue(t, !enrollmentResult.TermsAcknowledgementRequired, "Expected no terms acknowledgement required")
+	mstub.MockTransactionEnd("4")
+
+	// material terms change requires patients to accept the new version
+	mstub.MockTransactionStart("5")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = UpdateService(stub, org1Caller, []string{GenerateServiceTermsUpdateTest("v3"), "true"})
+	test_utils.AssertTrue(t, err == nil, "Expected UpdateService to succeed")
+	mstub.MockTransactionEnd("5")
+
+	mstub.MockTransactionStart("6")
+	stub = cached_stub.NewCachedStub(mstub)
+	enrollmentResult, err = GetEnrollmentInternal(stub, patient1Caller, "patient1", "service1")
+	test_utils.AssertTrue(t, err == nil, "Expected GetEnrollmentInternal to succeed")
+	test_utils.AssertTrue(t, enrollmentResult.TermsAcknowledgementRequired, "Expected terms acknowledgement required")
+	cvResultBytes, err := ValidateConsent(stub, service1Subgroup, []string{"patient1", "service1", "datatype1", consentOptionWrite, nowStr})
+	test_utils.AssertTrue(t, err == nil, "Expected ValidateConsent to succeed")
+	cvResult := ValidationResultWithLog{}
+	json.Unmarshal(cvResultBytes, &cvResult)
+	test_utils.AssertTrue(t, !cvResult.ConsentValidation.PermissionGranted, "Expected write access to be denied")
+	cvResultBytes, err = ValidateConsent(stub, service1Subgroup, []string{"patient1", "service1", "datatype1", consentOptionRead, nowStr})
+	test_utils.AssertTrue(t, err == nil, "Expected ValidateConsent to succeed")
+	cvResult = ValidationResultWithLog{}
+	json.Unmarshal(cvResultBytes, &cvResult)
+	test_utils.AssertTrue(t, cvResult.ConsentValidation.PermissionGranted, "Expected read access to be granted")
+	mstub.MockTransactionEnd("6")
+
+	// patient accepts the current version
+	mstub.MockTransactionStart("7")
+	stub = cached_stub.NewCachedStub(mstub)
+	_, err = AcknowledgeServiceTerms(stub, patient1Caller, []string{"service1", "2", nowStr})
+	test_utils.AssertTrue(t, err != nil, "Expected AcknowledgeServiceTerms of old version to fail")
+	_, err = AcknowledgeServiceTerms(stub, patient1Caller, []string{"service1", "3", nowStr})
+	test_utils.AssertTrue(t, err == nil, "Expected AcknowledgeServiceTerms to succeed")
+	mstub.MockTransactionEnd("7")
+
+	mstub.MockTransactionStart("8")
+	stub = cached_stub.NewCachedStub(mstub)
+	cvResultBytes, err = ValidateConsent(stub, service1Subgroup, []string{"patient1", "service1", "datatype1", consentOptionWrite, nowStr})
+	test_utils.AssertTrue(t, err == nil, "Expected ValidateConsent to succeed")
+	cvResult = ValidationResultWithLog{}
+	json.Unmarshal(cvResultBytes, &cvResult)
+	test_utils.AssertTrue(t, cvResult.ConsentValidation.PermissionGranted, "Expected write access to be granted")
+	mstub.MockTransactionEnd("8")
+}
@@ -19,13 +19,18 @@ import (
 	"common/bchcls/data_model"
 	"common/bchcls/datatype"
 	"common/bchcls/key_mgmt"
+	"common/bchcls/simple_rule"
 	"common/bchcls/user_mgmt"
 	"common/bchcls/user_mgmt/user_groups"
 	"common/bchcls/utils"
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"time"
 
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/common"
 	"github.com/pkg/errors"
 )
 
@@ -56,13 +61,14 @@ func CallerIsAdminOfService(caller data_model.User, service string, serviceOrg s
 
 // GetDataInternal is the internal function for downloading data using index
 // Assume caller is consent target
-func GetDataInternal(stub cached_stub.CachedStubInterface, caller data_model.User, fieldNames []string, startValues []string, endValues []string, maxNum int) ([]OwnerDataResult, error) {
+// filterRule is optional, records it does not allow are skipped before maxNum is applied
+func GetDataInternal(stub cached_stub.CachedStubInterface, caller data_model.User, fieldNames []string, startValues []string, endValues []string, maxNum int, filterRule *simple_rule.Rule) ([]OwnerDataResult, error) {
 	defer utils.ExitFnLog(utils.EnterFnLog())
 
 	datas := []OwnerDataResult{}
 
 	// Use index to find all consents
-	iter, err := asset_mgmt.GetAssetManager(stub, caller).GetAssetIter(OwnerDataNamespace, IndexData, fieldNames, startValues, endValues, true, false, KeyPathFunc, "", maxNum, nil)
+	iter, err := asset_mgmt.GetAssetManager(stub, caller).GetAssetIter(OwnerDataNamespace, IndexData, fieldNames, startValues, endValues, true, false, KeyPathFunc, "", maxNum, filterRule)
 	if err != nil {
 		logger.Errorf("GetAssets failed: %v", err)
 		return nil, errors.Wrap(err, "GetAssets failed")
@@ -513,46 +519,15 @@ func GetKeyPath(stub cached_stub.CachedStubInterface, caller data_model.User, as
 	if assetType == ContractAssetNamespace {
 		contractPublicData := ContractPublicData{}
 		err = json.Unmarshal(assetData.PublicData, &contractPublicData)
-		ownerService := data_model.User{ID: contractPublicData.OwnerServiceID}
-		requesterService := data_model.User{ID: contractPublicData.RequesterServiceID}
+		contractServices := []data_model.User{{ID: contractPublicData.OwnerServiceID}}
+		for _, requesterServiceID := range contractPublicData.requesterServiceIDs() {
+			contractServices = append(contractServices, data_model.User{ID: requesterServiceID})
+		}
 
 		// Option 2e: caller is direct admin (service admin) of contract data requester or data owner
 		// Key path: [caller private key ID, service owner private key hash, service owner private key ID, asset key ID]
-		keyPath = []string{caller.GetPubPrivKeyId(), ownerService.GetPrivateKeyHashSymKeyId(), ownerService.GetPubPrivKeyId(), assetKeyID}
-		pathExists, err = key_mgmt.VerifyAccessPath(stub, keyPath)
-		if err != nil {
-			logger.Errorf("KeyPath verification failed")
-			return nil, errors.Wrap(err, "KeyPath verification failed")
-		}
-
-		if pathExists {
-			fmt.Println()
-			fmt.Println("Option 2e path exists: ", keyPath)
-			fmt.Println()
-			return keyPath, nil
-		}
-
-		keyPath = []string{caller.GetPubPrivKeyId(), requesterService.GetPrivateKeyHashSymKeyId(), requesterService.GetPubPrivKeyId(), assetKeyID}
-		pathExists, err = key_mgmt.VerifyAccessPath(stub, keyPath)
-		if err != nil {
-			logger.Errorf("KeyPath verification failed")
-			return nil, errors.Wrap(err, "KeyPath verification failed")
-		}
-
-		if pathExists {
-			fmt.Println()
-			fmt.Println("Option 2e path exists: ", keyPath)
-			fmt.Println()
-			return keyPath, nil
-		}
-
-		// Option 2f: caller is indirect admin (org admin) of contract data requester or data owner
-		// Key path: [caller private key ID, org private key hash, org private key ID, service owner private key hash, service owner private key ID, asset key ID]
-		if len(options) >= 1 {
-			orgID := options[0]
-			org := data_model.User{ID: orgID}
-
-			keyPath = []string{caller.GetPubPrivKeyId(), org.GetPrivateKeyHashSymKeyId(), org.GetPubPrivKeyId(), ownerService.GetPrivateKeyHashSymKeyId(), ownerService.GetPubPrivKeyId(), assetKeyID}
+		for _, contractService := range contractServices {
+			keyPath = []string{caller.GetPubPrivKeyId(), contractService.GetPrivateKeyHashSymKeyId(), contractService.GetPubPrivKeyId(), assetKeyID}
 			pathExists, err = key_mgmt.VerifyAccessPath(stub, keyPath)
 			if err != nil {
 				logger.Errorf("KeyPath verification failed")
@@ -561,29 +536,38 @@ func GetKeyPath(stub cached_stub.CachedStubInterface, caller data_model.User, as
 
 			if pathExists {
 				fmt.Println()
-				fmt.Println("Option 2f path exists: ", keyPath)
+				fmt.Println("Option 2e path exists: ", keyPath)
 				fmt.Println()
 				return keyPath, nil
 			}
+		}
 
-			keyPath = []string{caller.GetPubPrivKeyId(), org.GetPrivateKeyHashSymKeyId(), org.GetPubPrivKeyId(), requesterService.GetPrivateKeyHashSymKeyId(), requesterService.GetPubPrivKeyId(), assetKeyID}
-			pathExists, err = key_mgmt.VerifyAccessPath(stub, keyPath)
-			if err != nil {
-				logger.Errorf("KeyPath verification failed")
-				return nil, errors.Wrap(err, "KeyPath verification failed")
-			}
+		// Option 2f: caller is indirect admin (org admin) of contract data requester or data owner
+		// Key path: [caller private key ID, org private key hash, org private key ID, service owner private key hash, service owner private key ID, asset key ID]
+		if len(options) >= 1 {
+			orgID := options[0]
+			org := data_model.User{ID: orgID}
 
-			if pathExists {
-				fmt.Println()
-				fmt.Println("Option 2f path exists: ", keyPath)
-				fmt.Println()
-				return keyPath, nil
+			for _, contractService := range contractServices {
+				keyPath = []string{caller.GetPubPrivKeyId(), org.GetPrivateKeyHashSymKeyId(), org.GetPubPrivKeyId(), contractService.GetPrivateKeyHashSymKeyId(), contractService.GetPubPrivKeyId(), assetKeyID}
+				pathExists, err = key_mgmt.VerifyAccessPath(stub, keyPath)
+				if err != nil {
+					logger.Errorf("KeyPath verification failed")
+					return nil, errors.Wrap(err, "KeyPath verification failed")
+				}
+
+				if pathExists {
+					fmt.Println()
+					fmt.Println("Option 2f path exists: ", keyPath)
+					fmt.Println()
+					return keyPath, nil
+				}
 			}
 		}
 	}
 
 	// ========================================================================================
-	if assetType == OwnerDataNamespace { // data
+	if assetType == OwnerDataNamespace || assetType == DataTagNamespace { // data and data tags share the data key
 		// Option 3a: caller has access via contract, caller is contract requester
 		// Key path: [caller private key ID, datatype sym key ID, asset key ID]
 		datatypeKeyID := datatype.GetDatatypeKeyID(assetData.Datatypes[0], assetData.OwnerIds[0])
@@ -906,3 +890,142 @@ func GetServiceCaller(stub cached_stub.CachedStubInterface, caller data_model.Us
 
 	return callerObj, nil
 }
+
+// GetOwnerCaller returns a caller object that can act as the data owner.
+// If caller is the owner, caller is returned as is.
+// Owner is org and caller is org admin, or owner is service and caller is service admin: owner user is returned.
+// Owner is service and caller is org admin: owner user is retrieved using org admin's key paths.
+func GetOwnerCaller(stub cached_stub.CachedStubInterface, caller data_model.User, owner string) (data_model.User, error) {
+	if caller.ID == owner {
+		return caller, nil
+	}
+
+	callerObj := data_model.User{}
+	var err error
+	solutionCaller := convertToSolutionUser(caller)
+	if solutionCaller.Org == owner || utils.InList(solutionCaller.SolutionInfo.Services, owner) {
+		callerObj, err = user_mgmt.GetUserData(stub, caller, owner, true, false)
+		if err != nil {
+			customErr := &GetUserError{User: owner}
+			logger.Errorf("%v: %v", customErr, err)
+			return data_model.User{}, errors.Wrap(err, customErr.Error())
+		}
+	} else {
+		symKeyPath, prvKeyPath, err := GetUserAssetSymAndPrivateKeyPaths(stub, caller, owner)
+		if err != nil {
+			logger.Errorf("Failed to get symKeyPath and prvKeyPath for user asset")
+			return data_model.User{}, errors.Wrap(err, "Failed to get symKeyPath and prvKeyPath for user asset")
+		}
+
+		callerObj, err = user_mgmt.GetUserData(stub, caller, owner, true, false, symKeyPath, prvKeyPath)
+		if err != nil {
+			customErr := &GetUserError{User: owner}
+			logger.Errorf("%v: %v", customErr, err)
+			return data_model.User{}, errors.Wrap(err, customErr.Error())
+		}
+	}
+
+	if callerObj.PrivateKey == nil {
+		logger.Errorf("Caller does not have access to owner private key")
+		return data_model.User{}, errors.New("Caller does not have access to owner private key")
+	}
+
+	return callerObj, nil
+}
+
+// GetBlockNumberByTxID returns the number of the block holding a transaction
+// Blocks are not visible to chaincode, so the block is looked up with the query system chaincode
+func GetBlockNumberByTxID(stub cached_stub.CachedStubInterface, txID string) (uint64, error) {
+	response := stub.InvokeChaincode("qscc", [][]byte{[]byte("GetBlockByTxID"), []byte(stub.GetChannelID()), []byte(txID)}, "")
+	if response.Status != shim.OK {
+		logger.Errorf("GetBlockByTxID failed: %v", response.Message)
+		return 0, errors.New("GetBlockByTxID failed: " + response.Message)
+	}
+
+	block := common.Block{}
+	err := proto.Unmarshal(response.Payload, &block)
+	if err != nil {
+		customErr := &custom_errors.UnmarshalError{Type: "Block"}
+		logger.Errorf("%v: %v", customErr, err)
+		return 0, errors.Wrap(err, customErr.Error())
+	}
+
+	if block.Header == nil {
+		logger.Errorf("Block of transaction %v has no header", txID)
+		return 0, errors.New("Block of transaction " + txID + " has no header")
+	}
+
+	return block.Header.Number, nil
+}
+
+// ParseTimestamp parses a timestamp argument and checks it is within 10 mins of current time
+func ParseTimestamp(timestampStr string) (int64, error) {
+	timestamp, err := strconv.ParseInt(timestampStr, 10, 64)
+	if err != nil {
+		logger.Errorf("Error converting timestamp to type int64")
+		return 0, errors.Wrap(err, "Error converting timestamp to type int64")
+	}
+
+	currTime := time.Now().Unix()
+	if currTime-timestamp > 10*60 || currTime-timestamp < -10*60 {
+		logger.Errorf("Invalid Timestamp (current time: %v)  %v", currTime, timestamp)
+		return 0, errors.New("Invalid Timestamp, not within possible time range")
+	}
+
+	return timestamp, nil
+}
+
+// getAssetPage iterates over the assets of an index range and collects a page of them, starting after the bookmark
+// match returns the ID of an asset, which is used as bookmark, and whether the asset matches the search
+// collect adds a matching asset to the page, and returns false if the asset was skipped
+// At most pageSize assets are collected, pageSize 0 collects all of them
+// Returns the bookmark of the next page, empty when there are no more matching assets
+func getAssetPage(stub cached_stub.CachedStubInterface, caller data_model.User, namespace string, indexTable string, fieldNames []string, startValues []string, endValues []string, decrypt bool, keyPathFunc asset_key_func.AssetKeyPathFunc, pageSize int, bookmark string, match func(asset *data_model.Asset) (string, bool), collect func(asset *data_model.Asset) (bool, error)) (string, error) {
+	defer utils.ExitFnLog(utils.EnterFnLog())
+
+	// assets that do not match are not counted, so the range is not limited
+	iter, err := asset_mgmt.GetAssetManager(stub, caller).GetAssetIter(namespace, indexTable, fieldNames, startValues, endValues, decrypt, false, keyPathFunc, "", -1, nil)
+	if err != nil {
+		logger.Errorf("GetAssets failed: %v", err)
+		return "", errors.Wrap(err, "GetAssets failed")
+	}
+
+	defer iter.Close()
+	collected := 0
+	lastID := ""
+	for iter.HasNext() {
+		asset, err := iter.Next()
+		if err != nil {
+			customErr := &custom_errors.IterError{}
+			logger.Errorf("%v: %v", customErr, err)
+			return "", errors.Wrap(err, customErr.Error())
+		}
+
+		if utils.IsStringEmpty(asset.AssetId) {
+			continue
+		}
+
+		// start of range includes the asset the bookmark points at
+		id, matches := match(asset)
+		if !matches || id == bookmark {
+			continue
+		}
+
+		// a matching asset past the page means there is a next page
+		if pageSize > 0 && collected == pageSize {
+			return lastID, nil
+		}
+
+		added, err := collect(asset)
+		if err != nil {
+			return "", err
+		}
+
+		if added {
+			collected++
+			lastID = id
+		}
+	}
+
+	return "", nil
+}